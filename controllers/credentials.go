@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+)
+
+// ReconcileRegistryCredentials keeps the copies of the kotsadm registry credentials in sync in
+// airgap installations. The credentials are copied into the embedded cluster namespace, used by
+// the copy artifacts jobs, and into the configured namespaces. Copies in namespaces no longer
+// configured are removed. We do not report errors back as the next reconcile, triggered by any
+// change to the kotsadm secret, will try again.
+func (r *InstallationReconciler) ReconcileRegistryCredentials(ctx context.Context, in *v1beta1.Installation) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if !in.Spec.AirGap {
+		return
+	}
+
+	namespaces := append([]string{ecNamespace}, r.RegistryCredsNamespaces...)
+	for _, ns := range namespaces {
+		op, err := artifacts.EnsureRegistrySecretInNamespace(ctx, r.Client, in, ns)
+		if k8serrors.IsNotFound(err) {
+			// either kotsadm has not created the credentials yet or the namespace does not exist.
+			log.V(1).Info("Skipping registry credentials sync", "namespace", ns, "reason", err.Error())
+			continue
+		} else if err != nil {
+			log.Error(err, "Failed to sync registry credentials", "namespace", ns)
+			continue
+		}
+		if op != controllerutil.OperationResultNone {
+			log.Info("Registry credentials synced", "namespace", ns, "operation", op)
+		}
+	}
+
+	deleted, err := artifacts.DeleteRegistrySecretCopies(ctx, r.Client, r.RegistryCredsNamespaces)
+	if err != nil {
+		log.Error(err, "Failed to delete stale registry credentials")
+	} else if len(deleted) > 0 {
+		log.Info("Deleted stale registry credentials", "namespaces", deleted)
+	}
+}
+
+// isRegistryCredsSecret returns true if the object is the registry credentials secret managed by
+// kotsadm.
+func isRegistryCredsSecret(obj client.Object) bool {
+	return obj.GetNamespace() == "kotsadm" && obj.GetName() == artifacts.RegistryCredsSecretName
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestInstallationReconciler_ReconcileRegistryCredentials(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	creds := func(ns, password string, labels map[string]string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry-creds", Namespace: ns, Labels: labels},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{".dockerconfigjson": []byte(password)},
+		}
+	}
+	managed := map[string]string{"app.kubernetes.io/managed-by": "embedded-cluster-operator"}
+	copied := map[string]string{
+		"app.kubernetes.io/managed-by":   "embedded-cluster-operator",
+		artifacts.RegistryCredsCopyLabel: "true",
+	}
+	namespace := func(name string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+
+	old := &v1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: "20240101000000", UID: "old"}}
+	in := &v1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240102000000", UID: "new"},
+		Spec:       v1beta1.InstallationSpec{AirGap: true},
+	}
+	ownedByOld := []metav1.OwnerReference{{
+		APIVersion: v1beta1.GroupVersion.String(), Kind: "Installation", Name: old.Name, UID: old.UID,
+		Controller: ptr.To(true),
+	}}
+	stale := creds(ecNamespace, "old-password", copied)
+	stale.OwnerReferences = ownedByOld
+	// copied before the copy label existed.
+	legacy := creds("legacy", "old-password", managed)
+	legacy.OwnerReferences = ownedByOld
+
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		old, in,
+		namespace(ecNamespace), namespace("vendor"), namespace("removed"), namespace("legacy"), namespace("owned"),
+		creds("kotsadm", "rotated-password", nil),
+		stale, legacy,
+		// created by the vendor in one of the registry credentials namespaces.
+		creds("owned", "vendor-password", nil),
+		creds("removed", "old-password", copied),
+		creds("unmanaged", "vendor-password", nil),
+		// managed by the operator but not a copy made for the registry credentials namespaces.
+		creds("other", "other-password", managed),
+	).Build()
+	r := &InstallationReconciler{Client: cli, RegistryCredsNamespaces: []string{"vendor", "legacy", "owned"}}
+	r.ReconcileRegistryCredentials(ctx, in)
+
+	for _, ns := range []string{ecNamespace, "vendor", "legacy"} {
+		var got corev1.Secret
+		req.NoError(cli.Get(ctx, client.ObjectKey{Namespace: ns, Name: "registry-creds"}, &got))
+		req.Equal("rotated-password", string(got.Data[".dockerconfigjson"]), ns)
+		req.Equal("embedded-cluster-operator", got.Labels["app.kubernetes.io/managed-by"], ns)
+		req.Equal("true", got.Labels[artifacts.RegistryCredsCopyLabel], ns)
+		req.Len(got.OwnerReferences, 1, ns)
+		req.Equal(in.Name, got.OwnerReferences[0].Name, ns)
+	}
+
+	err := cli.Get(ctx, client.ObjectKey{Namespace: "removed", Name: "registry-creds"}, &corev1.Secret{})
+	req.True(k8serrors.IsNotFound(err), err)
+	req.NoError(cli.Get(ctx, client.ObjectKey{Namespace: "unmanaged", Name: "registry-creds"}, &corev1.Secret{}))
+	req.NoError(cli.Get(ctx, client.ObjectKey{Namespace: "other", Name: "registry-creds"}, &corev1.Secret{}))
+
+	// the vendor secret is not adopted.
+	var owned corev1.Secret
+	req.NoError(cli.Get(ctx, client.ObjectKey{Namespace: "owned", Name: "registry-creds"}, &owned))
+	req.Equal("vendor-password", string(owned.Data[".dockerconfigjson"]))
+	req.Empty(owned.Labels)
+	req.Empty(owned.OwnerReferences)
+}
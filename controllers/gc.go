@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/upgrade"
+)
+
+// ArtifactsGCConditionType reports the space freed on the nodes by the removal of the artifacts
+// of older installations.
+const ArtifactsGCConditionType = "ArtifactsGarbageCollected"
+
+const (
+	versionMetadataPrefix    = "version-metadata-"
+	hostPreflightResultLabel = "embedded-cluster/host-preflight-result"
+)
+
+// ReconcileGarbageCollection removes what older installations left behind once the installation
+// has been installed. Only the artifacts, the version metadata and the upgrade checkpoints of the
+// installation and of the previous one are kept. The host preflight results of nodes that no
+// longer exist and the finished copy artifacts jobs of older installations are deleted. We do not report errors back
+// as this is not a critical operation, we will just retry on the next reconcile.
+func (r *InstallationReconciler) ReconcileGarbageCollection(ctx context.Context, in *v1beta1.Installation) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if in.Status.State != v1beta1.InstallationStateInstalled {
+		return
+	}
+
+	kept := []*v1beta1.Installation{in}
+	previous, err := r.previousInstallation(ctx, in)
+	if err != nil {
+		log.Error(err, "Failed to get previous installation, skipping garbage collection")
+		return
+	} else if previous != nil {
+		kept = append(kept, previous)
+	}
+
+	if err := r.collectVersionMetadata(ctx, in, kept); err != nil {
+		log.Error(err, "Failed to garbage collect version metadata")
+	}
+	if err := r.collectUpgradeCheckpoints(ctx, in, kept); err != nil {
+		log.Error(err, "Failed to garbage collect upgrade checkpoints")
+	}
+	if err := r.collectHostPreflightResults(ctx); err != nil {
+		log.Error(err, "Failed to garbage collect host preflight results")
+	}
+	if deleted, err := artifacts.DeleteFinishedArtifactsJobs(ctx, r.Client, in); err != nil {
+		log.Error(err, "Failed to garbage collect copy artifacts jobs")
+	} else if deleted > 0 {
+		log.Info("Deleted finished copy artifacts jobs", "count", deleted)
+	}
+
+	// images tarballs and charts are only placed on the nodes in airgap installations.
+	if !in.Spec.AirGap {
+		return
+	}
+	// an upgrade places its artifacts on the nodes before its installation exists, we would
+	// remove them as they are not used by the kept installations.
+	if copying, err := artifacts.CopyingArtifactsForOtherInstallation(ctx, r.Client, in); err != nil {
+		log.Error(err, "Failed to check for copy artifacts jobs, skipping garbage collection on nodes")
+	} else if copying {
+		log.Info("Artifacts are being copied for another installation, skipping garbage collection on nodes")
+	} else if err := r.collectNodeArtifacts(ctx, in, kept); err != nil {
+		log.Error(err, "Failed to garbage collect artifacts on nodes")
+	}
+}
+
+// previousInstallation returns the newest installation older than the given one that has not
+// been cancelled. Returns nil if there is none.
+func (r *InstallationReconciler) previousInstallation(ctx context.Context, in *v1beta1.Installation) (*v1beta1.Installation, error) {
+	installs, err := r.listInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, install := range installs {
+		if install.Name >= in.Name || install.Status.State == conditions.InstallationStateCancelled {
+			continue
+		}
+		return &install, nil
+	}
+	return nil, nil
+}
+
+// collectVersionMetadata deletes the version metadata config maps not used by the kept
+// installations. Config maps created after the installation are kept as they may belong to an
+// upgrade in progress.
+func (r *InstallationReconciler) collectVersionMetadata(ctx context.Context, in *v1beta1.Installation, kept []*v1beta1.Installation) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	keep := map[string]bool{}
+	for _, install := range kept {
+		if install.Spec.Config != nil && install.Spec.Config.Version != "" {
+			keep[release.LocalVersionMetadataConfigmap(install.Spec.Config.Version).Name] = true
+		}
+	}
+
+	var cms corev1.ConfigMapList
+	if err := r.List(ctx, &cms, client.InNamespace(ecNamespace)); err != nil {
+		return fmt.Errorf("list config maps: %w", err)
+	}
+	for _, cm := range cms.Items {
+		if !strings.HasPrefix(cm.Name, versionMetadataPrefix) || keep[cm.Name] {
+			continue
+		}
+		if cm.CreationTimestamp.After(in.CreationTimestamp.Time) {
+			continue
+		}
+		if err := r.Delete(ctx, &cm); err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("delete version metadata %s: %w", cm.Name, err)
+		}
+		log.Info("Deleted version metadata", "configmap", cm.Name)
+	}
+	return nil
+}
+
+// collectUpgradeCheckpoints deletes the upgrade checkpoints of the installations older than the
+// kept ones. Checkpoints of newer installations are kept as they may belong to an upgrade in
+// progress or to a cancelled one.
+func (r *InstallationReconciler) collectUpgradeCheckpoints(ctx context.Context, in *v1beta1.Installation, kept []*v1beta1.Installation) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	keep := map[string]bool{}
+	for _, install := range kept {
+		keep[install.Name] = true
+	}
+
+	var cms corev1.ConfigMapList
+	err := r.List(ctx, &cms, client.InNamespace(ecNamespace), client.HasLabels{upgrade.CheckpointLabel})
+	if err != nil {
+		return fmt.Errorf("list config maps: %w", err)
+	}
+	for _, cm := range cms.Items {
+		installation := cm.Labels[upgrade.CheckpointLabel]
+		if keep[installation] || installation > in.Name {
+			continue
+		}
+		if err := r.Delete(ctx, &cm); err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("delete upgrade checkpoint %s: %w", cm.Name, err)
+		}
+		log.Info("Deleted upgrade checkpoint", "configmap", cm.Name)
+	}
+	return nil
+}
+
+// collectHostPreflightResults deletes the host preflight results of the nodes that are no longer
+// part of the cluster.
+func (r *InstallationReconciler) collectHostPreflightResults(ctx context.Context) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	var nodes corev1.NodeList
+	if err := r.List(ctx, &nodes); err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	names := map[string]bool{}
+	for _, node := range nodes.Items {
+		names[node.Name] = true
+	}
+
+	var cms corev1.ConfigMapList
+	err := r.List(ctx, &cms, client.InNamespace(ecNamespace), client.HasLabels{hostPreflightResultLabel})
+	if err != nil {
+		return fmt.Errorf("list config maps: %w", err)
+	}
+	for _, cm := range cms.Items {
+		if names[cm.Labels[hostPreflightResultLabel]] {
+			continue
+		}
+		if err := r.Delete(ctx, &cm); err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("delete host preflight results %s: %w", cm.Name, err)
+		}
+		log.Info("Deleted host preflight results of removed node", "configmap", cm.Name)
+	}
+	return nil
+}
+
+// collectNodeArtifacts starts a job on every node removing the images tarballs and charts not
+// used by the kept installations and reports the space freed in the installation conditions.
+func (r *InstallationReconciler) collectNodeArtifacts(ctx context.Context, in *v1beta1.Installation, kept []*v1beta1.Installation) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	operatorImage := os.Getenv("EMBEDDEDCLUSTER_IMAGE")
+	if operatorImage == "" {
+		log.Info("No operator image defined, skipping garbage collection on nodes")
+		return nil
+	}
+
+	// if we can't tell what an installation uses we do not remove anything.
+	var keep []string
+	for _, install := range kept {
+		files, err := artifactsUsedBy(ctx, r.Client, install)
+		if err != nil {
+			return fmt.Errorf("get artifacts used by installation %s: %w", install.Name, err)
+		}
+		keep = append(keep, files...)
+	}
+
+	reports, err := artifacts.EnsureGarbageCollectionJobForNodes(ctx, r.Client, in, keep, operatorImage)
+	if err != nil {
+		return fmt.Errorf("ensure garbage collection jobs: %w", err)
+	} else if len(reports) == 0 {
+		return nil
+	}
+
+	var freed int64
+	for node, report := range reports {
+		freed += report.Freed
+		if len(report.Removed) > 0 {
+			log.Info("Removed artifacts from node", "node", node, "files", report.Removed)
+		}
+	}
+	in.Status.SetCondition(metav1.Condition{
+		Type:   ArtifactsGCConditionType,
+		Status: metav1.ConditionTrue,
+		Reason: "Collected",
+		Message: fmt.Sprintf(
+			"Freed %s on %d node(s)", resource.NewQuantity(freed, resource.BinarySI), len(reports),
+		),
+		ObservedGeneration: in.Generation,
+	})
+	return nil
+}
+
+// artifactsUsedBy returns the images tarball and the charts, relative to the data directory,
+// placed on the nodes for the installation.
+func artifactsUsedBy(ctx context.Context, cli client.Client, in *v1beta1.Installation) ([]string, error) {
+	tarball, err := artifacts.KeptImagesTarball(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("get images tarball: %w", err)
+	}
+	files := []string{tarball}
+	if in.Spec.Config == nil || in.Spec.Config.Version == "" {
+		return files, nil
+	}
+
+	meta, err := release.MetadataFor(ctx, in, cli)
+	if err != nil {
+		return nil, fmt.Errorf("get release metadata: %w", err)
+	}
+	chart := func(name, version string) string {
+		return fmt.Sprintf("charts/%s-%s.tgz", name, version)
+	}
+	for _, c := range meta.Configs.Charts {
+		files = append(files, chart(c.Name, c.Version))
+	}
+	for _, config := range meta.BuiltinConfigs {
+		for _, c := range config.Charts {
+			files = append(files, chart(c.Name, c.Version))
+		}
+	}
+	if in.Spec.Config.Extensions.Helm != nil {
+		for _, c := range in.Spec.Config.Extensions.Helm.Charts {
+			files = append(files, chart(c.Name, c.Version))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/upgrade"
+)
+
+func TestInstallationReconciler_ReconcileGarbageCollection(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	t.Setenv("EMBEDDEDCLUSTER_IMAGE", "operator:latest")
+
+	for _, version := range []string{"1.0.0+gc", "1.1.0+gc", "1.2.0+gc"} {
+		release.CacheMeta(version, ectypes.ReleaseMetadata{})
+	}
+	created := metav1.NewTime(time.Now().Add(-time.Hour))
+	installation := func(name, version, state string) *v1beta1.Installation {
+		in := &v1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: created},
+			Spec: v1beta1.InstallationSpec{
+				AirGap: true,
+				Config: &v1beta1.ConfigSpec{Version: version},
+			},
+		}
+		in.Status.SetState(state, "", nil)
+		return in
+	}
+	configmap := func(name string, labels map[string]string, age time.Duration) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         ecNamespace,
+				Labels:            labels,
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+			},
+		}
+	}
+	job := func(name, installation string, succeeded int32) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   ecNamespace,
+				Annotations: map[string]string{artifacts.InstallationNameAnnotation: installation},
+			},
+			Status: batchv1.JobStatus{Succeeded: succeeded},
+		}
+	}
+
+	oldest := installation("20240101000000", "1.0.0+gc", v1beta1.InstallationStateObsolete)
+	previous := installation("20240102000000", "1.1.0+gc", v1beta1.InstallationStateObsolete)
+	in := installation("20240103000000", "1.2.0+gc", v1beta1.InstallationStateInstalled)
+	metadata := func(version string) string {
+		return release.LocalVersionMetadataConfigmap(version).Name
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		oldest, previous, in,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		configmap(metadata("1.0.0+gc"), nil, 2*time.Hour),
+		configmap(metadata("1.1.0+gc"), nil, 2*time.Hour),
+		configmap(metadata("1.2.0+gc"), nil, 2*time.Hour),
+		// created after the installation, may belong to an upgrade in progress.
+		configmap(metadata("1.3.0+gc"), nil, 0),
+		configmap("node1-host-preflight-results", map[string]string{hostPreflightResultLabel: "node1"}, 2*time.Hour),
+		configmap("node2-host-preflight-results", map[string]string{hostPreflightResultLabel: "node2"}, 2*time.Hour),
+		configmap(upgrade.CheckpointName(oldest.Name), map[string]string{upgrade.CheckpointLabel: oldest.Name}, 2*time.Hour),
+		configmap(upgrade.CheckpointName(previous.Name), map[string]string{upgrade.CheckpointLabel: previous.Name}, 2*time.Hour),
+		configmap(upgrade.CheckpointName(in.Name), map[string]string{upgrade.CheckpointLabel: in.Name}, 2*time.Hour),
+		// an upgrade to a newer installation may be in progress.
+		configmap(upgrade.CheckpointName("20240104000000"), map[string]string{upgrade.CheckpointLabel: "20240104000000"}, 0),
+		job("copy-artifacts-node1", previous.Name, 1),
+		job("copy-artifacts-node2", in.Name, 1),
+	).Build()
+	r := &InstallationReconciler{Client: cli}
+
+	r.ReconcileGarbageCollection(ctx, in)
+
+	var cms corev1.ConfigMapList
+	req.NoError(cli.List(ctx, &cms, client.InNamespace(ecNamespace)))
+	var names []string
+	for _, cm := range cms.Items {
+		names = append(names, cm.Name)
+	}
+	req.ElementsMatch([]string{
+		metadata("1.1.0+gc"), metadata("1.2.0+gc"), metadata("1.3.0+gc"), "node1-host-preflight-results",
+		upgrade.CheckpointName(previous.Name), upgrade.CheckpointName(in.Name), upgrade.CheckpointName("20240104000000"),
+	}, names)
+
+	var jobs batchv1.JobList
+	req.NoError(cli.List(ctx, &jobs, client.InNamespace(ecNamespace)))
+	names = nil
+	for _, job := range jobs.Items {
+		names = append(names, job.Name)
+	}
+	req.ElementsMatch([]string{"copy-artifacts-node2", "gc-artifacts-node1"}, names)
+	req.Nil(meta.FindStatusCondition(in.Status.Conditions, ArtifactsGCConditionType))
+
+	// the gc job keeps the images tarballs of the installation and of the previous one.
+	var gcjob batchv1.Job
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: "gc-artifacts-node1", Namespace: ecNamespace}, &gcjob))
+	args := gcjob.Spec.Template.Spec.Containers[0].Args
+	req.Contains(args, "images/images-amd64-"+in.Name+".tar")
+	req.Contains(args, "images/images-amd64-"+previous.Name+".tar")
+	req.NotContains(args, "images/images-amd64-"+oldest.Name+".tar")
+
+	gcjob.Status.Succeeded = 1
+	req.NoError(cli.Status().Update(ctx, &gcjob))
+	req.NoError(cli.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "gc-artifacts-node1-abcde",
+			Namespace: ecNamespace,
+			Labels:    map[string]string{"job-name": "gc-artifacts-node1"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodSucceeded,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name: "embedded-cluster-gc",
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Message: `{"removed":["images/images-amd64-20240101000000.tar"],"freed":2147483648}`,
+						},
+					},
+				},
+			},
+		},
+	}))
+
+	r.ReconcileGarbageCollection(ctx, in)
+	cond := meta.FindStatusCondition(in.Status.Conditions, ArtifactsGCConditionType)
+	req.NotNil(cond)
+	req.Equal("Freed 2Gi on 1 node(s)", cond.Message)
+}
+
+func TestInstallationReconciler_ReconcileGarbageCollection_upgradeInProgress(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	t.Setenv("EMBEDDEDCLUSTER_IMAGE", "operator:latest")
+
+	release.CacheMeta("1.2.0+gc", ectypes.ReleaseMetadata{})
+	in := &v1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240103000000"},
+		Spec: v1beta1.InstallationSpec{
+			AirGap: true,
+			Config: &v1beta1.ConfigSpec{Version: "1.2.0+gc"},
+		},
+	}
+	in.Status.SetState(v1beta1.InstallationStateInstalled, "", nil)
+
+	// the upgrade has copied its artifacts to the node but has not created its installation yet.
+	copyJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "copy-artifacts-node1",
+			Namespace:   ecNamespace,
+			Annotations: map[string]string{artifacts.InstallationNameAnnotation: "20240104000000"},
+		},
+		Status: batchv1.JobStatus{Succeeded: 1},
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		in, copyJob, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+	).Build()
+	r := &InstallationReconciler{Client: cli}
+
+	r.ReconcileGarbageCollection(ctx, in)
+
+	var jobs batchv1.JobList
+	req.NoError(cli.List(ctx, &jobs, client.InNamespace(ecNamespace)))
+	var names []string
+	for _, job := range jobs.Items {
+		names = append(names, job.Name)
+	}
+	req.Equal([]string{"copy-artifacts-node1"}, names)
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"fmt"
+	"strings"
 
 	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
 	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
@@ -84,10 +85,82 @@ func yamlDiff(a, b string) (bool, error) {
 	return string(aYaml) != string(bYaml), nil
 }
 
+// chartErrorClass is a known class of helm errors. Each class has a reason code, used in the
+// installation conditions, and a hint on how to remediate the error.
+type chartErrorClass struct {
+	Reason string
+	Hint   string
+	// patterns are lower case substrings identifying errors of this class.
+	patterns []string
+}
+
+var (
+	chartErrorPendingUpgrade = chartErrorClass{
+		Reason: "ReleasePendingUpgrade",
+		Hint: "The helm release is stuck in a pending state. Roll it back or remove the pending release revision " +
+			"secret, or set the " + RemediatePendingUpgradeAnnotation + " annotation on the installation to have " +
+			"this done automatically.",
+		patterns: []string{"another operation (install/upgrade/rollback) is in progress"},
+	}
+	chartErrorUnknown = chartErrorClass{
+		Reason: "ChartFailed",
+		Hint:   "Inspect the chart status and the helm release in the chart namespace for details.",
+	}
+	// chartErrorClasses is the list of known error classes, in the order they are evaluated.
+	chartErrorClasses = []chartErrorClass{
+		chartErrorPendingUpgrade,
+		{
+			Reason:   "MissingCRD",
+			Hint:     "The chart uses a custom resource whose definition is not installed. Make sure the chart providing the definition is installed first.",
+			patterns: []string{"no matches for kind", "ensure crds are installed first", "resource mapping not found"},
+		},
+		{
+			Reason:   "ImmutableFieldChange",
+			Hint:     "The upgrade changes a field that cannot be updated in place. Delete the affected resource so the chart can recreate it.",
+			patterns: []string{"field is immutable"},
+		},
+		{
+			Reason:   "ImagePullFailed",
+			Hint:     "An image could not be pulled. Verify the registry is reachable, the credentials are valid and, in airgap installations, that the images were pushed to the registry.",
+			patterns: []string{"errimagepull", "imagepullbackoff", "failed to pull image"},
+		},
+		{
+			Reason:   "HookFailed",
+			Hint:     "A helm hook has failed. Inspect the logs of the hook job in the chart namespace.",
+			patterns: []string{"hooks failed", "failed pre-install", "failed post-install", "failed pre-upgrade", "failed post-upgrade"},
+		},
+		{
+			Reason:   "ResourceTimeout",
+			Hint:     "The chart resources did not become ready in time. Look for pods that are not ready in the chart namespace.",
+			patterns: []string{"timed out waiting for the condition", "context deadline exceeded"},
+		},
+	}
+)
+
+// classifyChartError returns the class of the given helm error.
+func classifyChartError(msg string) chartErrorClass {
+	msg = strings.ToLower(msg)
+	for _, class := range chartErrorClasses {
+		for _, pattern := range class.patterns {
+			if strings.Contains(msg, pattern) {
+				return class
+			}
+		}
+	}
+	return chartErrorUnknown
+}
+
+// chartError is an error reported by k0s for a given chart.
+type chartError struct {
+	Chart   string
+	Message string
+	Class   chartErrorClass
+}
+
 // check if all charts in the combinedConfigs are installed successfully with the desired version and values
-func detectChartCompletion(existingHelm *k0sv1beta1.HelmExtensions, installedCharts k0shelm.ChartList) ([]string, []string, error) {
+func detectChartCompletion(existingHelm *k0sv1beta1.HelmExtensions, installedCharts k0shelm.ChartList) ([]string, []chartError, error) {
 	incompleteCharts := []string{}
-	chartErrors := []string{}
+	chartErrors := []chartError{}
 	if existingHelm == nil {
 		return incompleteCharts, chartErrors, nil
 	}
@@ -116,7 +189,11 @@ func detectChartCompletion(existingHelm *k0sv1beta1.HelmExtensions, installedCha
 				}
 
 				if installedChart.Status.Error != "" {
-					chartErrors = append(chartErrors, installedChart.Status.Error)
+					chartErrors = append(chartErrors, chartError{
+						Chart:   chart.Name,
+						Message: installedChart.Status.Error,
+						Class:   classifyChartError(installedChart.Status.Error),
+					})
 					diffDetected = false
 				}
 
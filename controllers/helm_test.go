@@ -16,7 +16,7 @@ func Test_detectChartCompletion(t *testing.T) {
 	tests := []struct {
 		name                 string
 		args                 args
-		wantChartErrors      []string
+		wantChartErrors      []chartError
 		wantIncompleteCharts []string
 	}{
 		{
@@ -58,7 +58,7 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{},
-			wantChartErrors:      []string{},
+			wantChartErrors:      []chartError{},
 		},
 		{
 			name: "new chart",
@@ -90,7 +90,7 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{"test2"},
-			wantChartErrors:      []string{},
+			wantChartErrors:      []chartError{},
 		},
 		{
 			name: "removed chart",
@@ -126,7 +126,7 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{},
-			wantChartErrors:      []string{},
+			wantChartErrors:      []chartError{},
 		},
 		{
 			name: "added and removed chart",
@@ -154,7 +154,7 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{"test2"},
-			wantChartErrors:      []string{},
+			wantChartErrors:      []chartError{},
 		},
 		{
 			name: "no drift, but error",
@@ -195,7 +195,10 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{},
-			wantChartErrors:      []string{"test chart error", "test chart two error"},
+			wantChartErrors: []chartError{
+				{Chart: "test", Message: "test chart error", Class: chartErrorUnknown},
+				{Chart: "test2", Message: "test chart two error", Class: chartErrorUnknown},
+			},
 		},
 		{
 			name: "drift and error",
@@ -236,7 +239,10 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{},
-			wantChartErrors:      []string{"test chart error", "test chart two error"},
+			wantChartErrors: []chartError{
+				{Chart: "test", Message: "test chart error", Class: chartErrorUnknown},
+				{Chart: "test2", Message: "test chart two error", Class: chartErrorUnknown},
+			},
 		},
 		{
 			name: "drift values",
@@ -270,7 +276,7 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{"test"},
-			wantChartErrors:      []string{},
+			wantChartErrors:      []chartError{},
 		},
 		{
 			name: "values hash differs",
@@ -304,7 +310,7 @@ func Test_detectChartCompletion(t *testing.T) {
 				},
 			},
 			wantIncompleteCharts: []string{"test"},
-			wantChartErrors:      []string{},
+			wantChartErrors:      []chartError{},
 		},
 	}
 	for _, tt := range tests {
@@ -638,3 +644,25 @@ func Test_yamlDiff(t *testing.T) {
 		})
 	}
 }
+
+func Test_classifyChartError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{msg: "another operation (install/upgrade/rollback) is in progress", want: "ReleasePendingUpgrade"},
+		{msg: `resource mapping not found for name: "x" namespace: "" from "": no matches for kind "Foo" in version "bar/v1"`, want: "MissingCRD"},
+		{msg: `Deployment.apps "x" is invalid: spec.selector: Invalid value: ...: field is immutable`, want: "ImmutableFieldChange"},
+		{msg: "pod x: ImagePullBackOff", want: "ImagePullFailed"},
+		{msg: "pre-upgrade hooks failed: job failed: BackoffLimitExceeded", want: "HookFailed"},
+		{msg: "timed out waiting for the condition", want: "ResourceTimeout"},
+		{msg: "something else entirely", want: "ChartFailed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := classifyChartError(tt.msg)
+			require.Equal(t, tt.want, got.Reason)
+			require.NotEmpty(t, got.Hint)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/archive"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+// DefaultInstallationHistoryLimit is the default number of obsolete installations kept in the
+// cluster.
+const DefaultInstallationHistoryLimit = 20
+
+// RecordInstallationCompleted sets the completed condition the first time the installation
+// reaches the Installed state. The kubernetes version deployed is kept in an annotation, the
+// condition is not set until the release metadata holding it can be read.
+func (r *InstallationReconciler) RecordInstallationCompleted(ctx context.Context, in *v1beta1.Installation) error {
+	if in.Status.State != v1beta1.InstallationStateInstalled {
+		return nil
+	}
+	if meta.FindStatusCondition(in.Status.Conditions, conditions.CompletedConditionType) != nil {
+		return nil
+	}
+	if in.Spec.Config != nil && in.Spec.Config.Version != "" {
+		metadata, err := release.MetadataFor(ctx, in, r.Client)
+		if err != nil {
+			return fmt.Errorf("get release metadata: %w", err)
+		}
+		if err := r.patchInstallationKubernetesVersion(ctx, in, metadata.Versions["Kubernetes"]); err != nil {
+			return err
+		}
+	}
+	in.Status.SetCondition(metav1.Condition{
+		Type:               conditions.CompletedConditionType,
+		Status:             metav1.ConditionTrue,
+		Reason:             v1beta1.InstallationStateInstalled,
+		ObservedGeneration: in.Generation,
+	})
+	return nil
+}
+
+// patchInstallationKubernetesVersion records the kubernetes version deployed by the installation
+// in its annotations. Annotations are not part of the status so they are patched right away,
+// the patched resource version is copied back so the status can still be updated afterwards.
+func (r *InstallationReconciler) patchInstallationKubernetesVersion(ctx context.Context, in *v1beta1.Installation, version string) error {
+	if version == "" || in.Annotations[conditions.KubernetesVersionAnnotation] == version {
+		return nil
+	}
+	patched := in.DeepCopy()
+	patch := client.MergeFrom(in.DeepCopy())
+	if patched.Annotations == nil {
+		patched.Annotations = map[string]string{}
+	}
+	patched.Annotations[conditions.KubernetesVersionAnnotation] = version
+	if err := r.Patch(ctx, patched, patch); err != nil {
+		return fmt.Errorf("patch installation: %w", err)
+	}
+	in.Annotations = patched.Annotations
+	in.ResourceVersion = patched.ResourceVersion
+	return nil
+}
+
+// ReconcileInstallationHistory keeps only the most recent obsolete installations in the cluster.
+// Older ones are moved to the installation archive. We do not report errors back as this is not
+// a critical operation, we will just retry on the next reconcile.
+func (r *InstallationReconciler) ReconcileInstallationHistory(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx)
+
+	limit := r.InstallationHistoryLimit
+	if limit <= 0 {
+		limit = DefaultInstallationHistoryLimit
+	}
+
+	installs, err := r.listInstallations(ctx)
+	if err != nil {
+		log.Error(err, "Failed to list installations")
+		return
+	}
+	// cancelled installations are never picked up again, they are archived along with the
+	// obsolete ones.
+	var obsolete []v1beta1.Installation
+	for _, in := range installs {
+		if in.Status.State == v1beta1.InstallationStateObsolete ||
+			in.Status.State == conditions.InstallationStateCancelled {
+			obsolete = append(obsolete, in)
+		}
+	}
+	if len(obsolete) <= limit {
+		return
+	}
+
+	expired := obsolete[limit:]
+	log.Info("Archiving obsolete installations", "count", len(expired))
+	if err := archive.Add(ctx, r.Client, expired); err != nil {
+		log.Error(err, "Failed to archive installations")
+		return
+	}
+	for _, in := range expired {
+		if err := r.Delete(ctx, &in); err != nil {
+			log.Error(err, "Failed to delete archived installation", "installation", in.Name)
+		}
+	}
+}
+
+// finalStateCondition returns the condition recording the state of an installation that is
+// about to become obsolete.
+func finalStateCondition(in *v1beta1.Installation) metav1.Condition {
+	return metav1.Condition{
+		Type:               conditions.FinalStateConditionType,
+		Status:             metav1.ConditionTrue,
+		Reason:             fmt.Sprint(in.Status.State),
+		Message:            in.Status.Reason,
+		ObservedGeneration: in.Generation,
+	}
+}
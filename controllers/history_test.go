@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/archive"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+func TestInstallationReconciler_DisableOldInstallations(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	newest := v1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: "20240102000000"}}
+	old := v1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"}}
+	old.Status.SetState(v1beta1.InstallationStateHelmChartUpdateFailure, "chart failed", nil)
+
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).
+		WithObjects(&newest, &old).WithStatusSubresource(&newest, &old).Build()
+	r := &InstallationReconciler{Client: cli}
+	r.DisableOldInstallations(ctx, []v1beta1.Installation{old, newest})
+
+	var got v1beta1.Installation
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: old.Name}, &got))
+	req.Equal(v1beta1.InstallationStateObsolete, got.Status.State)
+	cond := meta.FindStatusCondition(got.Status.Conditions, conditions.FinalStateConditionType)
+	req.NotNil(cond)
+	req.Equal(v1beta1.InstallationStateHelmChartUpdateFailure, cond.Reason)
+	req.Equal("chart failed", cond.Message)
+}
+
+func TestInstallationReconciler_RecordInstallationCompleted(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	in := &v1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+		Spec:       v1beta1.InstallationSpec{AirGap: true, Config: &v1beta1.ConfigSpec{Version: "1.0.0+completed"}},
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(in).WithStatusSubresource(in).Build()
+	r := &InstallationReconciler{Client: cli}
+
+	in.Status.SetState(v1beta1.InstallationStateAddonsInstalling, "", nil)
+	req.NoError(r.RecordInstallationCompleted(ctx, in))
+	req.Nil(meta.FindStatusCondition(in.Status.Conditions, conditions.CompletedConditionType))
+
+	// the condition waits for the release metadata to be available.
+	in.Status.SetState(v1beta1.InstallationStateInstalled, "", nil)
+	req.Error(r.RecordInstallationCompleted(ctx, in))
+	req.Nil(meta.FindStatusCondition(in.Status.Conditions, conditions.CompletedConditionType))
+
+	release.CacheMeta("1.0.0+completed", ectypes.ReleaseMetadata{Versions: map[string]string{"Kubernetes": "v1.29.1+k0s.0"}})
+	req.NoError(r.RecordInstallationCompleted(ctx, in))
+	cond := meta.FindStatusCondition(in.Status.Conditions, conditions.CompletedConditionType)
+	req.NotNil(cond)
+	completed := cond.LastTransitionTime
+	req.Equal("v1.29.1+k0s.0", in.Annotations[conditions.KubernetesVersionAnnotation])
+
+	// the status can still be saved after the annotation has been patched.
+	req.NoError(cli.Status().Update(ctx, in.DeepCopy()))
+	var got v1beta1.Installation
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: in.Name}, &got))
+	req.Equal("v1.29.1+k0s.0", got.Annotations[conditions.KubernetesVersionAnnotation])
+	req.NotNil(meta.FindStatusCondition(got.Status.Conditions, conditions.CompletedConditionType))
+
+	// the condition is only set once.
+	req.NoError(r.RecordInstallationCompleted(ctx, in))
+	req.Equal(completed, meta.FindStatusCondition(in.Status.Conditions, conditions.CompletedConditionType).LastTransitionTime)
+}
+
+func TestInstallationReconciler_ReconcileInstallationHistory(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	objs := []client.Object{}
+	for i := 1; i <= 5; i++ {
+		in := &v1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("2024010%d000000", i)}}
+		in.Status.SetState(v1beta1.InstallationStateObsolete, "", nil)
+		if i == 2 {
+			// cancelled installations are archived as well.
+			in.Status.SetState(conditions.InstallationStateCancelled, "", nil)
+		}
+		objs = append(objs, in)
+	}
+	active := &v1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: "20240106000000"}}
+	active.Status.SetState(v1beta1.InstallationStateInstalled, "", nil)
+	objs = append(objs, active)
+
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(objs...).Build()
+	r := &InstallationReconciler{Client: cli, InstallationHistoryLimit: 2}
+	r.ReconcileInstallationHistory(ctx)
+
+	var list v1beta1.InstallationList
+	req.NoError(cli.List(ctx, &list))
+	names := []string{}
+	for _, in := range list.Items {
+		names = append(names, in.Name)
+	}
+	req.ElementsMatch([]string{"20240104000000", "20240105000000", "20240106000000"}, names)
+
+	archived, err := archive.List(ctx, cli)
+	req.NoError(err)
+	req.Len(archived, 3)
+	req.Equal("20240101000000", archived[0].Name)
+	req.Equal(v1beta1.InstallationStateObsolete, archived[0].Status.State)
+	req.Equal(conditions.InstallationStateCancelled, archived[1].Status.State)
+
+	// nothing changes once we are within the limit.
+	r.ReconcileInstallationHistory(ctx)
+	req.NoError(cli.List(ctx, &list))
+	req.Len(list.Items, 3)
+}
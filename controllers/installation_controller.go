@@ -35,37 +35,46 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/autopilot"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/charts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/metadata"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/metrics"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/openebs"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/upgrade"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/util"
 )
 
-// InstallationNameAnnotation is the annotation we keep in the autopilot plan so we can
-// map 1 to 1 one installation and one plan.
-const InstallationNameAnnotation = "embedded-cluster.replicated.com/installation-name"
-
-const HAConditionType = "HighAvailability"
-
 // requeueAfter is our default interval for requeueing. If nothing has changed with the
 // cluster nodes or the Installation object we will reconcile once every requeueAfter
 // interval.
 var requeueAfter = time.Hour
 
+// metadataPullOptions keeps the pull of the version metadata short when reconciling. Nothing
+// else is reconciled while it runs and a failed pull is retried on the next reconcile anyway.
+func metadataPullOptions(opts *artifacts.PullOptions) {
+	opts.Attempts = 2
+	opts.Backoff = time.Second
+	opts.MaxBackoff = time.Second
+}
+
 const copyHostPreflightResultsJobPrefix = "copy-host-preflight-results-"
 const ecNamespace = "embedded-cluster"
 
@@ -143,6 +152,12 @@ type InstallationReconciler struct {
 	client.Client
 	Discovery discovery.DiscoveryInterface
 	Scheme    *runtime.Scheme
+	// InstallationHistoryLimit is the number of obsolete installations kept in the cluster,
+	// older ones are archived. Defaults to DefaultInstallationHistoryLimit.
+	InstallationHistoryLimit int
+	// RegistryCredsNamespaces are the namespaces, besides the embedded cluster one, the registry
+	// credentials are copied into in airgap installations.
+	RegistryCredsNamespaces []string
 }
 
 // NodeHasChanged returns true if the node configuration has changed when compared to
@@ -307,7 +322,7 @@ func (r *InstallationReconciler) ReconcileK0sVersion(ctx context.Context, in *v1
 	// cluster version metadata is available inside the cluster. we can't use the internet
 	// to fetch it directly from our remote servers.
 	if in.Spec.AirGap {
-		if err := metadata.CopyVersionMetadataToCluster(ctx, r.Client, in); err != nil {
+		if err := metadata.CopyVersionMetadataToCluster(ctx, r.Client, in, metadataPullOptions); err != nil {
 			return fmt.Errorf("failed to copy version metadata to cluster: %w", err)
 		}
 	}
@@ -385,7 +400,7 @@ func (r *InstallationReconciler) ReconcileK0sVersion(ctx context.Context, in *v1
 	// reconciling we set the installation state according to the plan state.
 	// we check both the plan id and an annotation inside the plan. the usage
 	// of the plan id is deprecated in favour of the annotation.
-	annotation := plan.Annotations[InstallationNameAnnotation]
+	annotation := plan.Annotations[conditions.InstallationNameAnnotation]
 	if annotation == in.Name || plan.Spec.ID == in.Name {
 		// there are two plans needed to be run in sequence for airgap upgrades. the first one is
 		// the one that copies the artifacts to the nodes and the second one is the one that
@@ -477,7 +492,7 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 
 	if !in.Spec.HighAvailability {
 		in.Status.SetCondition(metav1.Condition{
-			Type:               HAConditionType,
+			Type:               conditions.HAConditionType,
 			Status:             metav1.ConditionFalse,
 			Reason:             "HANotEnabled",
 			ObservedGeneration: in.Generation,
@@ -486,18 +501,16 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 	}
 
 	if in.Spec.AirGap {
-		seaweedReady, err := k8sutil.GetChartHealth(ctx, r.Client, "seaweedfs")
-		if err != nil {
-			return fmt.Errorf("failed to check seaweedfs readiness: %w", err)
-		}
-		if !seaweedReady {
+		if err := charts.CheckAddonHealth(ctx, r.Client, in, "seaweedfs"); charts.IsAddonNotReady(err) {
 			in.Status.SetCondition(metav1.Condition{
-				Type:               HAConditionType,
+				Type:               conditions.HAConditionType,
 				Status:             metav1.ConditionFalse,
 				Reason:             "SeaweedFSNotReady",
 				ObservedGeneration: in.Generation,
 			})
 			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to check seaweedfs readiness: %w", err)
 		}
 
 		registryMigrated, err := registry.HasRegistryMigrated(ctx, r.Client)
@@ -506,7 +519,7 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 		}
 		if !registryMigrated {
 			in.Status.SetCondition(metav1.Condition{
-				Type:               HAConditionType,
+				Type:               conditions.HAConditionType,
 				Status:             metav1.ConditionFalse,
 				Reason:             "RegistryNotMigrated",
 				ObservedGeneration: in.Generation,
@@ -514,18 +527,16 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 			return nil
 		}
 
-		registryReady, err := k8sutil.GetChartHealth(ctx, r.Client, "docker-registry")
-		if err != nil {
-			return fmt.Errorf("failed to check docker-registry readiness: %w", err)
-		}
-		if !registryReady {
+		if err := charts.CheckAddonHealth(ctx, r.Client, in, "docker-registry"); charts.IsAddonNotReady(err) {
 			in.Status.SetCondition(metav1.Condition{
-				Type:               HAConditionType,
+				Type:               conditions.HAConditionType,
 				Status:             metav1.ConditionFalse,
 				Reason:             "RegistryNotReady",
 				ObservedGeneration: in.Generation,
 			})
 			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to check docker-registry readiness: %w", err)
 		}
 	}
 
@@ -535,7 +546,7 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 	}
 	if !adminConsole {
 		in.Status.SetCondition(metav1.Condition{
-			Type:               HAConditionType,
+			Type:               conditions.HAConditionType,
 			Status:             metav1.ConditionFalse,
 			Reason:             "AdminConsoleNotReady",
 			ObservedGeneration: in.Generation,
@@ -545,7 +556,7 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 
 	if in.Status.State != v1beta1.InstallationStateInstalled {
 		in.Status.SetCondition(metav1.Condition{
-			Type:               HAConditionType,
+			Type:               conditions.HAConditionType,
 			Status:             metav1.ConditionFalse,
 			Reason:             "InstallationNotReady",
 			ObservedGeneration: in.Generation,
@@ -554,7 +565,7 @@ func (r *InstallationReconciler) ReconcileHAStatus(ctx context.Context, in *v1be
 	}
 
 	in.Status.SetCondition(metav1.Condition{
-		Type:               HAConditionType,
+		Type:               conditions.HAConditionType,
 		Status:             metav1.ConditionTrue,
 		Reason:             "HAReady",
 		ObservedGeneration: in.Generation,
@@ -601,7 +612,7 @@ func (r *InstallationReconciler) ReconcileHelmCharts(ctx context.Context, in *v1
 		return fmt.Errorf("failed to get cluster config: %w", err)
 	}
 
-	combinedConfigs, err := charts.K0sHelmExtensionsFromInstallation(ctx, in, meta, &clusterConfig)
+	combinedConfigs, err := charts.K0sHelmExtensionsFromInstallation(ctx, r.Client, in, meta, &clusterConfig)
 	if err != nil {
 		return fmt.Errorf("failed to get helm charts from installation: %w", err)
 	}
@@ -617,28 +628,65 @@ func (r *InstallationReconciler) ReconcileHelmCharts(ctx context.Context, in *v1
 		existingHelm = clusterConfig.Spec.Extensions.Helm
 	}
 
-	chartDrift, changedCharts, err := detectChartDrift(cfgs, existingHelm)
+	// charts reading values from secrets are left out of the cluster config and released by
+	// jobs, k0s only reads values inline in its chart objects.
+	k0sCfgs, releasedCharts, err := charts.SplitValuesFromCharts(cfgs)
+	if err != nil {
+		return fmt.Errorf("failed to split charts reading values from secrets: %w", err)
+	}
+
+	chartDrift, changedCharts, err := detectChartDrift(k0sCfgs, existingHelm)
 	if err != nil {
 		return fmt.Errorf("failed to check chart drift: %w", err)
 	}
+	for _, chart := range releasedCharts {
+		if chartInExtensions(existingHelm, chart.Name) {
+			chartDrift = true
+			changedCharts = append(changedCharts, chart.Name)
+		}
+	}
 
 	// detect drift between the cluster config and the installer metadata
 	var installedCharts k0shelm.ChartList
 	if err := r.List(ctx, &installedCharts); err != nil {
 		return fmt.Errorf("failed to list installed charts: %w", err)
 	}
+
 	pendingCharts, chartErrors, err := detectChartCompletion(existingHelm, installedCharts)
 	if err != nil {
 		return fmt.Errorf("failed to check chart completion: %w", err)
 	}
 
+	releasePending, releaseErrors, err := r.ReconcileChartReleases(ctx, existingHelm, cfgs.Repositories, releasedCharts)
+	if err != nil {
+		return fmt.Errorf("failed to reconcile chart releases: %w", err)
+	}
+	pendingCharts = append(pendingCharts, releasePending...)
+	chartErrors = append(chartErrors, releaseErrors...)
+
+	// failed charts are reported with their remediation hint whatever the installation state,
+	// the retries may later add to the message once the installation has settled in a failure.
+	for _, cerr := range chartErrors {
+		log.Info("Chart error", "chart", cerr.Chart, "reason", cerr.Class.Reason, "hint", cerr.Class.Hint)
+		setChartCondition(in, cerr.Chart, cerr.Class, "Chart failed.")
+	}
+
 	// If any chart has errors, update installer state and return
 	// if there is a difference between what we want and what we have
 	// we should update the cluster instead of letting chart errors stop deployment permanently
 	if len(chartErrors) > 0 && !chartDrift {
-		chartErrorString := strings.Join(chartErrors, ",")
+		messages := []string{}
+		for _, cerr := range chartErrors {
+			messages = append(messages, cerr.Message)
+		}
+		chartErrorString := strings.Join(messages, ",")
 		chartErrorString = "failed to update helm charts: " + chartErrorString
 		log.Info("Chart errors", "errors", chartErrorString)
+		// the full errors are kept in the history record of the change that caused them,
+		// the installation status only holds a truncated version.
+		if err := charts.RecordHistoryErrors(ctx, r.Client, in.Name, chartErrorString); err != nil {
+			log.Error(err, "Failed to record chart errors in history")
+		}
 		if len(chartErrorString) > 1024 {
 			chartErrorString = chartErrorString[:1024]
 		}
@@ -648,6 +696,10 @@ func (r *InstallationReconciler) ReconcileHelmCharts(ctx context.Context, in *v1
 
 	// If all addons match their target version + values, mark installation as complete
 	if len(pendingCharts) == 0 && !chartDrift {
+		if err := charts.CheckAddonsHealth(ctx, r.Client, in, cfgs); err != nil {
+			in.Status.SetState(v1beta1.InstallationStateAddonsInstalling, err.Error(), nil)
+			return nil
+		}
 		in.Status.SetState(v1beta1.InstallationStateInstalled, "Addons upgraded", nil)
 		return nil
 	}
@@ -670,17 +722,104 @@ func (r *InstallationReconciler) ReconcileHelmCharts(ctx context.Context, in *v1
 		return nil
 	}
 
+	missingSecrets, err := charts.MissingAddonSecrets(ctx, r.Client, in, cfgs)
+	if err != nil {
+		return fmt.Errorf("failed to check addon secrets: %w", err)
+	}
+	if len(missingSecrets) > 0 {
+		msg := fmt.Sprintf("Missing addon secrets: %s", strings.Join(missingSecrets, ", "))
+		in.Status.SetState(v1beta1.InstallationStateHelmChartUpdateFailure, msg, nil)
+		return nil
+	}
+
+	// charts leaving the desired set give their providers a chance to clean up first.
+	if err := charts.RemoveAddons(ctx, r.Client, in, existingHelm, cfgs); err != nil {
+		return fmt.Errorf("failed to remove addons: %w", err)
+	}
+
 	// Replace the current chart configs with the new chart configs
-	clusterConfig.Spec.Extensions.Helm = cfgs
+	clusterConfig.Spec.Extensions.Helm = k0sCfgs
 	in.Status.SetState(v1beta1.InstallationStateAddonsInstalling, "Installing addons", nil)
 	log.Info("Updating cluster config with new helm charts", "updated charts", changedCharts)
 	//Update the clusterConfig
 	if err := r.Update(ctx, &clusterConfig); err != nil {
 		return fmt.Errorf("failed to update cluster config: %w", err)
 	}
+	if err := r.RecordChartHistory(ctx, in, existingHelm, k0sCfgs, changedCharts); err != nil {
+		log.Error(err, "Failed to record chart history")
+	}
+	return nil
+}
+
+// RecordChartHistory writes a history record describing the changes applied to the helm charts
+// in the cluster config.
+func (r *InstallationReconciler) RecordChartHistory(
+	ctx context.Context, in *v1beta1.Installation, before, after *k0sv1beta1.HelmExtensions, changedCharts []string,
+) error {
+	sort.Strings(changedCharts)
+	diffs, err := charts.ValuesDiffs(before, after, changedCharts)
+	if err != nil {
+		return fmt.Errorf("failed to diff chart values: %w", err)
+	}
+	rec := &charts.HistoryRecord{
+		Installation: in.Name,
+		Charts:       changedCharts,
+		Diffs:        diffs,
+	}
+	if err := charts.RecordHistory(ctx, r.Client, rec); err != nil {
+		return fmt.Errorf("failed to record history: %w", err)
+	}
 	return nil
 }
 
+// ReconcileChartReleases makes sure the charts reading values from secrets are released by their
+// jobs and uninstalls the releases of the charts that no longer read values from secrets. A
+// chart moving back to k0s is installed by k0s once its release has been uninstalled. Returns
+// the charts whose release is pending and the errors of the failed releases.
+func (r *InstallationReconciler) ReconcileChartReleases(
+	ctx context.Context, existingHelm *k0sv1beta1.HelmExtensions,
+	repos []k0sv1beta1.Repository, released []k0sv1beta1.Chart,
+) ([]string, []chartError, error) {
+	image := os.Getenv("EMBEDDEDCLUSTER_IMAGE")
+	pending := []string{}
+	failed := []chartError{}
+	names := []string{}
+	for _, chart := range released {
+		names = append(names, chart.Name)
+		inClusterConfig := chartInExtensions(existingHelm, chart.Name)
+		status, err := charts.EnsureChartRelease(ctx, r.Client, chart, repos, inClusterConfig, image)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to release chart %s: %w", chart.Name, err)
+		}
+		switch {
+		case status.Error != "":
+			failed = append(failed, chartError{
+				Chart:   chart.Name,
+				Message: status.Error,
+				Class:   classifyChartError(status.Error),
+			})
+		case !status.Done && !inClusterConfig:
+			// charts still in the cluster config are taken care of by the cluster config update.
+			pending = append(pending, chart.Name)
+		}
+	}
+	uninstalling, err := charts.UninstallChartReleases(ctx, r.Client, names, image)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to uninstall chart releases: %w", err)
+	}
+	return append(pending, uninstalling...), failed, nil
+}
+
+// chartInExtensions returns true if the helm extensions hold a chart with the given name.
+func chartInExtensions(ext *k0sv1beta1.HelmExtensions, name string) bool {
+	for _, chart := range ext.Charts {
+		if chart.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // SetStateBasedOnPlan sets the installation state based on the Plan state. For now we do not
 // report anything fancy but we should consider reporting here a summary of how many nodes
 // have been upgraded and how many are still pending.
@@ -765,7 +904,7 @@ func (r *InstallationReconciler) StartAutopilotUpgrade(ctx context.Context, in *
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "autopilot", // this is a fixed name and should not be changed
 			Annotations: map[string]string{
-				InstallationNameAnnotation: in.Name,
+				conditions.InstallationNameAnnotation: in.Name,
 			},
 		},
 		Spec: apv1b2.PlanSpec{
@@ -836,6 +975,7 @@ func (r *InstallationReconciler) DisableOldInstallations(ctx context.Context, it
 	})
 	for _, in := range items[1:] {
 		in.Status.NodesStatus = nil
+		in.Status.SetCondition(finalStateCondition(&in))
 		in.Status.SetState(
 			v1beta1.InstallationStateObsolete,
 			"This is not the most recent installation object",
@@ -912,15 +1052,16 @@ func constructHostPreflightResultsJob(nodeName, installationName string) *batchv
 }
 
 //+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
-//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;update;patch
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=embeddedcluster.replicated.com,resources=installations,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=embeddedcluster.replicated.com,resources=installations/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=embeddedcluster.replicated.com,resources=installations/finalizers,verbs=update
 //+kubebuilder:rbac:groups=autopilot.k0sproject.io,resources=plans,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=k0s.k0sproject.io,resources=clusterconfigs,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=helm.k0sproject.io,resources=charts,verbs=get;list;watch
+//+kubebuilder:rbac:groups=helm.k0sproject.io,resources=charts,verbs=get;list;watch;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch
 
 // Reconcile reconcile the installation object.
 func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -937,6 +1078,9 @@ func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		if in.Status.State == v1beta1.InstallationStateObsolete {
 			continue
 		}
+		if in.Status.State == conditions.InstallationStateCancelled {
+			continue
+		}
 		items = append(items, in)
 	}
 	log.Info("Reconciling installation")
@@ -946,6 +1090,23 @@ func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	}
 	in := r.CoalesceInstallations(ctx, items)
 
+	// the upgrade to this installation may have been cancelled through its annotation. this
+	// has to happen before anything else as the operator running may already be the new one.
+	if in.Annotations[upgrade.CancelAnnotation] == "true" {
+		if err := upgrade.Cancel(ctx, r.Client, in.Name); err != nil {
+			log.Error(err, "Failed to cancel upgrade")
+			in.Status.SetCondition(metav1.Condition{
+				Type:               conditions.CancelConditionType,
+				Status:             metav1.ConditionFalse,
+				Reason:             "CancelFailed",
+				Message:            err.Error(),
+				ObservedGeneration: in.Generation,
+			})
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
 	// if the embedded cluster version has changed we should not reconcile with the old version
 	if r.needsUpgrade(ctx, in) {
 		return ctrl.Result{}, fmt.Errorf("embedded cluster version has changed")
@@ -987,6 +1148,9 @@ func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		return ctrl.Result{}, fmt.Errorf("failed to copy host preflight results: %w", err)
 	}
 
+	// rotated registry credentials must reach the copies before the next upgrade.
+	r.ReconcileRegistryCredentials(ctx, in)
+
 	// if necessary start a k0s upgrade by means of autopilot. this also
 	// keeps the installation in sync with the state of the k0s upgrade.
 	if err := r.ReconcileK0sVersion(ctx, in); err != nil {
@@ -1021,10 +1185,25 @@ func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		return ctrl.Result{}, fmt.Errorf("failed to reconcile helm charts: %w", err)
 	}
 
+	// charts that failed to install are retried with an exponential backoff. we make sure
+	// to come back here once the next retry is due.
+	requeue := requeueAfter
+	retryIn, err := r.ReconcileChartRetries(ctx, in)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to reconcile chart retries: %w", err)
+	} else if retryIn > 0 && retryIn < requeue {
+		requeue = retryIn
+	}
+
 	if err := r.ReconcileHAStatus(ctx, in); err != nil {
 		return ctrl.Result{}, fmt.Errorf("failed to reconcile HA status: %w", err)
 	}
 
+	if err := r.RecordInstallationCompleted(ctx, in); err != nil {
+		log.Error(err, "Failed to record installation completion")
+	}
+	r.ReconcileGarbageCollection(ctx, in)
+
 	// save the installation status. nothing more to do with it.
 	if err := r.Status().Update(ctx, in.DeepCopy()); err != nil {
 		if errors.IsConflict(err) {
@@ -1037,6 +1216,7 @@ func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	// objects as obsolete. these are not necessary anymore and are kept only
 	// for historic reasons.
 	r.DisableOldInstallations(ctx, items)
+	r.ReconcileInstallationHistory(ctx)
 
 	// if we are not in an airgap environment this is the time to call back to
 	// replicated and inform the status of this installation.
@@ -1046,7 +1226,7 @@ func (r *InstallationReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	}
 
 	log.Info("Installation reconciliation ended")
-	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	return ctrl.Result{RequeueAfter: requeue}, nil
 }
 
 func (r *InstallationReconciler) needsUpgrade(ctx context.Context, in *v1beta1.Installation) bool {
@@ -1065,5 +1245,44 @@ func (r *InstallationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Watches(&corev1.Node{}, &handler.EnqueueRequestForObject{}).
 		Watches(&apv1b2.Plan{}, &handler.EnqueueRequestForObject{}).
 		Watches(&k0shelm.Chart{}, &handler.EnqueueRequestForObject{}).
+		Watches(
+			&corev1.Secret{}, &handler.EnqueueRequestForObject{},
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return obj.GetNamespace() == ecNamespace || isRegistryCredsSecret(obj)
+			})),
+		).
+		Watches(
+			&batchv1.Job{}, &handler.EnqueueRequestForObject{},
+			builder.WithPredicates(predicate.NewPredicateFuncs(isChartReleaseJob)),
+		).
 		Complete(r)
 }
+
+// ConfigureSecretsCache restricts the secrets cached by the manager to the ones the reconciler
+// watches, the embedded-cluster namespace secrets charts read values from and the kotsadm
+// registry credentials, instead of every secret in the cluster. Secrets are not read from the
+// cache, they are read straight from the api server.
+func ConfigureSecretsCache(opts *ctrl.Options) {
+	if opts.Cache.ByObject == nil {
+		opts.Cache.ByObject = map[client.Object]cache.ByObject{}
+	}
+	opts.Cache.ByObject[&corev1.Secret{}] = cache.ByObject{
+		Namespaces: map[string]cache.Config{
+			ecNamespace: {},
+			"kotsadm": {
+				FieldSelector: fields.OneTermEqualSelector("metadata.name", artifacts.RegistryCredsSecretName),
+			},
+		},
+	}
+	if opts.Client.Cache == nil {
+		opts.Client.Cache = &client.CacheOptions{}
+	}
+	opts.Client.Cache.DisableFor = append(opts.Client.Cache.DisableFor, &corev1.Secret{})
+}
+
+// isChartReleaseJob returns true if the object is a job releasing a chart reading values from
+// secrets.
+func isChartReleaseJob(obj client.Object) bool {
+	_, ok := obj.GetLabels()[charts.ChartReleaseLabel]
+	return ok
+}
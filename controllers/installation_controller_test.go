@@ -8,13 +8,19 @@ import (
 	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
 	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
 	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/charts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/discovery"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
@@ -192,6 +198,14 @@ func TestInstallationReconciler_ReconcileHelmCharts(t *testing.T) {
 			out: v1beta1.InstallationStatus{
 				State:  v1beta1.InstallationStateHelmChartUpdateFailure,
 				Reason: "failed to update helm charts: exterror",
+				Conditions: []metav1.Condition{
+					{
+						Type:    "HelmChart-extchart",
+						Status:  metav1.ConditionFalse,
+						Reason:  chartErrorUnknown.Reason,
+						Message: chartErrorUnknown.Hint + " Chart failed.",
+					},
+				},
 			},
 			releaseMeta: ectypes.ReleaseMetadata{
 				Configs: v1beta1.Helm{
@@ -256,6 +270,14 @@ func TestInstallationReconciler_ReconcileHelmCharts(t *testing.T) {
 			out: v1beta1.InstallationStatus{
 				State:  v1beta1.InstallationStateHelmChartUpdateFailure,
 				Reason: "failed to update helm charts: metaerror",
+				Conditions: []metav1.Condition{
+					{
+						Type:    "HelmChart-metachart",
+						Status:  metav1.ConditionFalse,
+						Reason:  chartErrorUnknown.Reason,
+						Message: chartErrorUnknown.Hint + " Chart failed.",
+					},
+				},
 			},
 			releaseMeta: ectypes.ReleaseMetadata{
 				Configs: v1beta1.Helm{
@@ -764,6 +786,14 @@ password: original`,
 			out: v1beta1.InstallationStatus{
 				State:  v1beta1.InstallationStateAddonsInstalling,
 				Reason: "Installing addons",
+				Conditions: []metav1.Condition{
+					{
+						Type:    "HelmChart-metachart",
+						Status:  metav1.ConditionFalse,
+						Reason:  chartErrorUnknown.Reason,
+						Message: chartErrorUnknown.Hint + " Chart failed.",
+					},
+				},
 			},
 			releaseMeta: ectypes.ReleaseMetadata{
 				Configs: v1beta1.Helm{
@@ -889,6 +919,7 @@ password: original`,
 			sch := runtime.NewScheme()
 			req.NoError(k0sv1beta1.AddToScheme(sch))
 			req.NoError(k0shelmv1beta1.AddToScheme(sch))
+			req.NoError(v1.AddToScheme(sch))
 			fakeCli := fake.NewClientBuilder().WithScheme(sch).WithRuntimeObjects(tt.fields.State...).Build()
 
 			r := &InstallationReconciler{
@@ -898,6 +929,9 @@ password: original`,
 			}
 			err := r.ReconcileHelmCharts(context.Background(), &tt.in)
 			req.NoError(err)
+			for i := range tt.in.Status.Conditions {
+				tt.in.Status.Conditions[i].LastTransitionTime = metav1.Time{}
+			}
 			req.Equal(tt.out, tt.in.Status)
 
 			if tt.updatedHelm != nil {
@@ -911,6 +945,79 @@ password: original`,
 	}
 }
 
+// removedAddonProvider records the removal of its chart.
+type removedAddonProvider struct {
+	charts.BaseAddonProvider
+	removed bool
+}
+
+func (p *removedAddonProvider) OnRemove(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	p.removed = true
+	return nil
+}
+
+func TestInstallationReconciler_ReconcileHelmCharts_removedChart(t *testing.T) {
+	req := require.New(t)
+
+	p := &removedAddonProvider{BaseAddonProvider: charts.BaseAddonProvider{Name: "removedchart"}}
+	charts.RegisterAddonProvider(p)
+
+	release.CacheMeta("goodver", ectypes.ReleaseMetadata{
+		Configs: v1beta1.Helm{
+			Charts: []v1beta1.Chart{{Name: "metachart", Version: "1", Order: 1}},
+		},
+	})
+	removedSpec := k0shelmv1beta1.ChartSpec{ReleaseName: "removedchart", Version: "1"}
+	metaSpec := k0shelmv1beta1.ChartSpec{ReleaseName: "metachart", Version: "1"}
+	fakeCli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&k0sv1beta1.ClusterConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s", Namespace: "kube-system"},
+			Spec: &k0sv1beta1.ClusterSpec{
+				Extensions: &k0sv1beta1.ClusterExtensions{
+					Helm: &k0sv1beta1.HelmExtensions{
+						Charts: []k0sv1beta1.Chart{
+							{Name: "metachart", Version: "1", Order: 101},
+							{Name: "removedchart", Version: "1"},
+						},
+					},
+				},
+			},
+		},
+		&k0shelmv1beta1.Chart{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-metachart", Namespace: "kube-system"},
+			Spec:       metaSpec,
+			Status:     k0shelmv1beta1.ChartStatus{Version: "1", ValuesHash: metaSpec.HashValues()},
+		},
+		&k0shelmv1beta1.Chart{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-removedchart", Namespace: "kube-system"},
+			Spec:       removedSpec,
+			Status:     k0shelmv1beta1.ChartStatus{Version: "1", ValuesHash: removedSpec.HashValues()},
+		},
+	).Build()
+	r := &InstallationReconciler{Client: fakeCli}
+
+	in := &v1beta1.Installation{
+		Status: v1beta1.InstallationStatus{State: v1beta1.InstallationStateKubernetesInstalled},
+		Spec: v1beta1.InstallationSpec{
+			Config: &v1beta1.ConfigSpec{
+				Version: "goodver",
+				Extensions: v1beta1.Extensions{
+					Helm: &v1beta1.Helm{Charts: []v1beta1.Chart{{Name: "extchart", Version: "2"}}},
+				},
+			},
+		},
+	}
+	req.NoError(r.ReconcileHelmCharts(context.Background(), in))
+	req.Equal(v1beta1.InstallationStateAddonsInstalling, in.Status.State)
+	req.True(p.removed)
+
+	var gotCluster k0sv1beta1.ClusterConfig
+	req.NoError(fakeCli.Get(context.Background(), client.ObjectKey{Name: "k0s", Namespace: "kube-system"}, &gotCluster))
+	for _, chart := range gotCluster.Spec.Extensions.Helm.Charts {
+		req.NotEqual("removedchart", chart.Name)
+	}
+}
+
 func TestInstallationReconciler_constructCreateCMCommand(t *testing.T) {
 	job := constructHostPreflightResultsJob("my-node", "install-name")
 	require.Len(t, job.Spec.Template.Spec.Containers, 1)
@@ -928,3 +1035,102 @@ func TestInstallationReconciler_constructCreateCMCommand(t *testing.T) {
 		Value: "my-node-host-preflight-results",
 	}, job.Spec.Template.Spec.Containers[0].Env[1])
 }
+
+func TestInstallationReconciler_ReconcileChartReleases(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	t.Setenv("EMBEDDEDCLUSTER_IMAGE", "operator:latest")
+
+	fakeCli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "embedded-cluster"},
+			Data:       map[string][]byte{"password": []byte("s3cr3t")},
+		},
+		&k0shelmv1beta1.Chart{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       "k0s-addon-chart-vendor",
+				Namespace:  "kube-system",
+				Finalizers: []string{"helm.k0sproject.io/uninstall-helm-release"},
+			},
+			Spec: k0shelmv1beta1.ChartSpec{ReleaseName: "vendor", Values: "abc: xyz\n"},
+		},
+	).Build()
+	r := &InstallationReconciler{Client: fakeCli}
+
+	released := []k0sv1beta1.Chart{{
+		Name:      "vendor",
+		ChartName: "repo/vendor",
+		Version:   "1.0.0",
+		TargetNS:  "vendor",
+		Values:    "abc: xyz\nembeddedClusterValuesFrom:\n- secret: creds\n  key: password\n  path: password\n",
+	}}
+	existingHelm := &k0sv1beta1.HelmExtensions{Charts: []k0sv1beta1.Chart{{Name: "vendor", Values: "abc: xyz\n"}}}
+
+	// while the chart is still in the cluster config the k0s chart object is kept, without its
+	// finalizer so the release is not uninstalled when the cluster config is updated.
+	pending, failed, err := r.ReconcileChartReleases(ctx, existingHelm, nil, released)
+	req.NoError(err)
+	req.Empty(pending)
+	req.Empty(failed)
+	var k0sChart k0shelmv1beta1.Chart
+	req.NoError(fakeCli.Get(ctx, client.ObjectKey{Name: "k0s-addon-chart-vendor", Namespace: "kube-system"}, &k0sChart))
+	req.Empty(k0sChart.Finalizers)
+
+	// once the chart left the cluster config the release job takes over.
+	existingHelm = &k0sv1beta1.HelmExtensions{}
+	pending, failed, err = r.ReconcileChartReleases(ctx, existingHelm, nil, released)
+	req.NoError(err)
+	req.Equal([]string{"vendor"}, pending)
+	req.Empty(failed)
+	pending, _, err = r.ReconcileChartReleases(ctx, existingHelm, nil, released)
+	req.NoError(err)
+	req.Equal([]string{"vendor"}, pending)
+
+	var job batchv1.Job
+	req.NoError(fakeCli.Get(ctx, client.ObjectKey{Name: "chart-release-vendor", Namespace: "embedded-cluster"}, &job))
+	req.Equal("operator:latest", job.Spec.Template.Spec.Containers[0].Image)
+	var values v1.Secret
+	req.NoError(fakeCli.Get(ctx, client.ObjectKey{Name: "chart-values-vendor", Namespace: "embedded-cluster"}, &values))
+	req.Equal("abc: xyz\npassword: s3cr3t\n", string(values.Data["values.yaml"]))
+
+	job.Status.Succeeded = 1
+	req.NoError(fakeCli.Status().Update(ctx, &job))
+	pending, failed, err = r.ReconcileChartReleases(ctx, existingHelm, nil, released)
+	req.NoError(err)
+	req.Empty(pending)
+	req.Empty(failed)
+
+	// charts no longer reading values from secrets have their release uninstalled.
+	pending, _, err = r.ReconcileChartReleases(ctx, existingHelm, nil, nil)
+	req.NoError(err)
+	req.Equal([]string{"vendor"}, pending)
+	req.NoError(fakeCli.Get(ctx, client.ObjectKey{Name: "chart-release-vendor", Namespace: "embedded-cluster"}, &job))
+	req.Contains(job.Spec.Template.Spec.Containers[0].Args, "uninstall")
+}
+
+func TestConfigureSecretsCache(t *testing.T) {
+	req := require.New(t)
+
+	var opts ctrl.Options
+	ConfigureSecretsCache(&opts)
+
+	var secrets cache.ByObject
+	for obj, byObject := range opts.Cache.ByObject {
+		if _, ok := obj.(*v1.Secret); ok {
+			secrets = byObject
+		}
+	}
+	req.Len(secrets.Namespaces, 2)
+
+	// charts read values from any secret in the embedded-cluster namespace.
+	req.Contains(secrets.Namespaces, "embedded-cluster")
+	req.Nil(secrets.Namespaces["embedded-cluster"].LabelSelector)
+
+	registryCreds := secrets.Namespaces["kotsadm"].FieldSelector
+	req.True(registryCreds.Matches(fields.Set{"metadata.name": "registry-creds"}))
+	req.False(registryCreds.Matches(fields.Set{"metadata.name": "kotsadm-password"}))
+
+	// secrets outside the cache must still be readable.
+	req.Len(opts.Client.Cache.DisableFor, 1)
+	req.IsType(&v1.Secret{}, opts.Client.Cache.DisableFor[0])
+}
@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ChartRetryAttemptsAnnotation holds the number of times we have forced k0s to retry
+	// the installation of a failed chart.
+	ChartRetryAttemptsAnnotation = "embedded-cluster.replicated.com/retry-attempts"
+	// ChartRetryLastAttemptAnnotation holds the time of the last forced retry (RFC3339).
+	ChartRetryLastAttemptAnnotation = "embedded-cluster.replicated.com/retry-last-attempt"
+	// ChartRetryKeyAnnotation holds a hash of the chart version and values the retries
+	// refer to. If the chart changes the retry count starts over.
+	ChartRetryKeyAnnotation = "embedded-cluster.replicated.com/retry-key"
+
+	// RemediatePendingUpgradeAnnotation can be set to "true" on the installation to opt into
+	// the automatic removal of helm release revisions stuck in a pending state.
+	RemediatePendingUpgradeAnnotation = "embedded-cluster.replicated.com/remediate-pending-upgrade"
+
+	// chartRetryMarker prefixes the yaml comment we add to the chart values to force k0s to
+	// reconcile the chart again. k0s only reacts to spec changes and re-installs the chart if
+	// the values hash changes, a comment changes the hash without changing the values.
+	chartRetryMarker = "# embedded-cluster-operator retry attempt: "
+)
+
+var (
+	// chartRetryMaxAttempts is the maximum number of times we retry a failed chart.
+	chartRetryMaxAttempts = 5
+	// chartRetryBaseBackoff is the time we wait before the first retry. The interval
+	// doubles after each attempt up to chartRetryMaxBackoff.
+	chartRetryBaseBackoff = 30 * time.Second
+	chartRetryMaxBackoff  = 10 * time.Minute
+)
+
+// ReconcileChartRetries forces k0s to retry the installation of charts that have failed. Retries
+// happen only once the installation has settled in the HelmChartUpdateFailure state and follow an
+// exponential backoff. Each failed chart is reported through a condition holding the class of the
+// error, a remediation hint and the number of attempts. The number of attempts is also recorded
+// in the installation annotations for the status and wait commands. Returns the time until the
+// next retry is due, zero if no retry is scheduled.
+func (r *InstallationReconciler) ReconcileChartRetries(ctx context.Context, in *v1beta1.Installation) (time.Duration, error) {
+	var installedCharts k0shelm.ChartList
+	if err := r.List(ctx, &installedCharts); err != nil {
+		return 0, fmt.Errorf("failed to list installed charts: %w", err)
+	}
+
+	var next time.Duration
+	now := time.Now()
+	retries := map[string]conditions.ChartRetries{}
+	for i := range installedCharts.Items {
+		chart := &installedCharts.Items[i]
+		if chart.Status.Error == "" {
+			if err := r.resetChartRetries(ctx, in, chart); err != nil {
+				return 0, fmt.Errorf("failed to reset retries for chart %s: %w", chart.Spec.ReleaseName, err)
+			}
+			continue
+		}
+		if in.Status.State != v1beta1.InstallationStateHelmChartUpdateFailure {
+			continue
+		}
+		wait, attempts, err := r.retryChart(ctx, in, chart, now)
+		if err != nil {
+			return 0, fmt.Errorf("failed to retry chart %s: %w", chart.Spec.ReleaseName, err)
+		}
+		retries[chart.Spec.ReleaseName] = conditions.ChartRetries{
+			Attempts:    attempts,
+			MaxAttempts: chartRetryMaxAttempts,
+		}
+		if wait > 0 && (next == 0 || wait < next) {
+			next = wait
+		}
+	}
+	if err := r.patchInstallationChartRetries(ctx, in, retries); err != nil {
+		return 0, fmt.Errorf("failed to record chart retries: %w", err)
+	}
+	return next, nil
+}
+
+// retryChart schedules or executes a retry for the given failed chart. Returns the time until
+// the next retry is due and the number of retries attempted so far.
+func (r *InstallationReconciler) retryChart(ctx context.Context, in *v1beta1.Installation, chart *k0shelm.Chart, now time.Time) (time.Duration, int, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	key := chartRetryKey(chart.Spec)
+	attempts, last := 0, now
+	if chart.Annotations[ChartRetryKeyAnnotation] == key {
+		attempts, _ = strconv.Atoi(chart.Annotations[ChartRetryAttemptsAnnotation])
+		if t, err := time.Parse(time.RFC3339, chart.Annotations[ChartRetryLastAttemptAnnotation]); err == nil {
+			last = t
+		}
+	}
+
+	// k0s has not yet processed our previous retry, wait for it to report back.
+	if chart.Spec.HashValues() != chart.Status.ValuesHash {
+		return 0, attempts, nil
+	}
+
+	if chart.Annotations[ChartRetryKeyAnnotation] != key {
+		// this is the first time we see this chart failing, we record the moment so the
+		// backoff is calculated from here.
+		if err := r.patchChartRetry(ctx, chart, key, 0, now, false); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	class := classifyChartError(chart.Status.Error)
+	if attempts >= chartRetryMaxAttempts {
+		msg := conditions.ChartRetriesExhaustedMessage(attempts)
+		setChartCondition(in, chart.Spec.ReleaseName, class, msg)
+		return 0, attempts, nil
+	}
+
+	due := last.Add(chartRetryBackoff(attempts))
+	if now.Before(due) {
+		msg := fmt.Sprintf("Retry %d of %d scheduled at %s.", attempts+1, chartRetryMaxAttempts, due.UTC().Format(time.RFC3339))
+		setChartCondition(in, chart.Spec.ReleaseName, class, msg)
+		return due.Sub(now), attempts, nil
+	}
+
+	msg := fmt.Sprintf("Retry %d of %d in progress.", attempts+1, chartRetryMaxAttempts)
+	if class.Reason == chartErrorPendingUpgrade.Reason && in.Annotations[RemediatePendingUpgradeAnnotation] == "true" {
+		removed, err := r.removePendingReleaseRevisions(ctx, chart)
+		if err != nil {
+			return 0, 0, fmt.Errorf("remove pending release revisions: %w", err)
+		}
+		msg = fmt.Sprintf("Removed %d pending release revision(s). %s", removed, msg)
+	}
+
+	log.Info("Retrying failed chart", "chart", chart.Spec.ReleaseName, "attempt", attempts+1, "reason", class.Reason)
+	if err := r.patchChartRetry(ctx, chart, key, attempts+1, now, true); err != nil {
+		return 0, 0, err
+	}
+	setChartCondition(in, chart.Spec.ReleaseName, class, msg)
+	return 0, attempts + 1, nil
+}
+
+// patchInstallationChartRetries records the retries of the failed charts in the installation
+// annotations. Only the annotations are patched, the status of the installation is saved at the
+// end of the reconcile.
+func (r *InstallationReconciler) patchInstallationChartRetries(
+	ctx context.Context, in *v1beta1.Installation, retries map[string]conditions.ChartRetries,
+) error {
+	if current, err := conditions.ChartRetriesFor(in); err == nil && equality.Semantic.DeepEqual(current, retries) {
+		return nil
+	}
+	patched := in.DeepCopy()
+	patch := client.MergeFrom(in.DeepCopy())
+	if err := conditions.SetChartRetries(patched, retries); err != nil {
+		return err
+	}
+	if err := r.Patch(ctx, patched, patch); err != nil {
+		return fmt.Errorf("patch installation: %w", err)
+	}
+	in.Annotations = patched.Annotations
+	in.ResourceVersion = patched.ResourceVersion
+	return nil
+}
+
+// setChartCondition reports a chart failure through the chart condition in the installation.
+func setChartCondition(in *v1beta1.Installation, chartName string, class chartErrorClass, msg string) {
+	in.Status.SetCondition(metav1.Condition{
+		Type:               conditions.ChartConditionType(chartName),
+		Status:             metav1.ConditionFalse,
+		Reason:             class.Reason,
+		Message:            fmt.Sprintf("%s %s", class.Hint, msg),
+		ObservedGeneration: in.Generation,
+	})
+}
+
+// removePendingReleaseRevisions deletes the helm release secrets for the chart that are in a
+// pending state (pending-install, pending-upgrade or pending-rollback). Helm then considers the
+// last deployed revision as the current one and the next attempt is able to proceed. Returns
+// the number of revisions removed.
+func (r *InstallationReconciler) removePendingReleaseRevisions(ctx context.Context, chart *k0shelm.Chart) (int, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	namespace := chart.Status.Namespace
+	if namespace == "" {
+		namespace = chart.Spec.Namespace
+	}
+	var secrets corev1.SecretList
+	if err := r.List(
+		ctx, &secrets,
+		client.InNamespace(namespace),
+		client.MatchingLabels{"owner": "helm", "name": chart.Spec.ReleaseName},
+	); err != nil {
+		return 0, fmt.Errorf("list release secrets: %w", err)
+	}
+
+	removed := 0
+	for _, secret := range secrets.Items {
+		if !strings.HasPrefix(secret.Labels["status"], "pending-") {
+			continue
+		}
+		log.Info("Removing pending helm release revision", "chart", chart.Spec.ReleaseName, "secret", secret.Name)
+		if err := r.Delete(ctx, &secret); client.IgnoreNotFound(err) != nil {
+			return 0, fmt.Errorf("delete release secret %s: %w", secret.Name, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// patchChartRetry records the retry attempt in the chart annotations. If retry is true the chart
+// values are also changed so k0s attempts to install the chart again.
+func (r *InstallationReconciler) patchChartRetry(ctx context.Context, chart *k0shelm.Chart, key string, attempts int, at time.Time, retry bool) error {
+	patch := client.MergeFrom(chart.DeepCopy())
+	if chart.Annotations == nil {
+		chart.Annotations = map[string]string{}
+	}
+	chart.Annotations[ChartRetryKeyAnnotation] = key
+	chart.Annotations[ChartRetryAttemptsAnnotation] = strconv.Itoa(attempts)
+	chart.Annotations[ChartRetryLastAttemptAnnotation] = at.UTC().Format(time.RFC3339)
+	if retry {
+		chart.Spec.Values = withChartRetryMarker(chart.Spec.Values, attempts)
+	}
+	if err := r.Patch(ctx, chart, patch); err != nil {
+		return fmt.Errorf("patch chart %s: %w", chart.Name, err)
+	}
+	return nil
+}
+
+// resetChartRetries removes the chart condition from the installation and, once the chart has
+// settled, the retry annotations from the chart.
+func (r *InstallationReconciler) resetChartRetries(ctx context.Context, in *v1beta1.Installation, chart *k0shelm.Chart) error {
+	meta.RemoveStatusCondition(&in.Status.Conditions, conditions.ChartConditionType(chart.Spec.ReleaseName))
+	if _, ok := chart.Annotations[ChartRetryKeyAnnotation]; !ok {
+		return nil
+	}
+	if chart.Spec.HashValues() != chart.Status.ValuesHash {
+		return nil
+	}
+	patch := client.MergeFrom(chart.DeepCopy())
+	delete(chart.Annotations, ChartRetryKeyAnnotation)
+	delete(chart.Annotations, ChartRetryAttemptsAnnotation)
+	delete(chart.Annotations, ChartRetryLastAttemptAnnotation)
+	if err := r.Patch(ctx, chart, patch); err != nil {
+		return fmt.Errorf("patch chart %s: %w", chart.Name, err)
+	}
+	return nil
+}
+
+// chartRetryBackoff returns the time to wait before executing the given retry attempt.
+func chartRetryBackoff(attempts int) time.Duration {
+	backoff := chartRetryBaseBackoff
+	for i := 0; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= chartRetryMaxBackoff {
+			return chartRetryMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// chartRetryKey returns a hash of the chart version and values, ignoring any retry marker.
+func chartRetryKey(spec k0shelm.ChartSpec) string {
+	data := spec.Version + "\x00" + withoutChartRetryMarker(spec.Values)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))[:10]
+}
+
+// withChartRetryMarker replaces any existing retry marker in the values by one for the given
+// attempt.
+func withChartRetryMarker(values string, attempt int) string {
+	values = withoutChartRetryMarker(values)
+	if values != "" && !strings.HasSuffix(values, "\n") {
+		values += "\n"
+	}
+	return fmt.Sprintf("%s%s%d\n", values, chartRetryMarker, attempt)
+}
+
+// withoutChartRetryMarker removes the retry marker from the values.
+func withoutChartRetryMarker(values string) string {
+	lines := strings.SplitAfter(values, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, chartRetryMarker) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "")
+}
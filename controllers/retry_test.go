@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	k0shelmv1beta1 "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_chartRetryBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, chartRetryBackoff(0))
+	assert.Equal(t, 60*time.Second, chartRetryBackoff(1))
+	assert.Equal(t, 4*time.Minute, chartRetryBackoff(3))
+	assert.Equal(t, chartRetryMaxBackoff, chartRetryBackoff(10))
+}
+
+func Test_withChartRetryMarker(t *testing.T) {
+	values := withChartRetryMarker("abc: xyz", 1)
+	assert.Equal(t, "abc: xyz\n# embedded-cluster-operator retry attempt: 1\n", values)
+
+	values = withChartRetryMarker(values, 2)
+	assert.Equal(t, "abc: xyz\n# embedded-cluster-operator retry attempt: 2\n", values)
+	assert.Equal(t, "abc: xyz\n", withoutChartRetryMarker(values))
+
+	// the marker must not change the values themselves.
+	diff, err := yamlDiff("abc: xyz", values)
+	require.NoError(t, err)
+	assert.False(t, diff)
+
+	assert.Equal(t,
+		chartRetryKey(k0shelmv1beta1.ChartSpec{Version: "1", Values: "abc: xyz\n"}),
+		chartRetryKey(k0shelmv1beta1.ChartSpec{Version: "1", Values: values}),
+	)
+}
+
+func TestInstallationReconciler_ReconcileChartRetries(t *testing.T) {
+	failedChart := func(annotations map[string]string) *k0shelmv1beta1.Chart {
+		spec := k0shelmv1beta1.ChartSpec{ReleaseName: "failing", Version: "1", Values: "abc: xyz\n"}
+		return &k0shelmv1beta1.Chart{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "k0s-addon-chart-failing",
+				Namespace:   "kube-system",
+				Annotations: annotations,
+			},
+			Spec: spec,
+			Status: k0shelmv1beta1.ChartStatus{
+				Version:    "1",
+				ValuesHash: spec.HashValues(),
+				Error:      "timed out waiting for the condition",
+			},
+		}
+	}
+	key := chartRetryKey(k0shelmv1beta1.ChartSpec{Version: "1", Values: "abc: xyz\n"})
+
+	tests := []struct {
+		name         string
+		state        string
+		chart        *k0shelmv1beta1.Chart
+		wantWait     bool
+		wantReason   string
+		wantMessage  string
+		wantAttempts string
+		wantValues   string
+		wantRetries  map[string]conditions.ChartRetries
+	}{
+		{
+			name:         "first failure schedules a retry",
+			state:        v1beta1.InstallationStateHelmChartUpdateFailure,
+			chart:        failedChart(nil),
+			wantWait:     true,
+			wantReason:   "ResourceTimeout",
+			wantMessage:  "Retry 1 of 5 scheduled",
+			wantAttempts: "0",
+			wantValues:   "abc: xyz\n",
+			wantRetries:  map[string]conditions.ChartRetries{"failing": {Attempts: 0, MaxAttempts: 5}},
+		},
+		{
+			name:  "due retry is executed",
+			state: v1beta1.InstallationStateHelmChartUpdateFailure,
+			chart: failedChart(map[string]string{
+				ChartRetryKeyAnnotation:         key,
+				ChartRetryAttemptsAnnotation:    "1",
+				ChartRetryLastAttemptAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			}),
+			wantReason:   "ResourceTimeout",
+			wantMessage:  "Retry 2 of 5 in progress",
+			wantAttempts: "2",
+			wantValues:   "abc: xyz\n# embedded-cluster-operator retry attempt: 2\n",
+			wantRetries:  map[string]conditions.ChartRetries{"failing": {Attempts: 2, MaxAttempts: 5}},
+		},
+		{
+			name:  "retries exhausted",
+			state: v1beta1.InstallationStateHelmChartUpdateFailure,
+			chart: failedChart(map[string]string{
+				ChartRetryKeyAnnotation:         key,
+				ChartRetryAttemptsAnnotation:    "5",
+				ChartRetryLastAttemptAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			}),
+			wantReason:   "ResourceTimeout",
+			wantMessage:  "Chart failed after 5 retries",
+			wantAttempts: "5",
+			wantValues:   "abc: xyz\n",
+			wantRetries:  map[string]conditions.ChartRetries{"failing": {Attempts: 5, MaxAttempts: 5}},
+		},
+		{
+			name:  "chart changed, retries start over",
+			state: v1beta1.InstallationStateHelmChartUpdateFailure,
+			chart: failedChart(map[string]string{
+				ChartRetryKeyAnnotation:         "other-key",
+				ChartRetryAttemptsAnnotation:    "5",
+				ChartRetryLastAttemptAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			}),
+			wantWait:     true,
+			wantReason:   "ResourceTimeout",
+			wantMessage:  "Retry 1 of 5 scheduled",
+			wantAttempts: "0",
+			wantValues:   "abc: xyz\n",
+			wantRetries:  map[string]conditions.ChartRetries{"failing": {Attempts: 0, MaxAttempts: 5}},
+		},
+		{
+			name:       "installation not in failure state",
+			state:      v1beta1.InstallationStateAddonsInstalling,
+			chart:      failedChart(nil),
+			wantValues: "abc: xyz\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+
+			sch := runtime.NewScheme()
+			req.NoError(k0shelmv1beta1.AddToScheme(sch))
+			req.NoError(v1beta1.AddToScheme(sch))
+			in := &v1beta1.Installation{
+				ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+				Status:     v1beta1.InstallationStatus{State: tt.state},
+			}
+			fakeCli := fake.NewClientBuilder().WithScheme(sch).WithObjects(tt.chart, in.DeepCopy()).Build()
+			r := &InstallationReconciler{Client: fakeCli}
+
+			wait, err := r.ReconcileChartRetries(context.Background(), in)
+			req.NoError(err)
+			req.Equal(tt.wantWait, wait > 0)
+
+			cond := meta.FindStatusCondition(in.Status.Conditions, conditions.ChartConditionType("failing"))
+			if tt.wantReason == "" {
+				req.Nil(cond)
+			} else {
+				req.NotNil(cond)
+				req.Equal(tt.wantReason, cond.Reason)
+				req.Contains(cond.Message, tt.wantMessage)
+			}
+
+			var got k0shelmv1beta1.Chart
+			req.NoError(fakeCli.Get(context.Background(), client.ObjectKeyFromObject(tt.chart), &got))
+			req.Equal(tt.wantValues, got.Spec.Values)
+			req.Equal(tt.wantAttempts, got.Annotations[ChartRetryAttemptsAnnotation])
+
+			// the retries are recorded in the installation for the status and wait commands.
+			var gotIn v1beta1.Installation
+			req.NoError(fakeCli.Get(context.Background(), client.ObjectKeyFromObject(in), &gotIn))
+			retries, err := conditions.ChartRetriesFor(&gotIn)
+			req.NoError(err)
+			if tt.wantRetries == nil {
+				req.Empty(retries)
+			} else {
+				req.Equal(tt.wantRetries, retries)
+			}
+			req.Equal(gotIn.Annotations, in.Annotations)
+		})
+	}
+}
+
+func TestInstallationReconciler_ReconcileChartRetries_pendingUpgrade(t *testing.T) {
+	spec := k0shelmv1beta1.ChartSpec{ReleaseName: "stuck", Namespace: "stuck", Version: "1", Values: "abc: xyz\n"}
+	chart := &k0shelmv1beta1.Chart{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "k0s-addon-chart-stuck",
+			Namespace: "kube-system",
+			Annotations: map[string]string{
+				ChartRetryKeyAnnotation:         chartRetryKey(spec),
+				ChartRetryAttemptsAnnotation:    "0",
+				ChartRetryLastAttemptAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: spec,
+		Status: k0shelmv1beta1.ChartStatus{
+			Version:    "1",
+			ValuesHash: spec.HashValues(),
+			Error:      "another operation (install/upgrade/rollback) is in progress",
+		},
+	}
+	release := func(name, status string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "stuck",
+				Labels:    map[string]string{"owner": "helm", "name": "stuck", "status": status},
+			},
+		}
+	}
+
+	for _, optIn := range []bool{false, true} {
+		req := require.New(t)
+
+		sch := runtime.NewScheme()
+		req.NoError(k0shelmv1beta1.AddToScheme(sch))
+		req.NoError(corev1.AddToScheme(sch))
+		req.NoError(v1beta1.AddToScheme(sch))
+		in := &v1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+			Status:     v1beta1.InstallationStatus{State: v1beta1.InstallationStateHelmChartUpdateFailure},
+		}
+		if optIn {
+			in.Annotations = map[string]string{RemediatePendingUpgradeAnnotation: "true"}
+		}
+		fakeCli := fake.NewClientBuilder().WithScheme(sch).WithObjects(
+			chart.DeepCopy(),
+			in.DeepCopy(),
+			release("sh.helm.release.v1.stuck.v1", "deployed"),
+			release("sh.helm.release.v1.stuck.v2", "pending-upgrade"),
+		).Build()
+		r := &InstallationReconciler{Client: fakeCli}
+
+		_, err := r.ReconcileChartRetries(context.Background(), in)
+		req.NoError(err)
+
+		cond := meta.FindStatusCondition(in.Status.Conditions, conditions.ChartConditionType("stuck"))
+		req.NotNil(cond)
+		req.Equal("ReleasePendingUpgrade", cond.Reason)
+
+		var secrets corev1.SecretList
+		req.NoError(fakeCli.List(context.Background(), &secrets, client.InNamespace("stuck")))
+		if optIn {
+			req.Len(secrets.Items, 1)
+			req.Equal("sh.helm.release.v1.stuck.v1", secrets.Items[0].Name)
+		} else {
+			req.Len(secrets.Items, 2)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package archive stores obsolete installation objects, compressed, in a config map so they
+// can be removed from the cluster without losing track of the upgrade history.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ConfigMapName is the name of the config map holding the archived installations.
+	ConfigMapName = "installation-archive"
+
+	configMapNamespace = "embedded-cluster"
+)
+
+// maxArchiveSize is the maximum size, in bytes, of the archived data. Config maps are limited to
+// 1MiB, once the limit is reached the oldest installations are dropped from the archive.
+var maxArchiveSize = 900 * 1024
+
+// Add compresses and stores the provided installations in the archive.
+func Add(ctx context.Context, cli client.Client, items []clusterv1beta1.Installation) error {
+	var cm corev1.ConfigMap
+	nsn := client.ObjectKey{Name: ConfigMapName, Namespace: configMapNamespace}
+	create := false
+	if err := cli.Get(ctx, nsn, &cm); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("get archive: %w", err)
+		}
+		create = true
+		cm = corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: nsn.Name, Namespace: nsn.Namespace},
+		}
+	}
+	if cm.BinaryData == nil {
+		cm.BinaryData = map[string][]byte{}
+	}
+
+	for _, in := range items {
+		data, err := compress(in)
+		if err != nil {
+			return fmt.Errorf("compress installation %s: %w", in.Name, err)
+		}
+		cm.BinaryData[in.Name] = data
+	}
+	trim(cm.BinaryData)
+
+	if create {
+		if err := cli.Create(ctx, &cm); err != nil {
+			return fmt.Errorf("create archive: %w", err)
+		}
+		return nil
+	}
+	if err := cli.Update(ctx, &cm); err != nil {
+		return fmt.Errorf("update archive: %w", err)
+	}
+	return nil
+}
+
+// List returns all archived installations sorted by name (creation order).
+func List(ctx context.Context, cli client.Client) ([]clusterv1beta1.Installation, error) {
+	var cm corev1.ConfigMap
+	nsn := client.ObjectKey{Name: ConfigMapName, Namespace: configMapNamespace}
+	if err := cli.Get(ctx, nsn, &cm); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get archive: %w", err)
+	}
+
+	items := []clusterv1beta1.Installation{}
+	for name, data := range cm.BinaryData {
+		in, err := decompress(data)
+		if err != nil {
+			return nil, fmt.Errorf("decompress installation %s: %w", name, err)
+		}
+		items = append(items, *in)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// trim removes the oldest entries until the archive fits in maxArchiveSize. Installation names
+// are timestamps so the oldest entries are the ones sorted first.
+func trim(data map[string][]byte) {
+	names := []string{}
+	size := 0
+	for name, entry := range data {
+		names = append(names, name)
+		size += len(name) + len(entry)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if size <= maxArchiveSize {
+			return
+		}
+		size -= len(name) + len(data[name])
+		delete(data, name)
+	}
+}
+
+func compress(in clusterv1beta1.Installation) ([]byte, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(data); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) (*clusterv1beta1.Installation, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer gr.Close()
+	raw, err := io.ReadAll(gr)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	var in clusterv1beta1.Installation
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &in, nil
+}
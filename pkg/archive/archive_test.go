@@ -0,0 +1,60 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func installation(name string) clusterv1beta1.Installation {
+	return clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       clusterv1beta1.InstallationSpec{ClusterID: "cluster-id"},
+		Status:     clusterv1beta1.InstallationStatus{State: clusterv1beta1.InstallationStateObsolete},
+	}
+}
+
+func TestAddList(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+
+	items, err := List(ctx, cli)
+	req.NoError(err)
+	req.Empty(items)
+
+	req.NoError(Add(ctx, cli, []clusterv1beta1.Installation{installation("20240102000000")}))
+	req.NoError(Add(ctx, cli, []clusterv1beta1.Installation{installation("20240101000000")}))
+
+	items, err = List(ctx, cli)
+	req.NoError(err)
+	req.Len(items, 2)
+	req.Equal("20240101000000", items[0].Name)
+	req.Equal("20240102000000", items[1].Name)
+	req.Equal("cluster-id", items[1].Spec.ClusterID)
+	req.Equal(clusterv1beta1.InstallationStateObsolete, items[1].Status.State)
+}
+
+func Test_trim(t *testing.T) {
+	orig := maxArchiveSize
+	defer func() { maxArchiveSize = orig }()
+	maxArchiveSize = 25
+
+	data := map[string][]byte{}
+	for i := 1; i <= 4; i++ {
+		data[fmt.Sprintf("2024010%d", i)] = []byte("xx")
+	}
+	trim(data)
+	// every entry takes 10 bytes, only the two newest fit.
+	req := require.New(t)
+	req.Len(data, 2)
+	req.Contains(data, "20240103")
+	req.Contains(data, "20240104")
+}
@@ -0,0 +1,112 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+// ArtifactDestinationPrefix prefixes the release metadata artifacts declaring where an
+// additional artifact is placed on the nodes. The rest of the key is the name of the artifact in
+// the installation additional artifacts and the value is a path relative to the embedded cluster
+// data directory, e.g. "destination/mytool": "bin/mytool". Artifacts without a declared
+// destination are placed in the bin directory under their own name.
+const ArtifactDestinationPrefix = "destination/"
+
+// additionalArtifactsDir is where the additional artifacts are pulled, relative to the data
+// directory, before they are verified and placed.
+const additionalArtifactsDir = "tmp/additional-artifacts"
+
+// reservedDestinations can't be used by additional artifacts as they are written by the copy
+// artifacts job itself.
+var reservedDestinations = []string{k0sBinary, k0sUpgradeBinary, imagesTarball}
+
+// AdditionalArtifacts returns the locations of the installation additional artifacts indexed by
+// their destination relative to the data directory.
+func AdditionalArtifacts(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (map[string]string, error) {
+	if in.Spec.Artifacts == nil || len(in.Spec.Artifacts.AdditionalArtifacts) == 0 {
+		return nil, nil
+	}
+
+	declared := map[string]string{}
+	if in.Spec.Config != nil && in.Spec.Config.Version != "" {
+		meta, err := release.MetadataFor(ctx, in, cli)
+		if err != nil {
+			return nil, fmt.Errorf("get release metadata: %w", err)
+		}
+		for name := range in.Spec.Artifacts.AdditionalArtifacts {
+			if dst, ok := meta.Artifacts[ArtifactDestinationPrefix+name]; ok {
+				declared[name] = dst
+			}
+		}
+	}
+
+	artifacts := map[string]string{}
+	for _, name := range sortedKeys(in.Spec.Artifacts.AdditionalArtifacts) {
+		dst, ok := declared[name]
+		if !ok {
+			dst = filepath.Join("bin", name)
+		}
+		dst = filepath.Clean(dst)
+		if !filepath.IsLocal(dst) {
+			return nil, fmt.Errorf("destination %s of additional artifact %s is outside the data directory", dst, name)
+		}
+		for _, reserved := range reservedDestinations {
+			if dst == reserved {
+				return nil, fmt.Errorf("destination %s of additional artifact %s is reserved", dst, name)
+			}
+		}
+		if _, ok := artifacts[dst]; ok {
+			return nil, fmt.Errorf("destination %s of additional artifact %s is used by another artifact", dst, name)
+		}
+		artifacts[dst] = in.Spec.Artifacts.AdditionalArtifacts[name]
+	}
+	return artifacts, nil
+}
+
+// PullAdditionalArtifacts pulls the additional artifacts, indexed by destination, from the
+// registry into the data directory where they wait to be verified and placed. Each artifact must
+// hold a single file. The pull options are applied to every artifact.
+func PullAdditionalArtifacts(ctx context.Context, log logr.Logger, cli client.Client, dataDir string, artifacts map[string]string, applyOpts ...func(*PullOptions)) error {
+	for _, dst := range sortedKeys(artifacts) {
+		if err := pullAdditionalArtifact(ctx, log, cli, dataDir, dst, artifacts[dst], applyOpts...); err != nil {
+			return fmt.Errorf("pull %s: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+func pullAdditionalArtifact(ctx context.Context, log logr.Logger, cli client.Client, dataDir, dst, from string, applyOpts ...func(*PullOptions)) error {
+	location, err := Pull(ctx, log, cli, from, applyOpts...)
+	if err != nil {
+		return fmt.Errorf("pull artifact: %w", err)
+	}
+	defer os.RemoveAll(location)
+
+	file, err := artifactFile(location)
+	if err != nil {
+		return fmt.Errorf("artifact %s: %w", from, err)
+	}
+
+	pulled := filepath.Join(dataDir, pulledAdditionalArtifact(dst))
+	if err := os.MkdirAll(filepath.Dir(pulled), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := moveFile(file, pulled); err != nil {
+		return fmt.Errorf("move artifact: %w", err)
+	}
+	return nil
+}
+
+// pulledAdditionalArtifact returns the path, relative to the data directory, the additional
+// artifact with the given destination is pulled into.
+func pulledAdditionalArtifact(dst string) string {
+	return filepath.Join(additionalArtifactsDir, dst)
+}
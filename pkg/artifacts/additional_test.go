@@ -0,0 +1,91 @@
+package artifacts
+
+import (
+	"context"
+	"testing"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+func TestAdditionalArtifacts(t *testing.T) {
+	tests := []struct {
+		name         string
+		destinations map[string]string
+		additional   map[string]string
+		want         map[string]string
+		wantErr      string
+	}{
+		{
+			name:       "no additional artifacts",
+			additional: nil,
+			want:       nil,
+		},
+		{
+			name:         "declared and default destinations",
+			destinations: map[string]string{"mytool": "tools/mytool"},
+			additional: map[string]string{
+				"mytool":    "registry:5000/vendor/mytool:1.0.0",
+				"othertool": "registry:5000/vendor/othertool:1.0.0",
+			},
+			want: map[string]string{
+				"tools/mytool":  "registry:5000/vendor/mytool:1.0.0",
+				"bin/othertool": "registry:5000/vendor/othertool:1.0.0",
+			},
+		},
+		{
+			name:         "destination outside the data directory",
+			destinations: map[string]string{"mytool": "../usr/bin/mytool"},
+			additional:   map[string]string{"mytool": "registry:5000/vendor/mytool:1.0.0"},
+			wantErr:      "destination ../usr/bin/mytool of additional artifact mytool is outside the data directory",
+		},
+		{
+			name:         "reserved destination",
+			destinations: map[string]string{"mytool": "bin/k0s-upgrade"},
+			additional:   map[string]string{"mytool": "registry:5000/vendor/mytool:1.0.0"},
+			wantErr:      "destination bin/k0s-upgrade of additional artifact mytool is reserved",
+		},
+		{
+			name:         "duplicated destination",
+			destinations: map[string]string{"mytool": "bin/othertool"},
+			additional: map[string]string{
+				"mytool":    "registry:5000/vendor/mytool:1.0.0",
+				"othertool": "registry:5000/vendor/othertool:1.0.0",
+			},
+			wantErr: "destination bin/othertool of additional artifact othertool is used by another artifact",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			version := "1.0.0+" + t.Name()
+			meta := ectypes.ReleaseMetadata{Artifacts: map[string]string{}}
+			for name, dst := range tt.destinations {
+				meta.Artifacts[ArtifactDestinationPrefix+name] = dst
+			}
+			release.CacheMeta(version, meta)
+
+			in := &clusterv1beta1.Installation{
+				ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+				Spec: clusterv1beta1.InstallationSpec{
+					Artifacts: &clusterv1beta1.ArtifactsLocation{AdditionalArtifacts: tt.additional},
+					Config:    &clusterv1beta1.ConfigSpec{Version: version},
+				},
+			}
+			cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+			got, err := AdditionalArtifacts(context.Background(), cli, in)
+			if tt.wantErr != "" {
+				req.EqualError(err, tt.wantErr)
+				return
+			}
+			req.NoError(err)
+			req.Equal(tt.want, got)
+		})
+	}
+}
@@ -3,34 +3,77 @@ package artifacts
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/go-logr/logr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/file"
-	"oras.land/oras-go/v2/registry"
-	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/errdef"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// Pull fetches an artifact from the registry pointed by 'from'. The artifact is stored in a temporary
+// InsecureRegistryEnv is the environment variable that, when set to "true", disables the
+// verification of the registry certificate and allows plain http even if the registry serves
+// tls. It is propagated to the jobs pulling artifacts on the nodes.
+const InsecureRegistryEnv = "EMBEDDEDCLUSTER_INSECURE_REGISTRY"
+
+// registryTLSSecret is the secret holding the certificate served by the registry running in the
+// cluster. The registry is deployed without tls when it does not exist.
+var registryTLSSecret = client.ObjectKey{Namespace: "registry", Name: "registry-tls"}
+
+// PullOptions holds the options for Pull.
+type PullOptions struct {
+	// Insecure skips the verification of the registry certificate and allows falling back to
+	// plain http. Defaults to the value of the InsecureRegistryEnv environment variable.
+	Insecure bool
+	// Attempts is the number of times the artifact is fetched before giving up. Retries skip
+	// the blobs fully copied by a previous attempt and resume the ones interrupted midway with a
+	// ranged request, blobs are fetched again from their start when the registry does not
+	// support ranges.
+	Attempts int
+	// Backoff is the time waited before the second attempt, it doubles on every attempt up to
+	// MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Concurrency is the number of blobs fetched at the same time. Zero means the oras default.
+	Concurrency int
+}
+
+// progressInterval is how often the progress of a blob being pulled is logged.
+var progressInterval = 5 * time.Second
+
+// Pull fetches an artifact from the registry pointed by 'from', or from the OCI image layout on
+// disk if 'from' starts with OCILayoutScheme. The artifact is stored in a temporary
 // directory and the path to this directory is returned. Callers are responsible for removing the temp
-// path when it is no longer needed. In case of error, the temporary directory is removed here.
-func Pull(ctx context.Context, log logr.Logger, cli client.Client, from string) (string, error) {
-	log.Info("Reading registry credentials from cluster")
-	store, err := registryAuth(ctx, log, cli)
-	if err != nil {
-		return "", fmt.Errorf("unable to get registry auth: %w", err)
+// path when it is no longer needed. In case of error, the temporary directory is removed here. The
+// registry certificate is verified against the CA in the registry tls secret, plain http is only
+// attempted when the secret does not exist or when insecure access has been requested. Failed
+// pulls are retried with backoff, see PullOptions.Attempts, and the progress of each blob is
+// logged.
+func Pull(ctx context.Context, log logr.Logger, cli client.Client, from string, applyOpts ...func(*PullOptions)) (string, error) {
+	opts := &PullOptions{
+		Insecure:   InsecureRegistry(),
+		Attempts:   5,
+		Backoff:    2 * time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+	for _, apply := range applyOpts {
+		apply(opts)
 	}
 
-	log.Info("Pulling artifact from registry", "from", from)
-	imgref, err := registry.ParseReference(from)
+	src, err := newSource(ctx, log, cli, from, opts)
 	if err != nil {
-		return "", fmt.Errorf("unable to parse image reference: %w", err)
+		return "", err
 	}
 
 	tmpdir, err := os.MkdirTemp("", "embedded-cluster-artifact-*")
@@ -38,43 +81,209 @@ func Pull(ctx context.Context, log logr.Logger, cli client.Client, from string)
 		return "", fmt.Errorf("unable to create temp dir: %w", err)
 	}
 
-	repo, err := remote.NewRepository(from)
-	if err != nil {
-		return "", fmt.Errorf("unable to create repository: %w", err)
-	}
-
+	// the same file store is used by all attempts so it knows which blobs were already copied.
 	fs, err := file.New(tmpdir)
 	if err != nil {
+		os.RemoveAll(tmpdir)
 		return "", fmt.Errorf("unable to create file store: %w", err)
 	}
 	defer fs.Close()
 
-	transp, ok := http.DefaultTransport.(*http.Transport)
-	if !ok {
-		return "", fmt.Errorf("unable to get default transport")
+	dst := &progressStore{Store: fs, log: log, dir: tmpdir}
+	copyOpts := oras.DefaultCopyOptions
+	copyOpts.Concurrency = opts.Concurrency
+	copyOpts.PostCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+		log.Info("Pulled blob", "digest", desc.Digest, "bytes", desc.Size)
+		return nil
+	}
+	copyOpts.OnCopySkipped = func(ctx context.Context, desc ocispec.Descriptor) error {
+		log.Info("Blob already pulled, skipping", "digest", desc.Digest, "bytes", desc.Size)
+		return nil
 	}
 
-	transp = transp.Clone()
-	transp.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	repo.Client = &auth.Client{
-		Client:     &http.Client{Transport: transp},
-		Credential: store.Get,
+	backoff := opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err = src.copy(ctx, dst, copyOpts)
+		if err == nil {
+			os.RemoveAll(filepath.Join(tmpdir, partialDir))
+			return tmpdir, nil
+		}
+		if attempt >= opts.Attempts || errors.Is(err, errdef.ErrNotFound) {
+			break
+		}
+		log.Info("Unable to fetch artifact, retrying", "attempt", attempt, "backoff", backoff, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			os.RemoveAll(tmpdir)
+			return "", fmt.Errorf("unable to fetch artifact: %w", multierr.Combine(err, ctx.Err()))
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, opts.MaxBackoff)
 	}
+	os.RemoveAll(tmpdir)
+	return "", err
+}
+
+// partialDir is where the blobs interrupted by a failed attempt are kept, relative to the
+// directory the artifact is pulled into, until the next attempt resumes them.
+const partialDir = ".partial"
 
-	tag := imgref.Reference
-	_, tlserr := oras.Copy(ctx, repo, tag, fs, tag, oras.DefaultCopyOptions)
-	if tlserr == nil {
-		return tmpdir, nil
+// progressStore is a file store logging the progress of the blobs pushed into it. Blobs
+// interrupted while being read from the source are set aside and resumed by the next push.
+type progressStore struct {
+	*file.Store
+	log logr.Logger
+	dir string
+}
+
+func (s *progressStore) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
+	name := expected.Annotations[ocispec.AnnotationTitle]
+	if name == "" {
+		// blobs without a name, the manifests and configs, are small and kept in memory.
+		return s.Store.Push(ctx, expected, s.progress(expected, content, 0))
 	}
 
-	// if we fail to fetch the artifact using https we gonna try once more using plain
-	// http as some versions of the registry were deployed without tls.
-	repo.PlainHTTP = true
-	log.Info("Unable to fetch artifact using tls, retrying with http")
-	if _, err := oras.Copy(ctx, repo, tag, fs, tag, oras.DefaultCopyOptions); err != nil {
-		os.RemoveAll(tmpdir)
-		err = multierr.Combine(tlserr, err)
-		return "", fmt.Errorf("unable to fetch artifacts with or without tls: %w", err)
+	partial := filepath.Join(s.dir, partialDir, expected.Digest.Encoded())
+	src := &sourceReader{Reader: content}
+	reader, offset, closer := s.resume(expected, partial, src)
+	defer closer()
+	err := s.Store.Push(ctx, expected, s.progress(expected, reader, offset))
+	if err == nil || src.err == nil {
+		// the partial file is of no use once the blob is complete or failed verification.
+		os.Remove(partial)
+		return err
+	}
+
+	// the source failed midway, what the file store wrote is kept for the next attempt. The
+	// part replayed from an earlier attempt has been read by then so the target holds it.
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		s.log.Info("Unable to keep partial blob", "digest", expected.Digest, "error", err.Error())
+	} else if err := os.Rename(filepath.Join(s.dir, name), partial); err != nil {
+		s.log.Info("Unable to keep partial blob", "digest", expected.Digest, "error", err.Error())
+	}
+	return err
+}
+
+// resume returns the content of the blob prefixed by the part kept from a previous attempt, the
+// size of that part and a function releasing it. The source is moved past the kept part, if it
+// can't seek the kept part is dropped and the blob is read from its start.
+func (s *progressStore) resume(expected ocispec.Descriptor, partial string, src *sourceReader) (io.Reader, int64, func()) {
+	info, err := os.Stat(partial)
+	if err != nil {
+		return src, 0, func() {}
+	}
+	offset := info.Size()
+	seeker, ok := src.Reader.(io.Seeker)
+	if !ok || offset == 0 || offset >= expected.Size {
+		os.Remove(partial)
+		return src, 0, func() {}
+	}
+	f, err := os.Open(partial)
+	if err != nil {
+		os.Remove(partial)
+		return src, 0, func() {}
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		s.log.Info("Unable to resume blob, fetching it from the start", "digest", expected.Digest, "error", err.Error())
+		f.Close()
+		os.Remove(partial)
+		return src, 0, func() {}
+	}
+	s.log.Info("Resuming blob", "digest", expected.Digest, "bytes", offset, "total", expected.Size)
+	return io.MultiReader(&replayReader{file: f}, src), offset, func() { f.Close() }
+}
+
+func (s *progressStore) progress(expected ocispec.Descriptor, content io.Reader, offset int64) io.Reader {
+	return &progressReader{
+		Reader: content,
+		log:    s.log,
+		desc:   expected,
+		read:   offset,
+		last:   time.Now(),
+	}
+}
+
+// sourceReader records the error returned while reading a blob from its source.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return n, err
+}
+
+// replayReader reads the part of a blob kept from a previous attempt. The file is removed once
+// read so the part is not held twice on disk.
+type replayReader struct {
+	file *os.File
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	if errors.Is(err, io.EOF) {
+		r.file.Close()
+		os.Remove(r.file.Name())
+	}
+	return n, err
+}
+
+// progressReader logs how many bytes of a blob have been read every progressInterval.
+type progressReader struct {
+	io.Reader
+	log  logr.Logger
+	desc ocispec.Descriptor
+	read int64
+	last time.Time
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if time.Since(r.last) >= progressInterval {
+		r.last = time.Now()
+		r.log.Info("Pulling blob", "digest", r.desc.Digest, "bytes", r.read, "total", r.desc.Size)
+	}
+	return n, err
+}
+
+// InsecureRegistry returns true if insecure access to the registry has been requested through
+// the InsecureRegistryEnv environment variable.
+func InsecureRegistry() bool {
+	return os.Getenv(InsecureRegistryEnv) == "true"
+}
+
+// registryTLSConfig returns the tls configuration used to reach the registry running in the
+// cluster and whether falling back to plain http is allowed. The registry certificate is
+// verified against the CA in the registry tls secret, or against the system roots when the
+// secret does not exist in which case the registry may also be serving plain http.
+func registryTLSConfig(ctx context.Context, log logr.Logger, cli client.Client, opts *PullOptions) (*tls.Config, bool, error) {
+	if opts.Insecure {
+		log.Info("Insecure registry access requested, skipping certificate verification")
+		return &tls.Config{InsecureSkipVerify: true}, true, nil
+	}
+
+	var secret corev1.Secret
+	if err := cli.Get(ctx, registryTLSSecret, &secret); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return nil, false, fmt.Errorf("get secret: %w", err)
+		}
+		log.Info("Secret registry-tls not found, registry may not be using tls")
+		return &tls.Config{}, true, nil
+	}
+
+	// the registry certificate is self signed, it is its own CA unless one is provided.
+	ca, ok := secret.Data["ca.crt"]
+	if !ok {
+		ca = secret.Data[corev1.TLSCertKey]
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, false, fmt.Errorf("no certificate found in secret %s", registryTLSSecret.Name)
 	}
-	return tmpdir, nil
+	return &tls.Config{RootCAs: pool}, false, nil
 }
@@ -0,0 +1,237 @@
+package artifacts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func Test_registryTLSConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "registry"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	secret := func(data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry-tls", Namespace: "registry"},
+			Data:       data,
+		}
+	}
+
+	tests := []struct {
+		name         string
+		objects      []client.Object
+		insecure     bool
+		wantVerified bool
+		wantPlain    bool
+		wantErr      string
+	}{
+		{
+			name:      "no secret allows plain http",
+			wantPlain: true,
+		},
+		{
+			name:         "certificate in secret is verified",
+			objects:      []client.Object{secret(map[string][]byte{corev1.TLSCertKey: cert})},
+			wantVerified: true,
+		},
+		{
+			name:         "ca in secret is verified",
+			objects:      []client.Object{secret(map[string][]byte{"ca.crt": cert, corev1.TLSCertKey: []byte("leaf")})},
+			wantVerified: true,
+		},
+		{
+			name:    "secret without certificate",
+			objects: []client.Object{secret(map[string][]byte{corev1.TLSCertKey: []byte("invalid")})},
+			wantErr: "no certificate found in secret registry-tls",
+		},
+		{
+			name:      "insecure skips verification",
+			objects:   []client.Object{secret(map[string][]byte{corev1.TLSCertKey: cert})},
+			insecure:  true,
+			wantPlain: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(tt.objects...).Build()
+
+			cfg, plain, err := registryTLSConfig(context.Background(), testr.New(t), cli, &PullOptions{Insecure: tt.insecure})
+			if tt.wantErr != "" {
+				req.EqualError(err, tt.wantErr)
+				return
+			}
+			req.NoError(err)
+			req.Equal(tt.wantPlain, plain)
+			req.Equal(tt.insecure, cfg.InsecureSkipVerify)
+			req.Equal(tt.wantVerified, cfg.RootCAs != nil)
+		})
+	}
+}
+
+func TestPull_retries(t *testing.T) {
+	req := require.New(t)
+	orig := progressInterval
+	defer func() { progressInterval = orig }()
+	progressInterval = 0
+
+	blob := []byte("tool")
+	blobDesc := ocispec.Descriptor{
+		MediaType:   "application/octet-stream",
+		Digest:      digest.FromBytes(blob),
+		Size:        int64(len(blob)),
+		Annotations: map[string]string{ocispec.AnnotationTitle: "mytool"},
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Layers:    []ocispec.Descriptor{blobDesc},
+	})
+	req.NoError(err)
+
+	// the blob fails to be served twice before succeeding.
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/1.0.0"):
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			_, _ = w.Write(manifest)
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+ocispec.DescriptorEmptyJSON.Digest.String()):
+			_, _ = w.Write(ocispec.DescriptorEmptyJSON.Data)
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+blobDesc.Digest.String()):
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	from := strings.TrimPrefix(srv.URL, "http://") + "/vendor/mytool:1.0.0"
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+	pull := func(attempts int) (string, error) {
+		return Pull(context.Background(), testr.New(t), cli, from, func(opts *PullOptions) {
+			opts.Attempts = attempts
+			opts.Backoff = time.Millisecond
+		})
+	}
+
+	_, err = pull(1)
+	req.ErrorContains(err, "unable to fetch artifacts with or without tls")
+
+	location, err := pull(3)
+	req.NoError(err)
+	defer os.RemoveAll(location)
+	data, err := os.ReadFile(filepath.Join(location, "mytool"))
+	req.NoError(err)
+	req.Equal(blob, data)
+}
+
+func TestPull_resumesInterruptedBlobs(t *testing.T) {
+	req := require.New(t)
+
+	blob := bytes.Repeat([]byte("embedded-cluster"), 4096)
+	blobDesc := ocispec.Descriptor{
+		MediaType:   "application/octet-stream",
+		Digest:      digest.FromBytes(blob),
+		Size:        int64(len(blob)),
+		Annotations: map[string]string{ocispec.AnnotationTitle: "images-amd64.tar"},
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Layers:    []ocispec.Descriptor{blobDesc},
+	})
+	req.NoError(err)
+
+	// the connection drops halfway through the first download of the blob.
+	interrupted := false
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/1.0.0"):
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			_, _ = w.Write(manifest)
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+ocispec.DescriptorEmptyJSON.Digest.String()):
+			_, _ = w.Write(ocispec.DescriptorEmptyJSON.Data)
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+blobDesc.Digest.String()):
+			if !interrupted {
+				interrupted = true
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+				_, _ = w.Write(blob[:len(blob)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			if rng := r.Header.Get("Range"); rng != "" {
+				ranges = append(ranges, rng)
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	from := strings.TrimPrefix(srv.URL, "http://") + "/vendor/images:1.0.0"
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+	location, err := Pull(context.Background(), testr.New(t), cli, from, func(opts *PullOptions) {
+		opts.Attempts = 2
+		opts.Backoff = time.Millisecond
+	})
+	req.NoError(err)
+	defer os.RemoveAll(location)
+
+	data, err := os.ReadFile(filepath.Join(location, "images-amd64.tar"))
+	req.NoError(err)
+	req.Equal(blob, data)
+	req.Len(ranges, 1)
+	req.Regexp(`^bytes=[1-9][0-9]*-`+fmt.Sprint(len(blob)-1)+`$`, ranges[0])
+	req.NoDirExists(filepath.Join(location, partialDir))
+}
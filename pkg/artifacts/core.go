@@ -0,0 +1,191 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Kinds of core artifacts pulled onto the nodes by the copy artifacts job.
+const (
+	CoreArtifactBinaries   = "binaries"
+	CoreArtifactImages     = "images"
+	CoreArtifactHelmCharts = "helmcharts"
+)
+
+// coreArtifactKinds are the kinds of core artifacts in the order they are pulled.
+var coreArtifactKinds = []string{CoreArtifactBinaries, CoreArtifactImages, CoreArtifactHelmCharts}
+
+// chartsDir is where the helm charts are extracted, relative to the data directory.
+const chartsDir = "charts"
+
+// DefaultBinaryName is the name of the embedded cluster binary when the installation does not
+// set one.
+const DefaultBinaryName = "embedded-cluster"
+
+// coreArtifactLocation returns the location of the given kind of core artifact.
+func coreArtifactLocation(loc *clusterv1beta1.ArtifactsLocation, kind string) string {
+	switch kind {
+	case CoreArtifactBinaries:
+		return loc.EmbeddedClusterBinary
+	case CoreArtifactImages:
+		return loc.Images
+	case CoreArtifactHelmCharts:
+		return loc.HelmCharts
+	}
+	return ""
+}
+
+// PullCoreArtifactOptions holds the options for PullCoreArtifact.
+type PullCoreArtifactOptions struct {
+	// DataDir is the embedded cluster data directory the artifact is pulled into.
+	DataDir string
+	// Kind is the kind of core artifact, one of CoreArtifactBinaries, CoreArtifactImages or
+	// CoreArtifactHelmCharts.
+	Kind string
+	// From is the location of the artifact.
+	From string
+	// BinaryName is the name of the embedded cluster binary in the binaries artifact.
+	BinaryName string
+}
+
+// PullCoreArtifact pulls one of the core artifacts onto the node and lays it out in the data
+// directory as the local artifact mirror does: the images tarball is moved to the images
+// directory, the helm charts are extracted into the charts directory and the embedded cluster
+// binary materializes the binaries it embeds. The artifact is pulled with Pull so the registry
+// certificate is verified, the pull options are applied as is.
+func PullCoreArtifact(ctx context.Context, log logr.Logger, cli client.Client, opts PullCoreArtifactOptions, applyOpts ...func(*PullOptions)) error {
+	location, err := Pull(ctx, log, cli, opts.From, applyOpts...)
+	if err != nil {
+		return fmt.Errorf("pull artifact: %w", err)
+	}
+	defer os.RemoveAll(location)
+
+	file, err := artifactFile(location)
+	if err != nil {
+		return fmt.Errorf("artifact %s: %w", opts.From, err)
+	}
+
+	switch opts.Kind {
+	case CoreArtifactImages:
+		dst := filepath.Join(opts.DataDir, imagesTarball)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+		if err := moveFile(file, dst); err != nil {
+			return fmt.Errorf("move images: %w", err)
+		}
+	case CoreArtifactHelmCharts:
+		if err := extractTarGz(file, filepath.Join(opts.DataDir, chartsDir)); err != nil {
+			return fmt.Errorf("extract helm charts: %w", err)
+		}
+	case CoreArtifactBinaries:
+		bindir := filepath.Join(location, "bin")
+		if err := extractTarGz(file, bindir); err != nil {
+			return fmt.Errorf("extract binary: %w", err)
+		}
+		bin := filepath.Join(bindir, opts.BinaryName)
+		if err := os.Chmod(bin, 0755); err != nil {
+			return fmt.Errorf("chmod binary: %w", err)
+		}
+		if err := materialize(ctx, bin, opts.DataDir); err != nil {
+			return fmt.Errorf("materialize binaries: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown core artifact kind %q", opts.Kind)
+	}
+	return nil
+}
+
+// materialize has the embedded cluster binary write the binaries it embeds into the data
+// directory.
+var materialize = func(ctx context.Context, bin, dataDir string) error {
+	out, err := exec.CommandContext(ctx, bin, "materialize", "--basedir", dataDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
+
+// artifactFile returns the path of the single file held by the pulled artifact.
+func artifactFile(location string) (string, error) {
+	entries, err := os.ReadDir(location)
+	if err != nil {
+		return "", fmt.Errorf("read artifact: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, entry.Name())
+		}
+	}
+	if len(files) != 1 {
+		return "", fmt.Errorf("holds %d files, expected one", len(files))
+	}
+	return filepath.Join(location, files[0]), nil
+}
+
+// extractTarGz extracts the regular files and directories of the gzipped tarball into dst.
+// Entries pointing outside of dst are refused.
+func extractTarGz(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("entry %s is outside the destination", hdr.Name)
+		}
+		path := filepath.Join(dst, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(path, tr, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,104 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestPullCoreArtifact(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	var materialized string
+	original := materialize
+	materialize = func(ctx context.Context, bin, dataDir string) error {
+		data, err := os.ReadFile(bin)
+		if err != nil {
+			return err
+		}
+		materialized = string(data)
+		return os.WriteFile(filepath.Join(dataDir, k0sBinary), []byte("k0s"), 0755)
+	}
+	t.Cleanup(func() { materialize = original })
+
+	layout := t.TempDir()
+	tagFile(t, layout, "images", "images-amd64.tar", []byte("images"))
+	tagFile(t, layout, "helmcharts", "charts.tar.gz", tarGz(t, map[string]string{"vendor-1.0.0.tgz": "chart"}))
+	tagFile(t, layout, "binaries", "embedded-cluster-amd64.tgz", tarGz(t, map[string]string{"my-app": "binary"}))
+	tagFile(t, layout, "escape", "charts.tar.gz", tarGz(t, map[string]string{"../escaped": "chart"}))
+
+	dataDir := t.TempDir()
+	req.NoError(os.MkdirAll(filepath.Join(dataDir, "bin"), 0755))
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+	pull := func(kind, tag string) error {
+		return PullCoreArtifact(ctx, testr.New(t), cli, PullCoreArtifactOptions{
+			DataDir:    dataDir,
+			Kind:       kind,
+			From:       OCILayoutScheme + layout + ":" + tag,
+			BinaryName: "my-app",
+		})
+	}
+
+	req.NoError(pull(CoreArtifactImages, "images"))
+	got, err := os.ReadFile(filepath.Join(dataDir, imagesTarball))
+	req.NoError(err)
+	req.Equal("images", string(got))
+
+	req.NoError(pull(CoreArtifactHelmCharts, "helmcharts"))
+	got, err = os.ReadFile(filepath.Join(dataDir, chartsDir, "vendor-1.0.0.tgz"))
+	req.NoError(err)
+	req.Equal("chart", string(got))
+
+	req.NoError(pull(CoreArtifactBinaries, "binaries"))
+	req.Equal("binary", materialized)
+	req.FileExists(filepath.Join(dataDir, k0sBinary))
+
+	req.ErrorContains(pull(CoreArtifactHelmCharts, "escape"), "outside the destination")
+	req.ErrorContains(pull("unknown", "images"), `unknown core artifact kind "unknown"`)
+}
+
+// tagFile pushes an artifact holding a single file into the oci layout under the given tag.
+func tagFile(t *testing.T, layout, tag, name string, data []byte) {
+	ctx := context.Background()
+	store, err := oci.New(layout)
+	require.NoError(t, err)
+	desc := content.NewDescriptorFromBytes("application/octet-stream", data)
+	desc.Annotations = map[string]string{ocispec.AnnotationTitle: name}
+	require.NoError(t, store.Push(ctx, desc, bytes.NewReader(data)))
+	manifest, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.embeddedcluster.artifact", oras.PackManifestOptions{
+		Layers: []ocispec.Descriptor{desc},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Tag(ctx, manifest, tag))
+}
+
+// tarGz returns a gzipped tarball holding the given files indexed by name.
+func tarGz(t *testing.T, files map[string]string) []byte {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range sortedKeys(files) {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
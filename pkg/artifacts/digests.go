@@ -0,0 +1,373 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/util"
+)
+
+const (
+	// ArtifactDigestPrefix prefixes the release metadata artifacts holding the sha256 digest of
+	// a file placed on the nodes. The rest of the key is the path of the file relative to the
+	// embedded cluster data directory, e.g. "sha256/images/images-amd64.tar".
+	ArtifactDigestPrefix = "sha256/"
+
+	// ArtifactsDigestsAnnotation holds, in the copy artifacts job, the json encoded digests of
+	// the files verified on the node indexed by path.
+	ArtifactsDigestsAnnotation = "embedded-cluster.replicated.com/artifacts-digests"
+
+	// NodeArtifactsDigestsLabel is set on the config maps recording the artifacts held by each
+	// node so they are not copied again. The config maps live in the embedded-cluster namespace
+	// as the operator is not allowed to write to the nodes.
+	NodeArtifactsDigestsLabel = "embedded-cluster.replicated.com/node-artifacts-digests"
+)
+
+const (
+	// nodeDigestsNodeKey is the config map key holding the name of the node.
+	nodeDigestsNodeKey = "node"
+	// nodeDigestsKey is the config map key holding the json encoded digests of the artifacts
+	// held by the node indexed by path.
+	nodeDigestsKey = "digests"
+)
+
+// imagesTarball is the path of the images tarball pulled onto the nodes.
+const imagesTarball = "images/images-amd64.tar"
+
+// defaultDigestedFiles are the files digested on the nodes when the release metadata does not
+// carry any digest.
+var defaultDigestedFiles = []string{k0sBinary, imagesTarball}
+
+// ExpectedDigests returns the digests of the files the release places on the nodes, indexed by
+// path. Returns nil if the release metadata does not carry digests or if the installation has no
+// version set.
+func ExpectedDigests(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (map[string]string, error) {
+	if in.Spec.Config == nil || in.Spec.Config.Version == "" {
+		return nil, nil
+	}
+	meta, err := release.MetadataFor(ctx, in, cli)
+	if err != nil {
+		return nil, fmt.Errorf("get release metadata: %w", err)
+	}
+	var digests map[string]string
+	for key, digest := range meta.Artifacts {
+		path, ok := strings.CutPrefix(key, ArtifactDigestPrefix)
+		if !ok {
+			continue
+		}
+		if digests == nil {
+			digests = map[string]string{}
+		}
+		digests[path] = digest
+	}
+	return digests, nil
+}
+
+// digestsCheckList returns the digests in the format expected by 'sha256sum -c'.
+func digestsCheckList(digests map[string]string) string {
+	lines := []string{}
+	for _, path := range sortedKeys(digests) {
+		lines = append(lines, fmt.Sprintf("%s  %s", digests[path], path))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// digestedFiles returns the files whose digest are reported by the legacy copy artifacts job.
+func digestedFiles(digests map[string]string) string {
+	if len(digests) == 0 {
+		return strings.Join(defaultDigestedFiles, " ")
+	}
+	return strings.Join(sortedKeys(digests), " ")
+}
+
+// parseDigests parses the output of 'sha256sum' into a map of digests indexed by path.
+func parseDigests(output string) (map[string]string, error) {
+	digests := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid digest line %q", line)
+		}
+		digests[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return digests, nil
+}
+
+// imagesID identifies the images tarball once placed on the nodes. The tarball is named after
+// its digest when known so nodes holding it can be skipped by later installations, otherwise it
+// is named after the installation.
+func imagesID(in *clusterv1beta1.Installation, digests map[string]string) string {
+	if digest := digests[imagesTarball]; len(digest) >= 12 {
+		return digest[:12]
+	}
+	return in.Name
+}
+
+// VerifiedDigests returns the digests recorded in the copy artifacts job once the node has
+// verified its artifacts. Returns nil if they have not been recorded yet.
+func VerifiedDigests(job *batchv1.Job) map[string]string {
+	return annotatedDigests(job.Annotations)
+}
+
+// holdsArtifacts returns true if the digests held by the node include all the expected ones.
+// Nothing is held if no digest is expected.
+func holdsArtifacts(held, expected map[string]string) bool {
+	if len(expected) == 0 {
+		return false
+	}
+	for path, digest := range expected {
+		if held[path] != digest {
+			return false
+		}
+	}
+	return true
+}
+
+func annotatedDigests(annotations map[string]string) map[string]string {
+	return decodeDigests(annotations[ArtifactsDigestsAnnotation])
+}
+
+func decodeDigests(raw string) map[string]string {
+	if raw == "" {
+		return nil
+	}
+	digests := map[string]string{}
+	if err := json.Unmarshal([]byte(raw), &digests); err != nil {
+		return nil
+	}
+	return digests
+}
+
+// RecordArtifactsDigests reads the digests in the placement report of the succeeded copy
+// artifacts jobs and records them in the job annotations. The reported digests are checked against the
+// ones in the release metadata, a mismatch is reported as an error. Nodes that verified the
+// expected digests themselves only report the digests of the other files.
+func RecordArtifactsDigests(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, jobs map[string]*batchv1.Job) error {
+	expected, err := ExpectedDigests(ctx, cli, in)
+	if err != nil {
+		return fmt.Errorf("get expected digests: %w", err)
+	}
+
+	for _, node := range sortedKeys(jobs) {
+		job := jobs[node]
+		if job == nil || job.Status.Succeeded == 0 || VerifiedDigests(job) != nil {
+			continue
+		}
+
+		output, err := jobTerminationMessage(ctx, cli, job)
+		if err != nil {
+			return fmt.Errorf("get job %s termination message: %w", job.Name, err)
+		} else if output == "" {
+			continue
+		}
+		report, err := parseArtifactsJobReport(job, output)
+		if err != nil {
+			return fmt.Errorf("parse node %s report: %w", node, err)
+		}
+		if isArtifactsCheckJob(job) && !report.Verified {
+			if err := resetArtifactsCheck(ctx, cli, job); err != nil {
+				return fmt.Errorf("reset node %s artifacts check: %w", node, err)
+			}
+			continue
+		}
+		digests := map[string]string{}
+		if report.Verified {
+			for path, digest := range expected {
+				digests[path] = digest
+			}
+		}
+		for path, digest := range report.Digests {
+			digests[path] = digest
+		}
+		for path, digest := range expected {
+			if digests[path] != digest {
+				return fmt.Errorf("node %s reported digest %q for %s, expected %q", node, digests[path], path, digest)
+			}
+		}
+
+		data, err := json.Marshal(digests)
+		if err != nil {
+			return fmt.Errorf("marshal digests: %w", err)
+		}
+		patch := client.MergeFrom(job.DeepCopy())
+		if job.Annotations == nil {
+			job.Annotations = map[string]string{}
+		}
+		job.Annotations[ArtifactsDigestsAnnotation] = string(data)
+		if err := cli.Patch(ctx, job, patch); err != nil {
+			return fmt.Errorf("patch job %s: %w", job.Name, err)
+		}
+
+		if err := recordNodeDigests(ctx, cli, node, string(data)); err != nil {
+			return fmt.Errorf("record node %s digests: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// parseArtifactsJobReport parses the termination message of the copy artifacts job. The legacy
+// jobs report the output of sha256sum for every digested file.
+func parseArtifactsJobReport(job *batchv1.Job, output string) (*PlaceReport, error) {
+	if job.Annotations[ArtifactsLegacyAnnotation] != "true" {
+		return parsePlaceReport(output)
+	}
+	digests, err := parseDigests(output)
+	if err != nil {
+		return nil, err
+	}
+	return &PlaceReport{Step: PlaceStepDone, Digests: digests}, nil
+}
+
+// nodeDigestsConfigMapName returns the name of the config map recording the artifacts held by
+// the node.
+func nodeDigestsConfigMapName(node string) string {
+	return util.NameWithLengthLimit(node, "-artifacts-digests")
+}
+
+// recordNodeDigests records the digests of the artifacts the node holds in its digests config
+// map.
+func recordNodeDigests(ctx context.Context, cli client.Client, node, digests string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeDigestsConfigMapName(node), Namespace: ecNamespace},
+	}
+	_, err := ctrl.CreateOrUpdate(ctx, cli, cm, func() error {
+		if cm.Labels == nil {
+			cm.Labels = map[string]string{}
+		}
+		cm.Labels[NodeArtifactsDigestsLabel] = "true"
+		cm.Data = map[string]string{nodeDigestsNodeKey: node, nodeDigestsKey: digests}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("create or update config map: %w", err)
+	}
+	return nil
+}
+
+// forgetNodeDigests deletes the config map recording the artifacts held by the node.
+func forgetNodeDigests(ctx context.Context, cli client.Client, node string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeDigestsConfigMapName(node), Namespace: ecNamespace},
+	}
+	if err := cli.Delete(ctx, cm); err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("delete config map: %w", err)
+	}
+	return nil
+}
+
+// listNodeDigests returns the digests of the artifacts recorded as held by each node, indexed
+// by node name.
+func listNodeDigests(ctx context.Context, cli client.Client) (map[string]map[string]string, error) {
+	var cms corev1.ConfigMapList
+	err := cli.List(ctx, &cms, client.InNamespace(ecNamespace), client.HasLabels{NodeArtifactsDigestsLabel})
+	if err != nil {
+		return nil, fmt.Errorf("list config maps: %w", err)
+	}
+	digests := map[string]map[string]string{}
+	for _, cm := range cms.Items {
+		if node := cm.Data[nodeDigestsNodeKey]; node != "" {
+			digests[node] = decodeDigests(cm.Data[nodeDigestsKey])
+		}
+	}
+	return digests, nil
+}
+
+// deleteNodeDigestsForRemovedNodes deletes the digests recorded for nodes that are no longer
+// part of the cluster.
+func deleteNodeDigestsForRemovedNodes(ctx context.Context, cli client.Client, nodes []corev1.Node) error {
+	recorded, err := listNodeDigests(ctx, cli)
+	if err != nil {
+		return fmt.Errorf("list node digests: %w", err)
+	}
+	for _, node := range nodes {
+		delete(recorded, node.Name)
+	}
+	for _, node := range sortedKeys(recorded) {
+		if err := forgetNodeDigests(ctx, cli, node); err != nil {
+			return fmt.Errorf("forget node %s digests: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// NodesHoldingArtifacts returns the names of the nodes recorded as already holding the
+// artifacts of the installation. Their copy artifacts job only checks the artifacts are still
+// there.
+func NodesHoldingArtifacts(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) ([]string, error) {
+	held, err := heldArtifactsDigests(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("get held artifacts digests: %w", err)
+	}
+	recorded, err := listNodeDigests(ctx, cli)
+	if err != nil {
+		return nil, fmt.Errorf("list node digests: %w", err)
+	}
+	var nodes corev1.NodeList
+	if err := cli.List(ctx, &nodes); err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	names := []string{}
+	for _, node := range nodes.Items {
+		if holdsArtifacts(recorded[node.Name], held) {
+			names = append(names, node.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// jobTerminationMessage returns the termination message of the succeeded pod of the job.
+func jobTerminationMessage(ctx context.Context, cli client.Client, job *batchv1.Job) (string, error) {
+	var pods corev1.PodList
+	err := cli.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name})
+	if err != nil {
+		return "", fmt.Errorf("list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil {
+				return status.State.Terminated.Message, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// ensureArtifactsVerified returns an error unless every node has verified the artifacts for the
+// installation.
+func ensureArtifactsVerified(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
+	jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+	if err != nil {
+		return fmt.Errorf("list artifacts jobs for nodes: %w", err)
+	}
+	for _, node := range sortedKeys(jobs) {
+		if jobs[node] == nil || VerifiedDigests(jobs[node]) == nil {
+			return fmt.Errorf("artifacts have not been verified on node %s", node)
+		}
+	}
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
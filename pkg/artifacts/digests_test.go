@@ -0,0 +1,236 @@
+package artifacts
+
+import (
+	"context"
+	"testing"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+func TestRecordArtifactsDigests(t *testing.T) {
+	release.CacheMeta("1.0.0+digests", ectypes.ReleaseMetadata{
+		Artifacts: map[string]string{
+			ArtifactDigestPrefix + "bin/k0s":                 "aaa",
+			ArtifactDigestPrefix + "images/images-amd64.tar": sha256Digest,
+		},
+	})
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-installation"},
+		Spec: clusterv1beta1.InstallationSpec{
+			Artifacts: &clusterv1beta1.ArtifactsLocation{Images: "images"},
+			Config:    &clusterv1beta1.ConfigSpec{Version: "1.0.0+digests"},
+		},
+	}
+	cfghash, err := HashForAirgapConfig(in)
+	require.NoError(t, err)
+
+	job := func(succeeded int32) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      copyArtifactsJobPrefix + "node1",
+				Namespace: ecNamespace,
+				Annotations: map[string]string{
+					InstallationNameAnnotation:    in.Name,
+					ArtifactsConfigHashAnnotation: cfghash,
+				},
+			},
+			Status: batchv1.JobStatus{Succeeded: succeeded},
+		}
+	}
+	pod := func(message string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      copyArtifactsJobPrefix + "node1-abcde",
+				Namespace: ecNamespace,
+				Labels:    map[string]string{"job-name": copyArtifactsJobPrefix + "node1"},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodSucceeded,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name: "embedded-cluster-updater",
+						State: corev1.ContainerState{
+							Terminated: &corev1.ContainerStateTerminated{Message: message},
+						},
+					},
+				},
+			},
+		}
+	}
+	legacyJob := job(1)
+	legacyJob.Annotations[ArtifactsLegacyAnnotation] = "true"
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+
+	tests := []struct {
+		name     string
+		objects  []client.Object
+		wantErr  string
+		verified map[string]string
+	}{
+		{
+			name:     "matching digests are recorded",
+			objects:  []client.Object{node, job(1), pod(`{"step":"Done","digests":{"bin/k0s":"aaa","images/images-amd64.tar":"` + sha256Digest + `"}}`)},
+			verified: map[string]string{"bin/k0s": "aaa", "images/images-amd64.tar": sha256Digest},
+		},
+		{
+			name:     "digests verified on the node are recorded",
+			objects:  []client.Object{node, job(1), pod(`{"step":"Done","digests":{"bin/mytool":"bbb"},"verified":true}`)},
+			verified: map[string]string{"bin/k0s": "aaa", "bin/mytool": "bbb", "images/images-amd64.tar": sha256Digest},
+		},
+		{
+			name:     "legacy jobs report the output of sha256sum",
+			objects:  []client.Object{node, legacyJob, pod("aaa  bin/k0s\n" + sha256Digest + "  images/images-amd64.tar\n")},
+			verified: map[string]string{"bin/k0s": "aaa", "images/images-amd64.tar": sha256Digest},
+		},
+		{
+			name:    "mismatching digests",
+			objects: []client.Object{node, job(1), pod(`{"step":"Done","digests":{"bin/k0s":"aaa","images/images-amd64.tar":"ccc"}}`)},
+			wantErr: `node node1 reported digest "ccc" for images/images-amd64.tar, expected "` + sha256Digest + `"`,
+		},
+		{
+			name:    "running jobs are ignored",
+			objects: []client.Object{node, job(0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			ctx := context.Background()
+			cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(tt.objects...).Build()
+
+			jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+			req.NoError(err)
+			err = RecordArtifactsDigests(ctx, cli, in, jobs)
+			if tt.wantErr != "" {
+				req.EqualError(err, tt.wantErr)
+			} else {
+				req.NoError(err)
+			}
+
+			var got batchv1.Job
+			req.NoError(cli.Get(ctx, client.ObjectKey{Name: copyArtifactsJobPrefix + "node1", Namespace: ecNamespace}, &got))
+			req.Equal(tt.verified, VerifiedDigests(&got))
+			recorded, err := listNodeDigests(ctx, cli)
+			req.NoError(err)
+			req.Equal(tt.verified, recorded["node1"])
+
+			// the airgap plan is only created once every node has verified its artifacts.
+			command, err := CreateAutopilotAirgapPlanCommand(ctx, cli, in)
+			if tt.verified == nil {
+				req.EqualError(err, "artifacts have not been verified on node node1")
+				return
+			}
+			req.NoError(err)
+			req.Equal(autopilotv1beta2.PlanResourceURL{
+				URL: "http://127.0.0.1:50000/images/images-amd64-2c26b46b68ff.tar",
+			}, command.AirgapUpdate.Platforms["linux-amd64"])
+		})
+	}
+}
+
+func TestEnsureArtifactsJobForNodes_checksNodesHoldingArtifacts(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	release.CacheMeta("1.0.0+held", ectypes.ReleaseMetadata{
+		Artifacts: map[string]string{
+			OperatorImageArtifact:                            "operator:1.0.0",
+			ArtifactDigestPrefix + "bin/k0s":                 "aaa",
+			ArtifactDigestPrefix + "images/images-amd64.tar": sha256Digest,
+		},
+	})
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-change"},
+		Spec: clusterv1beta1.InstallationSpec{
+			Artifacts: &clusterv1beta1.ArtifactsLocation{Images: "images"},
+			Config:    &clusterv1beta1.ConfigSpec{Version: "1.0.0+held"},
+		},
+	}
+	held := `{"bin/k0s":"aaa","images/images-amd64.tar":"` + sha256Digest + `"}`
+	stale := `{"bin/k0s":"aaa","images/images-amd64.tar":"ccc"}`
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3"}},
+		nodeDigestsConfigMap("node1", held),
+		nodeDigestsConfigMap("node2", stale),
+		// node4 left the cluster, its digests are forgotten.
+		nodeDigestsConfigMap("node4", held),
+	).Build()
+
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest"))
+	jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+	req.NoError(err)
+	req.ElementsMatch([]string{"node1", "node2", "node3"}, sortedKeys(jobs))
+	recorded, err := listNodeDigests(ctx, cli)
+	req.NoError(err)
+	req.ElementsMatch([]string{"node1", "node2"}, sortedKeys(recorded))
+	for _, node := range []string{"node2", "node3"} {
+		req.False(isArtifactsCheckJob(jobs[node]), "node %s should get a full copy", node)
+		req.NotEmpty(jobs[node].Spec.Template.Spec.InitContainers)
+	}
+
+	// the node holding the artifacts only gets a check.
+	check := jobs["node1"]
+	req.True(isArtifactsCheckJob(check))
+	req.Empty(check.Spec.Template.Spec.InitContainers)
+	req.Contains(check.Spec.Template.Spec.Containers[0].Args, "--check")
+
+	holding, err := NodesHoldingArtifacts(ctx, cli, in)
+	req.NoError(err)
+	req.Equal([]string{"node1"}, holding)
+
+	// the check finds the artifacts are gone, the node gets a full copy.
+	check.Status.Succeeded = 1
+	req.NoError(cli.Status().Update(ctx, check))
+	req.NoError(cli.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      check.Name + "-abcde",
+			Namespace: ecNamespace,
+			Labels:    map[string]string{"job-name": check.Name},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodSucceeded,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{Message: `{"step":"Missing","error":"stat bin/k0s-upgrade: no such file or directory"}`},
+					},
+				},
+			},
+		},
+	}))
+	jobs, err = ListArtifactsJobForNodes(ctx, cli, in)
+	req.NoError(err)
+	req.NoError(RecordArtifactsDigests(ctx, cli, in, jobs))
+	recorded, err = listNodeDigests(ctx, cli)
+	req.NoError(err)
+	req.NotContains(recorded, "node1")
+
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest"))
+	var job batchv1.Job
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: copyArtifactsJobPrefix + "node1", Namespace: ecNamespace}, &job))
+	req.False(isArtifactsCheckJob(&job))
+	req.NotEmpty(job.Spec.Template.Spec.InitContainers)
+}
+
+func nodeDigestsConfigMap(node, digests string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nodeDigestsConfigMapName(node),
+			Namespace: ecNamespace,
+			Labels:    map[string]string{NodeArtifactsDigestsLabel: "true"},
+		},
+		Data: map[string]string{nodeDigestsNodeKey: node, nodeDigestsKey: digests},
+	}
+}
@@ -0,0 +1,299 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/util"
+)
+
+const gcArtifactsJobPrefix = "gc-artifacts-"
+
+// GCKeepHashAnnotation holds the hash of the files kept by a garbage collection job, a new job
+// is created when they change.
+const GCKeepHashAnnotation = "embedded-cluster.replicated.com/gc-keep-hash"
+
+// gcPatterns are the files, relative to the data directory, considered for garbage collection.
+var gcPatterns = []string{"images/images-amd64-*.tar", "charts/*.tgz"}
+
+// GCReport is the result of the garbage collection on a node. It is written as json to the
+// termination message of the garbage collection job.
+type GCReport struct {
+	Removed []string `json:"removed,omitempty"`
+	Freed   int64    `json:"freed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// CollectGarbage removes the images tarballs and charts in the data directory that are not in
+// the keep list. The paths to keep are relative to the data directory. The report is written to
+// the report path, if set, even if the collection fails.
+func CollectGarbage(dataDir string, keep []string, reportPath string) (*GCReport, error) {
+	report := &GCReport{}
+	err := collectGarbage(dataDir, keep, report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if reportPath != "" {
+		data, merr := json.Marshal(report)
+		if merr != nil {
+			return report, fmt.Errorf("marshal report: %w", merr)
+		}
+		if werr := os.WriteFile(reportPath, data, 0644); werr != nil && err == nil {
+			err = fmt.Errorf("write report: %w", werr)
+		}
+	}
+	return report, err
+}
+
+func collectGarbage(dataDir string, keep []string, report *GCReport) error {
+	kept := map[string]bool{}
+	for _, path := range keep {
+		kept[filepath.Clean(path)] = true
+	}
+	for _, pattern := range gcPatterns {
+		paths, err := filepath.Glob(filepath.Join(dataDir, pattern))
+		if err != nil {
+			return fmt.Errorf("list %s: %w", pattern, err)
+		}
+		for _, path := range paths {
+			rel, err := filepath.Rel(dataDir, path)
+			if err != nil {
+				return fmt.Errorf("relative path of %s: %w", path, err)
+			}
+			if kept[rel] {
+				continue
+			}
+			info, err := os.Stat(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("stat %s: %w", rel, err)
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("remove %s: %w", rel, err)
+			}
+			report.Removed = append(report.Removed, rel)
+			report.Freed += info.Size()
+		}
+	}
+	return nil
+}
+
+// KeptImagesTarball returns the path, relative to the data directory, of the images tarball
+// placed on the nodes for the installation.
+func KeptImagesTarball(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (string, error) {
+	digests, err := ExpectedDigests(ctx, cli, in)
+	if err != nil {
+		return "", fmt.Errorf("get expected digests: %w", err)
+	}
+	return imagesTarballFor(imagesID(in, digests)), nil
+}
+
+// EnsureGarbageCollectionJobForNodes makes sure a job removing the artifacts that are not in the
+// keep list has been created on every node for the installation. Jobs on nodes that no longer
+// exist are deleted. Returns the reports of the jobs that have completed indexed by node name.
+func EnsureGarbageCollectionJobForNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, keep []string, operatorImage string) (map[string]*GCReport, error) {
+	sort.Strings(keep)
+	keephash := fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(keep, "\n"))))[:10]
+
+	var nodes corev1.NodeList
+	if err := cli.List(ctx, &nodes); err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	names := map[string]bool{}
+	reports := map[string]*GCReport{}
+	for _, node := range nodes.Items {
+		names[node.Name] = true
+
+		nsn := types.NamespacedName{Name: util.NameWithLengthLimit(gcArtifactsJobPrefix, node.Name), Namespace: ecNamespace}
+		var job batchv1.Job
+		err := cli.Get(ctx, nsn, &job)
+		if err == nil && job.Annotations[InstallationNameAnnotation] == in.Name && job.Annotations[GCKeepHashAnnotation] == keephash {
+			if job.Status.Succeeded > 0 {
+				report, err := gcJobReport(ctx, cli, &job)
+				if err != nil {
+					return nil, fmt.Errorf("get job %s report: %w", job.Name, err)
+				}
+				reports[node.Name] = report
+			}
+			continue
+		} else if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, fmt.Errorf("get job: %w", err)
+		}
+
+		newjob := gcArtifactsJobForNode(in, node.Name, keep, keephash, operatorImage)
+		err = k8sutil.EnsureObject(ctx, cli, newjob, func(opts *k8sutil.EnsureObjectOptions) {
+			opts.DeleteOptions = append(opts.DeleteOptions, client.PropagationPolicy(metav1.DeletePropagationForeground))
+			opts.ShouldDelete = func(obj client.Object) bool {
+				annotations := obj.GetAnnotations()
+				return annotations[InstallationNameAnnotation] != in.Name || annotations[GCKeepHashAnnotation] != keephash
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ensure gc job for node %s: %w", node.Name, err)
+		}
+	}
+
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs, client.InNamespace(ecNamespace)); err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	for _, job := range jobs.Items {
+		if !strings.HasPrefix(job.Name, gcArtifactsJobPrefix) || names[job.Spec.Template.Spec.NodeName] {
+			continue
+		}
+		err := cli.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationForeground))
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, fmt.Errorf("delete job %s: %w", job.Name, err)
+		}
+	}
+	return reports, nil
+}
+
+// gcJobReport returns the report written by the succeeded garbage collection job.
+func gcJobReport(ctx context.Context, cli client.Client, job *batchv1.Job) (*GCReport, error) {
+	message, err := jobTerminationMessage(ctx, cli, job)
+	if err != nil {
+		return nil, err
+	}
+	report := &GCReport{}
+	if message == "" {
+		return report, nil
+	}
+	if err := json.Unmarshal([]byte(message), report); err != nil {
+		return nil, fmt.Errorf("unmarshal report: %w", err)
+	}
+	return report, nil
+}
+
+func gcArtifactsJobForNode(in *clusterv1beta1.Installation, node string, keep []string, keephash, operatorImage string) *batchv1.Job {
+	args := []string{"artifacts", "gc", "--data-dir", "/var/lib/embedded-cluster"}
+	for _, path := range keep {
+		args = append(args, "--keep", path)
+	}
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      util.NameWithLengthLimit(gcArtifactsJobPrefix, node),
+			Namespace: ecNamespace,
+			Labels:    applyECOperatorLabels(nil, "gc"),
+			Annotations: map[string]string{
+				InstallationNameAnnotation: in.Name,
+				GCKeepHashAnnotation:       keephash,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					ServiceAccountName: "embedded-cluster-operator",
+					NodeName:           node,
+					Volumes: []corev1.Volume{
+						{
+							Name: "host",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{
+									Path: "/var/lib/embedded-cluster",
+									Type: ptr.To[corev1.HostPathType]("Directory"),
+								},
+							},
+						},
+					},
+					RestartPolicy:    corev1.RestartPolicyNever,
+					ImagePullSecrets: []corev1.LocalObjectReference{GetRegistryImagePullSecret()},
+					Containers: []corev1.Container{
+						{
+							Name:    "embedded-cluster-gc",
+							Image:   operatorImage,
+							Command: []string{"/manager"},
+							Args:    args,
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "host",
+									MountPath: "/var/lib/embedded-cluster",
+								},
+							},
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							// the operator image runs as non root by default.
+							SecurityContext: &corev1.SecurityContext{
+								RunAsUser: ptr.To[int64](0),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	return job
+}
+
+// DeleteFinishedArtifactsJobs deletes the copy artifacts jobs that have finished and belong to
+// installations older than the given one. Jobs of newer installations are kept as they belong to
+// an upgrade in progress, their annotations hold the digests verified on the nodes. Returns how
+// many jobs were deleted.
+func DeleteFinishedArtifactsJobs(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (int, error) {
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs, client.InNamespace(ecNamespace)); err != nil {
+		return 0, fmt.Errorf("list jobs: %w", err)
+	}
+	deleted := 0
+	for _, job := range jobs.Items {
+		if !strings.HasPrefix(job.Name, copyArtifactsJobPrefix) {
+			continue
+		}
+		if job.Annotations[InstallationNameAnnotation] >= in.Name || !isJobFinished(&job) {
+			continue
+		}
+		err := cli.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationForeground))
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return deleted, fmt.Errorf("delete job %s: %w", job.Name, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// CopyingArtifactsForOtherInstallation returns true if there are copy artifacts jobs for an
+// installation other than the given one that may still be needed: jobs of newer installations,
+// the artifacts of an upgrade in progress are placed on the nodes before its installation is
+// created, and jobs of older installations that are still running. The artifacts they place
+// are not in the keep list of the garbage collection so it must not run meanwhile.
+func CopyingArtifactsForOtherInstallation(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (bool, error) {
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs, client.InNamespace(ecNamespace)); err != nil {
+		return false, fmt.Errorf("list jobs: %w", err)
+	}
+	for _, job := range jobs.Items {
+		if !strings.HasPrefix(job.Name, copyArtifactsJobPrefix) {
+			continue
+		}
+		name := job.Annotations[InstallationNameAnnotation]
+		if name == in.Name {
+			continue
+		}
+		if name > in.Name || !isJobFinished(&job) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
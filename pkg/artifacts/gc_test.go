@@ -0,0 +1,47 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"images/images-amd64-new.tar": "new images",
+		"images/images-amd64-old.tar": "old images",
+		"charts/openebs-1.0.0.tgz":    "old chart",
+		"charts/openebs-2.0.0.tgz":    "new chart",
+		k0sUpgradeBinary:              "k0s",
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		req.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		req.NoError(os.WriteFile(path, []byte(content), 0644))
+	}
+	reportPath := filepath.Join(t.TempDir(), "termination-log")
+
+	keep := []string{"images/images-amd64-new.tar", "charts/openebs-2.0.0.tgz"}
+	report, err := CollectGarbage(dir, keep, reportPath)
+	req.NoError(err)
+	req.ElementsMatch([]string{"images/images-amd64-old.tar", "charts/openebs-1.0.0.tgz"}, report.Removed)
+	req.Equal(int64(len("old images")+len("old chart")), report.Freed)
+
+	for _, path := range append(keep, k0sUpgradeBinary) {
+		req.FileExists(filepath.Join(dir, path))
+	}
+	for _, path := range report.Removed {
+		req.NoFileExists(filepath.Join(dir, path))
+	}
+
+	data, err := os.ReadFile(reportPath)
+	req.NoError(err)
+	var written GCReport
+	req.NoError(json.Unmarshal(data, &written))
+	req.Equal(*report, written)
+}
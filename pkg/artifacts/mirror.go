@@ -0,0 +1,96 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"oras.land/oras-go/v2/registry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ecregistry "github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/util"
+)
+
+// LocalArtifactMirrorImageArtifact is the key of the local artifact mirror image in the release
+// metadata artifacts.
+const LocalArtifactMirrorImageArtifact = "local-artifact-mirror-image"
+
+// OperatorImageArtifact is the key of the operator image in the release metadata artifacts.
+const OperatorImageArtifact = "embedded-cluster-operator-image"
+
+// registryPort is the port the in-cluster registry listens on.
+const registryPort = 5000
+
+// LocalArtifactMirrorImage returns the local artifact mirror image for the installation. The
+// image is read from the release metadata so it always matches the version being installed. In
+// airgap installations the image is served by the registry running in the cluster so its
+// reference is rewritten to point there.
+func LocalArtifactMirrorImage(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (string, error) {
+	meta, err := release.MetadataFor(ctx, in, cli)
+	if err != nil {
+		return "", fmt.Errorf("get release metadata: %w", err)
+	}
+	image := meta.Artifacts[LocalArtifactMirrorImageArtifact]
+	if image == "" {
+		return "", fmt.Errorf("%s not found in release metadata", LocalArtifactMirrorImageArtifact)
+	}
+	return clusterImage(ctx, cli, in, image)
+}
+
+// OperatorImage returns the operator image of the release the installation points to. This is
+// the image placing the artifacts on the nodes, the image of the running operator belongs to the
+// previous release and may not know how to. As with the local artifact mirror image the
+// reference points to the registry running in the cluster in airgap installations. Returns an
+// empty string if the release metadata does not carry the image.
+func OperatorImage(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (string, error) {
+	if in.Spec.Config == nil || in.Spec.Config.Version == "" {
+		return "", nil
+	}
+	meta, err := release.MetadataFor(ctx, in, cli)
+	if err != nil {
+		return "", fmt.Errorf("get release metadata: %w", err)
+	}
+	image := meta.Artifacts[OperatorImageArtifact]
+	if image == "" {
+		return "", nil
+	}
+	return clusterImage(ctx, cli, in, image)
+}
+
+// clusterImage returns the reference to use for the image inside the cluster. In airgap
+// installations it is rewritten to point to the registry running in the cluster.
+func clusterImage(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, image string) (string, error) {
+	if !in.Spec.AirGap {
+		return image, nil
+	}
+
+	var clusterConfig k0sv1beta1.ClusterConfig
+	nsn := client.ObjectKey{Name: "k0s", Namespace: "kube-system"}
+	if err := cli.Get(ctx, nsn, &clusterConfig); err != nil {
+		return "", fmt.Errorf("get cluster config: %w", err)
+	}
+	registryIP, err := ecregistry.GetRegistryServiceIP(util.ClusterServiceCIDR(clusterConfig, in))
+	if err != nil {
+		return "", fmt.Errorf("get registry service ip: %w", err)
+	}
+	return rewriteImageRegistry(image, fmt.Sprintf("%s:%d", registryIP, registryPort))
+}
+
+// rewriteImageRegistry replaces the registry host of the image reference, keeping the repository
+// and the tag or digest.
+func rewriteImageRegistry(image, host string) (string, error) {
+	// references without a registry host are not accepted by the parser.
+	if first, _, found := strings.Cut(image, "/"); !found || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		image = "docker.io/" + image
+	}
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("parse image reference %q: %w", image, err)
+	}
+	ref.Registry = host
+	return ref.String(), nil
+}
@@ -0,0 +1,91 @@
+package artifacts
+
+import (
+	"context"
+	"testing"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+func TestLocalArtifactMirrorImage(t *testing.T) {
+	release.CacheMeta("1.0.0+lam", ectypes.ReleaseMetadata{
+		Artifacts: map[string]string{
+			LocalArtifactMirrorImageArtifact: "proxy.replicated.com/anonymous/replicated/embedded-cluster-local-artifact-mirror:1.0.0",
+		},
+	})
+	release.CacheMeta("1.0.0+nolam", ectypes.ReleaseMetadata{})
+
+	tests := []struct {
+		name    string
+		version string
+		airgap  bool
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "online",
+			version: "1.0.0+lam",
+			want:    "proxy.replicated.com/anonymous/replicated/embedded-cluster-local-artifact-mirror:1.0.0",
+		},
+		{
+			name:    "airgap points to the cluster registry",
+			version: "1.0.0+lam",
+			airgap:  true,
+			want:    "10.96.0.11:5000/anonymous/replicated/embedded-cluster-local-artifact-mirror:1.0.0",
+		},
+		{
+			name:    "missing from metadata",
+			version: "1.0.0+nolam",
+			wantErr: "local-artifact-mirror-image not found in release metadata",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+				&k0sv1beta1.ClusterConfig{
+					ObjectMeta: metav1.ObjectMeta{Name: "k0s", Namespace: "kube-system"},
+					Spec:       &k0sv1beta1.ClusterSpec{Network: &k0sv1beta1.Network{ServiceCIDR: "10.96.0.0/12"}},
+				},
+			).Build()
+			in := &clusterv1beta1.Installation{
+				Spec: clusterv1beta1.InstallationSpec{
+					AirGap: tt.airgap,
+					Config: &clusterv1beta1.ConfigSpec{Version: tt.version},
+				},
+			}
+
+			got, err := LocalArtifactMirrorImage(context.Background(), cli, in)
+			if tt.wantErr != "" {
+				req.ErrorContains(err, tt.wantErr)
+				return
+			}
+			req.NoError(err)
+			req.Equal(tt.want, got)
+		})
+	}
+}
+
+func Test_rewriteImageRegistry(t *testing.T) {
+	req := require.New(t)
+	for image, want := range map[string]string{
+		"registry.example.com/lam:1.0.0":         "10.0.0.1:5000/lam:1.0.0",
+		"replicated/lam:1.0.0":                   "10.0.0.1:5000/replicated/lam:1.0.0",
+		"localhost/lam@sha256:" + sha256Digest:   "10.0.0.1:5000/lam@sha256:" + sha256Digest,
+		"registry.example.com:443/a/b/lam:1.0.0": "10.0.0.1:5000/a/b/lam:1.0.0",
+	} {
+		got, err := rewriteImageRegistry(image, "10.0.0.1:5000")
+		req.NoError(err, image)
+		req.Equal(want, got, image)
+	}
+}
+
+const sha256Digest = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
@@ -0,0 +1,283 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// k0sBinary is the path of the k0s binary pulled onto the nodes.
+	k0sBinary = "bin/k0s"
+	// k0sUpgradeBinary is where the k0s binary is placed for autopilot to pick it up.
+	k0sUpgradeBinary = "bin/k0s-upgrade"
+	// tmpFilePrefix prefixes the temporary files written while placing the artifacts.
+	tmpFilePrefix = ".place-"
+	// maxPlaceReportSize is the size of the termination message the kubelet keeps, anything
+	// past it is truncated.
+	maxPlaceReportSize = 4096
+	// maxPlaceReportErrorSize bounds the error kept in the report so it always fits in the
+	// termination message.
+	maxPlaceReportErrorSize = 1024
+)
+
+// Steps reported while placing the artifacts on a node.
+const (
+	PlaceStepVerify = "Verify"
+	PlaceStepPlace  = "Place"
+	PlaceStepDone   = "Done"
+	// PlaceStepMissing is reported by CheckPlaced when some of the artifacts are not on the
+	// node.
+	PlaceStepMissing = "Missing"
+)
+
+// PlaceReport is the progress of the artifacts placement on a node. It is written as json to
+// the termination message of the copy artifacts job so it must fit in maxPlaceReportSize. To
+// keep it small Digests only holds the digests of the files that had no expected digest,
+// Verified is set once the expected ones have been checked on the node.
+type PlaceReport struct {
+	Step     string            `json:"step"`
+	Digests  map[string]string `json:"digests,omitempty"`
+	Verified bool              `json:"verified,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// PlaceOptions holds the options for Place.
+type PlaceOptions struct {
+	// DataDir is the embedded cluster data directory the artifacts were pulled into.
+	DataDir string
+	// ImagesID is used to name the images tarball once placed.
+	ImagesID string
+	// Digests are the expected digests of the pulled files indexed by path relative to the data
+	// directory. If empty the digests of the k0s binary and images tarball are only reported.
+	Digests map[string]string
+	// ReportPath is where the progress is written to, usually the termination message path.
+	ReportPath string
+	// Additional are the destinations, relative to the data directory, of the additional
+	// artifacts pulled onto the node. Their digests are reported under their destination.
+	Additional []string
+}
+
+// Place verifies the digests of the artifacts pulled into the data directory and moves the k0s
+// binary and the images tarball to where autopilot expects them, additional artifacts are moved
+// to their destination. Files are moved atomically and the pulled files are removed if they
+// could not be placed. The progress is written to the report path after each step. Images
+// tarballs of previous installations are left in place for the garbage collection to remove.
+func Place(opts PlaceOptions) (*PlaceReport, error) {
+	report := &PlaceReport{}
+	err := place(opts, report)
+	if err != nil {
+		// the digests are of no use once the placement failed, dropping them leaves room for
+		// the error.
+		report.Digests, report.Verified = nil, false
+		report.Error = err.Error()
+		if len(report.Error) > maxPlaceReportErrorSize {
+			report.Error = report.Error[:maxPlaceReportErrorSize]
+		}
+		cleanupPulledFiles(opts.DataDir)
+	}
+	if werr := writePlaceReport(opts.ReportPath, report); werr != nil && err == nil {
+		err = werr
+	}
+	return report, err
+}
+
+func place(opts PlaceOptions, report *PlaceReport) error {
+	step := func(name string) error {
+		report.Step = name
+		return writePlaceReport(opts.ReportPath, report)
+	}
+
+	if err := step(PlaceStepVerify); err != nil {
+		return err
+	}
+	paths := sortedKeys(opts.Digests)
+	if len(paths) == 0 {
+		paths = defaultDigestedFiles
+	}
+	pulled := map[string]string{}
+	for _, dst := range opts.Additional {
+		if _, ok := opts.Digests[dst]; !ok {
+			paths = append(paths, dst)
+		}
+		pulled[dst] = pulledAdditionalArtifact(dst)
+	}
+	digests := map[string]string{}
+	for _, path := range paths {
+		src := path
+		if p, ok := pulled[path]; ok {
+			src = p
+		}
+		digest, err := fileDigest(filepath.Join(opts.DataDir, src))
+		if err != nil {
+			return fmt.Errorf("digest %s: %w", path, err)
+		}
+		if expected, ok := opts.Digests[path]; ok {
+			if digest != expected {
+				return fmt.Errorf("digest mismatch for %s: got %s, expected %s", path, digest, expected)
+			}
+			continue
+		}
+		digests[path] = digest
+	}
+	report.Digests, report.Verified = digests, len(opts.Digests) > 0
+
+	if err := step(PlaceStepPlace); err != nil {
+		return err
+	}
+	tarball := imagesTarballFor(opts.ImagesID)
+	moves := [][2]string{{k0sBinary, k0sUpgradeBinary}, {imagesTarball, tarball}}
+	for _, dst := range opts.Additional {
+		moves = append(moves, [2]string{pulled[dst], dst})
+	}
+	for _, move := range moves {
+		src, dst := filepath.Join(opts.DataDir, move[0]), filepath.Join(opts.DataDir, move[1])
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("create directory for %s: %w", move[1], err)
+		}
+		if err := moveFile(src, dst); err != nil {
+			return fmt.Errorf("move %s to %s: %w", move[0], move[1], err)
+		}
+	}
+	// additional artifacts are mostly host tools, they are made executable like the k0s binary.
+	for _, dst := range opts.Additional {
+		if err := os.Chmod(filepath.Join(opts.DataDir, dst), 0755); err != nil {
+			return fmt.Errorf("chmod %s: %w", dst, err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(opts.DataDir, additionalArtifactsDir)); err != nil {
+		return fmt.Errorf("remove pulled additional artifacts: %w", err)
+	}
+
+	return step(PlaceStepDone)
+}
+
+// CheckPlaced confirms the artifacts of a previous placement are still on the node, it is used
+// instead of Place on nodes recorded as holding the artifacts. Files are only checked for
+// existence, their digests were verified when they were placed. The report is verified if all
+// the files were found, otherwise its step is PlaceStepMissing. Only a failure to write the
+// report is returned as an error so the copy can fall back to a full placement.
+func CheckPlaced(opts PlaceOptions) (*PlaceReport, error) {
+	report := &PlaceReport{Step: PlaceStepDone, Verified: true}
+	paths := append([]string{k0sUpgradeBinary, imagesTarballFor(opts.ImagesID)}, opts.Additional...)
+	for _, path := range paths {
+		if _, err := os.Stat(filepath.Join(opts.DataDir, path)); err != nil {
+			report.Step, report.Verified = PlaceStepMissing, false
+			report.Error = fmt.Sprintf("stat %s: %v", path, err)
+			break
+		}
+	}
+	return report, writePlaceReport(opts.ReportPath, report)
+}
+
+// imagesTarballFor returns the path of the placed images tarball with the given id.
+func imagesTarballFor(id string) string {
+	return fmt.Sprintf("images/images-amd64-%s.tar", id)
+}
+
+// fileDigest returns the hex encoded sha256 digest of the file.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// moveFile renames src to dst. If both are not on the same filesystem src is copied to a
+// temporary file next to dst which is then renamed, dst is never left partially written.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tmpFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// cleanupPulledFiles removes the pulled files that were not placed and any temporary file left
+// behind so a failed placement does not leave partial files on the node.
+func cleanupPulledFiles(dataDir string) {
+	for _, path := range []string{k0sBinary, imagesTarball} {
+		_ = os.Remove(filepath.Join(dataDir, path))
+	}
+	_ = os.RemoveAll(filepath.Join(dataDir, additionalArtifactsDir))
+	for _, dir := range []string{"bin", "images"} {
+		entries, err := os.ReadDir(filepath.Join(dataDir, dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), tmpFilePrefix) {
+				_ = os.Remove(filepath.Join(dataDir, dir, entry.Name()))
+			}
+		}
+	}
+}
+
+// writePlaceReport writes the report as json to the given path. Nothing is written if the path
+// is empty. An error is returned if the report does not fit in the termination message.
+func writePlaceReport(path string, report *PlaceReport) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	if len(data) > maxPlaceReportSize {
+		return fmt.Errorf("report of %d bytes exceeds the %d bytes limit, expected digests are missing for %d files", len(data), maxPlaceReportSize, len(report.Digests))
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+// parsePlaceReport parses the report written to the termination message of a copy artifacts
+// job.
+func parsePlaceReport(message string) (*PlaceReport, error) {
+	var report PlaceReport
+	if err := json.Unmarshal([]byte(message), &report); err != nil {
+		return nil, fmt.Errorf("unmarshal report: %w", err)
+	}
+	return &report, nil
+}
@@ -0,0 +1,171 @@
+package artifacts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlace(t *testing.T) {
+	// sha256 of "k0s" and "truncated".
+	const k0sDigest = "2b7bb4d64d416013eb5b4015dabe1d7cad590fd3ce7ce411f3a4489ae32f49b2"
+	const truncatedDigest = "227b1c2e53cfd4a3dc1cc26c83b9c4fccef2130f905aef3123fdc3dc2c9e4df6"
+	write := func(t *testing.T, dir string, files map[string]string) {
+		for path, content := range files {
+			path = filepath.Join(dir, path)
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		}
+	}
+
+	// enough additional artifacts without an expected digest to overflow the report.
+	many := map[string]string{k0sBinary: "k0s", imagesTarball: "images"}
+	var manyAdditional []string
+	for i := 0; i < 60; i++ {
+		dst := fmt.Sprintf("bin/tool-%02d", i)
+		many[filepath.Join(additionalArtifactsDir, dst)] = "k0s"
+		manyAdditional = append(manyAdditional, dst)
+	}
+
+	tests := []struct {
+		name       string
+		files      map[string]string
+		digests    map[string]string
+		additional []string
+		wantErr    string
+		wantStep   string
+		wantFiles  []string
+		gone       []string
+	}{
+		{
+			name: "places the artifacts",
+			files: map[string]string{
+				k0sBinary:                     "k0s",
+				imagesTarball:                 "images",
+				"images/images-amd64-old.tar": "old images",
+			},
+			wantStep:  PlaceStepDone,
+			wantFiles: []string{k0sUpgradeBinary, "images/images-amd64-abc.tar", "images/images-amd64-old.tar"},
+			gone:      []string{k0sBinary, imagesTarball},
+		},
+		{
+			name: "places the additional artifacts",
+			files: map[string]string{
+				k0sBinary:                             "k0s",
+				imagesTarball:                         "images",
+				"tmp/additional-artifacts/bin/mytool": "k0s",
+			},
+			digests:    map[string]string{k0sBinary: k0sDigest, "bin/mytool": k0sDigest},
+			additional: []string{"bin/mytool"},
+			wantStep:   PlaceStepDone,
+			wantFiles:  []string{k0sUpgradeBinary, "bin/mytool"},
+			gone:       []string{"tmp/additional-artifacts/bin/mytool"},
+		},
+		{
+			name: "additional artifact digest mismatch removes the pulled files",
+			files: map[string]string{
+				k0sBinary:                             "k0s",
+				imagesTarball:                         "images",
+				"tmp/additional-artifacts/bin/mytool": "truncated",
+			},
+			digests:    map[string]string{"bin/mytool": k0sDigest},
+			additional: []string{"bin/mytool"},
+			wantErr:    fmt.Sprintf("digest mismatch for bin/mytool: got %s, expected %s", truncatedDigest, k0sDigest),
+			wantStep:   PlaceStepVerify,
+			gone:       []string{"bin/mytool", "tmp/additional-artifacts/bin/mytool"},
+		},
+		{
+			name:     "digest mismatch removes the pulled files",
+			files:    map[string]string{k0sBinary: "truncated", imagesTarball: "images"},
+			digests:  map[string]string{k0sBinary: k0sDigest},
+			wantErr:  fmt.Sprintf("digest mismatch for bin/k0s: got %s, expected %s", truncatedDigest, k0sDigest),
+			wantStep: PlaceStepVerify,
+			gone:     []string{k0sBinary, imagesTarball, k0sUpgradeBinary},
+		},
+		{
+			name:       "report too large for the termination message",
+			files:      many,
+			additional: manyAdditional,
+			wantErr:    "exceeds the 4096 bytes limit, expected digests are missing for 62 files",
+			wantStep:   PlaceStepPlace,
+			gone:       []string{k0sBinary, imagesTarball, "bin/tool-00"},
+		},
+		{
+			name:     "missing images tarball",
+			files:    map[string]string{k0sBinary: "k0s"},
+			wantErr:  "digest images/images-amd64.tar",
+			wantStep: PlaceStepVerify,
+			gone:     []string{k0sBinary},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			dir := t.TempDir()
+			write(t, dir, tt.files)
+			reportPath := filepath.Join(t.TempDir(), "termination-log")
+
+			report, err := Place(PlaceOptions{DataDir: dir, ImagesID: "abc", Digests: tt.digests, ReportPath: reportPath, Additional: tt.additional})
+			if tt.wantErr != "" {
+				req.ErrorContains(err, tt.wantErr)
+			} else {
+				req.NoError(err)
+				req.Equal(len(tt.digests) > 0, report.Verified)
+				// only the digests we did not know about are reported.
+				for path := range tt.digests {
+					req.NotContains(report.Digests, path)
+				}
+				if _, ok := tt.digests[k0sBinary]; !ok {
+					req.Equal(k0sDigest, report.Digests[k0sBinary])
+				}
+			}
+
+			data, err := os.ReadFile(reportPath)
+			req.NoError(err)
+			req.LessOrEqual(len(data), maxPlaceReportSize)
+			written, err := parsePlaceReport(string(data))
+			req.NoError(err)
+			req.Equal(tt.wantStep, written.Step)
+			req.Equal(report.Error, written.Error)
+
+			for _, path := range tt.wantFiles {
+				req.FileExists(filepath.Join(dir, path))
+			}
+			for _, path := range tt.gone {
+				req.NoFileExists(filepath.Join(dir, path))
+			}
+		})
+	}
+}
+
+func TestCheckPlaced(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	reportPath := filepath.Join(t.TempDir(), "termination-log")
+	opts := PlaceOptions{DataDir: dir, ImagesID: "abc", ReportPath: reportPath, Additional: []string{"bin/mytool"}}
+
+	for _, path := range []string{k0sUpgradeBinary, imagesTarballFor("abc")} {
+		req.NoError(os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		req.NoError(os.WriteFile(filepath.Join(dir, path), []byte("placed"), 0644))
+	}
+	report, err := CheckPlaced(opts)
+	req.NoError(err)
+	req.Equal(PlaceStepMissing, report.Step)
+	req.False(report.Verified)
+	req.Contains(report.Error, "bin/mytool")
+
+	req.NoError(os.WriteFile(filepath.Join(dir, "bin/mytool"), []byte("placed"), 0755))
+	report, err = CheckPlaced(opts)
+	req.NoError(err)
+	req.Equal(PlaceStepDone, report.Step)
+	req.True(report.Verified)
+
+	data, err := os.ReadFile(reportPath)
+	req.NoError(err)
+	written, err := parsePlaceReport(string(data))
+	req.NoError(err)
+	req.Equal(report, written)
+}
@@ -3,6 +3,7 @@ package artifacts
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/go-logr/logr"
@@ -21,6 +22,10 @@ import (
 const (
 	RegistryCredsSecretName = "registry-creds"
 
+	// RegistryCredsCopyLabel is set to "true" on the copies of the registry credentials made by
+	// EnsureRegistrySecretInNamespace, only those are deleted by DeleteRegistrySecretCopies.
+	RegistryCredsCopyLabel = "embedded-cluster.replicated.com/registry-creds-copy"
+
 	kotsadmNamespace = "kotsadm"
 )
 
@@ -35,7 +40,21 @@ type dockerConfigEntry struct {
 	Password string `json:"password"`
 }
 
+// EnsureRegistrySecretInECNamespace copies the registry credentials from the kotsadm namespace
+// into the embedded cluster namespace.
 func EnsureRegistrySecretInECNamespace(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (controllerutil.OperationResult, error) {
+	return EnsureRegistrySecretInNamespace(ctx, cli, in, ecNamespace)
+}
+
+// errNotRegistrySecretCopy is returned when the registry credentials secret in a namespace was
+// not copied by the operator.
+var errNotRegistrySecretCopy = errors.New("secret is not a copy of the registry credentials")
+
+// EnsureRegistrySecretInNamespace copies the registry credentials from the kotsadm namespace into
+// the given namespace, updating the copy if the credentials have changed. The copy is owned by
+// the installation. A secret with the same name not copied by the operator is left untouched.
+func EnsureRegistrySecretInNamespace(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, namespace string) (controllerutil.OperationResult, error) {
+	log := ctrl.LoggerFrom(ctx)
 	op := controllerutil.OperationResultNone
 
 	nsn := types.NamespacedName{Name: RegistryCredsSecretName, Namespace: kotsadmNamespace}
@@ -46,11 +65,17 @@ func EnsureRegistrySecretInECNamespace(ctx context.Context, cli client.Client, i
 	}
 
 	obj := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{Name: RegistryCredsSecretName, Namespace: ecNamespace},
+		ObjectMeta: metav1.ObjectMeta{Name: RegistryCredsSecretName, Namespace: namespace},
 	}
 
 	op, err = ctrl.CreateOrUpdate(ctx, cli, obj, func() error {
+		if obj.ResourceVersion != "" && !isRegistrySecretCopy(obj) {
+			return errNotRegistrySecretCopy
+		}
 		if in.GetUID() != "" {
+			// the copy is handed over to the newest installation, an object can't have two
+			// controllers.
+			obj.OwnerReferences = removeInstallationOwners(obj.OwnerReferences)
 			err := ctrl.SetControllerReference(in, obj, cli.Scheme())
 			if err != nil {
 				return fmt.Errorf("set controller reference: %w", err)
@@ -58,19 +83,73 @@ func EnsureRegistrySecretInECNamespace(ctx context.Context, cli client.Client, i
 		}
 
 		obj.ObjectMeta.Labels = applyECOperatorLabels(obj.ObjectMeta.Labels, "upgrader")
+		obj.ObjectMeta.Labels[RegistryCredsCopyLabel] = "true"
 
 		obj.Type = corev1.SecretTypeDockerConfigJson
 		obj.Data = kotsadmSecret.Data
 
 		return nil
 	})
-	if err != nil {
+	if errors.Is(err, errNotRegistrySecretCopy) {
+		log.Info("Registry credentials secret not created by the operator, leaving it untouched", "namespace", namespace)
+		return controllerutil.OperationResultNone, nil
+	} else if err != nil {
 		return op, fmt.Errorf("create or update registry creds secret: %w", err)
 	}
 
 	return op, nil
 }
 
+// isRegistrySecretCopy returns true if the secret is a copy of the registry credentials made by
+// the operator. Copies made before RegistryCredsCopyLabel existed are controlled by an
+// installation.
+func isRegistrySecretCopy(secret *corev1.Secret) bool {
+	if secret.Labels[RegistryCredsCopyLabel] == "true" {
+		return true
+	}
+	owner := metav1.GetControllerOf(secret)
+	return owner != nil && owner.Kind == "Installation" && owner.APIVersion == clusterv1beta1.GroupVersion.String()
+}
+
+// DeleteRegistrySecretCopies deletes the copies of the registry credentials made by
+// EnsureRegistrySecretInNamespace outside of the given namespaces. The copy in the embedded cluster namespace is always
+// kept. Returns the namespaces the copies were deleted from.
+func DeleteRegistrySecretCopies(ctx context.Context, cli client.Client, keep []string) ([]string, error) {
+	kept := map[string]bool{ecNamespace: true, kotsadmNamespace: true}
+	for _, ns := range keep {
+		kept[ns] = true
+	}
+
+	var secrets corev1.SecretList
+	err := cli.List(ctx, &secrets, client.MatchingLabels{RegistryCredsCopyLabel: "true"})
+	if err != nil {
+		return nil, fmt.Errorf("list secrets: %w", err)
+	}
+	var deleted []string
+	for _, secret := range secrets.Items {
+		if secret.Name != RegistryCredsSecretName || kept[secret.Namespace] {
+			continue
+		}
+		if err := cli.Delete(ctx, &secret); err != nil && !k8serrors.IsNotFound(err) {
+			return deleted, fmt.Errorf("delete secret in namespace %s: %w", secret.Namespace, err)
+		}
+		deleted = append(deleted, secret.Namespace)
+	}
+	return deleted, nil
+}
+
+// removeInstallationOwners returns the owner references that do not point to an installation.
+func removeInstallationOwners(refs []metav1.OwnerReference) []metav1.OwnerReference {
+	var result []metav1.OwnerReference
+	for _, ref := range refs {
+		if ref.Kind == "Installation" && ref.APIVersion == clusterv1beta1.GroupVersion.String() {
+			continue
+		}
+		result = append(result, ref)
+	}
+	return result
+}
+
 func GetRegistryImagePullSecret() corev1.LocalObjectReference {
 	return corev1.LocalObjectReference{Name: RegistryCredsSecretName}
 }
@@ -0,0 +1,194 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"go.uber.org/multierr"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OCILayoutScheme prefixes the artifact references pointing to an OCI image layout on disk
+// instead of a registry, e.g. "oci-layout:///var/lib/artifacts/metadata:1.0.0". The layout may be
+// a directory or a tarball. The tag defaults to latest and a digest may be used instead. The
+// artifacts pulled on the nodes by the copy artifacts job are read from a layout present at the
+// same path on every node, see checkNodeArtifactsLocation.
+const OCILayoutScheme = "oci-layout://"
+
+// source is a location artifacts are pulled from.
+type source interface {
+	// copy copies the artifact into the target. It is called again if it fails.
+	copy(ctx context.Context, dst oras.Target, opts oras.CopyOptions) error
+}
+
+// newSource returns the source for the given artifact reference.
+func newSource(ctx context.Context, log logr.Logger, cli client.Client, from string, opts *PullOptions) (source, error) {
+	if path, ok := strings.CutPrefix(from, OCILayoutScheme); ok {
+		log.Info("Pulling artifact from OCI layout", "from", from)
+		return newOCILayoutSource(path)
+	}
+	return newRegistrySource(ctx, log, cli, from, opts)
+}
+
+// checkNodeArtifactsLocation returns an error if any of the artifacts pulled on the nodes points
+// to an OCI image layout that can't be read there. The legacy copy artifacts job pulls with the
+// local artifact mirror, which only pulls from registries. Otherwise the directory holding the
+// layout is mounted from the node so its path must be absolute and not at the root.
+func checkNodeArtifactsLocation(loc *clusterv1beta1.ArtifactsLocation, legacy bool) error {
+	refs := map[string]string{
+		"images":                  loc.Images,
+		"helm charts":             loc.HelmCharts,
+		"embedded cluster binary": loc.EmbeddedClusterBinary,
+	}
+	for name, ref := range loc.AdditionalArtifacts {
+		refs["additional artifact "+name] = ref
+	}
+	for _, name := range sortedKeys(refs) {
+		if !strings.HasPrefix(refs[name], OCILayoutScheme) {
+			continue
+		}
+		if legacy {
+			return fmt.Errorf("%s location %q is an oci layout, the release has no operator image to pull from one on the nodes", name, refs[name])
+		}
+		if _, err := nodeOCILayoutDir(refs[name]); err != nil {
+			return fmt.Errorf("%s location: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// nodeOCILayoutDir returns the directory holding the OCI image layout the reference points to.
+// The directory is mounted from the node into the containers pulling from the layout.
+func nodeOCILayoutDir(ref string) (string, error) {
+	src, err := newOCILayoutSource(strings.TrimPrefix(ref, OCILayoutScheme))
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(filepath.Clean(src.path))
+	if !filepath.IsAbs(src.path) || dir == "/" {
+		return "", fmt.Errorf("oci layout %q must be an absolute path outside the root directory", src.path)
+	}
+	return dir, nil
+}
+
+// registrySource pulls artifacts from a registry.
+type registrySource struct {
+	log       logr.Logger
+	repo      *remote.Repository
+	tag       string
+	plainHTTP bool
+}
+
+func newRegistrySource(ctx context.Context, log logr.Logger, cli client.Client, from string, opts *PullOptions) (*registrySource, error) {
+	log.Info("Reading registry credentials from cluster")
+	store, err := registryAuth(ctx, log, cli)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get registry auth: %w", err)
+	}
+
+	tlsConfig, plainHTTP, err := registryTLSConfig(ctx, log, cli, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get registry tls config: %w", err)
+	}
+
+	log.Info("Pulling artifact from registry", "from", from)
+	imgref, err := registry.ParseReference(from)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse image reference: %w", err)
+	}
+
+	repo, err := remote.NewRepository(from)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository: %w", err)
+	}
+
+	transp, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unable to get default transport")
+	}
+
+	transp = transp.Clone()
+	transp.TLSClientConfig = tlsConfig
+	repo.Client = &auth.Client{
+		Client:     &http.Client{Transport: transp},
+		Credential: store.Get,
+	}
+
+	return &registrySource{log: log, repo: repo, tag: imgref.Reference, plainHTTP: plainHTTP}, nil
+}
+
+// copy copies the artifact from the repository into the target. If allowed and the artifact
+// can't be fetched using tls it is fetched once more using plain http.
+func (s *registrySource) copy(ctx context.Context, dst oras.Target, opts oras.CopyOptions) error {
+	s.repo.PlainHTTP = false
+	_, tlserr := oras.Copy(ctx, s.repo, s.tag, dst, s.tag, opts)
+	if tlserr == nil {
+		return nil
+	} else if !s.plainHTTP {
+		return fmt.Errorf("unable to fetch artifact: %w", tlserr)
+	}
+
+	// if we fail to fetch the artifact using https we gonna try once more using plain
+	// http as some versions of the registry were deployed without tls.
+	s.repo.PlainHTTP = true
+	s.log.Info("Unable to fetch artifact using tls, retrying with http")
+	if _, err := oras.Copy(ctx, s.repo, s.tag, dst, s.tag, opts); err != nil {
+		err = multierr.Combine(tlserr, err)
+		return fmt.Errorf("unable to fetch artifacts with or without tls: %w", err)
+	}
+	return nil
+}
+
+// ociLayoutSource pulls artifacts from an OCI image layout directory or tarball.
+type ociLayoutSource struct {
+	path string
+	ref  string
+}
+
+// newOCILayoutSource parses the path, without scheme, of an artifact in an OCI image layout. The
+// reference is separated from the path by a colon for tags or by an at sign for digests.
+func newOCILayoutSource(path string) (*ociLayoutSource, error) {
+	src := &ociLayoutSource{path: path, ref: "latest"}
+	if before, after, found := strings.Cut(path, "@"); found {
+		src.path, src.ref = before, after
+	} else if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		src.path, src.ref = path[:i], path[i+1:]
+	}
+	if src.path == "" || src.ref == "" {
+		return nil, fmt.Errorf("invalid oci layout reference %q", path)
+	}
+	return src, nil
+}
+
+func (s *ociLayoutSource) copy(ctx context.Context, dst oras.Target, opts oras.CopyOptions) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("unable to read oci layout: %w", err)
+	}
+
+	var store oras.ReadOnlyTarget
+	if info.IsDir() {
+		store, err = oci.NewFromFS(ctx, os.DirFS(s.path))
+	} else {
+		store, err = oci.NewFromTar(ctx, s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open oci layout: %w", err)
+	}
+
+	if _, err := oras.Copy(ctx, store, s.ref, dst, s.ref, opts); err != nil {
+		return fmt.Errorf("unable to fetch artifact from oci layout: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func Test_newOCILayoutSource(t *testing.T) {
+	tests := []struct {
+		path     string
+		wantPath string
+		wantRef  string
+		wantErr  bool
+	}{
+		{path: "/var/lib/layout", wantPath: "/var/lib/layout", wantRef: "latest"},
+		{path: "/var/lib/layout:1.0.0", wantPath: "/var/lib/layout", wantRef: "1.0.0"},
+		{path: "/var/lib/layout.tar@sha256:abc", wantPath: "/var/lib/layout.tar", wantRef: "sha256:abc"},
+		{path: "/var/lib:8000/layout", wantPath: "/var/lib:8000/layout", wantRef: "latest"},
+		{path: ":1.0.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := require.New(t)
+			src, err := newOCILayoutSource(tt.path)
+			if tt.wantErr {
+				req.Error(err)
+				return
+			}
+			req.NoError(err)
+			req.Equal(tt.wantPath, src.path)
+			req.Equal(tt.wantRef, src.ref)
+		})
+	}
+}
+
+func TestPull_ociLayout(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	// build a layout holding a single file artifact tagged 1.0.0.
+	dir := t.TempDir()
+	store, err := oci.New(dir)
+	req.NoError(err)
+	data := []byte(`{"Versions":{}}`)
+	desc := content.NewDescriptorFromBytes("application/json", data)
+	desc.Annotations = map[string]string{ocispec.AnnotationTitle: "version-metadata.json"}
+	req.NoError(store.Push(ctx, desc, bytes.NewReader(data)))
+	manifest, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.embeddedcluster.metadata", oras.PackManifestOptions{
+		Layers: []ocispec.Descriptor{desc},
+	})
+	req.NoError(err)
+	req.NoError(store.Tag(ctx, manifest, "1.0.0"))
+
+	tarball := filepath.Join(t.TempDir(), "layout.tar")
+	writeTar(t, dir, tarball)
+
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+	for _, from := range []string{OCILayoutScheme + dir + ":1.0.0", OCILayoutScheme + tarball + ":1.0.0"} {
+		location, err := Pull(ctx, testr.New(t), cli, from)
+		req.NoError(err)
+		got, err := os.ReadFile(filepath.Join(location, "version-metadata.json"))
+		req.NoError(err)
+		req.Equal(data, got)
+		os.RemoveAll(location)
+	}
+
+	_, err = Pull(ctx, testr.New(t), cli, OCILayoutScheme+dir+":2.0.0")
+	req.ErrorContains(err, "not found")
+}
+
+// writeTar writes the content of the directory to a tarball.
+func writeTar(t *testing.T, dir, path string) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	defer tw.Close()
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: rel, Mode: 0644, Size: int64(len(data))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	require.NoError(t, err)
+}
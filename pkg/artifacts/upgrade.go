@@ -6,6 +6,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 
 	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
 	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
@@ -28,13 +31,77 @@ const copyArtifactsJobPrefix = "copy-artifacts-"
 const (
 	InstallationNameAnnotation    = "embedded-cluster.replicated.com/installation-name"
 	ArtifactsConfigHashAnnotation = "embedded-cluster.replicated.com/artifacts-config-hash"
+	// ArtifactsCheckAnnotation is set to "true" on the copy artifacts jobs that only check the
+	// artifacts recorded for the node are still there.
+	ArtifactsCheckAnnotation = "embedded-cluster.replicated.com/artifacts-check"
+	// ArtifactsLegacyAnnotation is set to "true" on the copy artifacts jobs placing the
+	// artifacts with the local artifact mirror alone. Their report is the output of sha256sum.
+	ArtifactsLegacyAnnotation = "embedded-cluster.replicated.com/artifacts-legacy"
 )
 
 // copyArtifactsJob is a job we create everytime we need to sync files into all nodes.
-// This job mounts /var/lib/embedded-cluster from the node and uses binaries that are
-// present there. This is not yet a complete version of the job as it misses some env
-// variables and a node selector, those are populated during the reconcile cycle.
+// This job mounts /var/lib/embedded-cluster from the node. The init containers pull the
+// artifacts using the operator and the operator then verifies and places them where autopilot
+// expects them. This is not yet a complete version of the job as it misses the init containers,
+// the images, some env variables, arguments and a node selector, those are populated during the
+// reconcile cycle.
 var copyArtifactsJob = &batchv1.Job{
+	TypeMeta: metav1.TypeMeta{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+	},
+	ObjectMeta: metav1.ObjectMeta{
+		Namespace: ecNamespace,
+	},
+	Spec: batchv1.JobSpec{
+		BackoffLimit: ptr.To[int32](2),
+		Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "embedded-cluster-operator",
+				Volumes: []corev1.Volume{
+					{
+						Name: "host",
+						VolumeSource: corev1.VolumeSource{
+							HostPath: &corev1.HostPathVolumeSource{
+								Path: "/var/lib/embedded-cluster",
+								Type: ptr.To[corev1.HostPathType]("Directory"),
+							},
+						},
+					},
+				},
+				RestartPolicy: corev1.RestartPolicyNever,
+				Containers: []corev1.Container{
+					{
+						Name: "embedded-cluster-updater",
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "host",
+								MountPath: "/var/lib/embedded-cluster",
+								ReadOnly:  false,
+							},
+						},
+						Command: []string{"/manager"},
+						// the placement report, including the digests of the artifacts, is
+						// written to the termination message so it can be recorded once the job
+						// succeeds.
+						TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+						// the operator image runs as non root by default.
+						SecurityContext: &corev1.SecurityContext{
+							RunAsUser: ptr.To[int64](0),
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// legacyCopyArtifactsJob is the copy artifacts job used when the release metadata does not carry
+// the operator image. The local artifact mirror pulls the artifacts and a shell script verifies
+// and places them, additional artifacts and checks are not supported. As copyArtifactsJob this
+// is not a complete version of the job, it misses the image, some env variables and a node
+// selector.
+var legacyCopyArtifactsJob = &batchv1.Job{
 	TypeMeta: metav1.TypeMeta{
 		APIVersion: "batch/v1",
 		Kind:       "Job",
@@ -76,12 +143,16 @@ var copyArtifactsJob = &batchv1.Job{
 							"/usr/local/bin/local-artifact-mirror pull binaries $INSTALLATION_DATA\n" +
 								"/usr/local/bin/local-artifact-mirror pull images $INSTALLATION_DATA\n" +
 								"/usr/local/bin/local-artifact-mirror pull helmcharts $INSTALLATION_DATA\n" +
-								"mv /var/lib/embedded-cluster/bin/k0s /var/lib/embedded-cluster/bin/k0s-upgrade\n" +
-								"rm /var/lib/embedded-cluster/images/images-amd64-* || true\n" +
-								"cd /var/lib/embedded-cluster/images/\n" +
-								"mv images-amd64.tar images-amd64-${INSTALLATION}.tar\n" +
+								"cd /var/lib/embedded-cluster\n" +
+								"if [ -n \"$ARTIFACTS_DIGESTS\" ]; then echo \"$ARTIFACTS_DIGESTS\" | sha256sum -c -; fi\n" +
+								"sha256sum $DIGESTED_FILES > /dev/termination-log\n" +
+								"mv bin/k0s bin/k0s-upgrade\n" +
+								"mv images/images-amd64.tar images/images-amd64-${IMAGES_ID}.tar\n" +
 								"echo 'done'",
 						},
+						// the digests of the artifacts are reported through the termination
+						// message so they can be recorded once the job succeeds.
+						TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
 					},
 				},
 			},
@@ -89,18 +160,166 @@ var copyArtifactsJob = &batchv1.Job{
 	},
 }
 
+// pullCoreArtifactContainer returns the container pulling the given kind of core artifact from
+// the registry. The pull goes through the operator rather than the local artifact mirror as the
+// latter does not verify the registry certificate.
+func pullCoreArtifactContainer(operatorImage, kind, from, binaryName string) corev1.Container {
+	return corev1.Container{
+		Name:  fmt.Sprintf("pull-%s", kind),
+		Image: operatorImage,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "host",
+				MountPath: "/var/lib/embedded-cluster",
+				ReadOnly:  false,
+			},
+		},
+		Command: []string{"/manager"},
+		Args: []string{
+			"artifacts", "pull",
+			"--data-dir", "/var/lib/embedded-cluster",
+			"--kind", kind,
+			"--from", from,
+			"--binary-name", binaryName,
+		},
+		// the operator image runs as non root by default.
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser: ptr.To[int64](0),
+		},
+	}
+}
+
+// mountNodeOCILayouts mounts into the container, read only and at the same path, the directory
+// holding the OCI image layout the reference points to so it can be pulled from the node. Layouts
+// within the data directory are already reachable through the host volume, references to
+// registries are ignored.
+func mountNodeOCILayouts(pod *corev1.PodSpec, container *corev1.Container, ref string) error {
+	if !strings.HasPrefix(ref, OCILayoutScheme) {
+		return nil
+	}
+	dir, err := nodeOCILayoutDir(ref)
+	if err != nil {
+		return err
+	}
+	if dir == "/var/lib/embedded-cluster" || strings.HasPrefix(dir, "/var/lib/embedded-cluster/") {
+		return nil
+	}
+
+	name := fmt.Sprintf("oci-layout-%x", sha256.Sum256([]byte(dir)))[:21]
+	if !slices.ContainsFunc(pod.Volumes, func(v corev1.Volume) bool { return v.Name == name }) {
+		pod.Volumes = append(pod.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: dir,
+					Type: ptr.To[corev1.HostPathType]("Directory"),
+				},
+			},
+		})
+	}
+	if !slices.ContainsFunc(container.VolumeMounts, func(m corev1.VolumeMount) bool { return m.Name == name }) {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: dir,
+			ReadOnly:  true,
+		})
+	}
+	return nil
+}
+
+// pullAdditionalArtifactsContainer returns the container pulling the additional artifacts from
+// the registry. The local artifact mirror does not know about them so they are pulled by the
+// operator, artifacts is the json encoded map of locations indexed by destination.
+func pullAdditionalArtifactsContainer(operatorImage, artifacts string) corev1.Container {
+	return corev1.Container{
+		Name:  "pull-additional",
+		Image: operatorImage,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "host",
+				MountPath: "/var/lib/embedded-cluster",
+				ReadOnly:  false,
+			},
+		},
+		Command: []string{"/manager"},
+		Args: []string{
+			"artifacts", "pull-additional",
+			"--data-dir", "/var/lib/embedded-cluster",
+			"--artifacts", artifacts,
+		},
+		// the operator image runs as non root by default.
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser: ptr.To[int64](0),
+		},
+	}
+}
+
+// EnsureArtifactsJobOptions holds the options for EnsureArtifactsJobForNodes.
+type EnsureArtifactsJobOptions struct {
+	// MaxConcurrent is the maximum number of jobs that may be running at the same time. Zero
+	// means no limit.
+	MaxConcurrent int
+	// OperatorImage is the image used to place the artifacts on the nodes. Defaults to the
+	// operator image in the release metadata, if there is none the local artifact mirror places
+	// the artifacts on its own.
+	OperatorImage string
+}
+
 // EnsureArtifactsJobForNodes copies the installation artifacts to the nodes in the cluster.
 // This is done by creating a job for each node in the cluster, which will pull the
-// artifacts from the internal registry.
-func EnsureArtifactsJobForNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string) error {
+// artifacts from the internal registry. The operator image pulls and places the artifacts, when
+// the release metadata does not carry it the legacy job running the local artifact mirror is
+// used instead. If no local artifact mirror image is provided the one from the release metadata
+// is used. Nodes recorded as already holding the artifacts get a job
+// that only checks the files are still there, if they are not the node gets a full copy. Checks
+// need the operator image, without it every node gets a full copy. When
+// a maximum number of concurrent jobs is set only that many jobs are started, the remaining
+// nodes are queued and this function needs to be called again as jobs complete. Nodes are
+// processed in name order.
+func EnsureArtifactsJobForNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string, applyOpts ...func(*EnsureArtifactsJobOptions)) error {
+	opts := &EnsureArtifactsJobOptions{}
+	for _, apply := range applyOpts {
+		apply(opts)
+	}
+
 	if in.Spec.Artifacts == nil {
 		return fmt.Errorf("no artifacts location defined")
 	}
 
+	if opts.OperatorImage == "" {
+		image, err := OperatorImage(ctx, cli, in)
+		if err != nil {
+			return fmt.Errorf("get operator image: %w", err)
+		}
+		opts.OperatorImage = image
+	}
+
+	if err := checkNodeArtifactsLocation(in.Spec.Artifacts, opts.OperatorImage == ""); err != nil {
+		return err
+	}
+
+	// the local artifact mirror is only used by the legacy jobs.
+	if opts.OperatorImage == "" && localArtifactMirrorImage == "" {
+		image, err := LocalArtifactMirrorImage(ctx, cli, in)
+		if err != nil {
+			return fmt.Errorf("get local artifact mirror image: %w", err)
+		}
+		localArtifactMirrorImage = image
+	}
+
+	// nodes that failed the check no longer hold the artifacts, this must happen before the
+	// nodes are read.
+	if err := resetFailedArtifactsChecks(ctx, cli, in); err != nil {
+		return fmt.Errorf("reset failed artifacts checks: %w", err)
+	}
+
 	var nodes corev1.NodeList
 	if err := cli.List(ctx, &nodes); err != nil {
 		return fmt.Errorf("list nodes: %w", err)
 	}
+	sort.SliceStable(nodes.Items, func(i, j int) bool {
+		return nodes.Items[i].Name < nodes.Items[j].Name
+	})
 
 	// generate a hash of the current config so we can detect config changes.
 	cfghash, err := HashForAirgapConfig(in)
@@ -108,17 +327,68 @@ func EnsureArtifactsJobForNodes(ctx context.Context, cli client.Client, in *clus
 		return fmt.Errorf("hash airgap config: %w", err)
 	}
 
+	held, err := heldArtifactsDigests(ctx, cli, in)
+	if err != nil {
+		return fmt.Errorf("get held artifacts digests: %w", err)
+	}
+
+	recorded, err := listNodeDigests(ctx, cli)
+	if err != nil {
+		return fmt.Errorf("list node digests: %w", err)
+	}
+
+	if err := deleteArtifactsJobsForRemovedNodes(ctx, cli, in, nodes.Items); err != nil {
+		return fmt.Errorf("delete artifacts jobs for removed nodes: %w", err)
+	}
+	if err := deleteNodeDigestsForRemovedNodes(ctx, cli, nodes.Items); err != nil {
+		return fmt.Errorf("delete node digests for removed nodes: %w", err)
+	}
+
+	jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+	if err != nil {
+		return fmt.Errorf("list artifacts jobs for nodes: %w", err)
+	}
+	running := 0
+	for _, job := range jobs {
+		if job != nil && !isJobFinished(job) {
+			running++
+		}
+	}
+
 	for _, node := range nodes.Items {
-		_, err := ensureArtifactsJobForNode(ctx, cli, in, node, localArtifactMirrorImage, cfghash)
+		if job, ok := jobs[node.Name]; !ok || job != nil {
+			continue
+		}
+		if opts.MaxConcurrent > 0 && running >= opts.MaxConcurrent {
+			break
+		}
+		check := opts.OperatorImage != "" && holdsArtifacts(recorded[node.Name], held)
+		_, err := ensureArtifactsJobForNode(ctx, cli, in, node, localArtifactMirrorImage, opts.OperatorImage, cfghash, check)
 		if err != nil {
 			return fmt.Errorf("ensure artifacts job for node: %w", err)
 		}
+		running++
 	}
 
 	return nil
 }
 
-// ListArtifactsJobForNodes list all the artifacts jobs for the nodes in the cluster.
+// isJobFinished returns true if the job has either succeeded or failed.
+func isJobFinished(job *batchv1.Job) bool {
+	if job.Status.Succeeded > 0 {
+		return true
+	}
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// ListArtifactsJobForNodes list all the artifacts jobs for the nodes in the cluster. Nodes for
+// which no job has been created yet for the installation map to a nil job, so do nodes whose
+// artifacts check failed as they are due for a full copy.
 func ListArtifactsJobForNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (map[string]*batchv1.Job, error) {
 	var nodes corev1.NodeList
 	if err := cli.List(ctx, &nodes); err != nil {
@@ -148,20 +418,137 @@ func ListArtifactsJobForNodes(ctx context.Context, cli client.Client, in *cluste
 			annotations := job.GetAnnotations()
 			oldjob := annotations[InstallationNameAnnotation] != in.Name
 			newcfg := annotations[ArtifactsConfigHashAnnotation] != cfghash
-			if !oldjob && !newcfg {
+			if !oldjob && !newcfg && !(isArtifactsCheckJob(job) && isJobFailed(job)) {
 				jobs[node.Name] = job
 				continue
 			}
 		} else if !k8serrors.IsNotFound(err) {
 			return nil, fmt.Errorf("get job: %w", err)
 		}
-
 		jobs[node.Name] = nil
 	}
 
 	return jobs, nil
 }
 
+// heldArtifactsDigests returns the expected digests of the installation artifacts when nodes
+// recorded as holding them can be checked instead of copied to. Returns nil if any of the
+// artifacts has no digest as we can't tell if a node holds it.
+func heldArtifactsDigests(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (map[string]string, error) {
+	expected, err := ExpectedDigests(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("get expected digests: %w", err)
+	}
+	additional, err := AdditionalArtifacts(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("get additional artifacts: %w", err)
+	}
+	for dst := range additional {
+		if _, ok := expected[dst]; !ok {
+			return nil, nil
+		}
+	}
+	return expected, nil
+}
+
+// isArtifactsCheckJob returns true if the job only checks the artifacts are on the node.
+func isArtifactsCheckJob(job *batchv1.Job) bool {
+	return job.Annotations[ArtifactsCheckAnnotation] == "true"
+}
+
+// isJobFailed returns true if the job has failed.
+func isJobFailed(job *batchv1.Job) bool {
+	return isJobFinished(job) && job.Status.Succeeded == 0
+}
+
+// resetFailedArtifactsChecks deletes the failed artifacts check jobs of the installation and
+// forgets the artifacts recorded for their nodes so they get a full copy.
+func resetFailedArtifactsChecks(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs, client.InNamespace(ecNamespace)); err != nil {
+		return fmt.Errorf("list jobs: %w", err)
+	}
+	for _, job := range jobs.Items {
+		if !strings.HasPrefix(job.Name, copyArtifactsJobPrefix) || !isArtifactsCheckJob(&job) {
+			continue
+		}
+		if job.Annotations[InstallationNameAnnotation] != in.Name || !isJobFailed(&job) {
+			continue
+		}
+		if err := resetArtifactsCheck(ctx, cli, &job); err != nil {
+			return fmt.Errorf("reset job %s: %w", job.Name, err)
+		}
+	}
+	return nil
+}
+
+// resetArtifactsCheck deletes the artifacts check job and the artifacts digests recorded for
+// its node, the node is then due for a full copy.
+func resetArtifactsCheck(ctx context.Context, cli client.Client, job *batchv1.Job) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	nodeName := job.Spec.Template.Spec.NodeName
+	log.Info("Artifacts not found on node, copying them again", "node", nodeName)
+
+	if err := forgetNodeDigests(ctx, cli, nodeName); err != nil {
+		return fmt.Errorf("forget node digests: %w", err)
+	}
+
+	err := cli.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationForeground))
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("delete job: %w", err)
+	}
+	return nil
+}
+
+// DeleteArtifactsJobsForInstallation deletes all the artifacts jobs created for the given
+// installation, stopping any copy still in progress.
+func DeleteArtifactsJobsForInstallation(ctx context.Context, cli client.Client, installation string) error {
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs, client.InNamespace(ecNamespace)); err != nil {
+		return fmt.Errorf("list jobs: %w", err)
+	}
+	for _, job := range jobs.Items {
+		if !strings.HasPrefix(job.Name, copyArtifactsJobPrefix) {
+			continue
+		}
+		if job.Annotations[InstallationNameAnnotation] != installation {
+			continue
+		}
+		err := cli.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationForeground))
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("delete job %s: %w", job.Name, err)
+		}
+	}
+	return nil
+}
+
+// deleteArtifactsJobsForRemovedNodes deletes the artifacts jobs of the installation scheduled on
+// nodes that are no longer part of the cluster, their pods would never complete.
+func deleteArtifactsJobsForRemovedNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, nodes []corev1.Node) error {
+	names := map[string]bool{}
+	for _, node := range nodes {
+		names[node.Name] = true
+	}
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs, client.InNamespace(ecNamespace)); err != nil {
+		return fmt.Errorf("list jobs: %w", err)
+	}
+	for _, job := range jobs.Items {
+		if !strings.HasPrefix(job.Name, copyArtifactsJobPrefix) {
+			continue
+		}
+		if job.Annotations[InstallationNameAnnotation] != in.Name || names[job.Spec.Template.Spec.NodeName] {
+			continue
+		}
+		err := cli.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationForeground))
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("delete job %s: %w", job.Name, err)
+		}
+	}
+	return nil
+}
+
 // HashForAirgapConfig generates a hash for the airgap configuration. We can use this to detect config changes between
 // different reconcile cycles.
 func HashForAirgapConfig(in *clusterv1beta1.Installation) (string, error) {
@@ -173,8 +560,8 @@ func HashForAirgapConfig(in *clusterv1beta1.Installation) (string, error) {
 	return hash[:10], nil
 }
 
-func ensureArtifactsJobForNode(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, node corev1.Node, localArtifactMirrorImage, cfghash string) (*batchv1.Job, error) {
-	job, err := getArtifactJobForNode(ctx, cli, in, node, localArtifactMirrorImage)
+func ensureArtifactsJobForNode(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, node corev1.Node, localArtifactMirrorImage, operatorImage, cfghash string, check bool) (*batchv1.Job, error) {
+	job, err := getArtifactJobForNode(ctx, cli, in, node, localArtifactMirrorImage, operatorImage, check)
 	if err != nil {
 		return nil, fmt.Errorf("get job for node: %w", err)
 	}
@@ -188,7 +575,9 @@ func ensureArtifactsJobForNode(ctx context.Context, cli client.Client, in *clust
 			annotations := obj.GetAnnotations()
 			oldjob := annotations[InstallationNameAnnotation] != in.Name
 			newcfg := annotations[ArtifactsConfigHashAnnotation] != cfghash
-			return oldjob || newcfg
+			newkind := annotations[ArtifactsCheckAnnotation] != job.Annotations[ArtifactsCheckAnnotation] ||
+				annotations[ArtifactsLegacyAnnotation] != job.Annotations[ArtifactsLegacyAnnotation]
+			return oldjob || newcfg || newkind
 		}
 	})
 	if err != nil {
@@ -198,7 +587,10 @@ func ensureArtifactsJobForNode(ctx context.Context, cli client.Client, in *clust
 	return job, nil
 }
 
-func getArtifactJobForNode(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, node corev1.Node, localArtifactMirrorImage string) (*batchv1.Job, error) {
+// getArtifactJobForNode returns the copy artifacts job for the node. If check is set the job does
+// not pull the artifacts, it only checks the ones recorded for the node are still there. Without
+// an operator image the legacy job is returned, check is then ignored.
+func getArtifactJobForNode(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, node corev1.Node, localArtifactMirrorImage, operatorImage string, check bool) (*batchv1.Job, error) {
 	hash, err := HashForAirgapConfig(in)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash airgap config: %w", err)
@@ -210,22 +602,122 @@ func getArtifactJobForNode(ctx context.Context, cli client.Client, in *clusterv1
 	}
 	inDataEncoded := base64.StdEncoding.EncodeToString(inData)
 
+	digests, err := ExpectedDigests(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get artifacts digests: %w", err)
+	}
+	digestsData, err := json.Marshal(digests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal artifacts digests: %w", err)
+	}
+
+	if operatorImage == "" {
+		job, err := getLegacyArtifactJobForNode(ctx, cli, in, node, localArtifactMirrorImage, hash, inDataEncoded, digests)
+		if err != nil {
+			return nil, err
+		}
+		return finishArtifactJob(cli, in, job)
+	}
+
 	job := copyArtifactsJob.DeepCopy()
 	job.ObjectMeta.Name = util.NameWithLengthLimit(copyArtifactsJobPrefix, node.Name)
 	job.ObjectMeta.Labels = applyECOperatorLabels(job.ObjectMeta.Labels, "upgrader")
 	job.ObjectMeta.Annotations = applyArtifactsJobAnnotations(job.GetAnnotations(), in, hash)
 	job.Spec.Template.Spec.NodeName = node.Name
+	binaryName := in.Spec.BinaryName
+	if binaryName == "" {
+		binaryName = DefaultBinaryName
+	}
+	for _, kind := range coreArtifactKinds {
+		from := coreArtifactLocation(in.Spec.Artifacts, kind)
+		container := pullCoreArtifactContainer(operatorImage, kind, from, binaryName)
+		if err := mountNodeOCILayouts(&job.Spec.Template.Spec, &container, from); err != nil {
+			return nil, fmt.Errorf("failed to mount %s oci layout: %w", kind, err)
+		}
+		job.Spec.Template.Spec.InitContainers = append(job.Spec.Template.Spec.InitContainers, container)
+	}
+
+	job.Spec.Template.Spec.Containers[0].Image = operatorImage
+	job.Spec.Template.Spec.Containers[0].Args = []string{
+		"artifacts", "place",
+		"--data-dir", "/var/lib/embedded-cluster",
+		"--images-id", imagesID(in, digests),
+		"--digests", string(digestsData),
+	}
+
+	additional, err := AdditionalArtifacts(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get additional artifacts: %w", err)
+	}
+	if len(additional) > 0 {
+		additionalData, err := json.Marshal(additional)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal additional artifacts: %w", err)
+		}
+		container := pullAdditionalArtifactsContainer(operatorImage, string(additionalData))
+		for _, dst := range sortedKeys(additional) {
+			if err := mountNodeOCILayouts(&job.Spec.Template.Spec, &container, additional[dst]); err != nil {
+				return nil, fmt.Errorf("failed to mount %s oci layout: %w", dst, err)
+			}
+		}
+		job.Spec.Template.Spec.InitContainers = append(job.Spec.Template.Spec.InitContainers, container)
+		for _, dst := range sortedKeys(additional) {
+			job.Spec.Template.Spec.Containers[0].Args = append(
+				job.Spec.Template.Spec.Containers[0].Args, "--additional", dst,
+			)
+		}
+	}
+	if InsecureRegistry() {
+		for i := range job.Spec.Template.Spec.InitContainers {
+			container := &job.Spec.Template.Spec.InitContainers[i]
+			container.Env = append(container.Env, corev1.EnvVar{Name: InsecureRegistryEnv, Value: "true"})
+		}
+	}
+	if check {
+		job.ObjectMeta.Annotations[ArtifactsCheckAnnotation] = "true"
+		job.Spec.Template.Spec.InitContainers = nil
+		job.Spec.Template.Spec.Containers[0].Args = append(job.Spec.Template.Spec.Containers[0].Args, "--check")
+	}
+	return finishArtifactJob(cli, in, job)
+}
+
+// getLegacyArtifactJobForNode returns the copy artifacts job for the node when the release
+// metadata does not carry the operator image. The local artifact mirror can't pull the
+// additional artifacts so an error is returned if the installation has any.
+func getLegacyArtifactJobForNode(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, node corev1.Node, localArtifactMirrorImage, hash, inDataEncoded string, digests map[string]string) (*batchv1.Job, error) {
+	additional, err := AdditionalArtifacts(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get additional artifacts: %w", err)
+	}
+	if len(additional) > 0 {
+		return nil, fmt.Errorf("additional artifacts need the operator image, %s not found in release metadata", OperatorImageArtifact)
+	}
+
+	job := legacyCopyArtifactsJob.DeepCopy()
+	job.ObjectMeta.Name = util.NameWithLengthLimit(copyArtifactsJobPrefix, node.Name)
+	job.ObjectMeta.Labels = applyECOperatorLabels(job.ObjectMeta.Labels, "upgrader")
+	job.ObjectMeta.Annotations = applyArtifactsJobAnnotations(job.GetAnnotations(), in, hash)
+	job.ObjectMeta.Annotations[ArtifactsLegacyAnnotation] = "true"
+	job.Spec.Template.Spec.NodeName = node.Name
 	job.Spec.Template.Spec.Containers[0].Env = append(
 		job.Spec.Template.Spec.Containers[0].Env,
 		corev1.EnvVar{Name: "INSTALLATION", Value: in.Name},
 		corev1.EnvVar{Name: "INSTALLATION_DATA", Value: inDataEncoded},
+		corev1.EnvVar{Name: "ARTIFACTS_DIGESTS", Value: digestsCheckList(digests)},
+		corev1.EnvVar{Name: "DIGESTED_FILES", Value: digestedFiles(digests)},
+		corev1.EnvVar{Name: "IMAGES_ID", Value: imagesID(in, digests)},
 	)
-
 	job.Spec.Template.Spec.Containers[0].Image = localArtifactMirrorImage
+	return job, nil
+}
+
+// finishArtifactJob adds to the copy artifacts job the registry pull secret and the reference
+// to the installation owning it.
+func finishArtifactJob(cli client.Client, in *clusterv1beta1.Installation, job *batchv1.Job) (*batchv1.Job, error) {
 	job.Spec.Template.Spec.ImagePullSecrets = append(job.Spec.Template.Spec.ImagePullSecrets, GetRegistryImagePullSecret())
 
 	if in.GetUID() != "" {
-		err = ctrl.SetControllerReference(in, job, cli.Scheme())
+		err := ctrl.SetControllerReference(in, job, cli.Scheme())
 		if err != nil {
 			return nil, fmt.Errorf("failed to set controller reference: %w", err)
 		}
@@ -235,8 +727,13 @@ func getArtifactJobForNode(ctx context.Context, cli client.Client, in *clusterv1
 }
 
 // CreateAutopilotAirgapPlanCommand creates the plan to execute an aigrap upgrade in all nodes. The
-// return of this function is meant to be used as part of an autopilot plan.
+// return of this function is meant to be used as part of an autopilot plan. An error is returned
+// until every node has verified the digests of its artifacts.
 func CreateAutopilotAirgapPlanCommand(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (*autopilotv1beta2.PlanCommand, error) {
+	if err := ensureArtifactsVerified(ctx, cli, in); err != nil {
+		return nil, err
+	}
+
 	meta, err := release.MetadataFor(ctx, in, cli)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get release metadata: %w", err)
@@ -252,7 +749,11 @@ func CreateAutopilotAirgapPlanCommand(ctx context.Context, cli client.Client, in
 		allNodes = append(allNodes, node.Name)
 	}
 
-	imageURL := fmt.Sprintf("http://127.0.0.1:50000/images/images-amd64-%s.tar", in.Name)
+	digests, err := ExpectedDigests(ctx, cli, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get artifacts digests: %w", err)
+	}
+	imageURL := fmt.Sprintf("http://127.0.0.1:50000/%s", imagesTarballFor(imagesID(in, digests)))
 
 	return &autopilotv1beta2.PlanCommand{
 		AirgapUpdate: &autopilotv1beta2.PlanCommandAirgapUpdate{
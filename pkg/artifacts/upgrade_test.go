@@ -8,14 +8,19 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
 	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 )
 
@@ -104,14 +109,16 @@ func TestEnsureArtifactsJobForNodes(t *testing.T) {
 
 				assert.Equal(t, "test-installation", job.ObjectMeta.Annotations[InstallationNameAnnotation])
 				assert.Equal(t, artifactsHash, job.ObjectMeta.Annotations[ArtifactsConfigHashAnnotation])
-				assert.Equal(t, "local-artifact-mirror", job.Spec.Template.Spec.Containers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.InitContainers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.Containers[0].Image)
 
 				err = cli.Get(context.Background(), client.ObjectKey{Namespace: ecNamespace, Name: copyArtifactsJobPrefix + "node2"}, job)
 				require.NoError(t, err)
 
 				assert.Equal(t, "test-installation", job.ObjectMeta.Annotations[InstallationNameAnnotation])
 				assert.Equal(t, artifactsHash, job.ObjectMeta.Annotations[ArtifactsConfigHashAnnotation])
-				assert.Equal(t, "local-artifact-mirror", job.Spec.Template.Spec.Containers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.InitContainers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.Containers[0].Image)
 			},
 		},
 		{
@@ -208,14 +215,16 @@ func TestEnsureArtifactsJobForNodes(t *testing.T) {
 
 				assert.Equal(t, "test-installation", job.ObjectMeta.Annotations[InstallationNameAnnotation])
 				assert.Equal(t, artifactsHash, job.ObjectMeta.Annotations[ArtifactsConfigHashAnnotation])
-				assert.Equal(t, "local-artifact-mirror", job.Spec.Template.Spec.Containers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.InitContainers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.Containers[0].Image)
 
 				err = cli.Get(context.Background(), client.ObjectKey{Namespace: ecNamespace, Name: copyArtifactsJobPrefix + "node2"}, job)
 				require.NoError(t, err)
 
 				assert.Equal(t, "test-installation", job.ObjectMeta.Annotations[InstallationNameAnnotation])
 				assert.Equal(t, artifactsHash, job.ObjectMeta.Annotations[ArtifactsConfigHashAnnotation])
-				assert.Equal(t, "local-artifact-mirror", job.Spec.Template.Spec.Containers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.InitContainers[0].Image)
+				assert.Equal(t, "operator:latest", job.Spec.Template.Spec.Containers[0].Image)
 			},
 		},
 	}
@@ -249,7 +258,9 @@ func TestEnsureArtifactsJobForNodes(t *testing.T) {
 				}()
 			}
 
-			if err := EnsureArtifactsJobForNodes(ctx, cli, tt.args.in, tt.args.localArtifactMirrorImage); (err != nil) != tt.wantErr {
+			if err := EnsureArtifactsJobForNodes(ctx, cli, tt.args.in, tt.args.localArtifactMirrorImage, func(opts *EnsureArtifactsJobOptions) {
+				opts.OperatorImage = "operator:latest"
+			}); (err != nil) != tt.wantErr {
 				t.Errorf("EnsureArtifactsJobForNodes() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
@@ -416,3 +427,231 @@ func TestListArtifactsJobForNodes(t *testing.T) {
 		})
 	}
 }
+
+func TestEnsureArtifactsJobForNodes_maxConcurrent(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-installation"},
+		Spec: clusterv1beta1.InstallationSpec{
+			Artifacts: &clusterv1beta1.ArtifactsLocation{Images: "images"},
+		},
+	}
+	objs := []client.Object{}
+	for _, name := range []string{"node3", "node1", "node2"} {
+		objs = append(objs, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(objs...).Build()
+
+	maxConcurrent := func(opts *EnsureArtifactsJobOptions) { opts.MaxConcurrent = 2 }
+	started := func() []string {
+		jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+		req.NoError(err)
+		nodes := []string{}
+		for node, job := range jobs {
+			if job != nil {
+				nodes = append(nodes, node)
+			}
+		}
+		return nodes
+	}
+
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest", maxConcurrent))
+	req.ElementsMatch([]string{"node1", "node2"}, started())
+
+	// nothing else starts while both jobs are running.
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest", maxConcurrent))
+	req.ElementsMatch([]string{"node1", "node2"}, started())
+
+	// the queued node starts once a job has completed.
+	var job batchv1.Job
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: copyArtifactsJobPrefix + "node1", Namespace: ecNamespace}, &job))
+	job.Status.Succeeded = 1
+	req.NoError(cli.Status().Update(ctx, &job))
+
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest", maxConcurrent))
+	req.ElementsMatch([]string{"node1", "node2", "node3"}, started())
+}
+
+func TestEnsureArtifactsJobForNodes_removedNode(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-installation"},
+		Spec: clusterv1beta1.InstallationSpec{
+			Artifacts: &clusterv1beta1.ArtifactsLocation{Images: "images"},
+		},
+	}
+	node1 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	node2 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(node1, node2).Build()
+
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest"))
+	jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+	req.NoError(err)
+	req.Len(jobs, 2)
+
+	// a node joins and another leaves while the artifacts are being copied.
+	req.NoError(cli.Delete(ctx, node2))
+	req.NoError(cli.Create(ctx, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3"}}))
+
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest"))
+	jobs, err = ListArtifactsJobForNodes(ctx, cli, in)
+	req.NoError(err)
+	req.Len(jobs, 2)
+	req.NotNil(jobs["node1"])
+	req.NotNil(jobs["node3"])
+
+	err = cli.Get(ctx, client.ObjectKey{Name: copyArtifactsJobPrefix + "node2", Namespace: ecNamespace}, &batchv1.Job{})
+	req.True(k8serrors.IsNotFound(err))
+}
+
+func TestEnsureArtifactsJobForNodes_operatorImage(t *testing.T) {
+	release.CacheMeta("1.0.0+operator", ectypes.ReleaseMetadata{
+		Artifacts: map[string]string{
+			OperatorImageArtifact:            "proxy.replicated.com/anonymous/replicated/embedded-cluster-operator-image:1.0.0",
+			ArtifactDigestPrefix + "bin/k0s": "aaa",
+		},
+	})
+	release.CacheMeta("1.0.0+nooperator", ectypes.ReleaseMetadata{
+		Artifacts: map[string]string{
+			ArtifactDigestPrefix + "bin/k0s": "aaa",
+		},
+	})
+
+	tests := []struct {
+		name       string
+		version    string
+		airgap     bool
+		wantImage  string
+		wantLegacy bool
+	}{
+		{
+			name:      "operator image from the release metadata",
+			version:   "1.0.0+operator",
+			wantImage: "proxy.replicated.com/anonymous/replicated/embedded-cluster-operator-image:1.0.0",
+		},
+		{
+			name:      "airgap operator image points to the cluster registry",
+			version:   "1.0.0+operator",
+			airgap:    true,
+			wantImage: "10.96.0.11:5000/anonymous/replicated/embedded-cluster-operator-image:1.0.0",
+		},
+		{
+			name:       "no operator image falls back on the local artifact mirror",
+			version:    "1.0.0+nooperator",
+			wantImage:  "lam:latest",
+			wantLegacy: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			ctx := context.Background()
+			in := &clusterv1beta1.Installation{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-installation"},
+				Spec: clusterv1beta1.InstallationSpec{
+					AirGap:    tt.airgap,
+					Artifacts: &clusterv1beta1.ArtifactsLocation{Images: "images"},
+					Config:    &clusterv1beta1.ConfigSpec{Version: tt.version},
+				},
+			}
+			// the node holds the artifacts but can only be checked with the operator image.
+			held := `{"bin/k0s":"aaa"}`
+			cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+				&k0sv1beta1.ClusterConfig{
+					ObjectMeta: metav1.ObjectMeta{Name: "k0s", Namespace: "kube-system"},
+					Spec:       &k0sv1beta1.ClusterSpec{Network: &k0sv1beta1.Network{ServiceCIDR: "10.96.0.0/12"}},
+				},
+				&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				nodeDigestsConfigMap("node1", held),
+			).Build()
+
+			req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest"))
+			jobs, err := ListArtifactsJobForNodes(ctx, cli, in)
+			req.NoError(err)
+			job := jobs["node1"]
+			req.NotNil(job)
+			req.Equal(tt.wantImage, job.Spec.Template.Spec.Containers[0].Image)
+			req.Equal(tt.wantLegacy, job.Annotations[ArtifactsLegacyAnnotation] == "true")
+			req.Equal(!tt.wantLegacy, isArtifactsCheckJob(job))
+			if tt.wantLegacy {
+				req.Empty(job.Spec.Template.Spec.InitContainers)
+				req.Equal("/bin/sh", job.Spec.Template.Spec.Containers[0].Command[0])
+				return
+			}
+			// the check job is turned into a full copy, the operator pulls the core artifacts.
+			req.NoError(resetArtifactsCheck(ctx, cli, job))
+			req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest"))
+			jobs, err = ListArtifactsJobForNodes(ctx, cli, in)
+			req.NoError(err)
+			pulls := jobs["node1"].Spec.Template.Spec.InitContainers
+			req.Len(pulls, 3)
+			req.Equal("pull-images", pulls[1].Name)
+			req.Equal(tt.wantImage, pulls[1].Image)
+			req.Equal([]string{
+				"artifacts", "pull",
+				"--data-dir", "/var/lib/embedded-cluster",
+				"--kind", "images",
+				"--from", "images",
+				"--binary-name", "embedded-cluster",
+			}, pulls[1].Args)
+		})
+	}
+}
+
+func TestEnsureArtifactsJobForNodes_ociLayout(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-installation"},
+		Spec: clusterv1beta1.InstallationSpec{
+			Artifacts: &clusterv1beta1.ArtifactsLocation{
+				Images:                  OCILayoutScheme + "/var/lib/artifacts/images.tar:1.0.0",
+				HelmCharts:              OCILayoutScheme + "/var/lib/artifacts/charts:1.0.0",
+				EmbeddedClusterBinary:   OCILayoutScheme + "/var/lib/embedded-cluster/layouts/binary:1.0.0",
+				EmbeddedClusterMetadata: OCILayoutScheme + "/var/lib/artifacts/metadata:1.0.0",
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+	).Build()
+	withOperator := func(opts *EnsureArtifactsJobOptions) { opts.OperatorImage = "operator:latest" }
+
+	// the local artifact mirror can't read layouts.
+	err := EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest")
+	req.EqualError(err, `embedded cluster binary location "oci-layout:///var/lib/embedded-cluster/layouts/binary:1.0.0" is an oci layout, the release has no operator image to pull from one on the nodes`)
+	var jobs batchv1.JobList
+	req.NoError(cli.List(ctx, &jobs))
+	req.Empty(jobs.Items)
+
+	// the directory holding the layout is mounted from the node.
+	req.NoError(EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest", withOperator))
+	var job batchv1.Job
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: copyArtifactsJobPrefix + "node1", Namespace: ecNamespace}, &job))
+	pod := job.Spec.Template.Spec
+	req.Len(pod.Volumes, 2)
+	req.Equal("/var/lib/artifacts", pod.Volumes[1].HostPath.Path)
+	mounts := map[string][]string{}
+	for _, container := range pod.InitContainers {
+		for _, mount := range container.VolumeMounts {
+			req.Equal(mount.Name != "host", mount.ReadOnly)
+			mounts[container.Name] = append(mounts[container.Name], mount.MountPath)
+		}
+	}
+	req.Equal(map[string][]string{
+		// the layout within the data directory is reachable through the host volume.
+		"pull-binaries":   {"/var/lib/embedded-cluster"},
+		"pull-images":     {"/var/lib/embedded-cluster", "/var/lib/artifacts"},
+		"pull-helmcharts": {"/var/lib/embedded-cluster", "/var/lib/artifacts"},
+	}, mounts)
+
+	// layouts at the root of the node can't be mounted.
+	in.Spec.Artifacts.Images = OCILayoutScheme + "/images:1.0.0"
+	err = EnsureArtifactsJobForNodes(ctx, cli, in, "lam:latest", withOperator)
+	req.EqualError(err, `images location: oci layout "/images" must be an absolute path outside the root directory`)
+}
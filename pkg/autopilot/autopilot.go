@@ -73,3 +73,46 @@ func HasPlanFailed(plan v1beta2.Plan) bool {
 		return HasThePlanEnded(plan) && !HasPlanSucceeded(plan)
 	}
 }
+
+// HasPlanStartedOnNodes returns true if any of the nodes targeted by the plan has already been
+// signaled to apply it.
+func HasPlanStartedOnNodes(plan v1beta2.Plan) bool {
+	started := func(targets []v1beta2.PlanCommandTargetStatus) bool {
+		for _, target := range targets {
+			if target.State != "" && target.State != core.SignalPending {
+				return true
+			}
+		}
+		return false
+	}
+	for _, cmd := range plan.Status.Commands {
+		if cmd.K0sUpdate != nil && (started(cmd.K0sUpdate.Controllers) || started(cmd.K0sUpdate.Workers)) {
+			return true
+		}
+		if cmd.AirgapUpdate != nil && started(cmd.AirgapUpdate.Workers) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanTargetNodes returns the names of the nodes statically targeted by the commands of the
+// plan.
+func PlanTargetNodes(plan v1beta2.Plan) []string {
+	nodes := []string{}
+	add := func(target v1beta2.PlanCommandTarget) {
+		if target.Discovery.Static != nil {
+			nodes = append(nodes, target.Discovery.Static.Nodes...)
+		}
+	}
+	for _, cmd := range plan.Spec.Commands {
+		if cmd.K0sUpdate != nil {
+			add(cmd.K0sUpdate.Targets.Controllers)
+			add(cmd.K0sUpdate.Targets.Workers)
+		}
+		if cmd.AirgapUpdate != nil {
+			add(cmd.AirgapUpdate.Workers)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,224 @@
+package charts
+
+import (
+	"context"
+	"fmt"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/util"
+)
+
+// adminConsoleProvider handles the admin-console chart.
+type adminConsoleProvider struct {
+	BaseAddonProvider
+}
+
+// DynamicValues sets "embeddedClusterID", "isAirgap", "isHA" and the proxy environment.
+func (p adminConsoleProvider) DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error) {
+	newVals, err := setHelmValue(values, "embeddedClusterID", in.Spec.ClusterID)
+	if err != nil {
+		return "", fmt.Errorf("set helm values admin-console.embeddedClusterID: %w", err)
+	}
+
+	newVals, err = setHelmValue(newVals, "isAirgap", fmt.Sprintf("%t", in.Spec.AirGap))
+	if err != nil {
+		return "", fmt.Errorf("set helm values admin-console.isAirgap: %w", err)
+	}
+
+	newVals, err = setHelmValue(newVals, "isHA", in.Spec.HighAvailability)
+	if err != nil {
+		return "", fmt.Errorf("set helm values admin-console.isHA: %w", err)
+	}
+
+	if in.Spec.Proxy != nil {
+		extraEnv := getExtraEnvFromProxy(in.Spec.Proxy.HTTPProxy, in.Spec.Proxy.HTTPSProxy, in.Spec.Proxy.NoProxy)
+		newVals, err = setHelmValue(newVals, "extraEnv", extraEnv)
+		if err != nil {
+			return "", fmt.Errorf("set helm values admin-console.extraEnv: %w", err)
+		}
+	}
+	return newVals, nil
+}
+
+// operatorProvider handles the embedded-cluster-operator chart.
+type operatorProvider struct {
+	BaseAddonProvider
+}
+
+// DynamicValues sets "embeddedBinaryName", "embeddedClusterID" and the proxy environment.
+func (p operatorProvider) DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error) {
+	newVals, err := setHelmValue(values, "embeddedBinaryName", in.Spec.BinaryName)
+	if err != nil {
+		return "", fmt.Errorf("set helm values embedded-cluster-operator.embeddedBinaryName: %w", err)
+	}
+
+	newVals, err = setHelmValue(newVals, "embeddedClusterID", in.Spec.ClusterID)
+	if err != nil {
+		return "", fmt.Errorf("set helm values embedded-cluster-operator.embeddedClusterID: %w", err)
+	}
+
+	if in.Spec.Proxy != nil {
+		extraEnv := getExtraEnvFromProxy(in.Spec.Proxy.HTTPProxy, in.Spec.Proxy.HTTPSProxy, in.Spec.Proxy.NoProxy)
+		newVals, err = setHelmValue(newVals, "extraEnv", extraEnv)
+		if err != nil {
+			return "", fmt.Errorf("set helm values embedded-cluster-operator.extraEnv: %w", err)
+		}
+	}
+	return newVals, nil
+}
+
+// seaweedfsProvider handles the seaweedfs chart, used as the registry storage in HA airgap
+// installations.
+type seaweedfsProvider struct {
+	BaseAddonProvider
+}
+
+// BuiltinConfig returns the seaweedfs builtin config for HA airgap installations.
+func (p seaweedfsProvider) BuiltinConfig(in *v1beta1.Installation) (string, bool) {
+	return "seaweedfs", in.Spec.AirGap && in.Spec.HighAvailability
+}
+
+// CheckHealth reports seaweedfs as not ready until its chart has been deployed in HA airgap
+// installations.
+func (p seaweedfsProvider) CheckHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	if !in.Spec.AirGap || !in.Spec.HighAvailability {
+		return nil
+	}
+	return checkChartHealth(ctx, cli, p.Name)
+}
+
+// registryProvider handles the docker-registry chart, deployed in airgap installations.
+type registryProvider struct {
+	BaseAddonProvider
+}
+
+// RequiredSecrets returns the seaweedfs s3 credentials once the HA registry, which stores its
+// data in seaweedfs, is deployed.
+func (p registryProvider) RequiredSecrets(in *v1beta1.Installation) []types.NamespacedName {
+	if name, ok := p.BuiltinConfig(in); !ok || name != "registry-ha" {
+		return nil
+	}
+	return []types.NamespacedName{{Namespace: registry.RegistryNamespace(), Name: registry.RegistryS3SecretName}}
+}
+
+// CheckHealth reports the registry as not ready until its chart has been deployed in airgap
+// installations.
+func (p registryProvider) CheckHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	if !in.Spec.AirGap {
+		return nil
+	}
+	return checkChartHealth(ctx, cli, p.Name)
+}
+
+// BuiltinConfig returns the registry builtin config for airgap installations. In HA installations
+// the HA registry is only deployed once the registry data has been migrated to seaweedfs.
+func (p registryProvider) BuiltinConfig(in *v1beta1.Installation) (string, bool) {
+	if !in.Spec.AirGap {
+		return "", false
+	}
+	if !in.Spec.HighAvailability {
+		return "registry", true
+	}
+	migrationStatus := k8sutil.CheckConditionStatus(in.Status, registry.RegistryMigrationStatusConditionType)
+	return "registry-ha", migrationStatus == metav1.ConditionTrue
+}
+
+// DynamicValues sets the registry service IP, the seaweedfs endpoint in HA installations and
+// the tls secret if it exists.
+func (p registryProvider) DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error) {
+	if !in.Spec.AirGap {
+		return values, nil
+	}
+
+	// handle the registry IP, which will always be present in airgap
+	serviceCIDR := util.ClusterServiceCIDR(*clusterConfig, in)
+	registryEndpoint, err := registry.GetRegistryServiceIP(serviceCIDR)
+	if err != nil {
+		return "", fmt.Errorf("get registry service IP: %w", err)
+	}
+
+	newVals, err := setHelmValue(values, "service.clusterIP", registryEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("set helm values docker-registry.service.clusterIP: %w", err)
+	}
+
+	if cli != nil {
+		var secret corev1.Secret
+		nsn := client.ObjectKey{Namespace: "registry", Name: "registry-tls"}
+		if err := cli.Get(ctx, nsn, &secret); err == nil {
+			newVals, err = setHelmValue(newVals, "tlsSecretName", nsn.Name)
+			if err != nil {
+				return "", fmt.Errorf("set helm values docker-registry.tlsSecretName: %w", err)
+			}
+		} else if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("get registry tls secret: %w", err)
+		}
+	}
+
+	if !in.Spec.HighAvailability {
+		return newVals, nil
+	}
+
+	// handle the seaweedFS endpoint, which will only be present in HA airgap
+	seaweedfsS3Endpoint, err := registry.GetSeaweedfsS3Endpoint(serviceCIDR)
+	if err != nil {
+		return "", fmt.Errorf("get seaweedfs s3 endpoint: %w", err)
+	}
+
+	newVals, err = setHelmValue(newVals, "s3.regionEndpoint", seaweedfsS3Endpoint)
+	if err != nil {
+		return "", fmt.Errorf("set helm values docker-registry.s3.regionEndpoint: %w", err)
+	}
+	return newVals, nil
+}
+
+// veleroProvider handles the velero chart, deployed when disaster recovery is supported.
+type veleroProvider struct {
+	BaseAddonProvider
+}
+
+// BuiltinConfig returns the velero builtin config if the license supports disaster recovery.
+func (p veleroProvider) BuiltinConfig(in *v1beta1.Installation) (string, bool) {
+	return "velero", in.Spec.LicenseInfo != nil && in.Spec.LicenseInfo.IsDisasterRecoverySupported
+}
+
+// DynamicValues sets the proxy environment.
+func (p veleroProvider) DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error) {
+	if in.Spec.Proxy == nil {
+		return values, nil
+	}
+	extraEnvVars := map[string]interface{}{
+		"extraEnvVars": map[string]string{
+			"HTTP_PROXY":  in.Spec.Proxy.HTTPProxy,
+			"HTTPS_PROXY": in.Spec.Proxy.HTTPSProxy,
+			"NO_PROXY":    in.Spec.Proxy.NoProxy,
+		},
+	}
+	newVals, err := setHelmValue(values, "configuration", extraEnvVars)
+	if err != nil {
+		return "", fmt.Errorf("set helm values velero.configuration: %w", err)
+	}
+	return newVals, nil
+}
+
+// checkChartHealth returns an error wrapping ErrAddonNotReady if the k0s chart has not been
+// deployed with its current version and values.
+func checkChartHealth(ctx context.Context, cli client.Client, chartName string) error {
+	ready, err := k8sutil.GetChartHealth(ctx, cli, chartName)
+	if err != nil {
+		return fmt.Errorf("check chart health: %w", err)
+	}
+	if !ready {
+		return fmt.Errorf("chart %s: %w", chartName, ErrAddonNotReady)
+	}
+	return nil
+}
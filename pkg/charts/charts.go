@@ -9,14 +9,11 @@ import (
 	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
 	"github.com/ohler55/ojg/jp"
 	"gopkg.in/yaml.v2"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
 	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
 	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
-	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
-	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
-	"github.com/replicatedhq/embedded-cluster-operator/pkg/util"
 )
 
 const (
@@ -27,10 +24,10 @@ const (
 // merging in the default charts and repositories from the release metadata with the user-provided
 // charts and repositories from the installation spec.
 func K0sHelmExtensionsFromInstallation(
-	ctx context.Context, in *clusterv1beta1.Installation,
+	ctx context.Context, cli client.Client, in *clusterv1beta1.Installation,
 	metadata *ectypes.ReleaseMetadata, clusterConfig *k0sv1beta1.ClusterConfig,
 ) (*v1beta1.Helm, error) {
-	combinedConfigs, err := mergeHelmConfigs(ctx, metadata, in, clusterConfig)
+	combinedConfigs, err := mergeHelmConfigs(ctx, cli, metadata, in, clusterConfig)
 	if err != nil {
 		return nil, fmt.Errorf("merge helm configs: %w", err)
 	}
@@ -51,7 +48,7 @@ func K0sHelmExtensionsFromInstallation(
 }
 
 // merge the default helm charts and repositories (from meta.Configs) with vendor helm charts (from in.Spec.Config.Extensions.Helm)
-func mergeHelmConfigs(ctx context.Context, meta *ectypes.ReleaseMetadata, in *clusterv1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig) (*v1beta1.Helm, error) {
+func mergeHelmConfigs(ctx context.Context, cli client.Client, meta *ectypes.ReleaseMetadata, in *clusterv1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig) (*v1beta1.Helm, error) {
 	// merge default helm charts (from meta.Configs) with vendor helm charts (from in.Spec.Config.Extensions.Helm)
 	combinedConfigs := &v1beta1.Helm{ConcurrencyLevel: 1}
 	if meta != nil {
@@ -76,42 +73,24 @@ func mergeHelmConfigs(ctx context.Context, meta *ectypes.ReleaseMetadata, in *cl
 		combinedConfigs.Repositories = append(combinedConfigs.Repositories, in.Spec.Config.Extensions.Helm.Repositories...)
 	}
 
-	if in != nil && in.Spec.AirGap {
-		if in.Spec.HighAvailability {
-			seaweedfsConfig, ok := meta.BuiltinConfigs["seaweedfs"]
-			if ok {
-				combinedConfigs.Charts = append(combinedConfigs.Charts, seaweedfsConfig.Charts...)
-				combinedConfigs.Repositories = append(combinedConfigs.Repositories, seaweedfsConfig.Repositories...)
-			}
-
-			migrationStatus := k8sutil.CheckConditionStatus(in.Status, registry.RegistryMigrationStatusConditionType)
-			if migrationStatus == metav1.ConditionTrue {
-				registryConfig, ok := meta.BuiltinConfigs["registry-ha"]
-				if ok {
-					combinedConfigs.Charts = append(combinedConfigs.Charts, registryConfig.Charts...)
-					combinedConfigs.Repositories = append(combinedConfigs.Repositories, registryConfig.Repositories...)
-				}
+	// append the builtin charts required by the installation
+	if in != nil && meta != nil {
+		for _, p := range AddonProviders() {
+			name, ok := p.BuiltinConfig(in)
+			if !ok {
+				continue
 			}
-		} else {
-			registryConfig, ok := meta.BuiltinConfigs["registry"]
+			config, ok := meta.BuiltinConfigs[name]
 			if ok {
-				combinedConfigs.Charts = append(combinedConfigs.Charts, registryConfig.Charts...)
-				combinedConfigs.Repositories = append(combinedConfigs.Repositories, registryConfig.Repositories...)
+				combinedConfigs.Charts = append(combinedConfigs.Charts, config.Charts...)
+				combinedConfigs.Repositories = append(combinedConfigs.Repositories, config.Repositories...)
 			}
 		}
 	}
 
-	if in != nil && in.Spec.LicenseInfo != nil && in.Spec.LicenseInfo.IsDisasterRecoverySupported {
-		config, ok := meta.BuiltinConfigs["velero"]
-		if ok {
-			combinedConfigs.Charts = append(combinedConfigs.Charts, config.Charts...)
-			combinedConfigs.Repositories = append(combinedConfigs.Repositories, config.Repositories...)
-		}
-	}
-
 	// update the infrastructure charts from the install spec
 	var err error
-	combinedConfigs.Charts, err = updateInfraChartsFromInstall(in, clusterConfig, combinedConfigs.Charts)
+	combinedConfigs.Charts, err = updateInfraChartsFromInstall(ctx, cli, in, clusterConfig, combinedConfigs.Charts)
 	if err != nil {
 		return nil, fmt.Errorf("update infrastructure charts from install: %w", err)
 	}
@@ -125,110 +104,22 @@ func mergeHelmConfigs(ctx context.Context, meta *ectypes.ReleaseMetadata, in *cl
 	return combinedConfigs, nil
 }
 
-// updateInfraChartsFromInstall updates the infrastructure charts with dynamic values from the installation spec
-func updateInfraChartsFromInstall(in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, charts []v1beta1.Chart) ([]v1beta1.Chart, error) {
+// updateInfraChartsFromInstall updates the infrastructure charts with dynamic values from the
+// installation spec. The values are provided by the addon provider registered for each chart.
+func updateInfraChartsFromInstall(
+	ctx context.Context, cli client.Client, in *v1beta1.Installation,
+	clusterConfig *k0sv1beta1.ClusterConfig, charts []v1beta1.Chart,
+) ([]v1beta1.Chart, error) {
 	for i, chart := range charts {
-		if chart.Name == "admin-console" {
-			// admin-console has "embeddedClusterID" and "isAirgap" as dynamic values
-			newVals, err := setHelmValue(chart.Values, "embeddedClusterID", in.Spec.ClusterID)
-			if err != nil {
-				return nil, fmt.Errorf("set helm values admin-console.embeddedClusterID: %w", err)
-			}
-
-			newVals, err = setHelmValue(newVals, "isAirgap", fmt.Sprintf("%t", in.Spec.AirGap))
-			if err != nil {
-				return nil, fmt.Errorf("set helm values admin-console.isAirgap: %w", err)
-			}
-
-			newVals, err = setHelmValue(newVals, "isHA", in.Spec.HighAvailability)
-			if err != nil {
-				return nil, fmt.Errorf("set helm values admin-console.isHA: %w", err)
-			}
-
-			if in.Spec.Proxy != nil {
-				extraEnv := getExtraEnvFromProxy(in.Spec.Proxy.HTTPProxy, in.Spec.Proxy.HTTPSProxy, in.Spec.Proxy.NoProxy)
-				newVals, err = setHelmValue(newVals, "extraEnv", extraEnv)
-				if err != nil {
-					return nil, fmt.Errorf("set helm values admin-console.extraEnv: %w", err)
-				}
-			}
-
-			charts[i].Values = newVals
-		}
-		if chart.Name == "embedded-cluster-operator" {
-			// embedded-cluster-operator has "embeddedBinaryName" and "embeddedClusterID" as dynamic values
-			newVals, err := setHelmValue(chart.Values, "embeddedBinaryName", in.Spec.BinaryName)
-			if err != nil {
-				return nil, fmt.Errorf("set helm values embedded-cluster-operator.embeddedBinaryName: %w", err)
-			}
-
-			newVals, err = setHelmValue(newVals, "embeddedClusterID", in.Spec.ClusterID)
-			if err != nil {
-				return nil, fmt.Errorf("set helm values embedded-cluster-operator.embeddedClusterID: %w", err)
-			}
-
-			if in.Spec.Proxy != nil {
-				extraEnv := getExtraEnvFromProxy(in.Spec.Proxy.HTTPProxy, in.Spec.Proxy.HTTPSProxy, in.Spec.Proxy.NoProxy)
-				newVals, err = setHelmValue(newVals, "extraEnv", extraEnv)
-				if err != nil {
-					return nil, fmt.Errorf("set helm values embedded-cluster-operator.extraEnv: %w", err)
-				}
-			}
-
-			charts[i].Values = newVals
-		}
-		if chart.Name == "docker-registry" {
-			if !in.Spec.AirGap {
-				continue
-			}
-
-			// handle the registry IP, which will always be present in airgap
-			serviceCIDR := util.ClusterServiceCIDR(*clusterConfig, in)
-			registryEndpoint, err := registry.GetRegistryServiceIP(serviceCIDR)
-			if err != nil {
-				return nil, fmt.Errorf("get registry service IP: %w", err)
-			}
-
-			newVals, err := setHelmValue(chart.Values, "service.clusterIP", registryEndpoint)
-			if err != nil {
-				return nil, fmt.Errorf("set helm values docker-registry.service.clusterIP: %w", err)
-			}
-			charts[i].Values = newVals
-
-			if !in.Spec.HighAvailability {
-				continue
-			}
-
-			// handle the seaweedFS endpoint, which will only be present in HA airgap
-			seaweedfsS3Endpoint, err := registry.GetSeaweedfsS3Endpoint(serviceCIDR)
-			if err != nil {
-				return nil, fmt.Errorf("get seaweedfs s3 endpoint: %w", err)
-			}
-
-			newVals, err = setHelmValue(newVals, "s3.regionEndpoint", seaweedfsS3Endpoint)
-			if err != nil {
-				return nil, fmt.Errorf("set helm values docker-registry.s3.regionEndpoint: %w", err)
-			}
-
-			charts[i].Values = newVals
+		p, ok := AddonProviderFor(chart.Name)
+		if !ok {
+			continue
 		}
-		if chart.Name == "velero" {
-			if in.Spec.Proxy != nil {
-				extraEnvVars := map[string]interface{}{
-					"extraEnvVars": map[string]string{
-						"HTTP_PROXY":  in.Spec.Proxy.HTTPProxy,
-						"HTTPS_PROXY": in.Spec.Proxy.HTTPSProxy,
-						"NO_PROXY":    in.Spec.Proxy.NoProxy,
-					},
-				}
-
-				newVals, err := setHelmValue(chart.Values, "configuration", extraEnvVars)
-				if err != nil {
-					return nil, fmt.Errorf("set helm values velero.configuration: %w", err)
-				}
-				charts[i].Values = newVals
-			}
+		newVals, err := p.DynamicValues(ctx, cli, in, clusterConfig, chart.Values)
+		if err != nil {
+			return nil, fmt.Errorf("set dynamic values for chart %s: %w", chart.Name, err)
 		}
+		charts[i].Values = newVals
 	}
 	return charts, nil
 }
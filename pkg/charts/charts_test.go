@@ -10,6 +10,7 @@ import (
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
 	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func Test_mergeHelmConfigs(t *testing.T) {
@@ -464,7 +465,7 @@ func Test_mergeHelmConfigs(t *testing.T) {
 			}
 
 			req := require.New(t)
-			got, err := mergeHelmConfigs(context.TODO(), tt.args.meta, &installation, &tt.args.clusterConfig)
+			got, err := mergeHelmConfigs(context.TODO(), fake.NewClientBuilder().Build(), tt.args.meta, &installation, &tt.args.clusterConfig)
 			req.NoError(err)
 			req.Equal(tt.want, got)
 		})
@@ -904,7 +905,7 @@ secrets:
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := require.New(t)
-			got, err := updateInfraChartsFromInstall(tt.args.in, &tt.args.clusterConfig, tt.args.charts)
+			got, err := updateInfraChartsFromInstall(context.TODO(), fake.NewClientBuilder().Build(), tt.args.in, &tt.args.clusterConfig, tt.args.charts)
 			req.NoError(err)
 			req.ElementsMatch(tt.want, got)
 		})
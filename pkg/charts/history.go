@@ -0,0 +1,267 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/pmezard/go-difflib/difflib"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// HistoryLabel flags the config maps holding a chart history record.
+	HistoryLabel = "embedded-cluster.replicated.com/chart-history"
+	// HistoryInstallationLabel holds the name of the installation a history record belongs to.
+	HistoryInstallationLabel = "embedded-cluster.replicated.com/installation"
+
+	historyNamespace       = "embedded-cluster"
+	historyInstallationKey = "installation"
+	historyTimeKey         = "time"
+	historyChartsKey       = "charts"
+	historyErrorsKey       = "errors"
+	historyDiffKeyPrefix   = "diff."
+)
+
+// HistoryRetention is the maximum number of history records kept in the cluster. Older records
+// are removed as new ones are written.
+var HistoryRetention = 20
+
+var (
+	// historyMaxDiffsSize is the space shared by the diffs of a history record. Config maps are
+	// limited to 1MiB, some room is left for the keys and the rest of the record.
+	historyMaxDiffsSize = 768 << 10
+	// historyMaxErrorsSize is the space available to the chart errors of a history record.
+	historyMaxErrorsSize = 128 << 10
+)
+
+// HistoryRecord describes a change to the helm charts in the cluster config. Records are stored
+// in config maps so they survive the truncation of the installation status and can be inspected
+// after the fact.
+type HistoryRecord struct {
+	// Name is the name of the config map holding the record.
+	Name         string
+	Installation string
+	Time         time.Time
+	// Charts holds the names of the charts that changed.
+	Charts []string
+	// Diffs holds a unified diff of the values for each of the changed charts.
+	Diffs map[string]string
+	// Errors holds the full text of the chart errors seen after the change, if any.
+	Errors string
+}
+
+// ValuesDiffs returns a unified diff of the values of each of the provided charts between the
+// before and after helm extensions. Charts missing on either side are diffed against empty values.
+func ValuesDiffs(before, after *k0sv1beta1.HelmExtensions, chartNames []string) (map[string]string, error) {
+	find := func(ext *k0sv1beta1.HelmExtensions, name string) (string, string) {
+		if ext == nil {
+			return "", ""
+		}
+		for _, chart := range ext.Charts {
+			if chart.Name == name {
+				return chart.Version, chart.Values
+			}
+		}
+		return "", ""
+	}
+
+	diffs := map[string]string{}
+	for _, name := range chartNames {
+		fromVersion, fromValues := find(before, name)
+		toVersion, toValues := find(after, name)
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitValuesLines(fromValues),
+			B:        splitValuesLines(toValues),
+			FromFile: fmt.Sprintf("%s@%s", name, fromVersion),
+			ToFile:   fmt.Sprintf("%s@%s", name, toVersion),
+			Context:  3,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("diff values of chart %s: %w", name, err)
+		}
+		if diff == "" && fromVersion != toVersion {
+			diff = fmt.Sprintf("--- %s@%s\n+++ %s@%s\n", name, fromVersion, name, toVersion)
+		}
+		diffs[name] = diff
+	}
+	return diffs, nil
+}
+
+// splitValuesLines splits the values in lines, each one of them terminated by a new line.
+func splitValuesLines(values string) []string {
+	if values == "" {
+		return nil
+	}
+	if !strings.HasSuffix(values, "\n") {
+		values += "\n"
+	}
+	lines := strings.SplitAfter(values, "\n")
+	return lines[:len(lines)-1]
+}
+
+// truncateHistoryValue shortens the value to at most max bytes, cutting it at the end of a line
+// when possible and noting how much was left out.
+func truncateHistoryValue(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	marker := fmt.Sprintf("\n... %d bytes truncated\n", len(value))
+	cut := max - len(marker)
+	if cut <= 0 {
+		return marker[1:]
+	}
+	if i := strings.LastIndexByte(value[:cut], '\n'); i > 0 {
+		cut = i
+	}
+	// never split a multi byte character.
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + marker
+}
+
+// RecordHistory writes a new history record to the cluster and removes the records exceeding
+// the retention limit. The record name and time are set on the provided record. Diffs and errors
+// are truncated so the record fits in a config map, the space is shared equally by the diffs.
+func RecordHistory(ctx context.Context, cli client.Client, rec *HistoryRecord) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Name = fmt.Sprintf("chart-history-%d", rec.Time.UnixMilli())
+
+	charts, err := json.Marshal(rec.Charts)
+	if err != nil {
+		return fmt.Errorf("marshal changed charts: %w", err)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      rec.Name,
+			Namespace: historyNamespace,
+			Labels: map[string]string{
+				HistoryLabel:             "true",
+				HistoryInstallationLabel: rec.Installation,
+			},
+		},
+		Data: map[string]string{
+			historyInstallationKey: rec.Installation,
+			historyTimeKey:         rec.Time.UTC().Format(time.RFC3339Nano),
+			historyChartsKey:       string(charts),
+			historyErrorsKey:       truncateHistoryValue(rec.Errors, historyMaxErrorsSize),
+		},
+	}
+	for name, diff := range rec.Diffs {
+		cm.Data[historyDiffKeyPrefix+name] = truncateHistoryValue(diff, historyMaxDiffsSize/len(rec.Diffs))
+	}
+	if err := cli.Create(ctx, cm); err != nil {
+		return fmt.Errorf("create history record: %w", err)
+	}
+
+	records, err := ListHistory(ctx, cli, "")
+	if err != nil {
+		return fmt.Errorf("list history records: %w", err)
+	}
+	for len(records) > HistoryRetention {
+		stale := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: records[0].Name, Namespace: historyNamespace},
+		}
+		if err := cli.Delete(ctx, stale); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("delete history record %s: %w", stale.Name, err)
+		}
+		records = records[1:]
+	}
+	return nil
+}
+
+// RecordHistoryErrors stores the full chart errors, truncated only if they don't fit in the
+// record, in the most recent history record for the installation. Nothing is done if there is
+// no record for the installation or if the record already holds the same errors.
+func RecordHistoryErrors(ctx context.Context, cli client.Client, installation, errors string) error {
+	errors = truncateHistoryValue(errors, historyMaxErrorsSize)
+	records, err := ListHistory(ctx, cli, installation)
+	if err != nil {
+		return fmt.Errorf("list history records: %w", err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	latest := records[len(records)-1]
+	if latest.Errors == errors {
+		return nil
+	}
+
+	var cm corev1.ConfigMap
+	nsn := client.ObjectKey{Name: latest.Name, Namespace: historyNamespace}
+	if err := cli.Get(ctx, nsn, &cm); err != nil {
+		return fmt.Errorf("get history record %s: %w", latest.Name, err)
+	}
+	patch := client.MergeFrom(cm.DeepCopy())
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[historyErrorsKey] = errors
+	if err := cli.Patch(ctx, &cm, patch); err != nil {
+		return fmt.Errorf("patch history record %s: %w", latest.Name, err)
+	}
+	return nil
+}
+
+// ListHistory returns the history records for the given installation, or for all installations
+// if none is provided, sorted from the oldest to the most recent.
+func ListHistory(ctx context.Context, cli client.Client, installation string) ([]HistoryRecord, error) {
+	labels := client.MatchingLabels{HistoryLabel: "true"}
+	if installation != "" {
+		labels[HistoryInstallationLabel] = installation
+	}
+	var cms corev1.ConfigMapList
+	if err := cli.List(ctx, &cms, client.InNamespace(historyNamespace), labels); err != nil {
+		return nil, fmt.Errorf("list config maps: %w", err)
+	}
+
+	records := []HistoryRecord{}
+	for _, cm := range cms.Items {
+		rec, err := historyRecordFromConfigMap(cm)
+		if err != nil {
+			return nil, fmt.Errorf("parse history record %s: %w", cm.Name, err)
+		}
+		records = append(records, rec)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+func historyRecordFromConfigMap(cm corev1.ConfigMap) (HistoryRecord, error) {
+	rec := HistoryRecord{
+		Name:         cm.Name,
+		Installation: cm.Data[historyInstallationKey],
+		Errors:       cm.Data[historyErrorsKey],
+		Diffs:        map[string]string{},
+	}
+	if raw := cm.Data[historyTimeKey]; raw != "" {
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return rec, fmt.Errorf("parse time: %w", err)
+		}
+		rec.Time = t
+	}
+	if raw := cm.Data[historyChartsKey]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &rec.Charts); err != nil {
+			return rec, fmt.Errorf("parse changed charts: %w", err)
+		}
+	}
+	for key, value := range cm.Data {
+		if name, ok := strings.CutPrefix(key, historyDiffKeyPrefix); ok {
+			rec.Diffs[name] = value
+		}
+	}
+	return rec, nil
+}
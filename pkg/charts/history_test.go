@@ -0,0 +1,140 @@
+package charts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestValuesDiffs(t *testing.T) {
+	before := &k0sv1beta1.HelmExtensions{
+		Charts: []k0sv1beta1.Chart{
+			{Name: "changed", Version: "1.0.0", Values: "abc: xyz\nreplicas: 1\n"},
+			{Name: "bumped", Version: "1.0.0", Values: "abc: xyz\n"},
+		},
+	}
+	after := &k0sv1beta1.HelmExtensions{
+		Charts: []k0sv1beta1.Chart{
+			{Name: "changed", Version: "1.0.0", Values: "abc: xyz\nreplicas: 2\n"},
+			{Name: "bumped", Version: "1.1.0", Values: "abc: xyz\n"},
+			{Name: "added", Version: "2.0.0", Values: "new: value\n"},
+		},
+	}
+
+	diffs, err := ValuesDiffs(before, after, []string{"added", "bumped", "changed"})
+	require.NoError(t, err)
+	require.Equal(t, "--- changed@1.0.0\n+++ changed@1.0.0\n@@ -1,2 +1,2 @@\n abc: xyz\n-replicas: 1\n+replicas: 2\n", diffs["changed"])
+	require.Equal(t, "--- bumped@1.0.0\n+++ bumped@1.1.0\n", diffs["bumped"])
+	require.Contains(t, diffs["added"], "+new: value\n")
+}
+
+func TestRecordHistory(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().Build()
+
+	oldRetention := HistoryRetention
+	HistoryRetention = 2
+	defer func() { HistoryRetention = oldRetention }()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		rec := &HistoryRecord{
+			Installation: "install",
+			Time:         start.Add(time.Duration(i) * time.Second),
+			Charts:       []string{"chart"},
+			Diffs:        map[string]string{"chart": "diff"},
+		}
+		req.NoError(RecordHistory(ctx, cli, rec))
+	}
+
+	records, err := ListHistory(ctx, cli, "install")
+	req.NoError(err)
+	req.Len(records, 2)
+	req.True(records[0].Time.Equal(start.Add(time.Second)))
+	req.Equal([]string{"chart"}, records[1].Charts)
+	req.Equal(map[string]string{"chart": "diff"}, records[1].Diffs)
+
+	// errors longer than what fits in the installation status are kept in full.
+	errors := strings.Repeat("x", 2048)
+	req.NoError(RecordHistoryErrors(ctx, cli, "install", errors))
+	req.NoError(RecordHistoryErrors(ctx, cli, "other", "ignored"))
+
+	records, err = ListHistory(ctx, cli, "")
+	req.NoError(err)
+	req.Len(records, 2)
+	req.Empty(records[0].Errors)
+	req.Equal(errors, records[1].Errors)
+}
+
+func TestRecordHistory_sizeLimit(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().Build()
+
+	// a values change large enough to overflow a config map on its own.
+	var before, after strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&before, "key%d: before\n", i)
+		fmt.Fprintf(&after, "key%d: after\n", i)
+	}
+	diffs, err := ValuesDiffs(
+		&k0sv1beta1.HelmExtensions{Charts: []k0sv1beta1.Chart{{Name: "a", Values: before.String()}, {Name: "b", Values: before.String()}}},
+		&k0sv1beta1.HelmExtensions{Charts: []k0sv1beta1.Chart{{Name: "a", Values: after.String()}, {Name: "b", Values: after.String()}}},
+		[]string{"a", "b"},
+	)
+	req.NoError(err)
+	req.Greater(len(diffs["a"]), 1<<20)
+
+	rec := &HistoryRecord{Installation: "install", Charts: []string{"a", "b"}, Diffs: diffs}
+	req.NoError(RecordHistory(ctx, cli, rec))
+	req.NoError(RecordHistoryErrors(ctx, cli, "install", strings.Repeat("é", 1<<20)))
+
+	var cm corev1.ConfigMap
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: rec.Name, Namespace: historyNamespace}, &cm))
+	size := 0
+	for key, value := range cm.Data {
+		size += len(key) + len(value)
+		req.True(utf8.ValidString(value), "key %s is not valid utf-8", key)
+	}
+	req.LessOrEqual(size, 1<<20)
+
+	records, err := ListHistory(ctx, cli, "install")
+	req.NoError(err)
+	req.Len(records, 1)
+	for _, name := range []string{"a", "b"} {
+		diff := records[0].Diffs[name]
+		req.LessOrEqual(len(diff), historyMaxDiffsSize/2)
+		req.True(strings.HasPrefix(diff, fmt.Sprintf("--- %s@\n+++ %s@\n", name, name)))
+		req.True(strings.HasSuffix(diff, fmt.Sprintf("\n... %d bytes truncated\n", len(diffs[name]))))
+	}
+	req.LessOrEqual(len(records[0].Errors), historyMaxErrorsSize)
+	req.Contains(records[0].Errors, "bytes truncated")
+}
+
+func Test_truncateHistoryValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		max   int
+		want  string
+	}{
+		{name: "fits", value: "abc\n", max: 4, want: "abc\n"},
+		{name: "cut at line", value: "line one\nline two\nline three\nline four\n", max: 38, want: "line one\n... 39 bytes truncated\n"},
+		{name: "no room", value: "abcdef", max: 3, want: "... 6 bytes truncated\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, truncateHistoryValue(tt.value, tt.max))
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package charts
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"sync"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AddonProvider holds the addon specific logic for a given helm chart. Providers are registered
+// in process through RegisterAddonProvider and are looked up by chart name.
+type AddonProvider interface {
+	// ChartName returns the name of the chart handled by the provider.
+	ChartName() string
+	// BuiltinConfig returns the name of the builtin config, from the release metadata, that
+	// must be deployed for the installation. Returns false if no builtin config is needed.
+	BuiltinConfig(in *v1beta1.Installation) (string, bool)
+	// DynamicValues returns the chart values with the values that depend on the installation
+	// and the cluster applied.
+	DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error)
+	// RequiredSecrets returns the secrets that must exist before the chart is deployed.
+	RequiredSecrets(in *v1beta1.Installation) []types.NamespacedName
+	// CheckHealth returns an error if the addon is not healthy. It is called once the chart
+	// has been deployed. Errors wrapping ErrAddonNotReady mean the addon is not ready yet.
+	CheckHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation) error
+	// OnRemove is called before the chart is removed from the cluster.
+	OnRemove(ctx context.Context, cli client.Client, in *v1beta1.Installation) error
+}
+
+// ErrAddonNotReady is wrapped by the errors returned by the health checks of addons that are not
+// ready yet, as opposed to the checks that could not be run.
+var ErrAddonNotReady = goerrors.New("not ready")
+
+// BaseAddonProvider implements AddonProvider without any addon specific logic. It is meant to
+// be embedded by providers so they only need to implement what they need.
+type BaseAddonProvider struct {
+	Name string
+}
+
+// ChartName returns the name of the chart handled by the provider.
+func (p BaseAddonProvider) ChartName() string {
+	return p.Name
+}
+
+// BuiltinConfig returns false, no builtin config is needed.
+func (p BaseAddonProvider) BuiltinConfig(in *v1beta1.Installation) (string, bool) {
+	return "", false
+}
+
+// DynamicValues returns the values unchanged.
+func (p BaseAddonProvider) DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error) {
+	return values, nil
+}
+
+// RequiredSecrets returns no secrets.
+func (p BaseAddonProvider) RequiredSecrets(in *v1beta1.Installation) []types.NamespacedName {
+	return nil
+}
+
+// CheckHealth always reports the addon as healthy.
+func (p BaseAddonProvider) CheckHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	return nil
+}
+
+// OnRemove does nothing.
+func (p BaseAddonProvider) OnRemove(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	return nil
+}
+
+var (
+	providers      = map[string]AddonProvider{}
+	providersOrder = []string{}
+	providersMutex = sync.RWMutex{}
+)
+
+func init() {
+	RegisterAddonProvider(adminConsoleProvider{BaseAddonProvider{Name: "admin-console"}})
+	RegisterAddonProvider(operatorProvider{BaseAddonProvider{Name: "embedded-cluster-operator"}})
+	RegisterAddonProvider(seaweedfsProvider{BaseAddonProvider{Name: "seaweedfs"}})
+	RegisterAddonProvider(registryProvider{BaseAddonProvider{Name: "docker-registry"}})
+	RegisterAddonProvider(veleroProvider{BaseAddonProvider{Name: "velero"}})
+}
+
+// RegisterAddonProvider registers a provider for its chart, replacing any provider previously
+// registered for the same chart. Providers are evaluated in the order they are registered.
+func RegisterAddonProvider(p AddonProvider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	if _, ok := providers[p.ChartName()]; !ok {
+		providersOrder = append(providersOrder, p.ChartName())
+	}
+	providers[p.ChartName()] = p
+}
+
+// AddonProviderFor returns the provider registered for the given chart.
+func AddonProviderFor(chartName string) (AddonProvider, bool) {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+	p, ok := providers[chartName]
+	return p, ok
+}
+
+// AddonProviders returns all registered providers in the order they have been registered.
+func AddonProviders() []AddonProvider {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+	result := make([]AddonProvider, 0, len(providersOrder))
+	for _, name := range providersOrder {
+		result = append(result, providers[name])
+	}
+	return result
+}
+
+// MissingAddonSecrets returns the secrets required by the providers of the given charts that
+// do not exist in the cluster.
+func MissingAddonSecrets(ctx context.Context, cli client.Client, in *v1beta1.Installation, ext *k0sv1beta1.HelmExtensions) ([]string, error) {
+	missing := []string{}
+	for _, chart := range ext.Charts {
+		p, ok := AddonProviderFor(chart.Name)
+		if !ok {
+			continue
+		}
+		for _, nsn := range p.RequiredSecrets(in) {
+			var secret corev1.Secret
+			if err := cli.Get(ctx, nsn, &secret); err != nil {
+				if errors.IsNotFound(err) {
+					missing = append(missing, nsn.String())
+					continue
+				}
+				return nil, fmt.Errorf("get secret %s for chart %s: %w", nsn, chart.Name, err)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// CheckAddonHealth runs the health check of the provider registered for the given chart. Returns
+// nil if there is no provider for the chart.
+func CheckAddonHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation, chartName string) error {
+	p, ok := AddonProviderFor(chartName)
+	if !ok {
+		return nil
+	}
+	return p.CheckHealth(ctx, cli, in)
+}
+
+// IsAddonNotReady returns true if the health check error reports an addon that is not ready yet.
+func IsAddonNotReady(err error) bool {
+	return goerrors.Is(err, ErrAddonNotReady)
+}
+
+// CheckAddonsHealth runs the health checks for the providers of the given charts, returning the
+// first failure.
+func CheckAddonsHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation, ext *k0sv1beta1.HelmExtensions) error {
+	for _, chart := range ext.Charts {
+		p, ok := AddonProviderFor(chart.Name)
+		if !ok {
+			continue
+		}
+		if err := p.CheckHealth(ctx, cli, in); err != nil {
+			return fmt.Errorf("addon %s is not healthy: %w", chart.Name, err)
+		}
+	}
+	return nil
+}
+
+// RemoveAddons calls the removal hooks of the providers for the charts present in before that
+// are no longer present in after.
+func RemoveAddons(ctx context.Context, cli client.Client, in *v1beta1.Installation, before, after *k0sv1beta1.HelmExtensions) error {
+	kept := map[string]bool{}
+	for _, chart := range after.Charts {
+		kept[chart.Name] = true
+	}
+	for _, chart := range before.Charts {
+		if kept[chart.Name] {
+			continue
+		}
+		p, ok := AddonProviderFor(chart.Name)
+		if !ok {
+			continue
+		}
+		if err := p.OnRemove(ctx, cli, in); err != nil {
+			return fmt.Errorf("remove addon %s: %w", chart.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package charts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
+)
+
+type testAddonProvider struct {
+	BaseAddonProvider
+	removed bool
+}
+
+func (p *testAddonProvider) DynamicValues(ctx context.Context, cli client.Client, in *v1beta1.Installation, clusterConfig *k0sv1beta1.ClusterConfig, values string) (string, error) {
+	return setHelmValue(values, "clusterID", in.Spec.ClusterID)
+}
+
+func (p *testAddonProvider) RequiredSecrets(in *v1beta1.Installation) []types.NamespacedName {
+	return []types.NamespacedName{{Namespace: "vendor", Name: "vendor-creds"}}
+}
+
+func (p *testAddonProvider) CheckHealth(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	return fmt.Errorf("not ready")
+}
+
+func (p *testAddonProvider) OnRemove(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+	p.removed = true
+	return nil
+}
+
+func TestAddonProviders(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	p := &testAddonProvider{BaseAddonProvider: BaseAddonProvider{Name: "vendor-addon"}}
+	RegisterAddonProvider(p)
+	defer func() {
+		providersMutex.Lock()
+		defer providersMutex.Unlock()
+		delete(providers, "vendor-addon")
+		providersOrder = providersOrder[:len(providersOrder)-1]
+	}()
+
+	got, ok := AddonProviderFor("vendor-addon")
+	req.True(ok)
+	req.Equal(p, got)
+
+	in := &v1beta1.Installation{Spec: v1beta1.InstallationSpec{ClusterID: "abc"}}
+	charts, err := updateInfraChartsFromInstall(ctx, nil, in, nil, []v1beta1.Chart{
+		{Name: "vendor-addon", Values: "abc: xyz\n"},
+		{Name: "other", Values: "abc: xyz\n"},
+	})
+	req.NoError(err)
+	req.Equal("abc: xyz\nclusterID: abc\n", charts[0].Values)
+	req.Equal("abc: xyz\n", charts[1].Values)
+
+	ext := &k0sv1beta1.HelmExtensions{Charts: []k0sv1beta1.Chart{{Name: "vendor-addon"}}}
+	cli := fake.NewClientBuilder().Build()
+	missing, err := MissingAddonSecrets(ctx, cli, in, ext)
+	req.NoError(err)
+	req.Equal([]string{"vendor/vendor-creds"}, missing)
+
+	req.NoError(cli.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vendor", Name: "vendor-creds"},
+	}))
+	missing, err = MissingAddonSecrets(ctx, cli, in, ext)
+	req.NoError(err)
+	req.Empty(missing)
+
+	req.ErrorContains(CheckAddonsHealth(ctx, cli, in, ext), "addon vendor-addon is not healthy: not ready")
+
+	req.NoError(RemoveAddons(ctx, cli, in, ext, ext))
+	req.False(p.removed)
+	req.NoError(RemoveAddons(ctx, cli, in, ext, &k0sv1beta1.HelmExtensions{}))
+	req.True(p.removed)
+}
+
+func Test_registryProvider_RequiredSecrets(t *testing.T) {
+	p := registryProvider{BaseAddonProvider{Name: "docker-registry"}}
+	migrated := v1beta1.InstallationStatus{
+		Conditions: []metav1.Condition{{Type: registry.RegistryMigrationStatusConditionType, Status: metav1.ConditionTrue}},
+	}
+	tests := []struct {
+		name string
+		in   v1beta1.Installation
+		want []types.NamespacedName
+	}{
+		{
+			name: "online",
+			in:   v1beta1.Installation{},
+		},
+		{
+			name: "airgap",
+			in:   v1beta1.Installation{Spec: v1beta1.InstallationSpec{AirGap: true}},
+		},
+		{
+			name: "airgap HA, registry data not migrated",
+			in:   v1beta1.Installation{Spec: v1beta1.InstallationSpec{AirGap: true, HighAvailability: true}},
+		},
+		{
+			name: "airgap HA, registry data migrated",
+			in:   v1beta1.Installation{Spec: v1beta1.InstallationSpec{AirGap: true, HighAvailability: true}, Status: migrated},
+			want: []types.NamespacedName{{Namespace: "registry", Name: "seaweedfs-s3-rw"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, p.RequiredSecrets(&tt.in))
+		})
+	}
+}
+
+func TestCheckAddonHealth(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	in := &v1beta1.Installation{Spec: v1beta1.InstallationSpec{AirGap: true, HighAvailability: true}}
+
+	chart := &k0shelm.Chart{
+		ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-seaweedfs", Namespace: "kube-system"},
+		Spec:       k0shelm.ChartSpec{Version: "1"},
+		Status:     k0shelm.ChartStatus{Version: "1"},
+	}
+	chart.Status.ValuesHash = chart.Spec.HashValues()
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(chart).Build()
+
+	req.NoError(CheckAddonHealth(ctx, cli, in, "seaweedfs"))
+	err := CheckAddonHealth(ctx, cli, in, "docker-registry")
+	req.True(IsAddonNotReady(err), "unexpected error %v", err)
+	// seaweedfs is not deployed in non HA installations.
+	req.NoError(CheckAddonHealth(ctx, cli, &v1beta1.Installation{Spec: v1beta1.InstallationSpec{AirGap: true}}, "seaweedfs"))
+	// charts without a provider are always healthy.
+	req.NoError(CheckAddonHealth(ctx, cli, in, "unknown"))
+}
+
+func Test_registryProvider_DynamicValues(t *testing.T) {
+	in := &v1beta1.Installation{Spec: v1beta1.InstallationSpec{AirGap: true}}
+	p := registryProvider{BaseAddonProvider{Name: "docker-registry"}}
+
+	cli := fake.NewClientBuilder().Build()
+	values, err := p.DynamicValues(context.Background(), cli, in, &k0sv1beta1.ClusterConfig{}, "ha: false\nservice:\n  clusterIP: 1.1.1.1\n")
+	require.NoError(t, err)
+	require.Equal(t, "ha: false\nservice:\n  clusterIP: 10.96.0.11\n", values)
+
+	cli = fake.NewClientBuilder().WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry-tls", Namespace: "registry"},
+	}).Build()
+	values, err = p.DynamicValues(context.Background(), cli, in, &k0sv1beta1.ClusterConfig{}, "ha: false\nservice:\n  clusterIP: 1.1.1.1\n")
+	require.NoError(t, err)
+	require.Equal(t, "ha: false\nservice:\n  clusterIP: 10.96.0.11\ntlsSecretName: registry-tls\n", values)
+}
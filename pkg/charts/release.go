@@ -0,0 +1,213 @@
+package charts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultReleaseTimeout is the time helm waits for the chart resources to be ready when the
+// chart does not set a timeout, the same k0s uses.
+const defaultReleaseTimeout = 10 * time.Minute
+
+// ReleaseOptions holds the options for Release.
+type ReleaseOptions struct {
+	// Name is the name of the release.
+	Name string
+	// Chart is a path to a chart archive, a chart in one of the repositories (repository/chart)
+	// or an oci reference.
+	Chart     string
+	Version   string
+	Namespace string
+	Timeout   time.Duration
+	// ValuesFile is the path to the values the chart is released with.
+	ValuesFile string
+	// RepositoriesFile is the path to a yaml list of the repositories the chart can be pulled
+	// from.
+	RepositoriesFile string
+}
+
+// Release installs the chart, or upgrades its release if it exists, the way k0s does it: the
+// namespace is created if needed, helm waits for the resources to be ready and the release is
+// rolled back on failure.
+func Release(ctx context.Context, opts ReleaseOptions) error {
+	values, err := chartutil.ReadValuesFile(opts.ValuesFile)
+	if err != nil {
+		return fmt.Errorf("read values: %w", err)
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultReleaseTimeout
+	}
+
+	cfg, err := helmActionConfig(opts.Namespace)
+	if err != nil {
+		return fmt.Errorf("create helm configuration: %w", err)
+	}
+	history := action.NewHistory(cfg)
+	history.Max = 1
+	_, err = history.Run(opts.Name)
+	if err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+		return fmt.Errorf("get release history: %w", err)
+	}
+	exists := err == nil
+
+	if !exists {
+		install := action.NewInstall(cfg)
+		install.ReleaseName = opts.Name
+		install.Namespace = opts.Namespace
+		install.CreateNamespace = true
+		install.Wait = true
+		install.WaitForJobs = true
+		install.Atomic = true
+		install.Timeout = timeout
+		install.Version = opts.Version
+		loaded, err := loadChart(&install.ChartPathOptions, opts)
+		if err != nil {
+			return err
+		}
+		rel, err := install.RunWithContext(ctx, loaded, values)
+		if err != nil {
+			return fmt.Errorf("install chart %s: %w", opts.Chart, err)
+		}
+		fmt.Printf("Installed release %s revision %d\n", rel.Name, rel.Version)
+		return nil
+	}
+
+	upgrade := action.NewUpgrade(cfg)
+	upgrade.Namespace = opts.Namespace
+	upgrade.Wait = true
+	upgrade.WaitForJobs = true
+	upgrade.Force = true
+	upgrade.Atomic = true
+	upgrade.Timeout = timeout
+	upgrade.Version = opts.Version
+	loaded, err := loadChart(&upgrade.ChartPathOptions, opts)
+	if err != nil {
+		return err
+	}
+	rel, err := upgrade.RunWithContext(ctx, opts.Name, loaded, values)
+	if err != nil {
+		return fmt.Errorf("upgrade chart %s: %w", opts.Chart, err)
+	}
+	fmt.Printf("Upgraded release %s to revision %d\n", rel.Name, rel.Version)
+	return nil
+}
+
+// Uninstall uninstalls the release, a release that does not exist is considered uninstalled.
+func Uninstall(ctx context.Context, name, namespace string) error {
+	cfg, err := helmActionConfig(namespace)
+	if err != nil {
+		return fmt.Errorf("create helm configuration: %w", err)
+	}
+	uninstall := action.NewUninstall(cfg)
+	uninstall.Wait = true
+	uninstall.Timeout = defaultReleaseTimeout
+	if _, err := uninstall.Run(name); errors.Is(err, driver.ErrReleaseNotFound) {
+		fmt.Printf("Release %s not found\n", name)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("uninstall release %s: %w", name, err)
+	}
+	fmt.Printf("Uninstalled release %s\n", name)
+	return nil
+}
+
+// loadChart locates the chart, downloading it if it is not a path on disk, and loads it.
+func loadChart(cpo *action.ChartPathOptions, opts ReleaseOptions) (*chart.Chart, error) {
+	name := opts.Chart
+	if !filepath.IsAbs(name) && !registry.IsOCI(name) {
+		repos, err := readRepositories(opts.RepositoriesFile)
+		if err != nil {
+			return nil, fmt.Errorf("read repositories: %w", err)
+		}
+		repoName, chartName, ok := strings.Cut(name, "/")
+		if !ok {
+			return nil, fmt.Errorf("chart %s is not a path, an oci reference or in a repository", name)
+		}
+		repo, ok := repos[repoName]
+		if !ok {
+			return nil, fmt.Errorf("repository %s not found", repoName)
+		}
+		name = chartName
+		cpo.RepoURL = repo.URL
+		cpo.Username = repo.Username
+		cpo.Password = repo.Password
+		cpo.InsecureSkipTLSverify = repo.Insecure
+	}
+
+	cache, err := os.MkdirTemp("", "helm-cache")
+	if err != nil {
+		return nil, fmt.Errorf("create helm cache: %w", err)
+	}
+	settings := cli.New()
+	settings.RepositoryCache = cache
+	settings.RepositoryConfig = filepath.Join(cache, "repositories.yaml")
+
+	path, err := cpo.LocateChart(name, settings)
+	if err != nil {
+		return nil, fmt.Errorf("locate chart %s: %w", opts.Chart, err)
+	}
+	loaded, err := loader.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("load chart %s: %w", opts.Chart, err)
+	}
+	if loaded.Metadata.Dependencies != nil {
+		if err := action.CheckDependencies(loaded, loaded.Metadata.Dependencies); err != nil {
+			return nil, fmt.Errorf("check chart %s dependencies: %w", opts.Chart, err)
+		}
+	}
+	return loaded, nil
+}
+
+// readRepositories reads the repositories file, indexing the repositories by name.
+func readRepositories(path string) (map[string]k0sv1beta1.Repository, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var repos []k0sv1beta1.Repository
+	if err := yaml.Unmarshal(data, &repos); err != nil {
+		return nil, fmt.Errorf("unmarshal repositories: %w", err)
+	}
+	result := map[string]k0sv1beta1.Repository{}
+	for _, repo := range repos {
+		result[repo.Name] = repo
+	}
+	return result, nil
+}
+
+// helmActionConfig returns the helm configuration for releases in the given namespace, using the
+// in-cluster configuration.
+func helmActionConfig(namespace string) (*action.Configuration, error) {
+	flags := genericclioptions.NewConfigFlags(false)
+	flags.Namespace = &namespace
+	cfg := &action.Configuration{}
+	logf := func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	}
+	if err := cfg.Init(flags, namespace, "secret", logf); err != nil {
+		return nil, err
+	}
+	regcli, err := registry.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("create registry client: %w", err)
+	}
+	cfg.RegistryClient = regcli
+	return cfg, nil
+}
@@ -0,0 +1,382 @@
+package charts
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+const (
+	// ChartReleaseLabel is set on the chart values secrets and on the release jobs, it holds the
+	// name of the chart they release.
+	ChartReleaseLabel = "embedded-cluster.replicated.com/chart-release"
+	// ChartReleaseHashAnnotation holds the hash of the release a job runs. It is also kept in the
+	// chart values secret the job reads.
+	ChartReleaseHashAnnotation = "embedded-cluster.replicated.com/chart-release-hash"
+	// ChartReleaseNamespaceAnnotation is kept in the chart values secrets, it holds the namespace
+	// the chart is released into so it can be uninstalled once the chart is removed.
+	ChartReleaseNamespaceAnnotation = "embedded-cluster.replicated.com/chart-release-namespace"
+	// ChartReleaseServiceAccountName is the service account the release jobs run as. helm
+	// manages every kind of object so the operator chart binds it to the cluster-admin role.
+	ChartReleaseServiceAccountName = "embedded-cluster-chart-release"
+
+	chartReleaseJobPrefix   = "chart-release-"
+	chartValuesSecretPrefix = "chart-values-"
+	chartValuesMountPath    = "/etc/chart-values"
+	chartValuesFile         = "values.yaml"
+	chartRepositoriesFile   = "repositories.yaml"
+	uninstallReleaseHash    = "uninstall"
+
+	// k0sChartFinalizer is the finalizer k0s sets on its chart objects to uninstall the release
+	// when they are deleted.
+	k0sChartFinalizer = "helm.k0sproject.io/uninstall-helm-release"
+)
+
+// ChartValuesSecretName returns the name of the secret holding the values a chart reading
+// values from secrets is released with.
+func ChartValuesSecretName(chart string) string {
+	return chartValuesSecretPrefix + chart
+}
+
+// ReleaseStatus is the status of the job releasing a chart.
+type ReleaseStatus struct {
+	// Done is true once the chart has been released with the desired values.
+	Done bool
+	// Error holds the error the job failed with.
+	Error string
+}
+
+// EnsureChartRelease renders the values of a chart reading values from secrets into its chart
+// values secret and makes sure a job releasing the chart with them exists. The job is replaced
+// whenever the chart, its values or the secrets it reads from change. A release still owned by
+// a k0s chart object, as the chart was installed by k0s before it read values from secrets, is
+// taken over once the chart has left the cluster config: the object is deleted without its
+// finalizer so the release is upgraded by the job instead of being uninstalled.
+func EnsureChartRelease(
+	ctx context.Context, cli client.Client, chart k0sv1beta1.Chart,
+	repos []k0sv1beta1.Repository, inClusterConfig bool, image string,
+) (*ReleaseStatus, error) {
+	if taken, err := takeOverK0sChart(ctx, cli, chart.Name, inClusterConfig); err != nil {
+		return nil, fmt.Errorf("take over k0s chart: %w", err)
+	} else if !taken {
+		return &ReleaseStatus{}, nil
+	}
+
+	values, err := ResolveValuesFrom(ctx, cli, chart.Values)
+	if err != nil {
+		return nil, fmt.Errorf("resolve values from secrets: %w", err)
+	}
+	repositories, err := yaml.Marshal(chartRepositories(chart, repos))
+	if err != nil {
+		return nil, fmt.Errorf("marshal repositories: %w", err)
+	}
+
+	job := releaseJob(chart.Name, image, releaseArgs(chart))
+	if filepath.IsAbs(chart.ChartName) {
+		// airgap charts are read from the disk of the node.
+		addHostPathVolume(job, filepath.Dir(chart.ChartName))
+	}
+	data := map[string][]byte{
+		chartValuesFile:       []byte(values),
+		chartRepositoriesFile: repositories,
+	}
+	hash := releaseHash(data, job.Spec.Template.Spec.Containers[0].Args)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChartValuesSecretName(chart.Name),
+			Namespace: chartValuesSecretNamespace,
+		},
+	}
+	if _, err := ctrl.CreateOrUpdate(ctx, cli, secret, func() error {
+		secret.Labels = applyChartLabels(secret.Labels, "chart-values")
+		secret.Labels[ChartReleaseLabel] = chart.Name
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[ChartReleaseHashAnnotation] = hash
+		secret.Annotations[ChartReleaseNamespaceAnnotation] = chart.TargetNS
+		secret.Data = data
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("ensure chart values secret: %w", err)
+	}
+
+	job.Annotations[ChartReleaseHashAnnotation] = hash
+	if err := ensureReleaseJob(ctx, cli, job); err != nil {
+		return nil, err
+	}
+	return releaseJobStatus(ctx, cli, job)
+}
+
+// UninstallChartReleases uninstalls the releases of the charts that no longer read values from
+// secrets, the given charts excepted, and removes their chart values secrets. Returns the names
+// of the charts whose release is still being uninstalled.
+func UninstallChartReleases(ctx context.Context, cli client.Client, keep []string, image string) ([]string, error) {
+	var secrets corev1.SecretList
+	if err := cli.List(
+		ctx, &secrets,
+		client.InNamespace(chartValuesSecretNamespace),
+		client.HasLabels{ChartReleaseLabel},
+	); err != nil {
+		return nil, fmt.Errorf("list chart values secrets: %w", err)
+	}
+
+	kept := map[string]bool{}
+	for _, name := range keep {
+		kept[name] = true
+	}
+	pending := []string{}
+	for _, secret := range secrets.Items {
+		name := secret.Labels[ChartReleaseLabel]
+		if kept[name] {
+			continue
+		}
+		namespace := secret.Annotations[ChartReleaseNamespaceAnnotation]
+		job := releaseJob(name, image, []string{"charts", "uninstall", "--name", name, "--namespace", namespace})
+		job.Annotations[ChartReleaseHashAnnotation] = uninstallReleaseHash
+		if err := ensureReleaseJob(ctx, cli, job); err != nil {
+			return nil, err
+		}
+		status, err := releaseJobStatus(ctx, cli, job)
+		if err != nil {
+			return nil, err
+		}
+		if status.Error != "" {
+			return nil, fmt.Errorf("uninstall chart %s: %s", name, status.Error)
+		}
+		if !status.Done {
+			pending = append(pending, name)
+			continue
+		}
+		if err := cli.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationForeground)); client.IgnoreNotFound(err) != nil {
+			return nil, fmt.Errorf("delete uninstall job of chart %s: %w", name, err)
+		}
+		if err := cli.Delete(ctx, &secret); client.IgnoreNotFound(err) != nil {
+			return nil, fmt.Errorf("delete values secret of chart %s: %w", name, err)
+		}
+	}
+	return pending, nil
+}
+
+// takeOverK0sChart returns true once there is no k0s chart object for the chart. The finalizer
+// of an existing k0s chart object is removed first so k0s does not uninstall the release when
+// the chart leaves the cluster config, the object is deleted once the chart has left it.
+func takeOverK0sChart(ctx context.Context, cli client.Client, name string, inClusterConfig bool) (bool, error) {
+	var installed k0shelm.ChartList
+	if err := cli.List(ctx, &installed); err != nil {
+		return false, fmt.Errorf("list k0s charts: %w", err)
+	}
+	for i := range installed.Items {
+		chart := &installed.Items[i]
+		if chart.Spec.ReleaseName != name {
+			continue
+		}
+		if controllerutil.RemoveFinalizer(chart, k0sChartFinalizer) {
+			if err := cli.Update(ctx, chart); err != nil {
+				return false, fmt.Errorf("remove finalizer from chart %s: %w", chart.Name, err)
+			}
+		}
+		if inClusterConfig {
+			// k0s would create the object again.
+			return false, nil
+		}
+		if err := cli.Delete(ctx, chart); client.IgnoreNotFound(err) != nil {
+			return false, fmt.Errorf("delete chart %s: %w", chart.Name, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// ensureReleaseJob creates the release job, replacing an existing one running another release.
+func ensureReleaseJob(ctx context.Context, cli client.Client, job *batchv1.Job) error {
+	hash := job.Annotations[ChartReleaseHashAnnotation]
+	err := k8sutil.EnsureObject(ctx, cli, job, func(opts *k8sutil.EnsureObjectOptions) {
+		opts.DeleteOptions = append(opts.DeleteOptions, client.PropagationPolicy(metav1.DeletePropagationForeground))
+		opts.ShouldDelete = func(obj client.Object) bool {
+			return obj.GetAnnotations()[ChartReleaseHashAnnotation] != hash
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("ensure release job: %w", err)
+	}
+	return nil
+}
+
+// releaseJobStatus returns the status of the release job. The error of a failed job is the
+// termination message of its last failed pod, its logs if it did not write any.
+func releaseJobStatus(ctx context.Context, cli client.Client, job *batchv1.Job) (*ReleaseStatus, error) {
+	if job.Status.Succeeded > 0 {
+		return &ReleaseStatus{Done: true}, nil
+	}
+	var failed *batchv1.JobCondition
+	for i, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			failed = &job.Status.Conditions[i]
+		}
+	}
+	if failed == nil {
+		return &ReleaseStatus{}, nil
+	}
+
+	var pods corev1.PodList
+	err := cli.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name})
+	if err != nil {
+		return nil, fmt.Errorf("list release job pods: %w", err)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+	message := failed.Message
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+				message = status.State.Terminated.Message
+			}
+		}
+	}
+	return &ReleaseStatus{Error: strings.TrimSpace(message)}, nil
+}
+
+// releaseArgs returns the arguments of the release job for the chart.
+func releaseArgs(chart k0sv1beta1.Chart) []string {
+	args := []string{
+		"charts", "release",
+		"--name", chart.Name,
+		"--chart", chart.ChartName,
+		"--version", chart.Version,
+		"--namespace", chart.TargetNS,
+		"--values", filepath.Join(chartValuesMountPath, chartValuesFile),
+		"--repositories", filepath.Join(chartValuesMountPath, chartRepositoriesFile),
+	}
+	if chart.Timeout > 0 {
+		args = append(args, "--timeout", chart.Timeout.String())
+	}
+	return args
+}
+
+// chartRepositories returns the repository the chart is pulled from, if any.
+func chartRepositories(chart k0sv1beta1.Chart, repos []k0sv1beta1.Repository) []k0sv1beta1.Repository {
+	name, _, ok := strings.Cut(chart.ChartName, "/")
+	if !ok {
+		return []k0sv1beta1.Repository{}
+	}
+	for _, repo := range repos {
+		if repo.Name == name {
+			return []k0sv1beta1.Repository{repo}
+		}
+	}
+	return []k0sv1beta1.Repository{}
+}
+
+// releaseHash returns a short hash of the chart values secret data and the job arguments.
+func releaseHash(data map[string][]byte, args []string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s\x00%s\x00", key, data[key])
+	}
+	for _, arg := range args {
+		fmt.Fprintf(h, "%s\x00", arg)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:10]
+}
+
+// releaseJob returns a job running the operator image with the given arguments. The chart
+// values secret is mounted in the job.
+func releaseJob(name, image string, args []string) *batchv1.Job {
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        chartReleaseJobPrefix + name,
+			Namespace:   chartValuesSecretNamespace,
+			Labels:      applyChartLabels(nil, "chart-release"),
+			Annotations: map[string]string{},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: ChartReleaseServiceAccountName,
+					Volumes: []corev1.Volume{
+						{
+							Name: "chart-values",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: ChartValuesSecretName(name),
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:                     "release",
+							Image:                    image,
+							Command:                  []string{"/manager"},
+							Args:                     args,
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "chart-values",
+									MountPath: chartValuesMountPath,
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	job.Labels[ChartReleaseLabel] = name
+	return job
+}
+
+// addHostPathVolume mounts the given directory of the node in the release job.
+func addHostPathVolume(job *batchv1.Job, dir string) {
+	spec := &job.Spec.Template.Spec
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "charts",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: dir},
+		},
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      "charts",
+		MountPath: dir,
+		ReadOnly:  true,
+	})
+}
+
+func applyChartLabels(labels map[string]string, component string) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels["app.kubernetes.io/component"] = component
+	labels["app.kubernetes.io/part-of"] = "embedded-cluster"
+	labels["app.kubernetes.io/managed-by"] = "embedded-cluster-operator"
+	return labels
+}
@@ -0,0 +1,123 @@
+package charts
+
+import (
+	"context"
+	"testing"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestEnsureChartRelease(t *testing.T) {
+	ctx := context.Background()
+	creds := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "embedded-cluster"},
+		Data:       map[string][]byte{"password": []byte("s3cr3t")},
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(creds).Build()
+	chart := k0sv1beta1.Chart{
+		Name:      "vendor",
+		ChartName: "/var/lib/embedded-cluster/charts/vendor-1.0.0.tgz",
+		Version:   "1.0.0",
+		TargetNS:  "vendor",
+		Values:    "embeddedClusterValuesFrom:\n- secret: creds\n  key: password\n  path: password\n",
+	}
+
+	status, err := EnsureChartRelease(ctx, cli, chart, nil, false, "operator:latest")
+	require.NoError(t, err)
+	require.Equal(t, &ReleaseStatus{}, status)
+
+	var job batchv1.Job
+	key := client.ObjectKey{Name: "chart-release-vendor", Namespace: "embedded-cluster"}
+	require.NoError(t, cli.Get(ctx, key, &job))
+	hash := job.Annotations[ChartReleaseHashAnnotation]
+	require.NotEmpty(t, hash)
+	// airgap charts are read from the node.
+	require.Len(t, job.Spec.Template.Spec.Volumes, 2)
+	require.Equal(t, "/var/lib/embedded-cluster/charts", job.Spec.Template.Spec.Volumes[1].HostPath.Path)
+
+	var values corev1.Secret
+	require.NoError(t, cli.Get(ctx, client.ObjectKey{Name: "chart-values-vendor", Namespace: "embedded-cluster"}, &values))
+	require.Equal(t, "password: s3cr3t\n", string(values.Data["values.yaml"]))
+	require.Equal(t, hash, values.Annotations[ChartReleaseHashAnnotation])
+	require.Equal(t, "vendor", values.Annotations[ChartReleaseNamespaceAnnotation])
+
+	// the failure of the job is reported with the termination message of its pod.
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:    batchv1.JobFailed,
+		Status:  corev1.ConditionTrue,
+		Message: "Job has reached the specified backoff limit",
+	}}
+	require.NoError(t, cli.Status().Update(ctx, &job))
+	require.NoError(t, cli.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "chart-release-vendor-abcde",
+			Namespace: "embedded-cluster",
+			Labels:    map[string]string{"job-name": "chart-release-vendor"},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{Message: "install chart: timed out waiting for the condition\n"},
+				},
+			}},
+		},
+	}))
+	status, err = EnsureChartRelease(ctx, cli, chart, nil, false, "operator:latest")
+	require.NoError(t, err)
+	require.Equal(t, &ReleaseStatus{Error: "install chart: timed out waiting for the condition"}, status)
+
+	// rotating the secret releases the chart again.
+	creds.Data["password"] = []byte("rotated")
+	require.NoError(t, cli.Update(ctx, creds))
+	status, err = EnsureChartRelease(ctx, cli, chart, nil, false, "operator:latest")
+	require.NoError(t, err)
+	require.Equal(t, &ReleaseStatus{}, status)
+	require.NoError(t, cli.Get(ctx, key, &job))
+	require.NotEqual(t, hash, job.Annotations[ChartReleaseHashAnnotation])
+	require.Empty(t, job.Status.Conditions)
+}
+
+func TestUninstallChartReleases(t *testing.T) {
+	ctx := context.Background()
+	secret := func(name string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        ChartValuesSecretName(name),
+				Namespace:   "embedded-cluster",
+				Labels:      map[string]string{ChartReleaseLabel: name},
+				Annotations: map[string]string{ChartReleaseNamespaceAnnotation: name},
+			},
+		}
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(secret("vendor"), secret("kept")).Build()
+
+	pending, err := UninstallChartReleases(ctx, cli, []string{"kept"}, "operator:latest")
+	require.NoError(t, err)
+	require.Equal(t, []string{"vendor"}, pending)
+
+	var job batchv1.Job
+	key := client.ObjectKey{Name: "chart-release-vendor", Namespace: "embedded-cluster"}
+	require.NoError(t, cli.Get(ctx, key, &job))
+	require.Equal(t, []string{"charts", "uninstall", "--name", "vendor", "--namespace", "vendor"}, job.Spec.Template.Spec.Containers[0].Args)
+	err = cli.Get(ctx, client.ObjectKey{Name: "chart-release-kept", Namespace: "embedded-cluster"}, &batchv1.Job{})
+	require.True(t, k8serrors.IsNotFound(err))
+
+	job.Status.Succeeded = 1
+	require.NoError(t, cli.Status().Update(ctx, &job))
+	pending, err = UninstallChartReleases(ctx, cli, []string{"kept"}, "operator:latest")
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	err = cli.Get(ctx, client.ObjectKey{Name: ChartValuesSecretName("vendor"), Namespace: "embedded-cluster"}, &corev1.Secret{})
+	require.True(t, k8serrors.IsNotFound(err))
+	require.NoError(t, cli.Get(ctx, client.ObjectKey{Name: ChartValuesSecretName("kept"), Namespace: "embedded-cluster"}, &corev1.Secret{}))
+}
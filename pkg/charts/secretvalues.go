@@ -0,0 +1,132 @@
+package charts
+
+import (
+	"context"
+	"fmt"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Chart values are read from secrets through a ValuesFromKey entry in the chart values, listing
+// the secret keys and the values path each of them is set at:
+//
+//	embeddedClusterValuesFrom:
+//	- secret: vendor-creds
+//	  key: password
+//	  path: auth.password
+//
+// Charts are k0s Chart objects, defined outside of this repository, so the reference can't be a
+// field of its own and lives in the values. k0s only reads the values inline in its chart objects
+// thus charts with such a reference are left out of the cluster config and released by a job
+// running helm with the values rendered into the chart values secret instead. The secret values
+// never end up in a custom resource.
+const (
+	// ValuesFromKey is the top level key of the chart values listing the values read from
+	// secrets. It is removed from the values before they are handed to helm.
+	ValuesFromKey = "embeddedClusterValuesFrom"
+
+	chartValuesSecretNamespace = "embedded-cluster"
+)
+
+// ValueFrom is a helm value whose content is read from a key in a secret in the embedded-cluster
+// namespace.
+type ValueFrom struct {
+	Secret string `yaml:"secret"`
+	Key    string `yaml:"key"`
+	Path   string `yaml:"path"`
+}
+
+// ValuesFrom returns the values read from secrets listed in the chart values and the values
+// without the ValuesFromKey entry.
+func ValuesFrom(values string) ([]ValueFrom, string, error) {
+	var parsed struct {
+		ValuesFrom []ValueFrom `yaml:"embeddedClusterValuesFrom"`
+	}
+	if err := yaml.Unmarshal([]byte(values), &parsed); err != nil {
+		return nil, "", fmt.Errorf("unmarshal values: %w", err)
+	}
+	if len(parsed.ValuesFrom) == 0 {
+		return nil, values, nil
+	}
+	for _, vf := range parsed.ValuesFrom {
+		if vf.Secret == "" || vf.Key == "" || vf.Path == "" {
+			return nil, "", fmt.Errorf("%s entries require a secret, a key and a path", ValuesFromKey)
+		}
+	}
+
+	stripped := yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(values), &stripped); err != nil {
+		return nil, "", fmt.Errorf("unmarshal values: %w", err)
+	}
+	for i, item := range stripped {
+		if item.Key == ValuesFromKey {
+			stripped = append(stripped[:i], stripped[i+1:]...)
+			break
+		}
+	}
+	if len(stripped) == 0 {
+		return parsed.ValuesFrom, "", nil
+	}
+	out, err := yaml.Marshal(stripped)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshal values: %w", err)
+	}
+	return parsed.ValuesFrom, string(out), nil
+}
+
+// SplitValuesFromCharts returns the helm extensions without the charts reading values from
+// secrets, these are returned on their own. k0s installs the former, the latter are released
+// through release jobs.
+func SplitValuesFromCharts(ext *k0sv1beta1.HelmExtensions) (*k0sv1beta1.HelmExtensions, []k0sv1beta1.Chart, error) {
+	k0sCharts := ext.DeepCopy()
+	k0sCharts.Charts = nil
+	var released []k0sv1beta1.Chart
+	for _, chart := range ext.Charts {
+		vfs, _, err := ValuesFrom(chart.Values)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read values from secrets of chart %s: %w", chart.Name, err)
+		}
+		if len(vfs) > 0 {
+			released = append(released, chart)
+			continue
+		}
+		k0sCharts.Charts = append(k0sCharts.Charts, chart)
+	}
+	return k0sCharts, released, nil
+}
+
+// ResolveValuesFrom returns the chart values with the values read from secrets set at their
+// path, in the order they are listed. It fails if a secret or a key does not exist.
+func ResolveValuesFrom(ctx context.Context, cli client.Client, values string) (string, error) {
+	vfs, values, err := ValuesFrom(values)
+	if err != nil {
+		return "", err
+	}
+	secrets := map[string]*corev1.Secret{}
+	for _, vf := range vfs {
+		secret, ok := secrets[vf.Secret]
+		if !ok {
+			secret = &corev1.Secret{}
+			key := client.ObjectKey{Namespace: chartValuesSecretNamespace, Name: vf.Secret}
+			if err := cli.Get(ctx, key, secret); k8serrors.IsNotFound(err) {
+				return "", fmt.Errorf("secret %s not found", vf.Secret)
+			} else if err != nil {
+				return "", fmt.Errorf("get secret %s: %w", vf.Secret, err)
+			}
+			secrets[vf.Secret] = secret
+		}
+		value, ok := secret.Data[vf.Key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in secret %s", vf.Key, vf.Secret)
+		}
+		values, err = setHelmValue(values, vf.Path, string(value))
+		if err != nil {
+			return "", fmt.Errorf("set value from secret %s key %s: %w", vf.Secret, vf.Key, err)
+		}
+	}
+	return values, nil
+}
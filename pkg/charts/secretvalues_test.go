@@ -0,0 +1,129 @@
+package charts
+
+import (
+	"context"
+	"testing"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestValuesFrom(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     string
+		wantFrom   []ValueFrom
+		wantValues string
+		wantErr    string
+	}{
+		{
+			name:       "no values from secrets",
+			values:     "abc: xyz\n",
+			wantValues: "abc: xyz\n",
+		},
+		{
+			name: "values from secrets",
+			values: `abc: xyz
+embeddedClusterValuesFrom:
+- secret: vendor-creds
+  key: password
+  path: auth.password
+auth:
+  enabled: true
+`,
+			wantFrom:   []ValueFrom{{Secret: "vendor-creds", Key: "password", Path: "auth.password"}},
+			wantValues: "abc: xyz\nauth:\n  enabled: true\n",
+		},
+		{
+			name: "only values from secrets",
+			values: `embeddedClusterValuesFrom:
+- secret: vendor-creds
+  key: password
+  path: auth.password
+`,
+			wantFrom: []ValueFrom{{Secret: "vendor-creds", Key: "password", Path: "auth.password"}},
+		},
+		{
+			name: "missing path",
+			values: `embeddedClusterValuesFrom:
+- secret: vendor-creds
+  key: password
+`,
+			wantErr: "require a secret, a key and a path",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, values, err := ValuesFrom(tt.values)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantFrom, from)
+			require.Equal(t, tt.wantValues, values)
+		})
+	}
+}
+
+func TestSplitValuesFromCharts(t *testing.T) {
+	ext := &k0sv1beta1.HelmExtensions{
+		Repositories: []k0sv1beta1.Repository{{Name: "repo", URL: "https://charts.example.com"}},
+		Charts: []k0sv1beta1.Chart{
+			{Name: "vendor", Values: "embeddedClusterValuesFrom:\n- secret: creds\n  key: password\n  path: password\n"},
+			{Name: "other", Values: "abc: xyz\n"},
+		},
+	}
+
+	k0sCharts, released, err := SplitValuesFromCharts(ext)
+	require.NoError(t, err)
+	require.Equal(t, ext.Repositories, k0sCharts.Repositories)
+	require.Len(t, k0sCharts.Charts, 1)
+	require.Equal(t, "other", k0sCharts.Charts[0].Name)
+	require.Len(t, released, 1)
+	require.Equal(t, "vendor", released[0].Name)
+
+	// the original extensions must not be modified.
+	require.Len(t, ext.Charts, 2)
+}
+
+func TestResolveValuesFrom(t *testing.T) {
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "vendor-creds", Namespace: "embedded-cluster"},
+			Data: map[string][]byte{
+				"username": []byte("admin"),
+				"password": []byte("s3cr3t"),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "vendor-creds", Namespace: "default"},
+			Data:       map[string][]byte{"token": []byte("nope")},
+		},
+	).Build()
+
+	values := `auth:
+  enabled: true
+embeddedClusterValuesFrom:
+- secret: vendor-creds
+  key: username
+  path: auth.username
+- secret: vendor-creds
+  key: password
+  path: auth.password
+`
+	got, err := ResolveValuesFrom(context.Background(), cli, values)
+	require.NoError(t, err)
+	require.Equal(t, "auth:\n  enabled: true\n  password: s3cr3t\n  username: admin\n", got)
+
+	missingKey := "embeddedClusterValuesFrom:\n- secret: vendor-creds\n  key: token\n  path: token\n"
+	_, err = ResolveValuesFrom(context.Background(), cli, missingKey)
+	require.ErrorContains(t, err, "key token not found in secret vendor-creds")
+
+	missingSecret := "embeddedClusterValuesFrom:\n- secret: other-creds\n  key: token\n  path: token\n"
+	_, err = ResolveValuesFrom(context.Background(), cli, missingSecret)
+	require.ErrorContains(t, err, "secret other-creds not found")
+}
@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func ArtifactsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "artifacts",
+		Short: "Manage the artifacts on the node",
+	}
+
+	cmd.AddCommand(
+		ArtifactsPullCmd(),
+		ArtifactsPullAdditionalCmd(),
+		ArtifactsPlaceCmd(),
+		ArtifactsGCCmd(),
+	)
+
+	return cmd
+}
+
+func ArtifactsPullCmd() *cobra.Command {
+	var opts artifacts.PullCoreArtifactOptions
+	var attempts, concurrency int
+
+	cmd := &cobra.Command{
+		Use:          "pull",
+		Short:        "Pull a core artifact from the registry onto the node",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := k8sutil.KubeClient()
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			log := ctrl.LoggerFrom(cmd.Context())
+			err = artifacts.PullCoreArtifact(cmd.Context(), log, cli, opts, func(opts *artifacts.PullOptions) {
+				opts.Attempts = attempts
+				opts.Concurrency = concurrency
+			})
+			if err != nil {
+				return fmt.Errorf("failed to pull %s: %w", opts.Kind, err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.DataDir, "data-dir", "/var/lib/embedded-cluster", "Embedded cluster data directory the artifact is pulled into")
+	cmd.Flags().StringVar(&opts.Kind, "kind", "", "Kind of core artifact to pull, one of binaries, images or helmcharts")
+	cmd.Flags().StringVar(&opts.From, "from", "", "Location of the artifact")
+	cmd.Flags().StringVar(&opts.BinaryName, "binary-name", artifacts.DefaultBinaryName, "Name of the embedded cluster binary in the binaries artifact")
+	cmd.Flags().IntVar(&attempts, "attempts", 5, "Number of times the artifact is fetched before giving up")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 0, "Number of blobs fetched at the same time, 0 uses the default")
+	for _, flag := range []string{"kind", "from"} {
+		if err := cmd.MarkFlagRequired(flag); err != nil {
+			panic(err)
+		}
+	}
+
+	return cmd
+}
+
+func ArtifactsPullAdditionalCmd() *cobra.Command {
+	var dataDir, additional string
+	var attempts, concurrency int
+
+	cmd := &cobra.Command{
+		Use:          "pull-additional",
+		Short:        "Pull the additional artifacts from the registry onto the node",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			locations := map[string]string{}
+			if err := json.Unmarshal([]byte(additional), &locations); err != nil {
+				return fmt.Errorf("failed to parse artifacts: %w", err)
+			}
+
+			cli, err := k8sutil.KubeClient()
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			log := ctrl.LoggerFrom(cmd.Context())
+			err = artifacts.PullAdditionalArtifacts(cmd.Context(), log, cli, dataDir, locations, func(opts *artifacts.PullOptions) {
+				opts.Attempts = attempts
+				opts.Concurrency = concurrency
+			})
+			if err != nil {
+				return fmt.Errorf("failed to pull additional artifacts: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dataDir, "data-dir", "/var/lib/embedded-cluster", "Embedded cluster data directory the artifacts are pulled into")
+	cmd.Flags().StringVar(&additional, "artifacts", "", "Locations of the additional artifacts as a json object indexed by destination")
+	cmd.Flags().IntVar(&attempts, "attempts", 5, "Number of times an artifact is fetched before giving up")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 0, "Number of blobs fetched at the same time, 0 uses the default")
+	err := cmd.MarkFlagRequired("artifacts")
+	if err != nil {
+		panic(err)
+	}
+
+	return cmd
+}
+
+func ArtifactsPlaceCmd() *cobra.Command {
+	var dataDir, imagesID, digests, report string
+	var additional []string
+	var check bool
+
+	cmd := &cobra.Command{
+		Use:          "place",
+		Short:        "Verify the pulled artifacts and place them for the upgrade",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			expected := map[string]string{}
+			if digests != "" {
+				if err := json.Unmarshal([]byte(digests), &expected); err != nil {
+					return fmt.Errorf("failed to parse digests: %w", err)
+				}
+			}
+
+			opts := artifacts.PlaceOptions{
+				DataDir:    dataDir,
+				ImagesID:   imagesID,
+				Digests:    expected,
+				ReportPath: report,
+				Additional: additional,
+			}
+			if check {
+				if _, err := artifacts.CheckPlaced(opts); err != nil {
+					return fmt.Errorf("failed to check placed artifacts: %w", err)
+				}
+				return nil
+			}
+
+			_, err := artifacts.Place(opts)
+			if err != nil {
+				return fmt.Errorf("failed to place artifacts: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dataDir, "data-dir", "/var/lib/embedded-cluster", "Embedded cluster data directory the artifacts were pulled into")
+	cmd.Flags().StringVar(&imagesID, "images-id", "", "Identifier used to name the placed images tarball")
+	cmd.Flags().StringVar(&digests, "digests", "", "Expected digests of the artifacts as a json object indexed by path")
+	cmd.Flags().StringSliceVar(&additional, "additional", nil, "Destination, relative to the data directory, of a pulled additional artifact (can be repeated)")
+	cmd.Flags().StringVar(&report, "report", "/dev/termination-log", "Path the placement progress is written to")
+	cmd.Flags().BoolVar(&check, "check", false, "Only check the artifacts of a previous placement are still on the node")
+	err := cmd.MarkFlagRequired("images-id")
+	if err != nil {
+		panic(err)
+	}
+
+	return cmd
+}
+
+func ArtifactsGCCmd() *cobra.Command {
+	var dataDir, report string
+	var keep []string
+
+	cmd := &cobra.Command{
+		Use:          "gc",
+		Short:        "Remove the images tarballs and charts no longer needed on the node",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := artifacts.CollectGarbage(dataDir, keep, report)
+			if err != nil {
+				return fmt.Errorf("failed to collect garbage: %w", err)
+			}
+			for _, path := range result.Removed {
+				fmt.Fprintf(cmd.OutOrStdout(), "removed %s\n", path)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "freed %d bytes\n", result.Freed)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dataDir, "data-dir", "/var/lib/embedded-cluster", "Embedded cluster data directory")
+	cmd.Flags().StringSliceVar(&keep, "keep", nil, "Path, relative to the data directory, of a file to keep (can be repeated)")
+	cmd.Flags().StringVar(&report, "report", "/dev/termination-log", "Path the garbage collection report is written to")
+
+	return cmd
+}
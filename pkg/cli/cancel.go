@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/upgrade"
+	"github.com/spf13/cobra"
+)
+
+// UpgradeCancelCmd returns a cobra command for cancelling an upgrade in progress.
+func UpgradeCancelCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "cancel INSTALLATION",
+		Short:        "Cancel the upgrade to the given installation",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := k8sutil.KubeClient()
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			if err := upgrade.Cancel(cmd.Context(), cli, args[0]); err != nil {
+				return fmt.Errorf("failed to cancel upgrade: %w", err)
+			}
+
+			fmt.Printf("Upgrade to installation %s cancelled\n", args[0])
+			return nil
+		},
+	}
+
+	return cmd
+}
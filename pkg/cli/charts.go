@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/charts"
+)
+
+func ChartsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "charts",
+		Short: "Manage the releases of the charts reading values from secrets",
+	}
+
+	cmd.AddCommand(
+		ChartsReleaseCmd(),
+		ChartsUninstallCmd(),
+	)
+
+	return cmd
+}
+
+func ChartsReleaseCmd() *cobra.Command {
+	var opts charts.ReleaseOptions
+
+	cmd := &cobra.Command{
+		Use:          "release",
+		Short:        "Install or upgrade a chart release",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := charts.Release(cmd.Context(), opts); err != nil {
+				return fmt.Errorf("failed to release chart: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.Name, "name", "", "Name of the release")
+	cmd.Flags().StringVar(&opts.Chart, "chart", "", "Chart path, oci reference or repository/chart name")
+	cmd.Flags().StringVar(&opts.Version, "version", "", "Chart version")
+	cmd.Flags().StringVar(&opts.Namespace, "namespace", "", "Namespace the chart is released into")
+	cmd.Flags().DurationVar(&opts.Timeout, "timeout", 0, "Time to wait for the chart resources, 0 uses the default")
+	cmd.Flags().StringVar(&opts.ValuesFile, "values", "", "Path to the chart values")
+	cmd.Flags().StringVar(&opts.RepositoriesFile, "repositories", "", "Path to the repositories the chart can be pulled from")
+	for _, flag := range []string{"name", "chart", "namespace", "values"} {
+		if err := cmd.MarkFlagRequired(flag); err != nil {
+			panic(err)
+		}
+	}
+
+	return cmd
+}
+
+func ChartsUninstallCmd() *cobra.Command {
+	var name, namespace string
+
+	cmd := &cobra.Command{
+		Use:          "uninstall",
+		Short:        "Uninstall a chart release",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := charts.Uninstall(cmd.Context(), name, namespace); err != nil {
+				return fmt.Errorf("failed to uninstall chart: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Name of the release")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Namespace of the release")
+	for _, flag := range []string{"name", "namespace"} {
+		if err := cmd.MarkFlagRequired(flag); err != nil {
+			panic(err)
+		}
+	}
+
+	return cmd
+}
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/status"
+	"github.com/spf13/cobra"
+)
+
+// HistoryCmd returns a cobra command listing all installations, including the archived ones.
+func HistoryCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:          "history",
+		Short:        "List the installation history of the cluster",
+		SilenceUsage: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return fmt.Errorf("invalid output format %q, must be table or json", output)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := k8sutil.KubeClient()
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			entries, err := status.CollectHistory(cmd.Context(), cli)
+			if err != nil {
+				return fmt.Errorf("failed to collect history: %w", err)
+			}
+
+			if output == "json" {
+				return status.WriteHistoryJSON(os.Stdout, entries)
+			}
+			return status.WriteHistoryTable(os.Stdout, entries)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format (table or json)")
+
+	return cmd
+}
@@ -21,12 +21,18 @@ func MigrateCmd() *cobra.Command {
 }
 
 func MigrateRegistryDataCmd() *cobra.Command {
+	var concurrency int
+	var partSize int64
+
 	cmd := &cobra.Command{
 		Use:          "registry-data",
 		Short:        "Run the registry-data migration",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			err := migrations.RegistryData(cmd.Context())
+			err := migrations.RegistryData(cmd.Context(), func(opts *migrations.RegistryDataOptions) {
+				opts.Concurrency = concurrency
+				opts.PartSize = partSize
+			})
 			if err != nil {
 				return fmt.Errorf("migration failed: %w", err)
 			}
@@ -34,5 +40,8 @@ func MigrateRegistryDataCmd() *cobra.Command {
 		},
 	}
 
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of files uploaded at the same time")
+	cmd.Flags().Int64Var(&partSize, "part-size", 64<<20, "Size in bytes of the parts larger files are uploaded in")
+
 	return cmd
 }
@@ -26,6 +26,8 @@ func RootCmd() *cobra.Command {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var installationHistoryLimit int
+	var registryCredsNamespaces []string
 
 	cmd := &cobra.Command{
 		Use:          "manager",
@@ -46,7 +48,7 @@ func RootCmd() *cobra.Command {
 			zaplog := zap.New(zap.UseDevMode(true))
 			ctrl.SetLogger(zaplog)
 
-			mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+			opts := ctrl.Options{
 				Scheme: k8sutil.Scheme(),
 				Metrics: metricsserver.Options{
 					BindAddress: metricsAddr,
@@ -56,7 +58,10 @@ func RootCmd() *cobra.Command {
 				LeaderElection:                enableLeaderElection,
 				LeaderElectionID:              "3f2343ef.replicated.com",
 				LeaderElectionReleaseOnCancel: true,
-			})
+			}
+			controllers.ConfigureSecretsCache(&opts)
+
+			mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), opts)
 			if err != nil {
 				setupLog.Error(err, "unable to start manager")
 				os.Exit(1)
@@ -66,6 +71,9 @@ func RootCmd() *cobra.Command {
 				Client:    mgr.GetClient(),
 				Scheme:    mgr.GetScheme(),
 				Discovery: discovery.NewDiscoveryClientForConfigOrDie(ctrl.GetConfigOrDie()),
+
+				InstallationHistoryLimit: installationHistoryLimit,
+				RegistryCredsNamespaces:  registryCredsNamespaces,
 			}).SetupWithManager(mgr); err != nil {
 				setupLog.Error(err, "unable to create controller", "controller", "Installation")
 				os.Exit(1)
@@ -97,6 +105,10 @@ func RootCmd() *cobra.Command {
 	cmd.Flags().BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	cmd.Flags().IntVar(&installationHistoryLimit, "installation-history-limit", controllers.DefaultInstallationHistoryLimit,
+		"Number of obsolete installations kept in the cluster, older ones are archived.")
+	cmd.Flags().StringSliceVar(&registryCredsNamespaces, "registry-creds-namespaces", nil,
+		"Namespaces the registry credentials are copied into in airgap installations, besides the embedded cluster one.")
 
 	return cmd
 }
@@ -115,5 +127,9 @@ func addSubcommands(cmd *cobra.Command) {
 	cmd.AddCommand(
 		MigrateCmd(),
 		UpgradeCmd(),
+		StatusCmd(),
+		HistoryCmd(),
+		ArtifactsCmd(),
+		ChartsCmd(),
 	)
 }
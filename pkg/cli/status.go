@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/status"
+	"github.com/spf13/cobra"
+)
+
+// StatusCmd returns a cobra command summarising the health of the newest installation.
+func StatusCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:          "status",
+		Short:        "Show the status of the embedded cluster installation",
+		SilenceUsage: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return fmt.Errorf("invalid output format %q, must be table or json", output)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := k8sutil.KubeClient()
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			report, err := status.Collect(cmd.Context(), cli)
+			if err != nil {
+				return fmt.Errorf("failed to collect status: %w", err)
+			}
+
+			if output == "json" {
+				return status.WriteJSON(os.Stdout, report)
+			}
+			return status.WriteTable(os.Stdout, report)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format (table or json)")
+
+	return cmd
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
@@ -14,17 +15,36 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 )
 
+// podLogsTailLines is the number of log lines reported for each failing pod when an upgrade
+// phase fails or times out.
+const podLogsTailLines = 20
+
 // UpgradeCmd returns a cobra command for upgrading the embedded cluster operator.
 // It is called by KOTS admin console to upgrade the embedded cluster operator and installation.
 func UpgradeCmd() *cobra.Command {
-	var installationFile, localArtifactMirrorImage string
+	var installationFile, localArtifactMirrorImage, operatorImage, output string
+	var waitForInstallation bool
+	var maxConcurrentArtifactJobs int
+	var timeout, operatorChartTimeout, artifactsTimeout, airgapImagesTimeout time.Duration
 
 	cmd := &cobra.Command{
 		Use:          "upgrade",
 		Short:        "Upgrade the embedded cluster operator",
 		SilenceUsage: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if output != "text" && output != "json" {
+				return fmt.Errorf("invalid output format %q, must be text or json", output)
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fmt.Println("Upgrade command started")
+			// when streaming json the output must only contain progress events.
+			stdout := io.Writer(os.Stdout)
+			if waitForInstallation && output == "json" {
+				stdout = os.Stderr
+			}
+
+			fmt.Fprintln(stdout, "Upgrade command started")
 
 			cli, err := k8sutil.KubeClient()
 			if err != nil {
@@ -41,20 +61,55 @@ func UpgradeCmd() *cobra.Command {
 				return fmt.Errorf("failed to decode installation: %w", err)
 			}
 
-			fmt.Printf("Upgrading to installation %s (k0s version %s)\n", in.Name, in.Spec.Config.Version)
+			fmt.Fprintf(stdout, "Upgrading to installation %s (k0s version %s)\n", in.Name, in.Spec.Config.Version)
 
-			err = upgrade.Upgrade(cmd.Context(), cli, in, localArtifactMirrorImage)
+			ctx := cmd.Context()
+			if waitForInstallation && timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			err = upgrade.Upgrade(ctx, cli, in, localArtifactMirrorImage, func(opts *upgrade.UpgradeOptions) {
+				opts.OperatorChartTimeout = operatorChartTimeout
+				opts.ArtifactsTimeout = artifactsTimeout
+				opts.AirgapImagesTimeout = airgapImagesTimeout
+				opts.MaxConcurrentArtifactJobs = maxConcurrentArtifactJobs
+				opts.OperatorImage = operatorImage
+				opts.PodLogs = func(ctx context.Context, namespace, pod, container string) (string, error) {
+					return k8sutil.PodLogs(ctx, namespace, pod, container, podLogsTailLines)
+				}
+			})
 			if err != nil {
 				return fmt.Errorf("failed to upgrade: %w", err)
 			}
 
-			fmt.Println("Upgrade command completed successfully")
+			if waitForInstallation {
+				fmt.Fprintf(stdout, "Waiting for installation %s to settle\n", in.Name)
+				w := upgrade.ProgressWriter{Out: os.Stdout, JSON: output == "json"}
+				err = upgrade.WaitForInstallation(ctx, cli, in.Name, w)
+				if err != nil {
+					return fmt.Errorf("failed to wait for installation: %w", err)
+				}
+			}
+
+			fmt.Fprintln(stdout, "Upgrade command completed successfully")
 			return nil
 		},
 	}
 
-	// TODO(upgrade): local-artifact-mirror-image should be included in the installation object
-	cmd.Flags().StringVar(&localArtifactMirrorImage, "local-artifact-mirror-image", "", "Local artifact mirror image")
+	cmd.Flags().BoolVar(&waitForInstallation, "wait", false, "Wait for the installation to be installed or to fail")
+	cmd.Flags().DurationVar(&timeout, "timeout", time.Hour, "Maximum time to wait for the upgrade when --wait is set")
+	cmd.Flags().DurationVar(&operatorChartTimeout, "operator-chart-timeout", 15*time.Minute, "Maximum time to wait for the operator chart to be deployed (0 waits forever)")
+	cmd.Flags().DurationVar(&artifactsTimeout, "artifacts-timeout", time.Hour, "Maximum time to wait for the artifacts to be copied to the nodes (0 waits forever)")
+	cmd.Flags().DurationVar(&airgapImagesTimeout, "airgap-images-timeout", time.Hour, "Maximum time to wait for the airgap images to be uploaded to the nodes (0 waits forever)")
+	cmd.Flags().StringVar(&output, "output", "text", "Format of the progress reported when --wait is set (text or json)")
+
+	cmd.Flags().IntVar(&maxConcurrentArtifactJobs, "max-concurrent-artifact-jobs", 0, "Maximum number of nodes copying the airgap artifacts at the same time (0 for no limit)")
+	cmd.Flags().StringVar(&localArtifactMirrorImage, "local-artifact-mirror-image", "", "Local artifact mirror image, overrides the image referenced in the release metadata")
+	cmd.Flags().StringVar(&operatorImage, "operator-image", "", "Operator image used to place the artifacts on the nodes, defaults to the one in the release metadata")
+
+	cmd.AddCommand(UpgradeCancelCmd())
 
 	cmd.Flags().StringVar(&installationFile, "installation", "", "Path to the installation file")
 	err := cmd.MarkFlagRequired("installation")
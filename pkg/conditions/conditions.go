@@ -0,0 +1,114 @@
+// Package conditions holds the conditions, states and annotations the operator sets on
+// installations. It is shared by the operator, the upgrade commands and the status reports so
+// none of them has to import the others.
+package conditions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// CompletedConditionType is set once the installation reaches the Installed state. The
+	// condition transition time marks the end of the upgrade.
+	CompletedConditionType = "Completed"
+	// FinalStateConditionType is set when the installation becomes obsolete. The condition
+	// reason holds the state the installation was in when it was superseded.
+	FinalStateConditionType = "FinalState"
+	// HAConditionType holds the progress of the migration to high availability.
+	HAConditionType = "HighAvailability"
+	// CancelConditionType is set when the upgrade to the installation could not be cancelled
+	// as requested.
+	CancelConditionType = "UpgradeCancel"
+
+	// InstallationStateCancelled is the state of an installation whose upgrade has been
+	// cancelled. Cancelled installations are ignored by the operator.
+	InstallationStateCancelled = "Cancelled"
+
+	// InstallationNameAnnotation is the annotation we keep in the autopilot plan so we can
+	// map 1 to 1 one installation and one plan.
+	InstallationNameAnnotation = "embedded-cluster.replicated.com/installation-name"
+
+	// ChartRetriesAnnotation is kept in the installation, it holds the retries of its failed
+	// charts as a json object indexed by chart name so they can be read without parsing the
+	// chart condition messages.
+	ChartRetriesAnnotation = "embedded-cluster.replicated.com/chart-retries"
+
+	// KubernetesVersionAnnotation is kept in the installation once it completes, it holds the
+	// kubernetes version the installation deployed.
+	KubernetesVersionAnnotation = "embedded-cluster.replicated.com/kubernetes-version"
+
+	// chartConditionPrefix prefixes the type of the conditions holding the status of a chart.
+	chartConditionPrefix = "HelmChart-"
+)
+
+// ChartRetries holds the number of times the operator has retried a failed chart.
+type ChartRetries struct {
+	Attempts    int `json:"attempts"`
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+// Exhausted returns true once the operator has given up retrying the chart.
+func (c ChartRetries) Exhausted() bool {
+	return c.Attempts >= c.MaxAttempts
+}
+
+// ChartConditionType returns the type of the installation condition holding the status of
+// the given chart.
+func ChartConditionType(chartName string) string {
+	return chartConditionPrefix + chartName
+}
+
+// IsChartCondition returns true if the condition holds the status of a chart.
+func IsChartCondition(cond metav1.Condition) bool {
+	return strings.HasPrefix(cond.Type, chartConditionPrefix)
+}
+
+// ChartName returns the name of the chart whose status the chart condition holds.
+func ChartName(cond metav1.Condition) string {
+	return strings.TrimPrefix(cond.Type, chartConditionPrefix)
+}
+
+// ChartRetriesExhaustedMessage returns the message reported once a chart failed the given number
+// of retries and won't be retried again.
+func ChartRetriesExhaustedMessage(attempts int) string {
+	return fmt.Sprintf("Chart failed after %d retries.", attempts)
+}
+
+// ChartRetriesFor returns the retries of the failed charts of the installation, indexed by chart
+// name.
+func ChartRetriesFor(in metav1.Object) (map[string]ChartRetries, error) {
+	retries := map[string]ChartRetries{}
+	data, ok := in.GetAnnotations()[ChartRetriesAnnotation]
+	if !ok {
+		return retries, nil
+	}
+	if err := json.Unmarshal([]byte(data), &retries); err != nil {
+		return nil, fmt.Errorf("unmarshal chart retries: %w", err)
+	}
+	return retries, nil
+}
+
+// SetChartRetries records the retries of the failed charts in the installation annotations. The
+// annotation is removed if no chart is being retried.
+func SetChartRetries(in metav1.Object, retries map[string]ChartRetries) error {
+	annotations := in.GetAnnotations()
+	if len(retries) == 0 {
+		delete(annotations, ChartRetriesAnnotation)
+		in.SetAnnotations(annotations)
+		return nil
+	}
+	data, err := json.Marshal(retries)
+	if err != nil {
+		return fmt.Errorf("marshal chart retries: %w", err)
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ChartRetriesAnnotation] = string(data)
+	in.SetAnnotations(annotations)
+	return nil
+}
@@ -1,7 +1,9 @@
 package k8sutil
 
 import (
+	"context"
 	"fmt"
+	"io"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -11,8 +13,10 @@ import (
 	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
 	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
 	embeddedclusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
@@ -43,3 +47,26 @@ func KubeClient() (client.Client, error) {
 	}
 	return client.New(cfg, client.Options{Scheme: newScheme})
 }
+
+// PodLogs returns the last lines of the logs of a container in a pod.
+func PodLogs(ctx context.Context, namespace, pod, container string, tailLines int64) (string, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return "", fmt.Errorf("unable to process kubernetes config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return "", fmt.Errorf("create clientset: %w", err)
+	}
+	opts := &corev1.PodLogOptions{Container: container, TailLines: &tailLines}
+	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(pod, opts).Stream(ctx)
+	if err != nil {
+		return "", fmt.Errorf("stream logs: %w", err)
+	}
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return "", fmt.Errorf("read logs: %w", err)
+	}
+	return string(data), nil
+}
@@ -16,8 +16,10 @@ import (
 )
 
 // CopyVersionMetadataToCluster makes sure a config map with the embedded cluster version metadata exists in the
-// cluster. The data is read from the internal registry on the repository pointed by EmbeddedClusterMetadata.
-func CopyVersionMetadataToCluster(ctx context.Context, cli client.Client, in *v1beta1.Installation) error {
+// cluster. The data is read from the internal registry on the repository pointed by EmbeddedClusterMetadata,
+// or from an OCI image layout on disk if it is an oci-layout:// reference. The pull options are passed along to
+// artifacts.Pull.
+func CopyVersionMetadataToCluster(ctx context.Context, cli client.Client, in *v1beta1.Installation, pullOpts ...func(*artifacts.PullOptions)) error {
 	log := ctrl.LoggerFrom(ctx)
 
 	// if there is no configuration, no version inside the configuration or the no artifacts location
@@ -39,8 +41,8 @@ func CopyVersionMetadataToCluster(ctx context.Context, cli client.Client, in *v1
 	}
 
 	// pull the artifact from the artifact location pointed by EmbeddedClusterMetadata. This property
-	// points to a repository inside the registry running on the cluster.
-	location, err := artifacts.Pull(ctx, log, cli, in.Spec.Artifacts.EmbeddedClusterMetadata)
+	// points to a repository inside the registry running on the cluster or to an oci layout.
+	location, err := artifacts.Pull(ctx, log, cli, in.Spec.Artifacts.EmbeddedClusterMetadata, pullOpts...)
 	if err != nil {
 		return fmt.Errorf("pull artifact: %w", err)
 	}
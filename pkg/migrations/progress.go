@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
+)
+
+// progressInterval is how often the registry data migration progress is published.
+var progressInterval = 10 * time.Second
+
+// countFiles returns the number of regular files under the directory and their total size.
+func countFiles(root string) (int, int64, error) {
+	var files int
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// progressReporter keeps track of the files migrated and publishes the progress, for the
+// operator to report it, every progressInterval. It is safe for concurrent use.
+type progressReporter struct {
+	mu        sync.Mutex
+	cli       client.Client
+	progress  registry.MigrationProgress
+	published time.Time
+}
+
+func newProgressReporter(cli client.Client, files int, size int64) *progressReporter {
+	now := time.Now()
+	return &progressReporter{
+		cli: cli,
+		progress: registry.MigrationProgress{
+			FilesTotal: files,
+			BytesTotal: size,
+			StartedAt:  now,
+			UpdatedAt:  now,
+		},
+		published: now,
+	}
+}
+
+// add records a migrated file and how many of its bytes were already in the bucket, and
+// publishes the progress if it has not been for a while.
+func (r *progressReporter) add(ctx context.Context, size, skipped int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.FilesDone++
+	r.progress.BytesDone += size
+	r.progress.BytesSkipped += skipped
+	if time.Since(r.published) >= progressInterval {
+		r.publishLocked(ctx)
+	}
+}
+
+// publish writes the progress to the progress config map. Failing to do so does not stop the
+// migration.
+func (r *progressReporter) publish(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.publishLocked(ctx)
+}
+
+func (r *progressReporter) publishLocked(ctx context.Context) {
+	r.published = time.Now()
+	r.progress.UpdatedAt = r.published
+	fmt.Printf("%s\n", r.progress.Message())
+	if err := registry.WriteMigrationProgress(ctx, r.cli, r.progress); err != nil {
+		fmt.Printf("Failed to publish migration progress: %v\n", err)
+	}
+}
@@ -15,14 +15,41 @@ import (
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// registryDataDir is where the registry data is mounted in the migration job.
+const registryDataDir = "/var/lib/embedded-cluster/registry"
+
+// RegistryDataOptions holds the options for RegistryData.
+type RegistryDataOptions struct {
+	// Concurrency is the number of files uploaded at the same time.
+	Concurrency int
+	// PartSize is the size of the parts files larger than it are uploaded in. It can't be
+	// smaller than 5MiB.
+	PartSize int64
+}
+
 // RegistryData runs a migration that copies data from the disk (/var/lib/embedded-cluster/registry)
 // to the seaweedfs s3 store. If it fails, it will scale the registry deployment back to 1. If it
-// succeeds, it will create a secret used to indicate success to the operator.
-func RegistryData(ctx context.Context) error {
+// succeeds, it will create a secret used to indicate success to the operator. The progress is
+// published periodically to a config map the operator reports in the installation status. Files
+// already in the bucket are not uploaded again, nor are the parts of the interrupted multipart
+// uploads, so a failed migration is resumed when retried.
+func RegistryData(ctx context.Context, applyOpts ...func(*RegistryDataOptions)) error {
+	opts := &RegistryDataOptions{
+		Concurrency: 4,
+		PartSize:    64 << 20,
+	}
+	for _, apply := range applyOpts {
+		apply(opts)
+	}
+	if opts.PartSize < minPartSize {
+		return fmt.Errorf("part size %d is smaller than the minimum of %d", opts.PartSize, minPartSize)
+	}
+
 	// if the migration fails, we need to scale the registry back to 1
 	success := false
 	defer func() {
@@ -61,49 +88,41 @@ func RegistryData(ctx context.Context) error {
 		Bucket: &registryStr,
 	})
 	if err != nil {
-		if !strings.Contains(err.Error(), "BucketAlreadyExists") {
+		// the bucket is already there if a previous migration attempt failed.
+		if !strings.Contains(err.Error(), "BucketAlreadyExists") && !strings.Contains(err.Error(), "BucketAlreadyOwnedByYou") {
 			return fmt.Errorf("create bucket: %w", err)
 		}
 	}
 
-	fmt.Printf("Running registry data migration\n")
-	err = filepath.Walk("/var/lib/embedded-cluster/registry", func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-
-		f, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("open file: %w", err)
-		}
-		defer f.Close()
-
-		relPath, err := filepath.Rel("/var/lib/embedded-cluster", path)
-		if err != nil {
-			return fmt.Errorf("get relative path: %w", err)
-		}
-
-		fmt.Printf("uploading %s, size %d\n", relPath, info.Size())
-		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-			Bucket: &registryStr,
-			Body:   f,
-			Key:    &relPath,
-		})
-		if err != nil {
-			return fmt.Errorf("upload object: %w", err)
-		}
+	cli, err := k8sutil.KubeClient()
+	if err != nil {
+		return fmt.Errorf("unable to create kubernetes client: %w", err)
+	}
 
-		return nil
-	})
+	fmt.Printf("Counting registry data\n")
+	files, size, err := countFiles(registryDataDir)
 	if err != nil {
-		return fmt.Errorf("walk registry data: %w", err)
+		return fmt.Errorf("count registry data: %w", err)
 	}
+	progress := newProgressReporter(cli, files, size)
+	progress.publish(ctx)
 
-	fmt.Printf("Creating registry data migration secret\n")
-	cli, err := k8sutil.KubeClient()
+	fmt.Printf("Running registry data migration\n")
+	up := &uploader{
+		s3:     s3Client,
+		bucket: registryStr,
+		opts:   *opts,
+		onUploaded: func(size, skipped int64) {
+			progress.add(ctx, size, skipped)
+		},
+	}
+	err = up.uploadDir(ctx, filepath.Dir(registryDataDir), registryDataDir)
 	if err != nil {
-		return fmt.Errorf("unable to create kubernetes client: %w", err)
+		return fmt.Errorf("upload registry data: %w", err)
 	}
+	progress.publish(ctx)
+
+	fmt.Printf("Creating registry data migration secret\n")
 
 	migrationSecret := corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
@@ -119,7 +138,7 @@ func RegistryData(ctx context.Context) error {
 		},
 	}
 	err = cli.Create(ctx, &migrationSecret)
-	if err != nil {
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
 		return fmt.Errorf("create registry data migration secret: %w", err)
 	}
 
@@ -0,0 +1,425 @@
+package migrations
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// checksumKey is the object tag holding the hex encoded sha256 digest of the uploaded file. It
+// is used to tell if an object was fully uploaded by a previous run. The digest is computed while
+// the file is uploaded so it is only known, and tagged, once the object exists.
+const checksumKey = "sha256"
+
+// minPartSize is the smallest part size accepted by s3 for multipart uploads.
+const minPartSize = 5 << 20
+
+// s3API is the subset of the s3 client used to upload the registry data.
+type s3API interface {
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObjectTagging(context.Context, *s3.GetObjectTaggingInput, ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(context.Context, *s3.PutObjectTaggingInput, ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListMultipartUploads(context.Context, *s3.ListMultipartUploadsInput, ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+	ListParts(context.Context, *s3.ListPartsInput, ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+}
+
+// uploader copies the files under a directory to a bucket. Objects already in the bucket with
+// the size and checksum of the file are not uploaded again and multipart uploads left behind are
+// resumed, so an interrupted upload can be resumed by running it again.
+type uploader struct {
+	s3     s3API
+	bucket string
+	opts   RegistryDataOptions
+	// onUploaded is called with the size of the file after it has been uploaded or skipped and
+	// with how many of its bytes were already in the bucket, it may be called concurrently.
+	onUploaded func(size, skipped int64)
+}
+
+// uploadDir uploads the files under root, keyed by their path relative to base, with at most
+// opts.Concurrency uploads running at the same time. Multipart uploads left behind by a previous
+// run are resumed by the upload of their file, the ones for files that no longer exist are
+// aborted once all the files have been uploaded.
+func (u *uploader) uploadDir(ctx context.Context, base, root string) error {
+	pending, err := u.listMultipartUploads(ctx)
+	if err != nil {
+		return fmt.Errorf("list incomplete multipart uploads: %w", err)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(u.opts.Concurrency, 1))
+	walked := map[string]bool{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		key, err := filepath.Rel(base, path)
+		if err != nil {
+			return fmt.Errorf("get relative path: %w", err)
+		}
+		if gctx.Err() != nil {
+			// an upload failed, no need to walk any further.
+			return filepath.SkipAll
+		}
+		walked[key] = true
+		uploads := pending[key]
+		g.Go(func() error {
+			if err := u.uploadFile(gctx, path, key, info.Size(), uploads); err != nil {
+				return fmt.Errorf("upload %s: %w", key, err)
+			}
+			return nil
+		})
+		return nil
+	})
+	if gerr := g.Wait(); gerr != nil {
+		return gerr
+	} else if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		if !walked[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := u.abortMultipartUploads(ctx, key, pending[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads the file under the given key unless an object with the same size and
+// checksum already exists. Files larger than the part size are uploaded in parts, resuming one
+// of the given multipart uploads if possible. The checksum is computed while uploading.
+func (u *uploader) uploadFile(ctx context.Context, path, key string, size int64, uploads []types.MultipartUpload) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	uploaded, err := u.isUploaded(ctx, f, key, size)
+	if err != nil {
+		return fmt.Errorf("check object: %w", err)
+	}
+	if uploaded {
+		fmt.Printf("Skipping %s, already uploaded\n", key)
+		if err := u.abortMultipartUploads(ctx, key, uploads); err != nil {
+			return err
+		}
+		u.onUploaded(size, size)
+		return nil
+	}
+
+	fmt.Printf("Uploading %s, size %d\n", key, size)
+	var checksum string
+	var skipped int64
+	if size > u.opts.PartSize {
+		checksum, skipped, err = u.uploadMultipart(ctx, f, key, size, uploads)
+	} else {
+		if err := u.abortMultipartUploads(ctx, key, uploads); err != nil {
+			return err
+		}
+		checksum, err = u.putObject(ctx, f, key, size)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = u.s3.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket: &u.bucket,
+		Key:    &key,
+		Tagging: &types.Tagging{
+			TagSet: []types.Tag{{Key: aws.String(checksumKey), Value: aws.String(checksum)}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("tag object checksum: %w", err)
+	}
+	u.onUploaded(size, skipped)
+	return nil
+}
+
+// isUploaded returns true if the object exists with the given size and the checksum of the
+// file. The file is only hashed if the object has the same size and a recorded checksum.
+func (u *uploader) isUploaded(ctx context.Context, f *os.File, key string, size int64) (bool, error) {
+	head, err := u.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &u.bucket, Key: &key})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if aws.ToInt64(head.ContentLength) != size {
+		return false, nil
+	}
+
+	tags, err := u.s3.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: &u.bucket, Key: &key})
+	if err != nil {
+		return false, fmt.Errorf("get object tags: %w", err)
+	}
+	var recorded string
+	for _, tag := range tags.TagSet {
+		if aws.ToString(tag.Key) == checksumKey {
+			recorded = aws.ToString(tag.Value)
+		}
+	}
+	if recorded == "" {
+		// uploaded by a migration that did not record checksums.
+		return false, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, size)); err != nil {
+		return false, fmt.Errorf("checksum file: %w", err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)) == recorded, nil
+}
+
+// putObject uploads the file in a single request and returns its checksum.
+func (u *uploader) putObject(ctx context.Context, f *os.File, key string, size int64) (string, error) {
+	hash := sha256.New()
+	body := newHashingReader(f, 0, size, hash)
+	_, err := u.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &u.bucket,
+		Key:           &key,
+		Body:          body,
+		ContentLength: &size,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := body.finish(); err != nil {
+		return "", fmt.Errorf("checksum file: %w", err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// uploadMultipart uploads the file in parts of opts.PartSize and returns its checksum and how
+// many bytes were already uploaded. The newest of the given multipart uploads is resumed if its
+// parts have the expected sizes, parts that differ from the file are uploaded again. The upload
+// is left behind on failure so the next run can resume it.
+func (u *uploader) uploadMultipart(ctx context.Context, f *os.File, key string, size int64, uploads []types.MultipartUpload) (string, int64, error) {
+	uploadID, uploaded, err := u.resumableUpload(ctx, key, size, uploads)
+	if err != nil {
+		return "", 0, err
+	}
+	if uploadID == nil {
+		created, err := u.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: &u.bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("create multipart upload: %w", err)
+		}
+		uploadID = created.UploadId
+	} else {
+		fmt.Printf("Resuming multipart upload of %s, %d parts already uploaded\n", key, len(uploaded))
+	}
+
+	hash := sha256.New()
+	var skipped int64
+	var parts []types.CompletedPart
+	for offset, number := int64(0), int32(1); offset < size; offset, number = offset+u.opts.PartSize, number+1 {
+		length := min(u.opts.PartSize, size-offset)
+		body := newHashingReader(f, offset, length, hash)
+		if part, ok := uploaded[number]; ok {
+			same, err := sameETag(body, part.ETag)
+			if err != nil {
+				return "", 0, fmt.Errorf("check part %d: %w", number, err)
+			}
+			if same {
+				parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(number)})
+				skipped += length
+				continue
+			}
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return "", 0, fmt.Errorf("rewind part %d: %w", number, err)
+			}
+		}
+
+		part, err := u.s3.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        &u.bucket,
+			Key:           &key,
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(number),
+			Body:          body,
+			ContentLength: aws.Int64(length),
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("upload part %d: %w", number, err)
+		}
+		if err := body.finish(); err != nil {
+			return "", 0, fmt.Errorf("checksum part %d: %w", number, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(number)})
+	}
+
+	_, err = u.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &u.bucket,
+		Key:             &key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), skipped, nil
+}
+
+// resumableUpload returns the id of the newest of the multipart uploads and its parts indexed
+// by number. The other uploads are aborted, so is the newest one if its parts were not cut at
+// opts.PartSize for a file of the given size. Returns a nil id if there is nothing to resume.
+func (u *uploader) resumableUpload(ctx context.Context, key string, size int64, uploads []types.MultipartUpload) (*string, map[int32]types.Part, error) {
+	if len(uploads) == 0 {
+		return nil, nil, nil
+	}
+	uploads = append([]types.MultipartUpload(nil), uploads...)
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return aws.ToTime(uploads[i].Initiated).After(aws.ToTime(uploads[j].Initiated))
+	})
+	if err := u.abortMultipartUploads(ctx, key, uploads[1:]); err != nil {
+		return nil, nil, err
+	}
+	newest := uploads[0]
+
+	parts := map[int32]types.Part{}
+	input := &s3.ListPartsInput{Bucket: &u.bucket, Key: &key, UploadId: newest.UploadId}
+	for {
+		out, err := u.s3.ListParts(ctx, input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("list parts: %w", err)
+		}
+		for _, part := range out.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = part
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		input.PartNumberMarker = out.NextPartNumberMarker
+	}
+
+	for number, part := range parts {
+		offset := int64(number-1) * u.opts.PartSize
+		if number < 1 || offset >= size || aws.ToInt64(part.Size) != min(u.opts.PartSize, size-offset) {
+			fmt.Printf("Parts of the multipart upload of %s do not match the file\n", key)
+			if err := u.abortMultipartUploads(ctx, key, uploads[:1]); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, nil
+		}
+	}
+	return newest.UploadId, parts, nil
+}
+
+// sameETag reads the part and returns true if the etag is its md5 digest, as set by s3 for
+// parts uploaded without server side encryption.
+func sameETag(part io.Reader, etag *string) (bool, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, part); err != nil {
+		return false, err
+	}
+	return strings.Trim(aws.ToString(etag), `"`) == fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// listMultipartUploads returns the multipart uploads in progress in the bucket indexed by key.
+func (u *uploader) listMultipartUploads(ctx context.Context) (map[string][]types.MultipartUpload, error) {
+	uploads := map[string][]types.MultipartUpload{}
+	input := &s3.ListMultipartUploadsInput{Bucket: &u.bucket}
+	for {
+		out, err := u.s3.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range out.Uploads {
+			key := aws.ToString(upload.Key)
+			uploads[key] = append(uploads[key], upload)
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return uploads, nil
+		}
+		input.KeyMarker, input.UploadIdMarker = out.NextKeyMarker, out.NextUploadIdMarker
+	}
+}
+
+// abortMultipartUploads aborts the given multipart uploads of the key.
+func (u *uploader) abortMultipartUploads(ctx context.Context, key string, uploads []types.MultipartUpload) error {
+	for _, upload := range uploads {
+		fmt.Printf("Aborting incomplete multipart upload of %s\n", key)
+		_, err := u.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &u.bucket,
+			Key:      &key,
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			return fmt.Errorf("abort multipart upload of %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// hashingReader reads a section of a file and feeds its bytes to a hash, in order and only
+// once. The s3 client may rewind the body, to sign it or to retry a request, without the bytes
+// being hashed twice.
+type hashingReader struct {
+	section *io.SectionReader
+	hash    hash.Hash
+	// offset is the position in the section and hashed how many of its bytes were hashed.
+	offset int64
+	hashed int64
+}
+
+func newHashingReader(f io.ReaderAt, offset, length int64, hash hash.Hash) *hashingReader {
+	return &hashingReader{section: io.NewSectionReader(f, offset, length), hash: hash}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.section.Read(p)
+	if end := r.offset + int64(n); r.offset <= r.hashed && end > r.hashed {
+		r.hash.Write(p[r.hashed-r.offset : n])
+		r.hashed = end
+	}
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.section.Seek(offset, whence)
+	if err == nil {
+		r.offset = pos
+	}
+	return pos, err
+}
+
+// finish hashes the bytes of the section that have not been read, the hash then holds the
+// whole section.
+func (r *hashingReader) finish() error {
+	n, err := io.Copy(r.hash, io.NewSectionReader(r.section, r.hashed, r.section.Size()-r.hashed))
+	r.hashed += n
+	return err
+}
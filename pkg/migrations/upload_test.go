@@ -0,0 +1,395 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeObject struct {
+	data []byte
+	tags map[string]string
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int32][]byte
+}
+
+// fakeS3 is an in memory bucket recording the keys written to it and the parts uploaded.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	uploads  map[string]*fakeUpload
+	written  []string
+	aborted  []string
+	parts    []string
+	failPart int32
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]fakeObject{}, uploads: map[string]*fakeUpload{}}
+}
+
+func etagOf(data []byte) *string {
+	return aws.String(fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data))))
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(obj.data)))}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[*in.Key] = fakeObject{data: data}
+	f.written = append(f.written, *in.Key)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectTagging(_ context.Context, in *s3.GetObjectTaggingInput, _ ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.GetObjectTaggingOutput{}
+	for key, value := range f.objects[*in.Key].tags {
+		out.TagSet = append(out.TagSet, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) PutObjectTagging(_ context.Context, in *s3.PutObjectTaggingInput, _ ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	obj.tags = map[string]string{}
+	for _, tag := range in.Tagging.TagSet {
+		obj.tags[*tag.Key] = *tag.Value
+	}
+	f.objects[*in.Key] = obj
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("upload-%d", len(f.uploads))
+	f.uploads[id] = &fakeUpload{key: *in.Key, parts: map[int32][]byte{}}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if *in.PartNumber == f.failPart {
+		return nil, fmt.Errorf("connection reset")
+	}
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploads[*in.UploadId].parts[*in.PartNumber] = data
+	f.parts = append(f.parts, fmt.Sprintf("%s#%d", *in.Key, *in.PartNumber))
+	return &s3.UploadPartOutput{ETag: etagOf(data)}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload := f.uploads[*in.UploadId]
+	var data []byte
+	for _, part := range in.MultipartUpload.Parts {
+		if *part.ETag != *etagOf(upload.parts[*part.PartNumber]) {
+			return nil, &types.NoSuchUpload{}
+		}
+		data = append(data, upload.parts[*part.PartNumber]...)
+	}
+	f.objects[upload.key] = fakeObject{data: data}
+	f.written = append(f.written, upload.key)
+	delete(f.uploads, *in.UploadId)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, *in.UploadId)
+	f.aborted = append(f.aborted, *in.Key)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListMultipartUploads(_ context.Context, _ *s3.ListMultipartUploadsInput, _ ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListMultipartUploadsOutput{}
+	for id, upload := range f.uploads {
+		out.Uploads = append(out.Uploads, types.MultipartUpload{Key: aws.String(upload.key), UploadId: aws.String(id)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) ListParts(_ context.Context, in *s3.ListPartsInput, _ ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListPartsOutput{}
+	for number, data := range f.uploads[*in.UploadId].parts {
+		out.Parts = append(out.Parts, types.Part{
+			PartNumber: aws.Int32(number),
+			Size:       aws.Int64(int64(len(data))),
+			ETag:       etagOf(data),
+		})
+	}
+	return out, nil
+}
+
+func checksumOf(data string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+func Test_uploader_uploadDir(t *testing.T) {
+	files := map[string]string{
+		"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data":                   "small",
+		"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data":                   "a blob larger than the part size",
+		"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link": "sha256:aaaa",
+	}
+
+	tests := []struct {
+		name        string
+		existing    map[string]fakeObject
+		uploads     map[string]*fakeUpload
+		failPart    int32
+		wantWritten []string
+		wantParts   []string
+		wantSkipped int64
+		wantAborted []string
+		wantPending int
+		wantErr     bool
+	}{
+		{
+			name: "empty bucket",
+			wantWritten: []string{
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data",
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link",
+			},
+			wantParts: []string{
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#1",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#2",
+			},
+		},
+		{
+			name: "half migrated bucket",
+			existing: map[string]fakeObject{
+				// fully uploaded by a previous run.
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data": {
+					data: []byte("small"), tags: map[string]string{checksumKey: checksumOf("small")},
+				},
+				// uploaded by a migration that did not record checksums.
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link": {
+					data: []byte("sha256:aaaa"),
+				},
+			},
+			uploads: map[string]*fakeUpload{
+				// parts cut at another part size can't be resumed.
+				"stale": {key: "registry/docker/registry/v2/blobs/sha256/bb/bbbb/data", parts: map[int32][]byte{1: []byte("a blob")}},
+				// the file is gone.
+				"gone": {key: "registry/docker/registry/v2/blobs/sha256/cc/cccc/data", parts: map[int32][]byte{}},
+			},
+			wantWritten: []string{
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data",
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link",
+			},
+			wantParts: []string{
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#1",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#2",
+			},
+			wantSkipped: 5,
+			wantAborted: []string{
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data",
+				"registry/docker/registry/v2/blobs/sha256/cc/cccc/data",
+			},
+		},
+		{
+			name: "checksums in tags",
+			existing: map[string]fakeObject{
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data": {
+					data: []byte("small"), tags: map[string]string{checksumKey: checksumOf("small")},
+				},
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data": {
+					data: []byte("a blob larger than the part size"), tags: map[string]string{checksumKey: checksumOf("a blob larger than the part size")},
+				},
+			},
+			uploads: map[string]*fakeUpload{
+				"leftover": {key: "registry/docker/registry/v2/blobs/sha256/bb/bbbb/data", parts: map[int32][]byte{1: []byte("a blob larger th")}},
+			},
+			wantWritten: []string{
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link",
+			},
+			wantSkipped: 37,
+			wantAborted: []string{"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data"},
+		},
+		{
+			name: "checksum mismatch",
+			existing: map[string]fakeObject{
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data": {
+					data: []byte("SMALL"), tags: map[string]string{checksumKey: checksumOf("SMALL")},
+				},
+			},
+			wantWritten: []string{
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data",
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link",
+			},
+			wantParts: []string{
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#1",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#2",
+			},
+		},
+		{
+			name: "resumed multipart upload",
+			uploads: map[string]*fakeUpload{
+				"previous": {key: "registry/docker/registry/v2/blobs/sha256/bb/bbbb/data", parts: map[int32][]byte{1: []byte("a blob larger th")}},
+			},
+			wantWritten: []string{
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data",
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link",
+			},
+			wantParts:   []string{"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#2"},
+			wantSkipped: 16,
+		},
+		{
+			name: "resumed multipart upload with a modified part",
+			uploads: map[string]*fakeUpload{
+				"previous": {key: "registry/docker/registry/v2/blobs/sha256/bb/bbbb/data", parts: map[int32][]byte{1: []byte("A BLOB LARGER TH")}},
+			},
+			wantWritten: []string{
+				"registry/docker/registry/v2/blobs/sha256/aa/aaaa/data",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data",
+				"registry/docker/registry/v2/repositories/app/_manifests/tags/1.0.0/link",
+			},
+			wantParts: []string{
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#1",
+				"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#2",
+			},
+		},
+		{
+			name:        "failed multipart upload",
+			failPart:    2,
+			wantParts:   []string{"registry/docker/registry/v2/blobs/sha256/bb/bbbb/data#1"},
+			wantPending: 1,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+
+			base := t.TempDir()
+			for path, content := range files {
+				req.NoError(os.MkdirAll(filepath.Join(base, filepath.Dir(path)), 0755))
+				req.NoError(os.WriteFile(filepath.Join(base, path), []byte(content), 0644))
+			}
+
+			fake := newFakeS3()
+			fake.failPart = tt.failPart
+			for key, obj := range tt.existing {
+				fake.objects[key] = obj
+			}
+			for id, upload := range tt.uploads {
+				fake.uploads[id] = upload
+			}
+
+			var mu sync.Mutex
+			var uploaded int
+			var skipped int64
+			up := &uploader{
+				s3:     fake,
+				bucket: "registry",
+				opts:   RegistryDataOptions{Concurrency: 2, PartSize: 16},
+				onUploaded: func(size, skip int64) {
+					mu.Lock()
+					defer mu.Unlock()
+					uploaded++
+					skipped += skip
+				},
+			}
+			err := up.uploadDir(context.Background(), base, filepath.Join(base, "registry"))
+			sort.Strings(fake.written)
+			sort.Strings(fake.aborted)
+			req.Equal(tt.wantAborted, fake.aborted)
+			req.Equal(tt.wantParts, fake.parts)
+			req.Len(fake.uploads, tt.wantPending, "multipart uploads left behind")
+			if tt.wantErr {
+				req.Error(err)
+				return
+			}
+			req.NoError(err)
+
+			req.Equal(tt.wantWritten, fake.written)
+			req.Equal(len(files), uploaded)
+			req.Equal(tt.wantSkipped, skipped)
+			for path, content := range files {
+				obj, ok := fake.objects[path]
+				req.True(ok, "object %s not uploaded", path)
+				req.Equal(content, string(obj.data))
+				req.Equal(checksumOf(content), obj.tags[checksumKey])
+			}
+		})
+	}
+}
+
+func Test_hashingReader(t *testing.T) {
+	req := require.New(t)
+	data := []byte("0123456789abcdefghij")
+	want := checksumOf("456789abcdef")
+
+	// the client reads part of the body, rewinds it and reads it again.
+	hash := sha256.New()
+	r := newHashingReader(bytes.NewReader(data), 4, 12, hash)
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(r, buf)
+	req.NoError(err)
+	_, err = r.Seek(0, io.SeekStart)
+	req.NoError(err)
+	read, err := io.ReadAll(r)
+	req.NoError(err)
+	req.Equal("456789abcdef", string(read))
+	req.NoError(r.finish())
+	req.Equal(want, fmt.Sprintf("%x", hash.Sum(nil)))
+
+	// the client seeks past bytes it does not read.
+	hash = sha256.New()
+	r = newHashingReader(bytes.NewReader(data), 4, 12, hash)
+	_, err = r.Seek(6, io.SeekStart)
+	req.NoError(err)
+	_, err = io.ReadAll(r)
+	req.NoError(err)
+	req.NoError(r.finish())
+	req.Equal(want, fmt.Sprintf("%x", hash.Sum(nil)))
+}
@@ -21,9 +21,10 @@ const registryDataMigrationJobName = "registry-data-migration"
 const RegistryMigrationStatusConditionType = "RegistryMigrationStatus"
 const RegistryMigrationServiceAccountName = "registry-data-migration-serviceaccount"
 
-// registryS3SecretName is the name of the Registry secret.
+// RegistryS3SecretName is the name of the secret holding the seaweedfs s3 credentials used by the
+// registry in HA installations.
 // This secret name is defined in the chart in the release metadata.
-const registryS3SecretName = "seaweedfs-s3-rw"
+const RegistryS3SecretName = "seaweedfs-s3-rw"
 
 // MigrateRegistryData should be called when transitioning from non-HA to HA airgapped installations
 // this function creates a job that will scale down the registry deployment then upload the data to s3
@@ -74,10 +75,18 @@ func MigrateRegistryData(ctx context.Context, in *clusterv1beta1.Installation, c
 		}
 	} else {
 		if migrationJob.Status.Active > 0 {
+			// the progress is informative only, the migration goes on without it.
+			message := ""
+			if progress, err := ReadMigrationProgress(ctx, cli); err != nil {
+				ctrl.LoggerFrom(ctx).Error(err, "Failed to read registry data migration progress")
+			} else if progress != nil {
+				message = progress.Message()
+			}
 			in.Status.SetCondition(metav1.Condition{
 				Type:               RegistryMigrationStatusConditionType,
 				Status:             metav1.ConditionFalse,
 				Reason:             "MigrationJobInProgress",
+				Message:            message,
 				ObservedGeneration: in.Generation,
 			})
 			return nil
@@ -95,6 +104,16 @@ func MigrateRegistryData(ctx context.Context, in *clusterv1beta1.Installation, c
 		return nil
 	}
 
+	if err := ensureMigrationProgressRBAC(ctx, cli, in); err != nil {
+		in.Status.SetCondition(metav1.Condition{
+			Type:               RegistryMigrationStatusConditionType,
+			Status:             metav1.ConditionFalse,
+			Reason:             "MigrationJobFailedCreation",
+			ObservedGeneration: in.Generation,
+		})
+		return fmt.Errorf("ensure migration progress rbac: %w", err)
+	}
+
 	// create the migration job
 	migrationJob, err = newMigrationJob(in, cli)
 	if err != nil {
@@ -142,6 +161,10 @@ func HasRegistryMigrated(ctx context.Context, cli client.Client) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("cleanup registry migration job: %w", err)
 	}
+	err = deleteMigrationProgress(ctx, cli)
+	if err != nil {
+		return false, fmt.Errorf("cleanup registry migration progress: %w", err)
+	}
 
 	return true, nil
 }
@@ -187,7 +210,7 @@ func newMigrationJob(in *clusterv1beta1.Installation, cli client.Client) (batchv
 								{
 									SecretRef: &corev1.SecretEnvSource{
 										LocalObjectReference: corev1.LocalObjectReference{
-											Name: registryS3SecretName,
+											Name: RegistryS3SecretName,
 										},
 									},
 								},
@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RegistryDataMigrationProgressConfigMapName is the config map the registry data migration job
+// publishes its progress to.
+const RegistryDataMigrationProgressConfigMapName = "registry-data-migration-progress"
+
+// MigrationProgress is the progress of the registry data migration.
+type MigrationProgress struct {
+	FilesDone  int   `json:"filesDone"`
+	FilesTotal int   `json:"filesTotal"`
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal"`
+	// BytesSkipped are the bytes counted as done because they were already in the bucket, they
+	// are not taken into account when estimating the transfer rate.
+	BytesSkipped int64     `json:"bytesSkipped,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// Remaining estimates the time left to migrate the remaining bytes based on the transfer rate
+// observed so far. Returns zero if no estimate can be made yet.
+func (p MigrationProgress) Remaining() time.Duration {
+	elapsed := p.UpdatedAt.Sub(p.StartedAt)
+	transferred := p.BytesDone - p.BytesSkipped
+	if transferred <= 0 || elapsed <= 0 || p.BytesDone >= p.BytesTotal {
+		return 0
+	}
+	rate := float64(transferred) / elapsed.Seconds()
+	return time.Duration(float64(p.BytesTotal-p.BytesDone) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// Message describes the progress for humans, e.g. "Migrated 3/10 files, 1Gi/4Gi (25%), about 3m0s
+// remaining".
+func (p MigrationProgress) Message() string {
+	percent := 100
+	if p.BytesTotal > 0 {
+		percent = int(p.BytesDone * 100 / p.BytesTotal)
+	}
+	msg := fmt.Sprintf(
+		"Migrated %d/%d files, %s/%s (%d%%)", p.FilesDone, p.FilesTotal,
+		resource.NewQuantity(p.BytesDone, resource.BinarySI), resource.NewQuantity(p.BytesTotal, resource.BinarySI), percent,
+	)
+	if remaining := p.Remaining(); remaining > 0 {
+		msg += fmt.Sprintf(", about %s remaining", remaining)
+	}
+	return msg
+}
+
+// WriteMigrationProgress publishes the progress of the registry data migration. The migration
+// job service account is allowed to do so by the role created by ensureMigrationProgressRBAC.
+func WriteMigrationProgress(ctx context.Context, cli client.Client, p MigrationProgress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal progress: %w", err)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RegistryDataMigrationProgressConfigMapName,
+			Namespace: registryNamespace,
+		},
+	}
+	_, err = ctrl.CreateOrUpdate(ctx, cli, cm, func() error {
+		cm.Data = map[string]string{"progress.json": string(data)}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("write progress config map: %w", err)
+	}
+	return nil
+}
+
+// ensureMigrationProgressRBAC allows the registry data migration job service account to publish
+// its progress. The service account is created by the installer with the permissions needed by
+// the migration itself, the progress config map is an addition of the operator so we grant
+// access to it here. The role and its binding are owned by the installation.
+func ensureMigrationProgressRBAC(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: RegistryDataMigrationProgressConfigMapName, Namespace: registryNamespace},
+	}
+	_, err := ctrl.CreateOrUpdate(ctx, cli, role, func() error {
+		role.Labels = applyRegistryLabels(role.Labels, registryDataMigrationJobName)
+		role.Rules = []rbacv1.PolicyRule{
+			{
+				// create can't be restricted to a resource name.
+				APIGroups: []string{""},
+				Resources: []string{"configmaps"},
+				Verbs:     []string{"create"},
+			},
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{RegistryDataMigrationProgressConfigMapName},
+				Verbs:         []string{"get", "update", "patch"},
+			},
+		}
+		return ctrl.SetControllerReference(in, role, cli.Scheme())
+	})
+	if err != nil {
+		return fmt.Errorf("create or update role: %w", err)
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: RegistryDataMigrationProgressConfigMapName, Namespace: registryNamespace},
+	}
+	_, err = ctrl.CreateOrUpdate(ctx, cli, binding, func() error {
+		binding.Labels = applyRegistryLabels(binding.Labels, registryDataMigrationJobName)
+		binding.RoleRef = rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		}
+		binding.Subjects = []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      RegistryMigrationServiceAccountName,
+				Namespace: registryNamespace,
+			},
+		}
+		return ctrl.SetControllerReference(in, binding, cli.Scheme())
+	})
+	if err != nil {
+		return fmt.Errorf("create or update role binding: %w", err)
+	}
+	return nil
+}
+
+// ReadMigrationProgress returns the last progress published by the registry data migration job.
+// Returns nil if none has been published yet.
+func ReadMigrationProgress(ctx context.Context, cli client.Client) (*MigrationProgress, error) {
+	var cm corev1.ConfigMap
+	nsn := client.ObjectKey{Namespace: registryNamespace, Name: RegistryDataMigrationProgressConfigMapName}
+	if err := cli.Get(ctx, nsn, &cm); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get progress config map: %w", err)
+	}
+	var p MigrationProgress
+	if err := json.Unmarshal([]byte(cm.Data["progress.json"]), &p); err != nil {
+		return nil, fmt.Errorf("unmarshal progress: %w", err)
+	}
+	return &p, nil
+}
+
+// deleteMigrationProgress removes the progress published by the registry data migration job.
+func deleteMigrationProgress(ctx context.Context, cli client.Client) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: RegistryDataMigrationProgressConfigMapName, Namespace: registryNamespace},
+	}
+	if err := cli.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("delete progress config map: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestMigrationProgress_Message(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		progress MigrationProgress
+		want     string
+	}{
+		{
+			name: "not started",
+			progress: MigrationProgress{
+				FilesTotal: 10, BytesTotal: 4 << 30, StartedAt: started, UpdatedAt: started,
+			},
+			want: "Migrated 0/10 files, 0/4Gi (0%)",
+		},
+		{
+			name: "in progress",
+			progress: MigrationProgress{
+				FilesDone: 3, FilesTotal: 10, BytesDone: 1 << 30, BytesTotal: 4 << 30,
+				StartedAt: started, UpdatedAt: started.Add(time.Minute),
+			},
+			want: "Migrated 3/10 files, 1Gi/4Gi (25%), about 3m0s remaining",
+		},
+		{
+			name: "done",
+			progress: MigrationProgress{
+				FilesDone: 10, FilesTotal: 10, BytesDone: 4 << 30, BytesTotal: 4 << 30,
+				StartedAt: started, UpdatedAt: started.Add(4 * time.Minute),
+			},
+			want: "Migrated 10/10 files, 4Gi/4Gi (100%)",
+		},
+		{
+			name: "resumed",
+			progress: MigrationProgress{
+				FilesDone: 6, FilesTotal: 10, BytesDone: 3 << 30, BytesTotal: 4 << 30, BytesSkipped: 2 << 30,
+				StartedAt: started, UpdatedAt: started.Add(time.Minute),
+			},
+			want: "Migrated 6/10 files, 3Gi/4Gi (75%), about 1m0s remaining",
+		},
+		{
+			name:     "empty registry",
+			progress: MigrationProgress{StartedAt: started, UpdatedAt: started},
+			want:     "Migrated 0/0 files, 0/0 (100%)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.progress.Message())
+		})
+	}
+}
+
+func TestMigrationProgress_readWrite(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).Build()
+
+	got, err := ReadMigrationProgress(ctx, cli)
+	req.NoError(err)
+	req.Nil(got)
+
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	progress := MigrationProgress{FilesTotal: 2, BytesTotal: 10, StartedAt: started, UpdatedAt: started}
+	req.NoError(WriteMigrationProgress(ctx, cli, progress))
+	progress.FilesDone, progress.BytesDone = 1, 5
+	req.NoError(WriteMigrationProgress(ctx, cli, progress))
+
+	got, err = ReadMigrationProgress(ctx, cli)
+	req.NoError(err)
+	req.Equal(progress, *got)
+
+	req.NoError(deleteMigrationProgress(ctx, cli))
+	got, err = ReadMigrationProgress(ctx, cli)
+	req.NoError(err)
+	req.Nil(got)
+}
+
+func Test_ensureMigrationProgressRBAC(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	in := &clusterv1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: "20240101000000", UID: "uid"}}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(in).Build()
+
+	// ensuring twice updates the existing objects.
+	req.NoError(ensureMigrationProgressRBAC(ctx, cli, in))
+	req.NoError(ensureMigrationProgressRBAC(ctx, cli, in))
+
+	nsn := client.ObjectKey{Namespace: registryNamespace, Name: RegistryDataMigrationProgressConfigMapName}
+	var role rbacv1.Role
+	req.NoError(cli.Get(ctx, nsn, &role))
+	req.Len(role.Rules, 2)
+	req.Equal([]string{RegistryDataMigrationProgressConfigMapName}, role.Rules[1].ResourceNames)
+	req.Contains(role.Rules[1].Verbs, "update")
+	req.Equal(in.Name, role.OwnerReferences[0].Name)
+
+	var binding rbacv1.RoleBinding
+	req.NoError(cli.Get(ctx, nsn, &binding))
+	req.Equal(role.Name, binding.RoleRef.Name)
+	req.Equal([]rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      RegistryMigrationServiceAccountName,
+		Namespace: registryNamespace,
+	}}, binding.Subjects)
+}
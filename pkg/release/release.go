@@ -14,9 +14,7 @@ import (
 	"github.com/gosimple/slug"
 	"github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
 	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
-	"gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -37,27 +35,6 @@ func LocalVersionMetadataConfigmap(version string) types.NamespacedName {
 	}
 }
 
-// configureRegistryTLS makes sure that the docker-registry values contains an entry for the
-// tls secret. this function should be called only if the tls secret exists.
-func configureRegistryTLS(meta *ectypes.ReleaseMetadata, ext *v1beta1.Helm) error {
-	for i, chart := range ext.Charts {
-		if chart.Name != "docker-registry" {
-			continue
-		}
-		var values map[string]interface{}
-		if err := yaml.Unmarshal([]byte(chart.Values), &values); err != nil {
-			return fmt.Errorf("failed to unmarshal registry chart values: %w", err)
-		}
-		values["tlsSecretName"] = "registry-tls"
-		newValues, err := yaml.Marshal(values)
-		if err != nil {
-			return fmt.Errorf("unable to marshal new registry chart values: %w", err)
-		}
-		ext.Charts[i].Values = string(newValues)
-	}
-	return nil
-}
-
 // MetadataFor determines from where to read the metadata (from the cluster or remotely) and calls
 // the appropriate function.
 func MetadataFor(ctx context.Context, in *v1beta1.Installation, cli client.Client) (*ectypes.ReleaseMetadata, error) {
@@ -68,8 +45,6 @@ func MetadataFor(ctx context.Context, in *v1beta1.Installation, cli client.Clien
 }
 
 // localMetadataFor reads metadata for a given release. Attempts to read a local config map.
-// If running on airgap environment this function also assess if the registry requires
-// tls or not and customize the release metadata accordingly.
 func localMetadataFor(ctx context.Context, cli client.Client, version string) (*ectypes.ReleaseMetadata, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -94,33 +69,6 @@ func localMetadataFor(ctx context.Context, cli client.Client, version string) (*
 	if err := json.Unmarshal([]byte(data), meta); err != nil {
 		return nil, fmt.Errorf("failed to decode bundle: %w", err)
 	}
-	cache[version] = meta
-
-	var secret corev1.Secret
-	nsn = types.NamespacedName{Namespace: "registry", Name: "registry-tls"}
-	if err := cli.Get(ctx, nsn, &secret); err != nil {
-		if errors.IsNotFound(err) {
-			return metaFromCache(version)
-		}
-		return nil, fmt.Errorf("failed to get registry tls secret: %w", err)
-	}
-
-	registryExt, ok := meta.BuiltinConfigs["registry"]
-	if ok {
-		err := configureRegistryTLS(meta, &registryExt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to configure registry-ha tls: %w", err)
-		}
-	}
-
-	registryHAExt, ok := meta.BuiltinConfigs["registry-ha"]
-	if ok {
-		err := configureRegistryTLS(meta, &registryHAExt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to configure registry tls: %w", err)
-		}
-	}
-
 	cache[version] = meta
 	return metaFromCache(version)
 }
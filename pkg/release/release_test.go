@@ -92,7 +92,7 @@ func Test_localMetadataFor(t *testing.T) {
 			},
 		},
 		{
-			name: "registry secret exists",
+			name: "registry secret exists, metadata is not changed",
 			args: args{
 				cli: fake.NewClientBuilder().WithObjects(
 					&corev1.ConfigMap{
@@ -122,7 +122,7 @@ func Test_localMetadataFor(t *testing.T) {
 						Charts: []v1beta1.Chart{
 							{
 								Name:   "docker-registry",
-								Values: "ha: false\ntlsSecretName: registry-tls\n",
+								Values: "ha: false\n",
 							},
 						},
 					},
@@ -130,7 +130,7 @@ func Test_localMetadataFor(t *testing.T) {
 						Charts: []v1beta1.Chart{
 							{
 								Name:   "docker-registry",
-								Values: "ha: true\ntlsSecretName: registry-tls\n",
+								Values: "ha: true\n",
 							},
 						},
 					},
@@ -0,0 +1,117 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/archive"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+)
+
+// HistoryEntry summarises an installation, live or archived. FinalState is the state the
+// installation was in when it was superseded by a newer one, or its current state if it is
+// still the active installation.
+type HistoryEntry struct {
+	Name              string     `json:"name"`
+	Version           string     `json:"version,omitempty"`
+	KubernetesVersion string     `json:"kubernetesVersion,omitempty"`
+	State             string     `json:"state"`
+	FinalState        string     `json:"finalState"`
+	Archived          bool       `json:"archived"`
+	Created           time.Time  `json:"created"`
+	Completed         *time.Time `json:"completed,omitempty"`
+	Duration          string     `json:"duration,omitempty"`
+}
+
+// CollectHistory returns an entry for every installation, including the archived ones, sorted
+// from the oldest to the newest.
+func CollectHistory(ctx context.Context, cli client.Client) ([]HistoryEntry, error) {
+	var list clusterv1beta1.InstallationList
+	if err := cli.List(ctx, &list); err != nil {
+		return nil, fmt.Errorf("list installations: %w", err)
+	}
+	archived, err := archive.List(ctx, cli)
+	if err != nil {
+		return nil, fmt.Errorf("list archived installations: %w", err)
+	}
+
+	entries := []HistoryEntry{}
+	seen := map[string]bool{}
+	for _, in := range list.Items {
+		seen[in.Name] = true
+		entries = append(entries, historyEntry(in, false))
+	}
+	// an installation may be found in both places if we failed to delete it after archiving.
+	for _, in := range archived {
+		if !seen[in.Name] {
+			entries = append(entries, historyEntry(in, true))
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func historyEntry(in clusterv1beta1.Installation, archived bool) HistoryEntry {
+	entry := HistoryEntry{
+		Name:       in.Name,
+		State:      in.Status.State,
+		FinalState: in.Status.State,
+		Archived:   archived,
+		Created:    in.CreationTimestamp.Time,
+	}
+	if in.Spec.Config != nil {
+		entry.Version = in.Spec.Config.Version
+	}
+	entry.KubernetesVersion = in.Annotations[conditions.KubernetesVersionAnnotation]
+	if cond := meta.FindStatusCondition(in.Status.Conditions, conditions.FinalStateConditionType); cond != nil {
+		entry.FinalState = cond.Reason
+	}
+	if cond := meta.FindStatusCondition(in.Status.Conditions, conditions.CompletedConditionType); cond != nil {
+		completed := cond.LastTransitionTime.Time
+		entry.Completed = &completed
+		if !entry.Created.IsZero() {
+			entry.Duration = completed.Sub(entry.Created).Round(time.Second).String()
+		}
+	}
+	return entry
+}
+
+// WriteHistoryJSON writes the history entries as indented json.
+func WriteHistoryJSON(w io.Writer, entries []HistoryEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal history: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// WriteHistoryTable writes the history entries as a human readable table.
+func WriteHistoryTable(w io.Writer, entries []HistoryEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tVERSION\tKUBERNETES\tFINAL STATE\tCREATED\tCOMPLETED\tDURATION\tARCHIVED\n")
+	for _, entry := range entries {
+		created, completed := "", ""
+		if !entry.Created.IsZero() {
+			created = entry.Created.Format(time.RFC3339)
+		}
+		if entry.Completed != nil {
+			completed = entry.Completed.Format(time.RFC3339)
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			entry.Name, entry.Version, entry.KubernetesVersion, entry.FinalState,
+			created, completed, entry.Duration, entry.Archived,
+		)
+	}
+	return tw.Flush()
+}
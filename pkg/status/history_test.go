@@ -0,0 +1,85 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/archive"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestCollectHistory(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	created := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	completed := created.Add(90 * time.Second)
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&clusterv1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "20240102000000",
+				CreationTimestamp: metav1.NewTime(created),
+				Annotations:       map[string]string{conditions.KubernetesVersionAnnotation: "1.29.1"},
+			},
+			Spec: clusterv1beta1.InstallationSpec{Config: &clusterv1beta1.ConfigSpec{Version: "1.1.0"}},
+			Status: clusterv1beta1.InstallationStatus{
+				State: clusterv1beta1.InstallationStateObsolete,
+				Conditions: []metav1.Condition{
+					{Type: "FinalState", Status: metav1.ConditionTrue, Reason: clusterv1beta1.InstallationStateInstalled},
+					{Type: "Completed", Status: metav1.ConditionTrue, LastTransitionTime: metav1.NewTime(completed)},
+				},
+			},
+		},
+		&clusterv1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{Name: "20240103000000"},
+			Spec:       clusterv1beta1.InstallationSpec{Config: &clusterv1beta1.ConfigSpec{Version: "1.2.0"}},
+			Status:     clusterv1beta1.InstallationStatus{State: clusterv1beta1.InstallationStateAddonsInstalling},
+		},
+	).Build()
+
+	req.NoError(archive.Add(ctx, cli, []clusterv1beta1.Installation{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+			Status: clusterv1beta1.InstallationStatus{
+				State: clusterv1beta1.InstallationStateObsolete,
+				Conditions: []metav1.Condition{
+					{Type: "FinalState", Status: metav1.ConditionTrue, Reason: clusterv1beta1.InstallationStateFailed},
+				},
+			},
+		},
+	}))
+
+	entries, err := CollectHistory(ctx, cli)
+	req.NoError(err)
+	req.Len(entries, 3)
+
+	req.Equal("20240101000000", entries[0].Name)
+	req.True(entries[0].Archived)
+	req.Equal(clusterv1beta1.InstallationStateFailed, entries[0].FinalState)
+
+	req.Equal("20240102000000", entries[1].Name)
+	req.False(entries[1].Archived)
+	req.Equal("1.1.0", entries[1].Version)
+	req.Equal("1.29.1", entries[1].KubernetesVersion)
+	req.Equal(clusterv1beta1.InstallationStateInstalled, entries[1].FinalState)
+	req.Equal("1m30s", entries[1].Duration)
+
+	req.Equal("20240103000000", entries[2].Name)
+	req.Equal(clusterv1beta1.InstallationStateAddonsInstalling, entries[2].FinalState)
+	req.Nil(entries[2].Completed)
+
+	buf := bytes.NewBuffer(nil)
+	req.NoError(WriteHistoryTable(buf, entries))
+	req.Contains(buf.String(), "1m30s")
+	buf.Reset()
+	req.NoError(WriteHistoryJSON(buf, entries))
+	req.Contains(buf.String(), `"kubernetesVersion": "1.29.1"`)
+}
@@ -0,0 +1,277 @@
+// Package status gathers, from the different objects in the cluster, a summary of the health
+// of the embedded cluster installation.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/registry"
+)
+
+// Report is a summary of the installation health.
+type Report struct {
+	Installation      string             `json:"installation"`
+	State             string             `json:"state"`
+	Reason            string             `json:"reason,omitempty"`
+	Conditions        []metav1.Condition `json:"conditions,omitempty"`
+	HighAvailability  bool               `json:"highAvailability"`
+	HAStatus          string             `json:"haStatus,omitempty"`
+	RegistryMigration string             `json:"registryMigration,omitempty"`
+	Nodes             []NodeReport       `json:"nodes"`
+	Plan              *PlanReport        `json:"plan,omitempty"`
+	Charts            []ChartReport      `json:"charts"`
+}
+
+// NodeReport holds the status of a node. Tracked is true if the node is part of the nodes
+// status in the installation.
+type NodeReport struct {
+	Name           string `json:"name"`
+	Ready          string `json:"ready"`
+	KubeletVersion string `json:"kubeletVersion,omitempty"`
+	Tracked        bool   `json:"tracked"`
+}
+
+// PlanReport holds the status of the autopilot plan and of each of its target nodes.
+type PlanReport struct {
+	Installation string           `json:"installation,omitempty"`
+	State        string           `json:"state"`
+	Nodes        []PlanNodeReport `json:"nodes,omitempty"`
+}
+
+// PlanNodeReport holds the state of a node in the autopilot plan.
+type PlanNodeReport struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	State string `json:"state"`
+}
+
+// ChartReport holds the health of a k0s helm chart. Retries is set while the operator retries
+// the failed chart.
+type ChartReport struct {
+	Name    string                   `json:"name"`
+	Version string                   `json:"version"`
+	Healthy bool                     `json:"healthy"`
+	Error   string                   `json:"error,omitempty"`
+	Retries *conditions.ChartRetries `json:"retries,omitempty"`
+}
+
+// Collect builds the report for the newest installation that is not obsolete nor cancelled.
+func Collect(ctx context.Context, cli client.Client) (*Report, error) {
+	in, err := newestInstallation(ctx, cli)
+	if err != nil {
+		return nil, fmt.Errorf("get installation: %w", err)
+	}
+
+	report := &Report{
+		Installation:     in.Name,
+		State:            in.Status.State,
+		Reason:           in.Status.Reason,
+		Conditions:       in.Status.Conditions,
+		HighAvailability: in.Spec.HighAvailability,
+	}
+	if cond := meta.FindStatusCondition(in.Status.Conditions, conditions.HAConditionType); cond != nil {
+		report.HAStatus = cond.Reason
+	}
+	if cond := meta.FindStatusCondition(in.Status.Conditions, registry.RegistryMigrationStatusConditionType); cond != nil {
+		report.RegistryMigration = cond.Reason
+	}
+
+	if report.Nodes, err = collectNodes(ctx, cli, in); err != nil {
+		return nil, fmt.Errorf("collect nodes: %w", err)
+	}
+	if report.Plan, err = collectPlan(ctx, cli); err != nil {
+		return nil, fmt.Errorf("collect autopilot plan: %w", err)
+	}
+	if report.Charts, err = collectCharts(ctx, cli, in); err != nil {
+		return nil, fmt.Errorf("collect charts: %w", err)
+	}
+	return report, nil
+}
+
+func newestInstallation(ctx context.Context, cli client.Client) (*clusterv1beta1.Installation, error) {
+	var list clusterv1beta1.InstallationList
+	if err := cli.List(ctx, &list); err != nil {
+		return nil, fmt.Errorf("list installations: %w", err)
+	}
+	items := list.Items
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[j].Name < items[i].Name
+	})
+	for _, in := range items {
+		if in.Status.State == clusterv1beta1.InstallationStateObsolete {
+			continue
+		}
+		if in.Status.State == conditions.InstallationStateCancelled {
+			continue
+		}
+		return &in, nil
+	}
+	return nil, fmt.Errorf("no active installation found")
+}
+
+func collectNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) ([]NodeReport, error) {
+	var nodes corev1.NodeList
+	if err := cli.List(ctx, &nodes); err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	tracked := map[string]bool{}
+	for _, status := range in.Status.NodesStatus {
+		tracked[status.Name] = true
+	}
+
+	reports := []NodeReport{}
+	seen := map[string]bool{}
+	for _, node := range nodes.Items {
+		seen[node.Name] = true
+		ready := string(corev1.ConditionUnknown)
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == corev1.NodeReady {
+				ready = string(cond.Status)
+			}
+		}
+		reports = append(reports, NodeReport{
+			Name:           node.Name,
+			Ready:          ready,
+			KubeletVersion: node.Status.NodeInfo.KubeletVersion,
+			Tracked:        tracked[node.Name],
+		})
+	}
+	// nodes known to the installation that no longer exist in the cluster.
+	for _, status := range in.Status.NodesStatus {
+		if !seen[status.Name] {
+			reports = append(reports, NodeReport{Name: status.Name, Ready: "Missing", Tracked: true})
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports, nil
+}
+
+func collectPlan(ctx context.Context, cli client.Client) (*PlanReport, error) {
+	var plan autopilotv1beta2.Plan
+	if err := cli.Get(ctx, client.ObjectKey{Name: "autopilot"}, &plan); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get autopilot plan: %w", err)
+	}
+
+	report := &PlanReport{
+		Installation: plan.Annotations[conditions.InstallationNameAnnotation],
+		State:        string(plan.Status.State),
+	}
+	add := func(role string, targets []autopilotv1beta2.PlanCommandTargetStatus) {
+		for _, target := range targets {
+			report.Nodes = append(report.Nodes, PlanNodeReport{Name: target.Name, Role: role, State: string(target.State)})
+		}
+	}
+	for _, cmd := range plan.Status.Commands {
+		if cmd.K0sUpdate != nil {
+			add("controller", cmd.K0sUpdate.Controllers)
+			add("worker", cmd.K0sUpdate.Workers)
+		}
+		if cmd.AirgapUpdate != nil {
+			add("worker", cmd.AirgapUpdate.Workers)
+		}
+	}
+	return report, nil
+}
+
+func collectCharts(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) ([]ChartReport, error) {
+	var charts k0shelm.ChartList
+	if err := cli.List(ctx, &charts); err != nil {
+		return nil, fmt.Errorf("list charts: %w", err)
+	}
+	retries, err := conditions.ChartRetriesFor(in)
+	if err != nil {
+		return nil, fmt.Errorf("read chart retries: %w", err)
+	}
+
+	reports := []ChartReport{}
+	for _, chart := range charts.Items {
+		name := strings.TrimPrefix(chart.Name, "k0s-addon-chart-")
+		healthy, err := k8sutil.GetChartHealth(ctx, cli, name)
+		if err != nil {
+			return nil, fmt.Errorf("get chart %s health: %w", name, err)
+		}
+		report := ChartReport{
+			Name:    name,
+			Version: chart.Status.Version,
+			Healthy: healthy,
+			Error:   chart.Status.Error,
+		}
+		if chartRetries, ok := retries[name]; ok {
+			report.Retries = &chartRetries
+		}
+		reports = append(reports, report)
+	}
+	sort.SliceStable(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports, nil
+}
+
+// WriteJSON writes the report as indented json.
+func WriteJSON(w io.Writer, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// WriteTable writes the report as a set of human readable tables.
+func WriteTable(w io.Writer, report *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Installation:\t%s\n", report.Installation)
+	fmt.Fprintf(tw, "State:\t%s\n", report.State)
+	fmt.Fprintf(tw, "Reason:\t%s\n", report.Reason)
+	fmt.Fprintf(tw, "High availability:\t%t\t%s\n", report.HighAvailability, report.HAStatus)
+	if report.RegistryMigration != "" {
+		fmt.Fprintf(tw, "Registry migration:\t%s\n", report.RegistryMigration)
+	}
+
+	fmt.Fprintf(tw, "\nCONDITION\tSTATUS\tREASON\tMESSAGE\n")
+	for _, cond := range report.Conditions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", cond.Type, cond.Status, cond.Reason, cond.Message)
+	}
+
+	fmt.Fprintf(tw, "\nNODE\tREADY\tKUBELET\tTRACKED\n")
+	for _, node := range report.Nodes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", node.Name, node.Ready, node.KubeletVersion, node.Tracked)
+	}
+
+	if report.Plan != nil {
+		fmt.Fprintf(tw, "\nAutopilot plan:\t%s\t(installation %s)\n", report.Plan.State, report.Plan.Installation)
+		fmt.Fprintf(tw, "PLAN NODE\tROLE\tSTATE\n")
+		for _, node := range report.Plan.Nodes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", node.Name, node.Role, node.State)
+		}
+	}
+
+	fmt.Fprintf(tw, "\nCHART\tVERSION\tHEALTHY\tRETRIES\tERROR\n")
+	for _, chart := range report.Charts {
+		retries := "-"
+		if chart.Retries != nil {
+			retries = fmt.Sprintf("%d/%d", chart.Retries.Attempts, chart.Retries.MaxAttempts)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", chart.Name, chart.Version, chart.Healthy, retries, chart.Error)
+	}
+	return tw.Flush()
+}
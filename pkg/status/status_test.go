@@ -0,0 +1,109 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestCollect(t *testing.T) {
+	req := require.New(t)
+
+	healthySpec := k0shelm.ChartSpec{ReleaseName: "admin-console", Version: "1.0.0"}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&clusterv1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{Name: "20240102000000"},
+			Status:     clusterv1beta1.InstallationStatus{State: clusterv1beta1.InstallationStateObsolete},
+		},
+		&clusterv1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "20240101000000",
+				Annotations: map[string]string{
+					conditions.ChartRetriesAnnotation: `{"velero":{"attempts":2,"maxAttempts":5}}`,
+				},
+			},
+			Spec: clusterv1beta1.InstallationSpec{HighAvailability: true},
+			Status: clusterv1beta1.InstallationStatus{
+				State:       clusterv1beta1.InstallationStateInstalled,
+				Reason:      "Addons upgraded",
+				NodesStatus: []clusterv1beta1.NodeStatus{{Name: "node1"}, {Name: "node3"}},
+				Conditions: []metav1.Condition{
+					{Type: "HighAvailability", Status: metav1.ConditionTrue, Reason: "HAReady"},
+				},
+			},
+		},
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+				NodeInfo:   corev1.NodeSystemInfo{KubeletVersion: "v1.29.1+k0s"},
+			},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		&autopilotv1beta2.Plan{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "autopilot",
+				Annotations: map[string]string{"embedded-cluster.replicated.com/installation-name": "20240101000000"},
+			},
+			Status: autopilotv1beta2.PlanStatus{
+				State: "Completed",
+				Commands: []autopilotv1beta2.PlanCommandStatus{
+					{
+						K0sUpdate: &autopilotv1beta2.PlanCommandK0sUpdateStatus{
+							Controllers: []autopilotv1beta2.PlanCommandTargetStatus{{Name: "node1", State: "Completed"}},
+						},
+					},
+				},
+			},
+		},
+		&k0shelm.Chart{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-admin-console", Namespace: "kube-system"},
+			Spec:       healthySpec,
+			Status:     k0shelm.ChartStatus{Version: "1.0.0", ValuesHash: healthySpec.HashValues()},
+		},
+		&k0shelm.Chart{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-velero", Namespace: "kube-system"},
+			Spec:       k0shelm.ChartSpec{ReleaseName: "velero", Version: "2.0.0"},
+			Status:     k0shelm.ChartStatus{Version: "2.0.0", Error: "boom"},
+		},
+	).Build()
+
+	report, err := Collect(context.Background(), cli)
+	req.NoError(err)
+	req.Equal("20240101000000", report.Installation)
+	req.Equal(clusterv1beta1.InstallationStateInstalled, report.State)
+	req.Equal("HAReady", report.HAStatus)
+	req.Equal([]NodeReport{
+		{Name: "node1", Ready: "True", KubeletVersion: "v1.29.1+k0s", Tracked: true},
+		{Name: "node2", Ready: "Unknown"},
+		{Name: "node3", Ready: "Missing", Tracked: true},
+	}, report.Nodes)
+	req.Equal(&PlanReport{
+		Installation: "20240101000000",
+		State:        "Completed",
+		Nodes:        []PlanNodeReport{{Name: "node1", Role: "controller", State: "Completed"}},
+	}, report.Plan)
+	req.Equal([]ChartReport{
+		{Name: "admin-console", Version: "1.0.0", Healthy: true},
+		{Name: "velero", Version: "2.0.0", Error: "boom", Retries: &conditions.ChartRetries{Attempts: 2, MaxAttempts: 5}},
+	}, report.Charts)
+
+	buf := bytes.NewBuffer(nil)
+	req.NoError(WriteTable(buf, report))
+	req.Contains(buf.String(), "velero")
+	req.Contains(buf.String(), "2/5")
+	buf.Reset()
+	req.NoError(WriteJSON(buf, report))
+	req.Contains(buf.String(), `"installation": "20240101000000"`)
+}
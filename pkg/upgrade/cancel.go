@@ -0,0 +1,176 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/autopilot"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+)
+
+// CancelAnnotation can be set to "true" on an installation to have the operator cancel the
+// upgrade to it.
+const CancelAnnotation = "embedded-cluster.replicated.com/cancel-upgrade"
+
+// Cancel aborts the upgrade to the installation with the given name. Depending on how far the
+// upgrade has got this deletes the autopilot plan, stops the copy artifacts jobs and restores the
+// operator chart in the cluster config. The installation is then marked as cancelled and the
+// previous one is reactivated. An upgrade can't be cancelled once nodes have started to upgrade
+// kubernetes or if it has already been completed.
+func Cancel(ctx context.Context, cli client.Client, name string) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	var in *clusterv1beta1.Installation
+	var existing clusterv1beta1.Installation
+	if err := cli.Get(ctx, client.ObjectKey{Name: name}, &existing); err == nil {
+		in = &existing
+	} else if !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("get installation: %w", err)
+	}
+
+	if in != nil {
+		switch in.Status.State {
+		case conditions.InstallationStateCancelled:
+			log.Info("Upgrade already cancelled", "installation", name)
+			return nil
+		case clusterv1beta1.InstallationStateInstalled, clusterv1beta1.InstallationStateObsolete:
+			return fmt.Errorf("upgrade to installation %s has already been completed", name)
+		}
+	}
+
+	var plan autopilotv1beta2.Plan
+	hasPlan := false
+	if err := cli.Get(ctx, client.ObjectKey{Name: "autopilot"}, &plan); err == nil {
+		hasPlan = plan.Annotations[conditions.InstallationNameAnnotation] == name
+	} else if !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("get autopilot plan: %w", err)
+	}
+	if hasPlan && isK0sUpdatePlan(plan) && autopilot.HasPlanStartedOnNodes(plan) {
+		return fmt.Errorf("kubernetes is already being upgraded on the nodes, the upgrade can no longer be cancelled")
+	}
+
+	// flag the checkpoint first so an upgrade command still running stops at its next phase.
+	cp, err := getCheckpoint(ctx, cli, name)
+	if err != nil {
+		return fmt.Errorf("get upgrade checkpoint: %w", err)
+	}
+	if cp == nil && in != nil {
+		if cp, err = CheckpointFor(ctx, cli, in); err != nil {
+			return fmt.Errorf("create upgrade checkpoint: %w", err)
+		}
+	}
+	if cp == nil {
+		return fmt.Errorf("no upgrade to installation %s found", name)
+	}
+	if err := cp.MarkCancelled(ctx, cli); err != nil {
+		return fmt.Errorf("mark upgrade cancelled: %w", err)
+	}
+
+	// the operator ignores cancelled installations, we do this before anything else so it does
+	// not recreate the plan we are about to delete.
+	if in != nil {
+		in.Status.SetState(conditions.InstallationStateCancelled, "Upgrade cancelled", nil)
+		if err := cli.Status().Update(ctx, in); err != nil {
+			return fmt.Errorf("update installation status: %w", err)
+		}
+		log.Info("Installation marked as cancelled", "installation", name)
+	}
+
+	if hasPlan {
+		if err := cli.Delete(ctx, &plan); err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("delete autopilot plan: %w", err)
+		}
+		log.Info("Autopilot plan deleted")
+	}
+
+	if err := artifacts.DeleteArtifactsJobsForInstallation(ctx, cli, name); err != nil {
+		return fmt.Errorf("delete artifacts jobs: %w", err)
+	}
+
+	if err := restoreOperatorChart(ctx, cli, cp); err != nil {
+		return fmt.Errorf("restore operator chart: %w", err)
+	}
+
+	if err := reactivatePreviousInstallation(ctx, cli, cp, name); err != nil {
+		return fmt.Errorf("reactivate previous installation: %w", err)
+	}
+
+	log.Info("Upgrade cancelled", "installation", name)
+	return nil
+}
+
+// isK0sUpdatePlan returns true if the plan upgrades k0s on the nodes. Other plans, such as the
+// one pushing the airgap images, can be interrupted safely.
+func isK0sUpdatePlan(plan autopilotv1beta2.Plan) bool {
+	for _, cmd := range plan.Spec.Commands {
+		if cmd.K0sUpdate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreOperatorChart puts back the operator chart entry replaced by the upgrade, if the upgrade
+// got as far as replacing it.
+func restoreOperatorChart(ctx context.Context, cli client.Client, cp *Checkpoint) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	previous, err := cp.PreviousOperatorChart()
+	if err != nil {
+		return fmt.Errorf("get previous operator chart: %w", err)
+	} else if previous == nil {
+		return nil
+	}
+
+	clusterConfig, err := getExistingClusterConfig(ctx, cli)
+	if err != nil {
+		return fmt.Errorf("get existing clusterconfig: %w", err)
+	}
+	if err := patchClusterConfigOperatorChart(ctx, cli, clusterConfig, *previous); err != nil {
+		return fmt.Errorf("patch clusterconfig with operator chart: %w", err)
+	}
+
+	log.Info("Operator chart restored", "version", previous.Version)
+	return nil
+}
+
+// reactivatePreviousInstallation restores the state and the nodes status the installation
+// preceding the cancelled one had before it was made obsolete, so the operator picks it up again.
+func reactivatePreviousInstallation(ctx context.Context, cli client.Client, cp *Checkpoint, name string) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	in, err := previousInstallation(ctx, cli, name)
+	if err != nil {
+		return fmt.Errorf("get previous installation: %w", err)
+	}
+	if in == nil || in.Status.State != clusterv1beta1.InstallationStateObsolete {
+		// the operator has not moved on from this installation yet.
+		return nil
+	}
+
+	state, reason := clusterv1beta1.InstallationStateInstalled, "Upgrade cancelled"
+	if cond := meta.FindStatusCondition(in.Status.Conditions, conditions.FinalStateConditionType); cond != nil {
+		state, reason = cond.Reason, cond.Message
+	}
+	nodes, err := cp.PreviousNodesStatus()
+	if err != nil {
+		return fmt.Errorf("get previous nodes status: %w", err)
+	}
+	if len(nodes) > 0 {
+		in.Status.NodesStatus = nodes
+	}
+	in.Status.SetState(state, reason, nil)
+	if err := cli.Status().Update(ctx, in); err != nil {
+		return fmt.Errorf("update installation %s status: %w", in.Name, err)
+	}
+	log.Info("Previous installation reactivated", "installation", in.Name, "state", state)
+	return nil
+}
@@ -0,0 +1,176 @@
+package upgrade
+
+import (
+	"context"
+	"testing"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestCancel(t *testing.T) {
+	previous := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+		Status: clusterv1beta1.InstallationStatus{
+			State: clusterv1beta1.InstallationStateObsolete,
+			Conditions: []metav1.Condition{
+				{Type: "FinalState", Status: metav1.ConditionTrue, Reason: clusterv1beta1.InstallationStateInstalled, Message: "Addons upgraded"},
+			},
+		},
+	}
+	target := func(state string) *clusterv1beta1.Installation {
+		return &clusterv1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{Name: "20240102000000"},
+			Spec:       clusterv1beta1.InstallationSpec{ClusterID: "abc"},
+			Status:     clusterv1beta1.InstallationStatus{State: state},
+		}
+	}
+	plan := func(cmd autopilotv1beta2.PlanCommand, status autopilotv1beta2.PlanCommandStatus) *autopilotv1beta2.Plan {
+		return &autopilotv1beta2.Plan{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "autopilot",
+				Annotations: map[string]string{conditions.InstallationNameAnnotation: "20240102000000"},
+			},
+			Spec:   autopilotv1beta2.PlanSpec{Commands: []autopilotv1beta2.PlanCommand{cmd}},
+			Status: autopilotv1beta2.PlanStatus{Commands: []autopilotv1beta2.PlanCommandStatus{status}},
+		}
+	}
+	k0sUpdate := autopilotv1beta2.PlanCommand{K0sUpdate: &autopilotv1beta2.PlanCommandK0sUpdate{}}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "copy-artifacts-node1",
+			Namespace:   "embedded-cluster",
+			Annotations: map[string]string{conditions.InstallationNameAnnotation: "20240102000000"},
+		},
+	}
+	clusterConfig := func(version string) *k0sv1beta1.ClusterConfig {
+		return &k0sv1beta1.ClusterConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s", Namespace: "kube-system"},
+			Spec: &k0sv1beta1.ClusterSpec{
+				Extensions: &k0sv1beta1.ClusterExtensions{
+					Helm: &k0sv1beta1.HelmExtensions{
+						Charts: k0sv1beta1.ChartsSettings{{Name: operatorChartName, Version: version}},
+					},
+				},
+			},
+		}
+	}
+
+	nodes := []clusterv1beta1.NodeStatus{{Name: "node1", Hash: "abc"}}
+
+	tests := []struct {
+		name          string
+		objects       []client.Object
+		operatorChart string
+		nodesStatus   []clusterv1beta1.NodeStatus
+		wantErr       string
+		wantPlan      bool
+		wantState     string
+		wantPrevious  string
+		wantVersion   string
+	}{
+		{
+			name:          "plan not started on nodes",
+			objects:       []client.Object{previous.DeepCopy(), target(clusterv1beta1.InstallationStateInstalling), plan(k0sUpdate, autopilotv1beta2.PlanCommandStatus{}), job.DeepCopy(), clusterConfig("2.0.0")},
+			operatorChart: "1.0.0",
+			nodesStatus:   nodes,
+			wantState:     conditions.InstallationStateCancelled,
+			wantPrevious:  clusterv1beta1.InstallationStateInstalled,
+			wantVersion:   "1.0.0",
+		},
+		{
+			name: "nodes already upgrading",
+			objects: []client.Object{
+				previous.DeepCopy(), target(clusterv1beta1.InstallationStateInstalling), clusterConfig("2.0.0"),
+				plan(k0sUpdate, autopilotv1beta2.PlanCommandStatus{
+					K0sUpdate: &autopilotv1beta2.PlanCommandK0sUpdateStatus{
+						Controllers: []autopilotv1beta2.PlanCommandTargetStatus{{Name: "node1", State: "SignalSent"}},
+					},
+				}),
+			},
+			wantErr:      "can no longer be cancelled",
+			wantPlan:     true,
+			wantState:    clusterv1beta1.InstallationStateInstalling,
+			wantPrevious: clusterv1beta1.InstallationStateObsolete,
+			wantVersion:  "2.0.0",
+		},
+		{
+			name: "airgap images plan is always deleted",
+			objects: []client.Object{
+				previous.DeepCopy(), target(clusterv1beta1.InstallationStateWaiting), clusterConfig("2.0.0"),
+				plan(autopilotv1beta2.PlanCommand{AirgapUpdate: &autopilotv1beta2.PlanCommandAirgapUpdate{}}, autopilotv1beta2.PlanCommandStatus{
+					AirgapUpdate: &autopilotv1beta2.PlanCommandAirgapUpdateStatus{
+						Workers: []autopilotv1beta2.PlanCommandTargetStatus{{Name: "node1", State: "SignalCompleted"}},
+					},
+				}),
+			},
+			wantState:    conditions.InstallationStateCancelled,
+			wantPrevious: clusterv1beta1.InstallationStateInstalled,
+			wantVersion:  "2.0.0",
+		},
+		{
+			name:         "upgrade already completed",
+			objects:      []client.Object{previous.DeepCopy(), target(clusterv1beta1.InstallationStateInstalled), clusterConfig("2.0.0")},
+			wantErr:      "already been completed",
+			wantState:    clusterv1beta1.InstallationStateInstalled,
+			wantPrevious: clusterv1beta1.InstallationStateObsolete,
+			wantVersion:  "2.0.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+			ctx := context.Background()
+			cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).
+				WithObjects(tt.objects...).WithStatusSubresource(&clusterv1beta1.Installation{}).Build()
+
+			if tt.operatorChart != "" {
+				cp, err := CheckpointFor(ctx, cli, target(""))
+				req.NoError(err)
+				req.NoError(cp.SetPreviousOperatorChart(ctx, cli, k0sv1beta1.Chart{Name: operatorChartName, Version: tt.operatorChart}))
+				req.NoError(cp.SetPreviousNodesStatus(ctx, cli, tt.nodesStatus))
+			}
+
+			err := Cancel(ctx, cli, "20240102000000")
+			if tt.wantErr != "" {
+				req.ErrorContains(err, tt.wantErr)
+			} else {
+				req.NoError(err)
+			}
+
+			var in clusterv1beta1.Installation
+			req.NoError(cli.Get(ctx, client.ObjectKey{Name: "20240102000000"}, &in))
+			req.Equal(tt.wantState, in.Status.State)
+			req.NoError(cli.Get(ctx, client.ObjectKey{Name: "20240101000000"}, &in))
+			req.Equal(tt.wantPrevious, in.Status.State)
+			req.Equal(tt.nodesStatus, in.Status.NodesStatus)
+
+			err = cli.Get(ctx, client.ObjectKey{Name: "autopilot"}, &autopilotv1beta2.Plan{})
+			req.Equal(tt.wantPlan, err == nil)
+			err = cli.Get(ctx, client.ObjectKeyFromObject(job), &batchv1.Job{})
+			if tt.wantErr == "" {
+				req.True(k8serrors.IsNotFound(err))
+			}
+
+			cfg, err := getExistingClusterConfig(ctx, cli)
+			req.NoError(err)
+			req.Equal(tt.wantVersion, findOperatorChart(cfg).Version)
+
+			if tt.wantErr == "" {
+				// a new attempt at the same upgrade is refused.
+				_, err = CheckpointFor(ctx, cli, target(""))
+				req.ErrorContains(err, "has been cancelled")
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package upgrade
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/k0s/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Upgrade phases, in the order they are executed.
+const (
+	PhaseCopyVersionMetadata = "copy-version-metadata"
+	PhaseDistributeArtifacts = "distribute-artifacts"
+	PhaseAirgapImages        = "airgap-images"
+	PhaseOperatorChart       = "operator-chart"
+	PhaseCreateInstallation  = "create-installation"
+)
+
+const (
+	// CheckpointLabel flags the config maps holding upgrade checkpoints. The label value is the
+	// name of the installation being upgraded to, the operator garbage collects the checkpoints
+	// of older installations through it.
+	CheckpointLabel = "embedded-cluster.replicated.com/upgrade-checkpoint"
+
+	checkpointNamespace = "embedded-cluster"
+	checkpointSpecKey   = "spec-hash"
+	// checkpointOperatorChartKey holds the operator chart entry found in the cluster config
+	// before it was replaced, it is used to restore it if the upgrade is cancelled.
+	checkpointOperatorChartKey = "previous-operator-chart"
+	// checkpointNodesStatusKey holds the nodes status of the installation being replaced, the
+	// operator clears it once the installation becomes obsolete. It is used to restore the
+	// installation if the upgrade is cancelled.
+	checkpointNodesStatusKey = "previous-nodes-status"
+	// checkpointCancelledKey is set, with the cancellation time, once the upgrade is cancelled.
+	checkpointCancelledKey = "cancelled"
+)
+
+// Checkpoint records the upgrade phases that have been completed for an installation. It is
+// stored in a config map so an interrupted upgrade can be resumed by running the upgrade
+// command again.
+type Checkpoint struct {
+	cm *corev1.ConfigMap
+}
+
+// CheckpointName returns the name of the config map holding the checkpoint for the installation.
+func CheckpointName(installation string) string {
+	return fmt.Sprintf("upgrade-checkpoint-%s", installation)
+}
+
+// CheckpointFor reads the checkpoint for the installation, creating it if it does not exist. If
+// the installation spec has changed since the checkpoint was written all phases are reset.
+func CheckpointFor(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) (*Checkpoint, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	hash, err := installationSpecHash(in)
+	if err != nil {
+		return nil, fmt.Errorf("hash installation spec: %w", err)
+	}
+
+	var cm corev1.ConfigMap
+	nsn := client.ObjectKey{Name: CheckpointName(in.Name), Namespace: checkpointNamespace}
+	if err := cli.Get(ctx, nsn, &cm); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return nil, fmt.Errorf("get checkpoint: %w", err)
+		}
+		cm = corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      nsn.Name,
+				Namespace: nsn.Namespace,
+				Labels:    map[string]string{CheckpointLabel: in.Name},
+			},
+			Data: map[string]string{checkpointSpecKey: hash},
+		}
+		if err := cli.Create(ctx, &cm); err != nil {
+			return nil, fmt.Errorf("create checkpoint: %w", err)
+		}
+		return &Checkpoint{cm: &cm}, nil
+	}
+
+	if _, ok := cm.Data[checkpointCancelledKey]; ok {
+		return nil, fmt.Errorf("upgrade to installation %s has been cancelled", in.Name)
+	}
+
+	if cm.Data[checkpointSpecKey] != hash {
+		log.Info("Installation changed since the last attempt, starting over")
+		data := map[string]string{checkpointSpecKey: hash}
+		// the operator chart and the previous installation may already have been replaced by
+		// the previous attempt.
+		for _, key := range []string{checkpointOperatorChartKey, checkpointNodesStatusKey} {
+			if value, ok := cm.Data[key]; ok {
+				data[key] = value
+			}
+		}
+		cm.Data = data
+		if err := cli.Update(ctx, &cm); err != nil {
+			return nil, fmt.Errorf("reset checkpoint: %w", err)
+		}
+	}
+	return &Checkpoint{cm: &cm}, nil
+}
+
+// getCheckpoint reads the checkpoint for the installation. Returns nil if there is none.
+func getCheckpoint(ctx context.Context, cli client.Client, installation string) (*Checkpoint, error) {
+	var cm corev1.ConfigMap
+	nsn := client.ObjectKey{Name: CheckpointName(installation), Namespace: checkpointNamespace}
+	if err := cli.Get(ctx, nsn, &cm); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get checkpoint: %w", err)
+	}
+	return &Checkpoint{cm: &cm}, nil
+}
+
+// Cancelled reads the checkpoint back from the cluster and returns true if the upgrade has been
+// cancelled in the meantime.
+func (c *Checkpoint) Cancelled(ctx context.Context, cli client.Client) (bool, error) {
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(c.cm), c.cm); err != nil {
+		return false, fmt.Errorf("get checkpoint: %w", err)
+	}
+	_, ok := c.cm.Data[checkpointCancelledKey]
+	return ok, nil
+}
+
+// MarkCancelled records the upgrade as cancelled. Upgrade attempts still in progress stop at the
+// next phase.
+func (c *Checkpoint) MarkCancelled(ctx context.Context, cli client.Client) error {
+	patch := client.MergeFrom(c.cm.DeepCopy())
+	if c.cm.Data == nil {
+		c.cm.Data = map[string]string{}
+	}
+	c.cm.Data[checkpointCancelledKey] = time.Now().UTC().Format(time.RFC3339)
+	if err := cli.Patch(ctx, c.cm, patch); err != nil {
+		return fmt.Errorf("patch checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Completed returns true if the phase has been completed.
+func (c *Checkpoint) Completed(phase string) bool {
+	_, ok := c.cm.Data[phase]
+	return ok
+}
+
+// CompletedAt returns the time the phase has been completed.
+func (c *Checkpoint) CompletedAt(phase string) (time.Time, bool) {
+	raw, ok := c.cm.Data[phase]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Complete records the phase as completed.
+func (c *Checkpoint) Complete(ctx context.Context, cli client.Client, phase string) error {
+	patch := client.MergeFrom(c.cm.DeepCopy())
+	if c.cm.Data == nil {
+		c.cm.Data = map[string]string{}
+	}
+	c.cm.Data[phase] = time.Now().UTC().Format(time.RFC3339)
+	if err := cli.Patch(ctx, c.cm, patch); err != nil {
+		return fmt.Errorf("patch checkpoint: %w", err)
+	}
+	return nil
+}
+
+// SetPreviousOperatorChart records the operator chart entry replaced by the upgrade. An
+// existing record is kept as it holds the chart from before the first attempt.
+func (c *Checkpoint) SetPreviousOperatorChart(ctx context.Context, cli client.Client, chart k0sv1beta1.Chart) error {
+	if _, ok := c.cm.Data[checkpointOperatorChartKey]; ok {
+		return nil
+	}
+	data, err := json.Marshal(chart)
+	if err != nil {
+		return fmt.Errorf("marshal chart: %w", err)
+	}
+	patch := client.MergeFrom(c.cm.DeepCopy())
+	if c.cm.Data == nil {
+		c.cm.Data = map[string]string{}
+	}
+	c.cm.Data[checkpointOperatorChartKey] = string(data)
+	if err := cli.Patch(ctx, c.cm, patch); err != nil {
+		return fmt.Errorf("patch checkpoint: %w", err)
+	}
+	return nil
+}
+
+// PreviousOperatorChart returns the operator chart entry replaced by the upgrade, if any.
+func (c *Checkpoint) PreviousOperatorChart() (*k0sv1beta1.Chart, error) {
+	raw, ok := c.cm.Data[checkpointOperatorChartKey]
+	if !ok {
+		return nil, nil
+	}
+	var chart k0sv1beta1.Chart
+	if err := json.Unmarshal([]byte(raw), &chart); err != nil {
+		return nil, fmt.Errorf("unmarshal chart: %w", err)
+	}
+	return &chart, nil
+}
+
+// SetPreviousNodesStatus records the nodes status of the installation replaced by the upgrade. An
+// existing record is kept as it holds the nodes status from before the first attempt.
+func (c *Checkpoint) SetPreviousNodesStatus(ctx context.Context, cli client.Client, nodes []clusterv1beta1.NodeStatus) error {
+	if _, ok := c.cm.Data[checkpointNodesStatusKey]; ok {
+		return nil
+	}
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		return fmt.Errorf("marshal nodes status: %w", err)
+	}
+	patch := client.MergeFrom(c.cm.DeepCopy())
+	if c.cm.Data == nil {
+		c.cm.Data = map[string]string{}
+	}
+	c.cm.Data[checkpointNodesStatusKey] = string(data)
+	if err := cli.Patch(ctx, c.cm, patch); err != nil {
+		return fmt.Errorf("patch checkpoint: %w", err)
+	}
+	return nil
+}
+
+// PreviousNodesStatus returns the nodes status of the installation replaced by the upgrade, if
+// any.
+func (c *Checkpoint) PreviousNodesStatus() ([]clusterv1beta1.NodeStatus, error) {
+	raw, ok := c.cm.Data[checkpointNodesStatusKey]
+	if !ok {
+		return nil, nil
+	}
+	var nodes []clusterv1beta1.NodeStatus
+	if err := json.Unmarshal([]byte(raw), &nodes); err != nil {
+		return nil, fmt.Errorf("unmarshal nodes status: %w", err)
+	}
+	return nodes, nil
+}
+
+// runPhase runs the phase unless the checkpoint shows it has already been completed. The phase
+// is recorded as completed once it succeeds.
+func runPhase(ctx context.Context, cli client.Client, cp *Checkpoint, phase string, fn func() error) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	if cp.Completed(phase) {
+		log.Info("Skipping completed upgrade phase", "phase", phase)
+		return nil
+	}
+	if cancelled, err := cp.Cancelled(ctx, cli); err != nil {
+		return fmt.Errorf("check cancellation: %w", err)
+	} else if cancelled {
+		return fmt.Errorf("upgrade cancelled before phase %s", phase)
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := cp.Complete(ctx, cli, phase); err != nil {
+		return fmt.Errorf("record phase %s: %w", phase, err)
+	}
+	return nil
+}
+
+func installationSpecHash(in *clusterv1beta1.Installation) (string, error) {
+	data, err := json.Marshal(in.Spec)
+	if err != nil {
+		return "", fmt.Errorf("marshal spec: %w", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:10], nil
+}
@@ -0,0 +1,116 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func TestCheckpoint(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().Build()
+
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+		Spec:       clusterv1beta1.InstallationSpec{ClusterID: "abc"},
+	}
+
+	cp, err := CheckpointFor(ctx, cli, in)
+	req.NoError(err)
+	req.False(cp.Completed(PhaseOperatorChart))
+
+	calls := 0
+	phase := func() error {
+		calls++
+		return nil
+	}
+	req.NoError(runPhase(ctx, cli, cp, PhaseOperatorChart, phase))
+	req.Equal(1, calls)
+
+	// failed phases are not recorded.
+	err = runPhase(ctx, cli, cp, PhaseCreateInstallation, func() error { return fmt.Errorf("boom") })
+	req.ErrorContains(err, "boom")
+
+	// a rerun skips the completed phases.
+	cp, err = CheckpointFor(ctx, cli, in)
+	req.NoError(err)
+	req.True(cp.Completed(PhaseOperatorChart))
+	req.False(cp.Completed(PhaseCreateInstallation))
+	_, ok := cp.CompletedAt(PhaseOperatorChart)
+	req.True(ok)
+	req.NoError(runPhase(ctx, cli, cp, PhaseOperatorChart, phase))
+	req.Equal(1, calls)
+
+	// a change to the installation spec starts over.
+	in.Spec.ClusterID = "xyz"
+	cp, err = CheckpointFor(ctx, cli, in)
+	req.NoError(err)
+	req.False(cp.Completed(PhaseOperatorChart))
+
+	var cm corev1.ConfigMap
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: CheckpointName(in.Name), Namespace: "embedded-cluster"}, &cm))
+	req.Equal(in.Name, cm.Labels[CheckpointLabel])
+}
+
+func Test_recordPreviousNodesStatus(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	nodes := []clusterv1beta1.NodeStatus{{Name: "node1", Hash: "abc"}}
+	previous := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+		Status:     clusterv1beta1.InstallationStatus{NodesStatus: nodes},
+	}
+	cancelled := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240102000000"},
+		Status:     clusterv1beta1.InstallationStatus{State: conditions.InstallationStateCancelled},
+	}
+	in := &clusterv1beta1.Installation{ObjectMeta: metav1.ObjectMeta{Name: "20240103000000"}}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(previous, cancelled).Build()
+
+	cp, err := CheckpointFor(ctx, cli, in)
+	req.NoError(err)
+	req.NoError(recordPreviousNodesStatus(ctx, cli, cp, in.Name))
+
+	// the record survives a change to the installation spec.
+	in.Spec.ClusterID = "xyz"
+	cp, err = CheckpointFor(ctx, cli, in)
+	req.NoError(err)
+	got, err := cp.PreviousNodesStatus()
+	req.NoError(err)
+	req.Equal(nodes, got)
+}
+
+func Test_createInstallation(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sch := runtime.NewScheme()
+	req.NoError(clusterv1beta1.AddToScheme(sch))
+	cli := fake.NewClientBuilder().WithScheme(sch).Build()
+
+	newInstallation := func(clusterID string) *clusterv1beta1.Installation {
+		return &clusterv1beta1.Installation{
+			ObjectMeta: metav1.ObjectMeta{Name: "20240101000000"},
+			Spec:       clusterv1beta1.InstallationSpec{ClusterID: clusterID},
+		}
+	}
+
+	req.NoError(createInstallation(ctx, cli, newInstallation("abc")))
+	// creating the same installation again is a noop.
+	req.NoError(createInstallation(ctx, cli, newInstallation("abc")))
+	// but a different installation with the same name is an error.
+	req.ErrorContains(createInstallation(ctx, cli, newInstallation("xyz")), "already exists with a different spec")
+}
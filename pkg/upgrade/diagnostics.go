@@ -0,0 +1,300 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	"github.com/k0sproject/k0s/pkg/autopilot/controller/plans/core"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/autopilot"
+)
+
+var (
+	// phasePollInterval is the interval at which the upgrade phases check if they are done.
+	phasePollInterval = 5 * time.Second
+	// progressLogInterval is the interval at which the progress of a phase is logged even if it
+	// has not changed.
+	progressLogInterval = time.Minute
+	// diagnosticsTimeout bounds the time spent collecting diagnostics once a phase timed out.
+	diagnosticsTimeout = 30 * time.Second
+)
+
+// PhaseTimeoutError is returned when an upgrade phase does not complete in time. Timeout is zero
+// if the phase had no timeout of its own but the upgrade deadline was reached. Diagnostics holds
+// what we could find out about the reason.
+type PhaseTimeoutError struct {
+	Phase       string
+	Timeout     time.Duration
+	Progress    string
+	Diagnostics string
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	msg := fmt.Sprintf("phase %s timed out", e.Phase)
+	if e.Timeout > 0 {
+		msg = fmt.Sprintf("%s after %s", msg, e.Timeout)
+	}
+	if e.Progress != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Progress)
+	}
+	if e.Diagnostics != "" {
+		msg = fmt.Sprintf("%s:\n%s", msg, e.Diagnostics)
+	}
+	return msg
+}
+
+// waitFunc checks if a phase is done. It also returns a short description of the progress made
+// so far.
+type waitFunc func(ctx context.Context) (bool, string, error)
+
+// diagnoseFunc describes why a phase has not completed.
+type diagnoseFunc func(ctx context.Context) string
+
+// waitForPhase polls until the phase is done, the timeout expires or the context is cancelled.
+// A zero timeout waits forever. The progress is logged when it changes and every
+// progressLogInterval. On timeout a PhaseTimeoutError holding the phase diagnostics is returned.
+func waitForPhase(ctx context.Context, phase string, timeout time.Duration, check waitFunc, diagnose diagnoseFunc) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	// the phase deadline only applies if it comes before the upgrade deadline, otherwise the
+	// timeout is reported as the upgrade one.
+	pctx, ownDeadline := ctx, false
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		if parent, ok := ctx.Deadline(); !ok || deadline.Before(parent) {
+			ownDeadline = true
+		}
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var progress string
+	var logged time.Time
+	err := wait.PollUntilContextCancel(pctx, phasePollInterval, true, func(ctx context.Context) (bool, error) {
+		done, current, err := check(ctx)
+		if err != nil || done {
+			return done, err
+		}
+		if current != progress || time.Since(logged) >= progressLogInterval {
+			log.Info("Waiting for upgrade phase", "phase", phase, "progress", current)
+			logged = time.Now()
+		}
+		progress = current
+		return false, nil
+	})
+	if err == nil || !errors.Is(pctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	// the context may have expired as well, we still want to report what went wrong.
+	dctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), diagnosticsTimeout)
+	defer cancel()
+	timeoutErr := &PhaseTimeoutError{
+		Phase:       phase,
+		Progress:    progress,
+		Diagnostics: diagnose(dctx),
+	}
+	if ownDeadline {
+		timeoutErr.Timeout = timeout
+	}
+	return timeoutErr
+}
+
+// chartStatus describes the state of the k0s chart with the given name compared to the
+// version we are waiting for.
+func chartStatus(ctx context.Context, cli client.Client, name, version string) string {
+	var chart k0shelm.Chart
+	nsn := client.ObjectKey{Name: fmt.Sprintf("k0s-addon-chart-%s", name), Namespace: "kube-system"}
+	if err := cli.Get(ctx, nsn, &chart); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return fmt.Sprintf("chart %s not found", name)
+		}
+		return fmt.Sprintf("failed to get chart %s: %v", name, err)
+	}
+	if chart.Status.Error != "" {
+		return fmt.Sprintf("chart %s error: %s", name, chart.Status.Error)
+	}
+	if chart.Status.Version != version {
+		return fmt.Sprintf("chart %s at version %q, waiting for %q", name, chart.Status.Version, version)
+	}
+	return fmt.Sprintf("chart %s at version %q, waiting for the values to be applied", name, version)
+}
+
+// States of the copy artifacts job of a node.
+const (
+	artifactsJobQueued    = "Queued"
+	artifactsJobRunning   = "Running"
+	artifactsJobVerifying = "Verifying"
+	artifactsJobSucceeded = "Succeeded"
+	artifactsJobFailed    = "Failed"
+)
+
+// artifactsJobState returns the state of a copy artifacts job. A nil job has not been started
+// yet. A job is only considered succeeded once the digests reported by the node were recorded.
+func artifactsJobState(job *batchv1.Job) string {
+	switch {
+	case job == nil:
+		return artifactsJobQueued
+	case job.Status.Succeeded > 0 && artifacts.VerifiedDigests(job) == nil:
+		return artifactsJobVerifying
+	case job.Status.Succeeded > 0:
+		return artifactsJobSucceeded
+	case jobFailedCondition(job) != nil:
+		return artifactsJobFailed
+	}
+	return artifactsJobRunning
+}
+
+// jobFailedCondition returns the failed condition of the job, if the job has failed.
+func jobFailedCondition(job *batchv1.Job) *batchv1.JobCondition {
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			return &cond
+		}
+	}
+	return nil
+}
+
+// jobsProgress returns how many of the jobs have succeeded, are running or are still queued.
+// Jobs whose digests are being verified are reported as running.
+func jobsProgress(jobs map[string]*batchv1.Job) string {
+	count := map[string]int{}
+	for _, job := range jobs {
+		state := artifactsJobState(job)
+		if state == artifactsJobVerifying {
+			state = artifactsJobRunning
+		}
+		count[state]++
+	}
+	return fmt.Sprintf(
+		"%d/%d nodes done, %d running, %d queued",
+		count[artifactsJobSucceeded], len(jobs), count[artifactsJobRunning], count[artifactsJobQueued],
+	)
+}
+
+// diagnoseJobs reports the state of the pods of the jobs that have not succeeded. The logs of
+// the failing containers are included if a podLogs function is provided.
+func diagnoseJobs(ctx context.Context, cli client.Client, jobs map[string]*batchv1.Job, podLogs PodLogsFunc) string {
+	nodes := []string{}
+	for node := range jobs {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	lines := []string{}
+	for _, node := range nodes {
+		job := jobs[node]
+		if job == nil {
+			lines = append(lines, fmt.Sprintf("node %s: queued", node))
+			continue
+		}
+		if job.Status.Succeeded > 0 {
+			if artifacts.VerifiedDigests(job) == nil {
+				lines = append(lines, fmt.Sprintf("node %s: job %s succeeded, artifacts digests not verified", node, job.Name))
+			}
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("node %s: job %s has not completed (%d active, %d failed)", node, job.Name, job.Status.Active, job.Status.Failed))
+
+		var pods corev1.PodList
+		err := cli.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name})
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("  failed to list pods: %v", err))
+			continue
+		}
+		for _, pod := range pods.Items {
+			lines = append(lines, fmt.Sprintf("  pod %s: %s", pod.Name, pod.Status.Phase))
+			// the artifacts are pulled by init containers before being placed.
+			statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+			for _, status := range statuses {
+				failing := false
+				switch {
+				case status.State.Waiting != nil:
+					lines = append(lines, strings.TrimRight(fmt.Sprintf("    container %s waiting: %s %s", status.Name, status.State.Waiting.Reason, status.State.Waiting.Message), " "))
+				case status.State.Terminated != nil && status.State.Terminated.ExitCode != 0:
+					failing = true
+					lines = append(lines, strings.TrimRight(fmt.Sprintf("    container %s terminated: %s %s", status.Name, status.State.Terminated.Reason, status.State.Terminated.Message), " "))
+				}
+				if !failing || podLogs == nil {
+					continue
+				}
+				logs, err := podLogs(ctx, pod.Namespace, pod.Name, status.Name)
+				if err != nil {
+					lines = append(lines, fmt.Sprintf("    failed to get logs: %v", err))
+					continue
+				}
+				for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+					lines = append(lines, "    | "+line)
+				}
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// planProgress returns the state of the autopilot plan and how many nodes are done.
+func planProgress(plan autopilotv1beta2.Plan) string {
+	total, done := 0, 0
+	count := func(targets []autopilotv1beta2.PlanCommandTargetStatus) {
+		for _, target := range targets {
+			total++
+			if target.State == core.SignalCompleted {
+				done++
+			}
+		}
+	}
+	for _, cmd := range plan.Status.Commands {
+		if cmd.K0sUpdate != nil {
+			count(cmd.K0sUpdate.Controllers)
+			count(cmd.K0sUpdate.Workers)
+		}
+		if cmd.AirgapUpdate != nil {
+			count(cmd.AirgapUpdate.Workers)
+		}
+	}
+	return fmt.Sprintf("%s, %d/%d nodes done", autopilot.ReasonForState(plan), done, total)
+}
+
+// diagnosePlan reports the state of the autopilot plan and of each of the nodes that are not
+// done yet.
+func diagnosePlan(ctx context.Context, cli client.Client) string {
+	var plan autopilotv1beta2.Plan
+	if err := cli.Get(ctx, client.ObjectKey{Name: "autopilot"}, &plan); err != nil {
+		return fmt.Sprintf("failed to get autopilot plan: %v", err)
+	}
+	lines := []string{fmt.Sprintf("autopilot plan state %q: %s", plan.Status.State, autopilot.ReasonForState(plan))}
+	report := func(targets []autopilotv1beta2.PlanCommandTargetStatus) {
+		for _, target := range targets {
+			if target.State != core.SignalCompleted {
+				lines = append(lines, fmt.Sprintf("node %s: %s", target.Name, target.State))
+			}
+		}
+	}
+	for _, cmd := range plan.Status.Commands {
+		if cmd.State != "" {
+			lines = append(lines, fmt.Sprintf("command %d: %s %s", cmd.ID, cmd.State, cmd.Description))
+		}
+		if cmd.K0sUpdate != nil {
+			report(cmd.K0sUpdate.Controllers)
+			report(cmd.K0sUpdate.Workers)
+		}
+		if cmd.AirgapUpdate != nil {
+			report(cmd.AirgapUpdate.Workers)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,163 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+)
+
+func Test_waitForPhase(t *testing.T) {
+	req := require.New(t)
+	orig := phasePollInterval
+	defer func() { phasePollInterval = orig }()
+	phasePollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+
+	calls := 0
+	err := waitForPhase(ctx, "test", time.Second, func(ctx context.Context) (bool, string, error) {
+		calls++
+		return calls == 3, fmt.Sprintf("%d/3", calls), nil
+	}, func(ctx context.Context) string { return "unused" })
+	req.NoError(err)
+	req.Equal(3, calls)
+
+	err = waitForPhase(ctx, "test", 50*time.Millisecond, func(ctx context.Context) (bool, string, error) {
+		return false, "1/3 nodes done", nil
+	}, func(ctx context.Context) string { return "node2: stuck" })
+	var timeoutErr *PhaseTimeoutError
+	req.True(errors.As(err, &timeoutErr))
+	req.Equal("test", timeoutErr.Phase)
+	req.Equal("1/3 nodes done", timeoutErr.Progress)
+	req.Equal("node2: stuck", timeoutErr.Diagnostics)
+	req.Contains(err.Error(), "phase test timed out after 50ms (1/3 nodes done):\nnode2: stuck")
+
+	// the upgrade deadline comes first, the phase timeout is not reported.
+	uctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = waitForPhase(uctx, "test", time.Hour, func(ctx context.Context) (bool, string, error) {
+		return false, "1/3 nodes done", nil
+	}, func(ctx context.Context) string { return "node2: stuck" })
+	req.True(errors.As(err, &timeoutErr))
+	req.Zero(timeoutErr.Timeout)
+	req.Contains(err.Error(), "phase test timed out (1/3 nodes done)")
+
+	// errors from the check are returned as is.
+	err = waitForPhase(ctx, "test", time.Second, func(ctx context.Context) (bool, string, error) {
+		return false, "", fmt.Errorf("boom")
+	}, nil)
+	req.EqualError(err, "boom")
+}
+
+func Test_chartStatus(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&k0shelm.Chart{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-failing", Namespace: "kube-system"},
+			Status:     k0shelm.ChartStatus{Version: "1.0.0", Error: "release failed"},
+		},
+		&k0shelm.Chart{
+			ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-old", Namespace: "kube-system"},
+			Status:     k0shelm.ChartStatus{Version: "1.0.0"},
+		},
+	).Build()
+
+	req.Equal("chart failing error: release failed", chartStatus(ctx, cli, "failing", "2.0.0"))
+	req.Equal(`chart old at version "1.0.0", waiting for "2.0.0"`, chartStatus(ctx, cli, "old", "2.0.0"))
+	req.Equal("chart missing not found", chartStatus(ctx, cli, "missing", "2.0.0"))
+}
+
+func Test_diagnoseJobs(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	jobs := map[string]*batchv1.Job{
+		"node1": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "copy-artifacts-node1",
+				Namespace:   "embedded-cluster",
+				Annotations: map[string]string{artifacts.ArtifactsDigestsAnnotation: `{"bin/k0s":"abc"}`},
+			},
+			Status: batchv1.JobStatus{Succeeded: 1},
+		},
+		"node2": {
+			ObjectMeta: metav1.ObjectMeta{Name: "copy-artifacts-node2", Namespace: "embedded-cluster"},
+			Status:     batchv1.JobStatus{Failed: 1},
+		},
+		"node3": nil,
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "copy-artifacts-node2-abcde",
+				Namespace: "embedded-cluster",
+				Labels:    map[string]string{"job-name": "copy-artifacts-node2"},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodFailed,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name: "embedded-cluster-updater",
+						State: corev1.ContainerState{
+							Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"},
+						},
+					},
+				},
+			},
+		},
+	).Build()
+	podLogs := func(ctx context.Context, namespace, pod, container string) (string, error) {
+		return "pulling binaries\nunauthorized\n", nil
+	}
+
+	req.Equal("1/3 nodes done, 1 running, 1 queued", jobsProgress(jobs))
+	req.Equal(
+		"node node2: job copy-artifacts-node2 has not completed (0 active, 1 failed)\n"+
+			"  pod copy-artifacts-node2-abcde: Failed\n"+
+			"    container embedded-cluster-updater terminated: Error\n"+
+			"    | pulling binaries\n"+
+			"    | unauthorized\n"+
+			"node node3: queued",
+		diagnoseJobs(ctx, cli, jobs, podLogs),
+	)
+}
+
+func Test_diagnosePlan(t *testing.T) {
+	req := require.New(t)
+	plan := &autopilotv1beta2.Plan{
+		ObjectMeta: metav1.ObjectMeta{Name: "autopilot"},
+		Status: autopilotv1beta2.PlanStatus{
+			State: "SchedulableWait",
+			Commands: []autopilotv1beta2.PlanCommandStatus{
+				{
+					AirgapUpdate: &autopilotv1beta2.PlanCommandAirgapUpdateStatus{
+						Workers: []autopilotv1beta2.PlanCommandTargetStatus{
+							{Name: "node1", State: "SignalCompleted"},
+							{Name: "node2", State: "SignalSent"},
+						},
+					},
+				},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(plan).Build()
+
+	req.Equal("Upgrade is being prepared, 1/2 nodes done", planProgress(*plan))
+	req.Equal(
+		"autopilot plan state \"SchedulableWait\": Upgrade is being prepared\nnode node2: SignalSent",
+		diagnosePlan(context.Background(), cli),
+	)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
@@ -15,14 +16,16 @@ import (
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/autopilot"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/charts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/metadata"
 	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/wait"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -34,41 +37,110 @@ const (
 	clusterConfigNamespace = "kube-system"
 )
 
+// PodLogsFunc returns the logs of a container in a pod.
+type PodLogsFunc func(ctx context.Context, namespace, pod, container string) (string, error)
+
+// UpgradeOptions holds the optional settings of an upgrade. A zero timeout waits forever.
+type UpgradeOptions struct {
+	// OperatorChartTimeout bounds the wait for the new operator chart to be deployed.
+	OperatorChartTimeout time.Duration
+	// ArtifactsTimeout bounds the wait for the artifacts to be copied to the nodes.
+	ArtifactsTimeout time.Duration
+	// AirgapImagesTimeout bounds the wait for autopilot to push the images to the nodes.
+	AirgapImagesTimeout time.Duration
+	// MaxConcurrentArtifactJobs is the maximum number of nodes copying the artifacts at the
+	// same time. Zero means no limit.
+	MaxConcurrentArtifactJobs int
+	// OperatorImage is the image placing the artifacts on the nodes. If empty the operator
+	// image in the release metadata is used.
+	OperatorImage string
+	// PodLogs, if set, is used to include the logs of failing pods when a phase times out.
+	PodLogs PodLogsFunc
+}
+
 // Upgrade upgrades the embedded cluster to the version specified in the installation. If the
 // installation is airgapped, the artifacts are copied to the nodes and the autopilot plan is
 // created to copy the images to the cluster. The operator chart is updated to the  version
 // specified in the installation. This will update the CRDs and operator. The installation is then
-// created and the operator will resume the upgrade process.
-func Upgrade(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string) error {
+// created and the operator will resume the upgrade process. Each phase is recorded in a
+// checkpoint once completed, if the upgrade is interrupted running it again skips the phases
+// that have already been completed. The local artifact mirror image is optional, if empty the
+// image referenced in the release metadata is used.
+func Upgrade(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string, applyOpts ...func(*UpgradeOptions)) error {
+	opts := &UpgradeOptions{}
+	for _, apply := range applyOpts {
+		apply(opts)
+	}
+
+	cp, err := CheckpointFor(ctx, cli, in)
+	if err != nil {
+		return fmt.Errorf("get upgrade checkpoint: %w", err)
+	}
+
 	if in.Spec.AirGap {
 		// in airgap installations we need to copy the artifacts to the nodes and then autopilot
 		// will copy the images to the cluster so we can start the new operator.
 
-		if localArtifactMirrorImage == "" {
-			return fmt.Errorf("local artifact mirror image is required for airgap installations")
+		err = runPhase(ctx, cli, cp, PhaseCopyVersionMetadata, func() error {
+			if err := metadata.CopyVersionMetadataToCluster(ctx, cli, in); err != nil {
+				return fmt.Errorf("copy version metadata to cluster: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		err := metadata.CopyVersionMetadataToCluster(ctx, cli, in)
+		err = runPhase(ctx, cli, cp, PhaseDistributeArtifacts, func() error {
+			// in airgap installations let's make sure all assets have been copied to nodes.
+			// this may take some time so we only move forward when 'ready'.
+			if err := ensureAirgapArtifactsOnNodes(ctx, cli, in, localArtifactMirrorImage, opts); err != nil {
+				return fmt.Errorf("ensure airgap artifacts: %w", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("copy version metadata to cluster: %w", err)
+			return err
 		}
 
-		err = airgapDistributeArtifacts(ctx, cli, in, localArtifactMirrorImage)
+		err = runPhase(ctx, cli, cp, PhaseAirgapImages, func() error {
+			// once all assets are in place we can create the autopilot plan to push the images to
+			// containerd.
+			if err := ensureAirgapArtifactsInCluster(ctx, cli, in, localArtifactMirrorImage, opts); err != nil {
+				return fmt.Errorf("autopilot copy airgap artifacts: %w", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("airgap distribute artifacts: %w", err)
+			return err
 		}
 	}
 
 	// update the operator chart prior to creating the installation to update the crd
 
-	err := applyOperatorChart(ctx, cli, in)
+	err = runPhase(ctx, cli, cp, PhaseOperatorChart, func() error {
+		if err := applyOperatorChart(ctx, cli, cp, in, opts); err != nil {
+			return fmt.Errorf("apply operator chart: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("apply operator chart: %w", err)
+		return err
 	}
 
-	err = createInstallation(ctx, cli, in)
+	err = runPhase(ctx, cli, cp, PhaseCreateInstallation, func() error {
+		// the operator clears the nodes status of the installation we replace, keep track of it
+		// so it can be restored if the upgrade is cancelled.
+		if err := recordPreviousNodesStatus(ctx, cli, cp, in.Name); err != nil {
+			return fmt.Errorf("record previous nodes status: %w", err)
+		}
+		if err := createInstallation(ctx, cli, in); err != nil {
+			return fmt.Errorf("apply installation: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("apply installation: %w", err)
+		return err
 	}
 
 	// once the new operator is running, it will take care of the rest of the upgrade
@@ -76,15 +148,61 @@ func Upgrade(ctx context.Context, cli client.Client, in *clusterv1beta1.Installa
 	return nil
 }
 
+// recordPreviousNodesStatus records in the checkpoint the nodes status of the installation
+// preceding the one with the given name.
+func recordPreviousNodesStatus(ctx context.Context, cli client.Client, cp *Checkpoint, name string) error {
+	previous, err := previousInstallation(ctx, cli, name)
+	if err != nil {
+		return fmt.Errorf("get previous installation: %w", err)
+	} else if previous == nil {
+		return nil
+	}
+	return cp.SetPreviousNodesStatus(ctx, cli, previous.Status.NodesStatus)
+}
+
+// previousInstallation returns the newest installation, other than a cancelled one, preceding
+// the installation with the given name. Returns nil if there is none.
+func previousInstallation(ctx context.Context, cli client.Client, name string) (*clusterv1beta1.Installation, error) {
+	var list clusterv1beta1.InstallationList
+	if err := cli.List(ctx, &list); err != nil {
+		return nil, fmt.Errorf("list installations: %w", err)
+	}
+	items := list.Items
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[j].Name < items[i].Name
+	})
+	for _, in := range items {
+		if in.Name >= name || in.Status.State == conditions.InstallationStateCancelled {
+			continue
+		}
+		return &in, nil
+	}
+	return nil, nil
+}
+
 func createInstallation(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
 	log := ctrl.LoggerFrom(ctx)
 
 	log.Info("Creating installation...")
 
-	// the installation always has a unique name (current timestamp), so we can just create it
+	// the installation always has a unique name (current timestamp), so we can just create it.
+	// if it already exists we are resuming an interrupted upgrade.
 
 	err := cli.Create(ctx, in)
-	if err != nil {
+	if k8serrors.IsAlreadyExists(err) {
+		var existing clusterv1beta1.Installation
+		if err := cli.Get(ctx, client.ObjectKeyFromObject(in), &existing); err != nil {
+			return fmt.Errorf("get existing installation: %w", err)
+		}
+		if existing.Status.State == conditions.InstallationStateCancelled {
+			return fmt.Errorf("installation %s has been cancelled", in.Name)
+		}
+		if !equality.Semantic.DeepEqual(existing.Spec, in.Spec) {
+			return fmt.Errorf("installation %s already exists with a different spec", in.Name)
+		}
+		log.Info("Installation already exists")
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("create installation: %w", err)
 	}
 
@@ -93,7 +211,7 @@ func createInstallation(ctx context.Context, cli client.Client, in *clusterv1bet
 	return nil
 }
 
-func applyOperatorChart(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
+func applyOperatorChart(ctx context.Context, cli client.Client, cp *Checkpoint, in *clusterv1beta1.Installation, opts *UpgradeOptions) error {
 	log := ctrl.LoggerFrom(ctx)
 
 	operatorChart, err := getOperatorChart(ctx, cli, in)
@@ -106,6 +224,14 @@ func applyOperatorChart(ctx context.Context, cli client.Client, in *clusterv1bet
 		return fmt.Errorf("get existing clusterconfig: %w", err)
 	}
 
+	// keep track of the chart we are replacing so it can be restored if the upgrade is
+	// cancelled.
+	if previous := findOperatorChart(clusterConfig); previous != nil {
+		if err := cp.SetPreviousOperatorChart(ctx, cli, *previous); err != nil {
+			return fmt.Errorf("record previous operator chart: %w", err)
+		}
+	}
+
 	// NOTE: It is not optimal to patch the cluster config prior to upgrading the cluster because
 	// the crd could be out of date. Ideally we would first run the auto-pilot upgrade and then
 	// patch the cluster config, but this command is run from an ephemeral binary in the pod, and
@@ -118,7 +244,7 @@ func applyOperatorChart(ctx context.Context, cli client.Client, in *clusterv1bet
 
 	log.Info("Waiting for operator chart to be up-to-date...")
 
-	err = waitForOperatorChart(ctx, cli, operatorChart.Version)
+	err = waitForOperatorChart(ctx, cli, operatorChart.Version, opts.OperatorChartTimeout)
 	if err != nil {
 		return fmt.Errorf("wait for operator chart: %w", err)
 	}
@@ -128,15 +254,21 @@ func applyOperatorChart(ctx context.Context, cli client.Client, in *clusterv1bet
 	return nil
 }
 
-func waitForOperatorChart(ctx context.Context, cli client.Client, version string) error {
-	err := wait.PollUntilContextCancel(ctx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+func waitForOperatorChart(ctx context.Context, cli client.Client, version string, timeout time.Duration) error {
+	check := func(ctx context.Context) (bool, string, error) {
 		ready, err := k8sutil.GetChartHealthVersion(ctx, cli, operatorChartName, version)
 		if err != nil {
-			return false, fmt.Errorf("get chart health: %w", err)
+			return false, "", fmt.Errorf("get chart health: %w", err)
 		}
-		return ready, nil
-	})
-	return err
+		if ready {
+			return true, "", nil
+		}
+		return false, chartStatus(ctx, cli, operatorChartName, version), nil
+	}
+	diagnose := func(ctx context.Context) string {
+		return chartStatus(ctx, cli, operatorChartName, version)
+	}
+	return waitForPhase(ctx, PhaseOperatorChart, timeout, check, diagnose)
 }
 
 func patchClusterConfigOperatorChart(ctx context.Context, cli client.Client, clusterConfig *k0sv1beta1.ClusterConfig, operatorChart k0sv1beta1.Chart) error {
@@ -198,6 +330,19 @@ func setClusterConfigOperatorChart(clusterConfig *k0sv1beta1.ClusterConfig, oper
 	return desired
 }
 
+// findOperatorChart returns the operator chart entry in the cluster config, if any.
+func findOperatorChart(clusterConfig *k0sv1beta1.ClusterConfig) *k0sv1beta1.Chart {
+	if clusterConfig.Spec == nil || clusterConfig.Spec.Extensions == nil || clusterConfig.Spec.Extensions.Helm == nil {
+		return nil
+	}
+	for _, chart := range clusterConfig.Spec.Extensions.Helm.Charts {
+		if chart.Name == operatorChartName {
+			return &chart
+		}
+	}
+	return nil
+}
+
 func getExistingClusterConfig(ctx context.Context, cli client.Client) (*k0sv1beta1.ClusterConfig, error) {
 	clusterConfig := &k0sv1beta1.ClusterConfig{}
 	err := cli.Get(ctx, client.ObjectKey{Name: clusterConfigName, Namespace: clusterConfigNamespace}, clusterConfig)
@@ -220,7 +365,7 @@ func getOperatorChart(ctx context.Context, cli client.Client, in *clusterv1beta1
 		return nil, fmt.Errorf("get cluster config: %w", err)
 	}
 
-	combinedConfigs, err := charts.K0sHelmExtensionsFromInstallation(ctx, in, metadata, &clusterConfig)
+	combinedConfigs, err := charts.K0sHelmExtensionsFromInstallation(ctx, cli, in, metadata, &clusterConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get helm charts from installation: %w", err)
 	}
@@ -240,118 +385,211 @@ func getOperatorChart(ctx context.Context, cli client.Client, in *clusterv1beta1
 	return nil, fmt.Errorf("operator chart not found")
 }
 
-const (
-	installationNameAnnotation = "embedded-cluster.replicated.com/installation-name"
-)
+func ensureAirgapArtifactsOnNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string, opts *UpgradeOptions) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	log.Info("Placing artifacts on nodes...")
+
+	op, err := artifacts.EnsureRegistrySecretInECNamespace(ctx, cli, in)
+	if err != nil {
+		return fmt.Errorf("ensure registry secret in ec namespace: %w", err)
+	} else if op != controllerutil.OperationResultNone {
+		log.Info("Registry credentials secret changed", "operation", op)
+	}
 
-func airgapDistributeArtifacts(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string) error {
-	// in airgap installations let's make sure all assets have been copied to nodes.
-	// this may take some time so we only move forward when 'ready'.
-	err := ensureAirgapArtifactsOnNodes(ctx, cli, in, localArtifactMirrorImage)
+	distribute, diagnose, err := artifactsDistribution(ctx, cli, in, localArtifactMirrorImage, opts)
 	if err != nil {
-		return fmt.Errorf("ensure airgap artifacts: %w", err)
+		return err
 	}
 
-	// once all assets are in place we can create the autopilot plan to push the images to
-	// containerd.
-	err = ensureAirgapArtifactsInCluster(ctx, cli, in)
+	held, err := artifacts.NodesHoldingArtifacts(ctx, cli, in)
 	if err != nil {
-		return fmt.Errorf("autopilot copy airgap artifacts: %w", err)
+		return fmt.Errorf("list nodes holding artifacts: %w", err)
+	} else if len(held) > 0 {
+		log.Info("Only checking the artifacts are still on the nodes already holding them", "nodes", held)
 	}
 
+	log.Info("Waiting for artifacts to be placed on nodes...")
+
+	err = waitForPhase(ctx, PhaseDistributeArtifacts, opts.ArtifactsTimeout, distribute, diagnose)
+	if err != nil {
+		return fmt.Errorf("wait for artifacts job for nodes: %w", err)
+	}
+
+	log.Info("Artifacts placed on nodes")
 	return nil
 }
 
-func ensureAirgapArtifactsOnNodes(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string) error {
+// artifactsDistribution starts the copy artifacts jobs and returns the functions to wait for
+// and diagnose them. Every check starts the jobs of the nodes that joined the cluster in the
+// meantime and drops the nodes that have been removed.
+func artifactsDistribution(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string, opts *UpgradeOptions) (waitFunc, diagnoseFunc, error) {
 	log := ctrl.LoggerFrom(ctx)
 
-	log.Info("Placing artifacts on nodes...")
+	if localArtifactMirrorImage == "" {
+		image, err := artifacts.LocalArtifactMirrorImage(ctx, cli, in)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get local artifact mirror image: %w", err)
+		}
+		localArtifactMirrorImage = image
+	}
 
-	op, err := artifacts.EnsureRegistrySecretInECNamespace(ctx, cli, in)
-	if err != nil {
-		return fmt.Errorf("ensure registry secret in ec namespace: %w", err)
-	} else if op != controllerutil.OperationResultNone {
-		log.Info("Registry credentials secret changed", "operation", op)
+	// jobs are started at most MaxConcurrentArtifactJobs at a time, we keep calling this while
+	// waiting so queued nodes are started as the earlier jobs complete.
+	ensureJobs := func(ctx context.Context) error {
+		return artifacts.EnsureArtifactsJobForNodes(ctx, cli, in, localArtifactMirrorImage, func(o *artifacts.EnsureArtifactsJobOptions) {
+			o.MaxConcurrent = opts.MaxConcurrentArtifactJobs
+			if opts.OperatorImage != "" {
+				o.OperatorImage = opts.OperatorImage
+			}
+		})
+	}
+	if err := ensureJobs(ctx); err != nil {
+		return nil, nil, fmt.Errorf("ensure artifacts job for nodes: %w", err)
 	}
 
-	err = artifacts.EnsureArtifactsJobForNodes(ctx, cli, in, localArtifactMirrorImage)
+	// without digests in the release metadata the nodes only report the digests of what they
+	// pulled, we make it clear nothing was verified.
+	expected, err := artifacts.ExpectedDigests(ctx, cli, in)
 	if err != nil {
-		return fmt.Errorf("ensure artifacts job for nodes: %w", err)
+		return nil, nil, fmt.Errorf("get expected digests: %w", err)
+	}
+	verification := ""
+	if len(expected) == 0 {
+		verification = ", digests verification skipped as the release metadata has none"
+		log.Info("The release metadata has no artifact digests, skipping their verification")
 	}
 
-	log.Info("Waiting for artifacts to be placed on nodes...")
+	var jobs map[string]*batchv1.Job
+	states := map[string]string{}
+	check := func(ctx context.Context) (bool, string, error) {
+		if err := ensureJobs(ctx); err != nil {
+			return false, "", fmt.Errorf("ensure artifacts job for nodes: %w", err)
+		}
 
-	err = wait.PollUntilContextCancel(ctx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
-		jobs, err := artifacts.ListArtifactsJobForNodes(ctx, cli, in)
+		var err error
+		jobs, err = artifacts.ListArtifactsJobForNodes(ctx, cli, in)
 		if err != nil {
-			return false, fmt.Errorf("list artifacts jobs for nodes: %w", err)
+			return false, "", fmt.Errorf("list artifacts jobs for nodes: %w", err)
+		}
+		// a node is only done once the digests of its artifacts have been verified.
+		if err := artifacts.RecordArtifactsDigests(ctx, cli, in, jobs); err != nil {
+			return false, "", fmt.Errorf("record artifacts digests: %w", err)
+		}
+
+		for nodeName := range states {
+			if _, ok := jobs[nodeName]; !ok {
+				log.Info("Node removed, dropping it from the artifacts copy", "node", nodeName)
+				delete(states, nodeName)
+			}
 		}
 
 		ready := true
 		for nodeName, job := range jobs {
-			if job == nil {
-				return false, fmt.Errorf("job for node %s not found", nodeName)
+			state := artifactsJobState(job)
+			if states[nodeName] != state {
+				log.Info("Artifacts copy progress", "node", nodeName, "state", state)
+				states[nodeName] = state
 			}
-			if job.Status.Succeeded > 0 {
+			switch state {
+			case artifactsJobSucceeded:
 				continue
+			case artifactsJobFailed:
+				// fail immediately if any job fails
+				cond := jobFailedCondition(job)
+				return false, "", fmt.Errorf(
+					"job for node %s failed: %s - %s\n%s", nodeName, cond.Reason, cond.Message,
+					diagnoseJobs(ctx, cli, map[string]*batchv1.Job{nodeName: job}, opts.PodLogs),
+				)
 			}
 			ready = false
-			for _, cond := range job.Status.Conditions {
-				if cond.Type == batchv1.JobFailed {
-					if cond.Status == corev1.ConditionTrue {
-						// fail immediately if any job fails
-						return false, fmt.Errorf("job for node %s failed: %s - %s", nodeName, cond.Reason, cond.Message)
-					}
-					break
-				}
-			}
-			// job is still running
 		}
 
-		return ready, nil
-	})
-	if err != nil {
-		return fmt.Errorf("wait for artifacts job for nodes: %w", err)
+		return ready, jobsProgress(jobs) + verification, nil
 	}
-
-	log.Info("Artifacts placed on nodes")
-	return nil
+	diagnose := func(ctx context.Context) string {
+		return diagnoseJobs(ctx, cli, jobs, opts.PodLogs)
+	}
+	return check, diagnose, nil
 }
 
-func ensureAirgapArtifactsInCluster(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
+// ensureAirgapArtifactsInCluster creates the autopilot plan importing the images on all nodes
+// and waits for it. If nodes join or leave the cluster before the plan has completed the
+// artifacts are copied to the new nodes and the plan is recreated for the current nodes.
+func ensureAirgapArtifactsInCluster(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation, localArtifactMirrorImage string, opts *UpgradeOptions) error {
 	log := ctrl.LoggerFrom(ctx)
 
 	log.Info("Uploading container images...")
 
-	err := autopilotEnsureAirgapArtifactsPlan(ctx, cli, in)
+	distribute, diagnoseDistribution, err := artifactsDistribution(ctx, cli, in, localArtifactMirrorImage, opts)
 	if err != nil {
-		return fmt.Errorf("ensure autopilot plan: %w", err)
+		return err
 	}
 
 	nsn := types.NamespacedName{Name: "autopilot"}
 	plan := autopilotv1beta2.Plan{}
+	planned := false
 
 	log.Info("Waiting for container images to be uploaded...")
 
-	err = wait.PollUntilContextCancel(ctx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+	check := func(ctx context.Context) (bool, string, error) {
 		err := cli.Get(ctx, nsn, &plan)
-		if err != nil {
-			return false, fmt.Errorf("get autopilot plan: %w", err)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return false, "", fmt.Errorf("get autopilot plan: %w", err)
+		}
+		exists := err == nil
+		if exists && plan.Annotations[conditions.InstallationNameAnnotation] != in.Name {
+			if planned {
+				return false, "", fmt.Errorf("autopilot plan for different installation")
+			}
+			exists = false
 		}
-		if plan.Annotations[installationNameAnnotation] != in.Name {
-			return false, fmt.Errorf("autopilot plan for different installation")
+		if exists && autopilot.HasPlanSucceeded(plan) {
+			return true, "", nil
 		}
 
-		switch {
-		case autopilot.HasPlanSucceeded(plan):
-			return true, nil
-		case autopilot.HasPlanFailed(plan):
+		var nodes corev1.NodeList
+		if err := cli.List(ctx, &nodes); err != nil {
+			return false, "", fmt.Errorf("list nodes: %w", err)
+		}
+		changed := exists && !sameNodes(autopilot.PlanTargetNodes(plan), nodes.Items)
+		if !exists || changed {
+			planned = false
+			// all nodes must hold the artifacts before the plan can be created.
+			done, progress, err := distribute(ctx)
+			if err != nil {
+				return false, "", err
+			} else if !done {
+				return false, fmt.Sprintf("copying artifacts to nodes, %s", progress), nil
+			}
+			if changed {
+				log.Info("Nodes changed, recreating the autopilot plan", "nodes", len(nodes.Items))
+				if err := cli.Delete(ctx, &plan); err != nil && !k8serrors.IsNotFound(err) {
+					return false, "", fmt.Errorf("delete autopilot plan: %w", err)
+				}
+			}
+			if err := autopilotEnsureAirgapArtifactsPlan(ctx, cli, in); err != nil {
+				return false, "", fmt.Errorf("ensure autopilot plan: %w", err)
+			}
+			planned = true
+			return false, "autopilot plan created", nil
+		}
+		planned = true
+
+		if autopilot.HasPlanFailed(plan) {
 			reason := autopilot.ReasonForState(plan)
-			return false, fmt.Errorf("autopilot plan failed: %s", reason)
+			return false, "", fmt.Errorf("autopilot plan failed: %s\n%s", reason, diagnosePlan(ctx, cli))
 		}
 		// plan is still running
-		return false, nil
-	})
+		return false, planProgress(plan), nil
+	}
+	diagnose := func(ctx context.Context) string {
+		if !planned {
+			return diagnoseDistribution(ctx)
+		}
+		return diagnosePlan(ctx, cli)
+	}
+	err = waitForPhase(ctx, PhaseAirgapImages, opts.AirgapImagesTimeout, check, diagnose)
 	if err != nil {
 		return fmt.Errorf("wait for autopilot plan: %w", err)
 	}
@@ -360,6 +598,23 @@ func ensureAirgapArtifactsInCluster(ctx context.Context, cli client.Client, in *
 	return nil
 }
 
+// sameNodes returns true if the plan targets exactly the given nodes.
+func sameNodes(targets []string, nodes []corev1.Node) bool {
+	if len(targets) != len(nodes) {
+		return false
+	}
+	names := map[string]bool{}
+	for _, node := range nodes {
+		names[node.Name] = true
+	}
+	for _, target := range targets {
+		if !names[target] {
+			return false
+		}
+	}
+	return true
+}
+
 func autopilotEnsureAirgapArtifactsPlan(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) error {
 	plan, err := getAutopilotAirgapArtifactsPlan(ctx, cli, in)
 	if err != nil {
@@ -368,7 +623,7 @@ func autopilotEnsureAirgapArtifactsPlan(ctx context.Context, cli client.Client,
 
 	err = k8sutil.EnsureObject(ctx, cli, plan, func(opts *k8sutil.EnsureObjectOptions) {
 		opts.ShouldDelete = func(obj client.Object) bool {
-			return obj.GetAnnotations()[installationNameAnnotation] != in.Name
+			return obj.GetAnnotations()[conditions.InstallationNameAnnotation] != in.Name
 		}
 	})
 	if err != nil {
@@ -398,7 +653,7 @@ func getAutopilotAirgapArtifactsPlan(ctx context.Context, cli client.Client, in
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "autopilot", // this is a fixed name and should not be changed
 			Annotations: map[string]string{
-				installationNameAnnotation: in.Name,
+				conditions.InstallationNameAnnotation: in.Name,
 			},
 		},
 		Spec: autopilotv1beta2.PlanSpec{
@@ -0,0 +1,122 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	ectypes "github.com/replicatedhq/embedded-cluster-kinds/types"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/artifacts"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/autopilot"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/k8sutil"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/release"
+)
+
+func Test_ensureAirgapArtifactsInCluster_removedNode(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	orig := phasePollInterval
+	defer func() { phasePollInterval = orig }()
+	phasePollInterval = 10 * time.Millisecond
+
+	const digest = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	release.CacheMeta("1.0.0+nodes", ectypes.ReleaseMetadata{
+		Versions: map[string]string{"Kubernetes": "v1.29.0+k0s.0"},
+		Artifacts: map[string]string{
+			artifacts.ArtifactDigestPrefix + "images/images-amd64.tar": digest,
+		},
+	})
+	in := &clusterv1beta1.Installation{
+		ObjectMeta: metav1.ObjectMeta{Name: "20240102000000"},
+		Spec: clusterv1beta1.InstallationSpec{
+			AirGap:    true,
+			Artifacts: &clusterv1beta1.ArtifactsLocation{Images: "images"},
+			Config:    &clusterv1beta1.ConfigSpec{Version: "1.0.0+nodes"},
+		},
+	}
+	cfghash, err := artifacts.HashForAirgapConfig(in)
+	req.NoError(err)
+	// node2 was removed after the plan was created, node1 already holds the artifacts and its
+	// check has been recorded.
+	digests := `{"images/images-amd64.tar":"` + digest + `"}`
+	cli := fake.NewClientBuilder().WithScheme(k8sutil.Scheme()).WithObjects(
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "copy-artifacts-node1",
+				Namespace: "embedded-cluster",
+				Annotations: map[string]string{
+					artifacts.InstallationNameAnnotation:    in.Name,
+					artifacts.ArtifactsConfigHashAnnotation: cfghash,
+					artifacts.ArtifactsCheckAnnotation:      "true",
+					artifacts.ArtifactsDigestsAnnotation:    digests,
+				},
+			},
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{NodeName: "node1"}},
+			},
+			Status: batchv1.JobStatus{Succeeded: 1},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "node1-artifacts-digests",
+				Namespace: "embedded-cluster",
+				Labels:    map[string]string{artifacts.NodeArtifactsDigestsLabel: "true"},
+			},
+			Data: map[string]string{"node": "node1", "digests": digests},
+		},
+		&autopilotv1beta2.Plan{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "autopilot",
+				Annotations: map[string]string{conditions.InstallationNameAnnotation: in.Name},
+			},
+			Spec: autopilotv1beta2.PlanSpec{
+				Commands: []autopilotv1beta2.PlanCommand{
+					{
+						AirgapUpdate: &autopilotv1beta2.PlanCommandAirgapUpdate{
+							Workers: autopilotv1beta2.PlanCommandTarget{
+								Discovery: autopilotv1beta2.PlanCommandTargetDiscovery{
+									Static: &autopilotv1beta2.PlanCommandTargetDiscoveryStatic{Nodes: []string{"node1", "node2"}},
+								},
+							},
+						},
+					},
+				},
+			},
+			Status: autopilotv1beta2.PlanStatus{State: "MissingSignalNode"},
+		},
+	).Build()
+
+	// nothing moves the recreated plan forward so the phase times out.
+	opts := &UpgradeOptions{AirgapImagesTimeout: 100 * time.Millisecond, OperatorImage: "operator:latest"}
+	err = ensureAirgapArtifactsInCluster(ctx, cli, in, "lam:latest", opts)
+	var timeoutErr *PhaseTimeoutError
+	req.True(errors.As(err, &timeoutErr), err)
+
+	var plan autopilotv1beta2.Plan
+	req.NoError(cli.Get(ctx, client.ObjectKey{Name: "autopilot"}, &plan))
+	req.Equal([]string{"node1"}, autopilot.PlanTargetNodes(plan))
+	req.Empty(plan.Status.State)
+}
+
+func Test_sameNodes(t *testing.T) {
+	req := require.New(t)
+	nodes := []corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+	}
+	req.True(sameNodes([]string{"node2", "node1"}, nodes))
+	req.False(sameNodes([]string{"node1"}, nodes))
+	req.False(sameNodes([]string{"node1", "node3"}, nodes))
+}
@@ -0,0 +1,237 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Kinds of progress events.
+const (
+	ProgressKindInstallation = "installation"
+	ProgressKindNode         = "node"
+	ProgressKindChart        = "chart"
+)
+
+// waitPollInterval is the interval at which the installation progress is read.
+var waitPollInterval = 5 * time.Second
+
+// ProgressEvent is a change in the state of the installation, of a node being upgraded by
+// autopilot or of a helm chart.
+type ProgressEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Message string    `json:"message,omitempty"`
+}
+
+// ProgressWriter writes progress events either as human readable text or as json lines.
+type ProgressWriter struct {
+	Out  io.Writer
+	JSON bool
+}
+
+// Write writes the event to the output.
+func (w ProgressWriter) Write(ev ProgressEvent) error {
+	if w.JSON {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		_, err = fmt.Fprintln(w.Out, string(data))
+		return err
+	}
+	line := fmt.Sprintf("%s %s %s: %s", ev.Time.Format(time.RFC3339), ev.Kind, ev.Name, ev.State)
+	if ev.Message != "" {
+		line = fmt.Sprintf("%s (%s)", line, ev.Message)
+	}
+	_, err := fmt.Fprintln(w.Out, line)
+	return err
+}
+
+// InstallationFailedError is returned by WaitForInstallation when the installation ends up in a
+// failed state.
+type InstallationFailedError struct {
+	State  string
+	Reason string
+}
+
+func (e *InstallationFailedError) Error() string {
+	return fmt.Sprintf("installation ended in state %s: %s", e.State, e.Reason)
+}
+
+// WaitForInstallation follows the installation with the given name until it reaches a final
+// state, writing every state transition of the installation, of the nodes in the autopilot plan
+// and of the helm charts to the provided writer. Returns nil once the installation is installed
+// or an InstallationFailedError if it failed. A chart failure is only final once the operator has
+// exhausted its retries.
+func WaitForInstallation(ctx context.Context, cli client.Client, name string, w ProgressWriter) error {
+	seen := map[string]string{}
+	emit := func(ev ProgressEvent) error {
+		key := ev.Kind + "/" + ev.Name
+		if seen[key] == ev.State+ev.Message {
+			return nil
+		}
+		seen[key] = ev.State + ev.Message
+		ev.Time = time.Now()
+		return w.Write(ev)
+	}
+
+	log := ctrl.LoggerFrom(ctx)
+	var result error
+	err := wait.PollUntilContextCancel(ctx, waitPollInterval, true, func(ctx context.Context) (bool, error) {
+		// the wait may last for an hour, api errors are expected to happen while the control
+		// plane is upgraded so only a missing installation ends it.
+		var in clusterv1beta1.Installation
+		if err := cli.Get(ctx, client.ObjectKey{Name: name}, &in); err != nil {
+			if k8serrors.IsNotFound(err) {
+				return false, fmt.Errorf("get installation: %w", err)
+			}
+			log.Info("Failed to get installation, retrying", "error", err)
+			return false, nil
+		}
+
+		events, err := nodeProgress(ctx, cli, &in)
+		if err != nil {
+			log.Info("Failed to get node progress, retrying", "error", err)
+			return false, nil
+		}
+		chartEvents, err := chartProgress(ctx, cli, &in)
+		if err != nil {
+			log.Info("Failed to get chart progress, retrying", "error", err)
+			return false, nil
+		}
+		events = append(events, chartEvents...)
+		events = append(events, ProgressEvent{
+			Kind:    ProgressKindInstallation,
+			Name:    in.Name,
+			State:   in.Status.State,
+			Message: in.Status.Reason,
+		})
+		for _, ev := range events {
+			if err := emit(ev); err != nil {
+				return false, fmt.Errorf("write progress: %w", err)
+			}
+		}
+
+		switch in.Status.State {
+		case clusterv1beta1.InstallationStateInstalled:
+			return true, nil
+		case clusterv1beta1.InstallationStateHelmChartUpdateFailure:
+			if !chartRetriesExhausted(&in) {
+				return false, nil
+			}
+			result = &InstallationFailedError{State: in.Status.State, Reason: in.Status.Reason}
+			return true, nil
+		case clusterv1beta1.InstallationStateFailed,
+			clusterv1beta1.InstallationStateObsolete,
+			conditions.InstallationStateCancelled:
+			result = &InstallationFailedError{State: in.Status.State, Reason: in.Status.Reason}
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("wait for installation: %w", err)
+	}
+	return result
+}
+
+// chartRetriesExhausted returns true if the operator won't retry any of the failed charts of the
+// installation. Failures that are not reported through a chart condition, a missing addon secret
+// for example, are not retried at all.
+func chartRetriesExhausted(in *clusterv1beta1.Installation) bool {
+	retries, err := conditions.ChartRetriesFor(in)
+	if err != nil {
+		return false
+	}
+	for _, cond := range in.Status.Conditions {
+		if !conditions.IsChartCondition(cond) || cond.Status != metav1.ConditionFalse {
+			continue
+		}
+		// a failed chart without retries has not been picked up by the operator yet.
+		if chart, ok := retries[conditions.ChartName(cond)]; !ok || !chart.Exhausted() {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeProgress returns the state of each node in the autopilot plan for the installation.
+func nodeProgress(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) ([]ProgressEvent, error) {
+	var plan autopilotv1beta2.Plan
+	if err := cli.Get(ctx, client.ObjectKey{Name: "autopilot"}, &plan); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get autopilot plan: %w", err)
+	}
+	if plan.Annotations[conditions.InstallationNameAnnotation] != in.Name {
+		return nil, nil
+	}
+
+	events := []ProgressEvent{}
+	add := func(targets []autopilotv1beta2.PlanCommandTargetStatus) {
+		for _, target := range targets {
+			events = append(events, ProgressEvent{
+				Kind:  ProgressKindNode,
+				Name:  target.Name,
+				State: string(target.State),
+			})
+		}
+	}
+	for _, cmd := range plan.Status.Commands {
+		if cmd.K0sUpdate != nil {
+			add(cmd.K0sUpdate.Controllers)
+			add(cmd.K0sUpdate.Workers)
+		}
+		if cmd.AirgapUpdate != nil {
+			add(cmd.AirgapUpdate.Workers)
+		}
+	}
+	return events, nil
+}
+
+// chartProgress returns the state of each of the helm charts once the installation has started
+// to deploy them.
+func chartProgress(ctx context.Context, cli client.Client, in *clusterv1beta1.Installation) ([]ProgressEvent, error) {
+	if !in.Status.GetKubernetesInstalled() {
+		return nil, nil
+	}
+	var charts k0shelm.ChartList
+	if err := cli.List(ctx, &charts); err != nil {
+		return nil, fmt.Errorf("list charts: %w", err)
+	}
+
+	events := []ProgressEvent{}
+	for _, chart := range charts.Items {
+		ev := ProgressEvent{Kind: ProgressKindChart, Name: chart.Spec.ReleaseName}
+		switch {
+		case chart.Status.Error != "":
+			ev.State, ev.Message = "Failed", chart.Status.Error
+		case chart.Status.Version != chart.Spec.Version || chart.Status.ValuesHash != chart.Spec.HashValues():
+			ev.State, ev.Message = "Pending", chart.Spec.Version
+		default:
+			ev.State, ev.Message = "Deployed", chart.Status.Version
+		}
+		events = append(events, ev)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+	return events, nil
+}
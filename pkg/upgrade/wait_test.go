@@ -0,0 +1,230 @@
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	autopilotv1beta2 "github.com/k0sproject/k0s/pkg/apis/autopilot/v1beta2"
+	k0shelm "github.com/k0sproject/k0s/pkg/apis/helm/v1beta1"
+	clusterv1beta1 "github.com/replicatedhq/embedded-cluster-kinds/apis/v1beta1"
+	"github.com/replicatedhq/embedded-cluster-operator/pkg/conditions"
+	"github.com/stretchr/testify/require"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestWaitForInstallation(t *testing.T) {
+	chartSpec := k0shelm.ChartSpec{ReleaseName: "admin-console", Version: "1.0.0"}
+	objects := func(state, reason string, conds []metav1.Condition, annotations map[string]string) []runtime.Object {
+		return []runtime.Object{
+			&clusterv1beta1.Installation{
+				ObjectMeta: metav1.ObjectMeta{Name: "20240101000000", Annotations: annotations},
+				Status:     clusterv1beta1.InstallationStatus{State: state, Reason: reason, Conditions: conds},
+			},
+			&autopilotv1beta2.Plan{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "autopilot",
+					Annotations: map[string]string{conditions.InstallationNameAnnotation: "20240101000000"},
+				},
+				Status: autopilotv1beta2.PlanStatus{
+					Commands: []autopilotv1beta2.PlanCommandStatus{
+						{
+							K0sUpdate: &autopilotv1beta2.PlanCommandK0sUpdateStatus{
+								Controllers: []autopilotv1beta2.PlanCommandTargetStatus{
+									{Name: "node1", State: "Completed"},
+								},
+							},
+						},
+					},
+				},
+			},
+			&k0shelm.Chart{
+				ObjectMeta: metav1.ObjectMeta{Name: "k0s-addon-chart-admin-console", Namespace: "kube-system"},
+				Spec:       chartSpec,
+				Status: k0shelm.ChartStatus{
+					Version:    "1.0.0",
+					ValuesHash: chartSpec.HashValues(),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		state       string
+		conditions  []metav1.Condition
+		annotations map[string]string
+		json        bool
+		wantErr     bool
+		wantLines   []string
+	}{
+		{
+			name:  "installed",
+			state: clusterv1beta1.InstallationStateInstalled,
+			wantLines: []string{
+				"node node1: Completed",
+				"chart admin-console: Deployed (1.0.0)",
+				"installation 20240101000000: Installed (done)",
+			},
+		},
+		{
+			name:    "chart failure",
+			state:   clusterv1beta1.InstallationStateHelmChartUpdateFailure,
+			wantErr: true,
+			wantLines: []string{
+				"installation 20240101000000: HelmChartUpdateFailure (done)",
+			},
+		},
+		{
+			name:  "chart failure after retries",
+			state: clusterv1beta1.InstallationStateHelmChartUpdateFailure,
+			conditions: []metav1.Condition{
+				{
+					Type:    conditions.ChartConditionType("admin-console"),
+					Status:  metav1.ConditionFalse,
+					Reason:  "ChartErrorUnknown",
+					Message: "Check the chart logs. " + conditions.ChartRetriesExhaustedMessage(5),
+				},
+			},
+			annotations: map[string]string{
+				conditions.ChartRetriesAnnotation: `{"admin-console":{"attempts":5,"maxAttempts":5}}`,
+			},
+			wantErr: true,
+			wantLines: []string{
+				"installation 20240101000000: HelmChartUpdateFailure (done)",
+			},
+		},
+		{
+			name:  "json",
+			state: clusterv1beta1.InstallationStateInstalled,
+			json:  true,
+			wantLines: []string{
+				`"kind":"node","name":"node1","state":"Completed"}`,
+				`"kind":"installation","name":"20240101000000","state":"Installed","message":"done"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+
+			sch := runtime.NewScheme()
+			req.NoError(clusterv1beta1.AddToScheme(sch))
+			req.NoError(autopilotv1beta2.AddToScheme(sch))
+			req.NoError(k0shelm.AddToScheme(sch))
+			cli := fake.NewClientBuilder().WithScheme(sch).WithRuntimeObjects(objects(tt.state, "done", tt.conditions, tt.annotations)...).Build()
+
+			buf := bytes.NewBuffer(nil)
+			err := WaitForInstallation(context.Background(), cli, "20240101000000", ProgressWriter{Out: buf, JSON: tt.json})
+			if tt.wantErr {
+				var ierr *InstallationFailedError
+				req.True(errors.As(err, &ierr))
+				req.Equal(tt.state, ierr.State)
+			} else {
+				req.NoError(err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			for _, want := range tt.wantLines {
+				found := false
+				for _, line := range lines {
+					if strings.HasSuffix(line, want) {
+						found = true
+					}
+				}
+				req.True(found, "%q not found in output:\n%s", want, buf.String())
+			}
+		})
+	}
+}
+
+func TestWaitForInstallation_keepsWaiting(t *testing.T) {
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+
+	retrying := metav1.Condition{
+		Type:    conditions.ChartConditionType("admin-console"),
+		Status:  metav1.ConditionFalse,
+		Reason:  "ChartErrorUnknown",
+		Message: "Check the chart logs. Retry 2 of 5 scheduled at 2024-01-01T00:00:00Z.",
+	}
+
+	tests := []struct {
+		name        string
+		state       string
+		conditions  []metav1.Condition
+		annotations map[string]string
+		failGets    int
+	}{
+		{
+			name:       "chart retry pending",
+			state:      clusterv1beta1.InstallationStateHelmChartUpdateFailure,
+			conditions: []metav1.Condition{retrying},
+			annotations: map[string]string{
+				conditions.ChartRetriesAnnotation: `{"admin-console":{"attempts":1,"maxAttempts":5}}`,
+			},
+		},
+		{
+			name:     "transient api errors",
+			state:    clusterv1beta1.InstallationStateKubernetesInstalled,
+			failGets: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := require.New(t)
+
+			sch := runtime.NewScheme()
+			req.NoError(clusterv1beta1.AddToScheme(sch))
+			req.NoError(autopilotv1beta2.AddToScheme(sch))
+			req.NoError(k0shelm.AddToScheme(sch))
+			in := &clusterv1beta1.Installation{
+				ObjectMeta: metav1.ObjectMeta{Name: "20240101000000", Annotations: tt.annotations},
+				Status:     clusterv1beta1.InstallationStatus{State: tt.state, Conditions: tt.conditions},
+			}
+			gets := 0
+			cli := fake.NewClientBuilder().WithScheme(sch).WithRuntimeObjects(in).WithInterceptorFuncs(interceptor.Funcs{
+				Get: func(ctx context.Context, cli client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					if _, ok := obj.(*clusterv1beta1.Installation); ok {
+						gets++
+						if gets <= tt.failGets {
+							return errors.New("connection refused")
+						}
+					}
+					return cli.Get(ctx, key, obj, opts...)
+				},
+			}).Build()
+
+			// the installation never reaches a final state, the wait only ends with the context.
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			buf := bytes.NewBuffer(nil)
+			err := WaitForInstallation(ctx, cli, "20240101000000", ProgressWriter{Out: buf})
+			req.ErrorIs(err, context.DeadlineExceeded)
+			req.Greater(gets, tt.failGets)
+			req.Contains(buf.String(), "installation 20240101000000: "+tt.state)
+		})
+	}
+}
+
+func TestWaitForInstallation_notFound(t *testing.T) {
+	req := require.New(t)
+
+	sch := runtime.NewScheme()
+	req.NoError(clusterv1beta1.AddToScheme(sch))
+	cli := fake.NewClientBuilder().WithScheme(sch).Build()
+
+	err := WaitForInstallation(context.Background(), cli, "20240101000000", ProgressWriter{Out: io.Discard})
+	req.Error(err)
+	req.True(k8serrors.IsNotFound(err))
+}